@@ -27,7 +27,7 @@ type Compressor struct {
 	Header
 	w          io.Writer
 	level      int
-	compressor io.WriteCloser
+	compressor *flate.Writer
 	digest     hash.Hash32
 	size       uint32
 	closed     bool
@@ -161,6 +161,26 @@ func (z *Compressor) Write(p []byte) (int, os.Error) {
 	return n, z.err
 }
 
+// Flush writes any pending compressed data to the underlying writer,
+// so that a reader can decompress all the data written so far.
+// It is useful when the data is sent over a network in pieces.
+func (z *Compressor) Flush() os.Error {
+	if z.err != nil {
+		return z.err
+	}
+	if z.closed {
+		return nil
+	}
+	if z.compressor == nil {
+		z.Write(nil)
+		if z.err != nil {
+			return z.err
+		}
+	}
+	z.err = z.compressor.Flush()
+	return z.err
+}
+
 // Calling Close does not close the wrapped io.Writer originally passed to NewWriter.
 func (z *Compressor) Close() os.Error {
 	if z.err != nil {
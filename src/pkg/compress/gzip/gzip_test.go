@@ -82,3 +82,31 @@ func TestWriter(t *testing.T) {
 			}
 		})
 }
+
+// Tests that data written before a Flush can be read before the
+// Compressor is closed.
+func TestFlush(t *testing.T) {
+	piper, pipew := io.Pipe()
+	defer piper.Close()
+	compressor, err := NewWriter(pipew)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	go func() {
+		compressor.Write([]byte("hello"))
+		if err := compressor.Flush(); err != nil {
+			t.Errorf("Flush: %v", err)
+		}
+	}()
+	decompressor, err := NewReader(piper)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(decompressor, b); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("read %q; want %q", b, "hello")
+	}
+}
@@ -7,6 +7,7 @@ package tls
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/des"
 	"crypto/hmac"
 	"crypto/rc4"
 	"crypto/x509"
@@ -22,8 +23,8 @@ type keyAgreement interface {
 	// In the case that the key agreement protocol doesn't use a
 	// ServerKeyExchange message, generateServerKeyExchange can return nil,
 	// nil.
-	generateServerKeyExchange(*Config, *clientHelloMsg, *serverHelloMsg) (*serverKeyExchangeMsg, os.Error)
-	processClientKeyExchange(*Config, *clientKeyExchangeMsg) ([]byte, os.Error)
+	generateServerKeyExchange(*Config, *Certificate, *clientHelloMsg, *serverHelloMsg) (*serverKeyExchangeMsg, os.Error)
+	processClientKeyExchange(*Config, *Certificate, *clientKeyExchangeMsg) ([]byte, os.Error)
 
 	// On the client side, the next two methods are called in order.
 
@@ -34,26 +35,63 @@ type keyAgreement interface {
 }
 
 // A cipherSuite is a specific combination of key agreement, cipher and MAC
-// function. All cipher suites currently assume RSA key agreement.
+// function.
 type cipherSuite struct {
 	// the lengths, in bytes, of the key material needed for each component.
 	keyLen int
 	macLen int
 	ivLen  int
-	ka     func() keyAgreement
+	ka     func(version uint16) keyAgreement
 	// If elliptic is set, a server will only consider this ciphersuite if
 	// the ClientHello indicated that the client supports an elliptic curve
 	// and point format that we can handle.
 	elliptic bool
-	cipher   func(key, iv []byte, isRead bool) interface{}
-	mac      func(macKey []byte) hash.Hash
+	// If ecdsa is set, the server's certificate must contain an ECDSA
+	// key rather than an RSA one.
+	ecdsa bool
+	// If tls12 is set, the suite may only be used with TLS 1.2.
+	tls12  bool
+	cipher func(key, iv []byte, isRead bool) interface{}
+	mac    func(macKey []byte) hash.Hash
 }
 
 var cipherSuites = map[uint16]*cipherSuite{
-	TLS_RSA_WITH_RC4_128_SHA:           &cipherSuite{16, 20, 0, rsaKA, false, cipherRC4, hmacSHA1},
-	TLS_RSA_WITH_AES_128_CBC_SHA:       &cipherSuite{16, 20, 16, rsaKA, false, cipherAES, hmacSHA1},
-	TLS_ECDHE_RSA_WITH_RC4_128_SHA:     &cipherSuite{16, 20, 0, ecdheRSAKA, true, cipherRC4, hmacSHA1},
-	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA: &cipherSuite{16, 20, 16, ecdheRSAKA, true, cipherAES, hmacSHA1},
+	TLS_RSA_WITH_RC4_128_SHA:                &cipherSuite{16, 20, 0, rsaKA, false, false, false, cipherRC4, hmacSHA1},
+	TLS_RSA_WITH_3DES_EDE_CBC_SHA:           &cipherSuite{24, 20, 8, rsaKA, false, false, false, cipher3DES, hmacSHA1},
+	TLS_RSA_WITH_AES_128_CBC_SHA:            &cipherSuite{16, 20, 16, rsaKA, false, false, false, cipherAES, hmacSHA1},
+	TLS_RSA_WITH_AES_256_CBC_SHA:            &cipherSuite{32, 20, 16, rsaKA, false, false, false, cipherAES, hmacSHA1},
+	TLS_RSA_WITH_AES_128_CBC_SHA256:         &cipherSuite{16, 32, 16, rsaKA, false, false, true, cipherAES, hmacSHA256},
+	TLS_RSA_WITH_AES_256_CBC_SHA256:         &cipherSuite{32, 32, 16, rsaKA, false, false, true, cipherAES, hmacSHA256},
+	TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        &cipherSuite{16, 20, 0, ecdheECDSAKA, true, true, false, cipherRC4, hmacSHA1},
+	TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    &cipherSuite{16, 20, 16, ecdheECDSAKA, true, true, false, cipherAES, hmacSHA1},
+	TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    &cipherSuite{32, 20, 16, ecdheECDSAKA, true, true, false, cipherAES, hmacSHA1},
+	TLS_ECDHE_RSA_WITH_RC4_128_SHA:          &cipherSuite{16, 20, 0, ecdheRSAKA, true, false, false, cipherRC4, hmacSHA1},
+	TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     &cipherSuite{24, 20, 8, ecdheRSAKA, true, false, false, cipher3DES, hmacSHA1},
+	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      &cipherSuite{16, 20, 16, ecdheRSAKA, true, false, false, cipherAES, hmacSHA1},
+	TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      &cipherSuite{32, 20, 16, ecdheRSAKA, true, false, false, cipherAES, hmacSHA1},
+	TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: &cipherSuite{16, 32, 16, ecdheECDSAKA, true, true, true, cipherAES, hmacSHA256},
+	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   &cipherSuite{16, 32, 16, ecdheRSAKA, true, false, true, cipherAES, hmacSHA256},
+}
+
+// defaultCipherSuiteOrder lists the ids of all of cipherSuites in the order
+// in which we prefer them: forward secrecy first, then AES before RC4
+// before 3DES, and the smaller key of a kind before the larger one.
+var defaultCipherSuiteOrder = []uint16{
+	TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	TLS_RSA_WITH_AES_128_CBC_SHA256,
+	TLS_RSA_WITH_AES_256_CBC_SHA256,
+	TLS_RSA_WITH_AES_128_CBC_SHA,
+	TLS_RSA_WITH_AES_256_CBC_SHA,
+	TLS_RSA_WITH_RC4_128_SHA,
+	TLS_RSA_WITH_3DES_EDE_CBC_SHA,
 }
 
 func cipherRC4(key, iv []byte, isRead bool) interface{} {
@@ -61,6 +99,14 @@ func cipherRC4(key, iv []byte, isRead bool) interface{} {
 	return cipher
 }
 
+func cipher3DES(key, iv []byte, isRead bool) interface{} {
+	block, _ := des.NewTripleDESCipher(key)
+	if isRead {
+		return cipher.NewCBCDecrypter(block, iv)
+	}
+	return cipher.NewCBCEncrypter(block, iv)
+}
+
 func cipherAES(key, iv []byte, isRead bool) interface{} {
 	block, _ := aes.NewCipher(key)
 	if isRead {
@@ -73,12 +119,20 @@ func hmacSHA1(key []byte) hash.Hash {
 	return hmac.NewSHA1(key)
 }
 
-func rsaKA() keyAgreement {
+func hmacSHA256(key []byte) hash.Hash {
+	return hmac.NewSHA256(key)
+}
+
+func rsaKA(version uint16) keyAgreement {
 	return rsaKeyAgreement{}
 }
 
-func ecdheRSAKA() keyAgreement {
-	return new(ecdheRSAKeyAgreement)
+func ecdheRSAKA(version uint16) keyAgreement {
+	return &ecdheKeyAgreement{version: version, sigType: signatureRSA}
+}
+
+func ecdheECDSAKA(version uint16) keyAgreement {
+	return &ecdheKeyAgreement{version: version, sigType: signatureECDSA}
 }
 
 // mutualCipherSuite returns a cipherSuite and its id given a list of supported
@@ -95,8 +149,19 @@ func mutualCipherSuite(have []uint16, want uint16) (suite *cipherSuite, id uint1
 // A list of the possible cipher suite ids. Taken from
 // http://www.iana.org/assignments/tls-parameters/tls-parameters.xml
 const (
-	TLS_RSA_WITH_RC4_128_SHA           uint16 = 0x0005
-	TLS_RSA_WITH_AES_128_CBC_SHA       uint16 = 0x002f
-	TLS_ECDHE_RSA_WITH_RC4_128_SHA     uint16 = 0xc011
-	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA uint16 = 0xc013
+	TLS_RSA_WITH_RC4_128_SHA                uint16 = 0x0005
+	TLS_RSA_WITH_3DES_EDE_CBC_SHA           uint16 = 0x000a
+	TLS_RSA_WITH_AES_128_CBC_SHA            uint16 = 0x002f
+	TLS_RSA_WITH_AES_256_CBC_SHA            uint16 = 0x0035
+	TLS_RSA_WITH_AES_128_CBC_SHA256         uint16 = 0x003c
+	TLS_RSA_WITH_AES_256_CBC_SHA256         uint16 = 0x003d
+	TLS_ECDHE_ECDSA_WITH_RC4_128_SHA        uint16 = 0xc007
+	TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA    uint16 = 0xc009
+	TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA    uint16 = 0xc00a
+	TLS_ECDHE_RSA_WITH_RC4_128_SHA          uint16 = 0xc011
+	TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA     uint16 = 0xc012
+	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA      uint16 = 0xc013
+	TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA      uint16 = 0xc014
+	TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256 uint16 = 0xc023
+	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256   uint16 = 0xc027
 )
@@ -5,11 +5,15 @@
 package tls
 
 import (
+	"container/list"
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha512"
 	"crypto/x509"
 	"io"
 	"io/ioutil"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,8 +24,15 @@ const (
 	recordHeaderLen = 5            // record header length
 	maxHandshake    = 65536        // maximum handshake we support (protocol max is 16 MB)
 
-	minVersion = 0x0301 // minimum supported version - TLS 1.0
-	maxVersion = 0x0301 // maximum supported version - TLS 1.0
+	minVersion = VersionTLS10 // minimum supported version
+	maxVersion = VersionTLS12 // maximum supported version
+)
+
+// TLS protocol versions.
+const (
+	VersionTLS10 = 0x0301
+	VersionTLS11 = 0x0302
+	VersionTLS12 = 0x0303
 )
 
 // TLS record types.
@@ -38,6 +49,7 @@ const (
 const (
 	typeClientHello        uint8 = 1
 	typeServerHello        uint8 = 2
+	typeNewSessionTicket   uint8 = 4
 	typeCertificate        uint8 = 11
 	typeServerKeyExchange  uint8 = 12
 	typeCertificateRequest uint8 = 13
@@ -60,6 +72,8 @@ var (
 	extensionStatusRequest   uint16 = 5
 	extensionSupportedCurves uint16 = 10
 	extensionSupportedPoints uint16 = 11
+	extensionSignatureAlgs   uint16 = 13
+	extensionSessionTicket   uint16 = 35
 	extensionNextProtoNeg    uint16 = 13172 // not IANA assigned
 )
 
@@ -89,11 +103,76 @@ const (
 	certTypeRSAFixedDH = 3 // A certificate containing a static DH key
 	certTypeDSSFixedDH = 4 // A certificate containing a static DH key
 	// Rest of these are reserved by the TLS spec
+
+	certTypeECDSASign = 64 // A certificate containing an ECDSA key (RFC 4492)
+)
+
+// Hash functions for TLS 1.2 (RFC 5246, section 7.4.1.4.1)
+const (
+	hashSHA1   uint8 = 2
+	hashSHA256 uint8 = 4
+)
+
+// Signature algorithms for TLS 1.2 (RFC 5246, section 7.4.1.4.1)
+const (
+	signatureRSA   uint8 = 1
+	signatureECDSA uint8 = 3
 )
 
+// signatureAndHash mirrors the TLS 1.2 SignatureAndHashAlgorithm struct in
+// RFC 5246, section 7.4.1.4.1.
+type signatureAndHash struct {
+	hash, signature uint8
+}
+
+// supportedSignatureAlgorithms contains the signature and hash algorithms
+// that we advertise in TLS 1.2, in order of preference.
+var supportedSignatureAlgorithms = []signatureAndHash{
+	{hashSHA256, signatureRSA},
+	{hashSHA256, signatureECDSA},
+	{hashSHA1, signatureRSA},
+	{hashSHA1, signatureECDSA},
+}
+
+// tls12Hash returns the hash function identified by a TLS 1.2 hash
+// algorithm number, or false if it is not one that we support.
+func tls12Hash(hash uint8) (crypto.Hash, bool) {
+	switch hash {
+	case hashSHA1:
+		return crypto.SHA1, true
+	case hashSHA256:
+		return crypto.SHA256, true
+	}
+	return 0, false
+}
+
+// pickTLS12Hash returns the TLS 1.2 hash algorithm with which to make a
+// signature of type sigType for a peer that advertised peerSigAndHashes, the
+// first of supportedSignatureAlgorithms that it also supports.
+func pickTLS12Hash(sigType uint8, peerSigAndHashes []signatureAndHash) (uint8, os.Error) {
+	if len(peerSigAndHashes) == 0 {
+		// A peer that sends no list supports SHA1. See RFC 5246,
+		// section 7.4.1.4.1.
+		return hashSHA1, nil
+	}
+	for _, sigAndHash := range supportedSignatureAlgorithms {
+		if sigAndHash.signature != sigType {
+			continue
+		}
+		for _, peer := range peerSigAndHashes {
+			if peer.hash == sigAndHash.hash && peer.signature == sigAndHash.signature {
+				return sigAndHash.hash, nil
+			}
+		}
+	}
+	return 0, os.ErrorString("no signature and hash algorithm in common")
+}
+
 // ConnectionState records basic TLS details about the connection.
 type ConnectionState struct {
+	Version                    uint16 // TLS version used by the connection
 	HandshakeComplete          bool
+	DidResume                  bool // connection resumes a previous TLS session
 	CipherSuite                uint16
 	NegotiatedProtocol         string
 	NegotiatedProtocolIsMutual bool
@@ -118,9 +197,26 @@ type Config struct {
 
 	// Certificates contains one or more certificate chains
 	// to present to the other side of the connection.
-	// Server configurations must include at least one certificate.
+	// Server configurations must include at least one certificate,
+	// unless they set GetCertificate.
 	Certificates []Certificate
 
+	// NameToCertificate maps from a certificate name to an element of
+	// Certificates. A server presents the certificate whose name
+	// matches the ServerName sent by the client, or else the first
+	// element of Certificates. A name may be a wildcard such as
+	// "*.example.com". If NameToCertificate is nil and there are
+	// several Certificates, a server builds it with
+	// BuildNameToCertificate before its first handshake.
+	NameToCertificate map[string]*Certificate
+
+	// GetCertificate, if not nil, is called by a server to find the
+	// certificate for the server name requested by a client, which is
+	// empty if the client sent none. If it returns a nil Certificate
+	// and a nil error, the certificate is chosen from Certificates.
+	// It may be called concurrently from different goroutines.
+	GetCertificate func(serverName string) (*Certificate, os.Error)
+
 	// RootCAs defines the set of root certificate authorities
 	// that clients use when verifying server certificates.
 	// If RootCAs is nil, TLS uses the host's root CA set.
@@ -139,9 +235,151 @@ type Config struct {
 	// anything more than self-signed.
 	AuthenticateClient bool
 
-	// CipherSuites is a list of supported cipher suites. If CipherSuites
-	// is nil, TLS uses a list of suites supported by the implementation.
+	// CipherSuites is a list of supported cipher suites, in order of
+	// preference. If CipherSuites is nil, TLS uses a list of suites
+	// supported by the implementation.
 	CipherSuites []uint16
+
+	// PreferServerCipherSuites controls whether a server selects the
+	// client's most preferred cipher suite, or its own: the first of
+	// CipherSuites that the client also supports.
+	PreferServerCipherSuites bool
+
+	// MinVersion contains the minimum TLS version that is acceptable.
+	// If zero, TLS 1.0 is taken as the minimum.
+	MinVersion uint16
+
+	// MaxVersion contains the maximum TLS version that is acceptable.
+	// If zero, the maximum version supported by this package is used,
+	// which is currently TLS 1.2.
+	MaxVersion uint16
+
+	// SessionTicketsDisabled may be set to true to disable session ticket
+	// (resumption) support.
+	SessionTicketsDisabled bool
+
+	// SessionTicketKey is used by TLS servers to provide session
+	// resumption. See RFC 5077. If zero, it will be filled with random
+	// data before the first server handshake, unless session ticket keys
+	// have been set with SetSessionTicketKeys.
+	//
+	// If multiple servers are terminating connections for the same host
+	// they should all have the same SessionTicketKey. If the
+	// SessionTicketKey leaks, previously recorded and future TLS
+	// connections using that key are compromised.
+	SessionTicketKey [32]byte
+
+	// ClientSessionCache is a cache of ClientSessionState entries for TLS
+	// session resumption. If it is nil, clients do not resume sessions.
+	ClientSessionCache ClientSessionCache
+
+	serverInitOnce sync.Once // guards calling (*Config).serverInit
+
+	// mutex protects sessionTicketKeys.
+	mutex sync.RWMutex
+	// sessionTicketKeys contains the keys that encrypt and decrypt
+	// session tickets, the first being used to encrypt new ones.
+	sessionTicketKeys []ticketKey
+}
+
+// ticketKeyNameLen is the number of bytes of identifier that is prepended to
+// an encrypted session ticket in order to identify the key used to encrypt it.
+const ticketKeyNameLen = 16
+
+// ticketKey is the internal representation of a session ticket key.
+type ticketKey struct {
+	// keyName is an opaque byte string that serves to identify the session
+	// ticket key. It's exposed as plaintext in every session ticket.
+	keyName [ticketKeyNameLen]byte
+	aesKey  [16]byte
+	hmacKey [16]byte
+}
+
+// ticketKeyFromBytes converts from the external representation of a session
+// ticket key to a ticketKey. Externally, session ticket keys are 32 random
+// bytes and this function expands that into sufficient name and key material.
+func ticketKeyFromBytes(b [32]byte) (key ticketKey) {
+	h := sha512.New()
+	h.Write(b[:])
+	hashed := h.Sum()
+	copy(key.keyName[:], hashed[:ticketKeyNameLen])
+	copy(key.aesKey[:], hashed[ticketKeyNameLen:ticketKeyNameLen+16])
+	copy(key.hmacKey[:], hashed[ticketKeyNameLen+16:ticketKeyNameLen+32])
+	return key
+}
+
+// Clone returns a copy of c that may be changed without affecting c,
+// such as to fill in ServerName for a single connection. The copy
+// shares the session ticket keys of c, but not their later updates.
+func (c *Config) Clone() *Config {
+	nc := new(Config)
+	c.mutex.RLock()
+	*nc = *c
+	c.mutex.RUnlock()
+	nc.serverInitOnce = sync.Once{}
+	nc.mutex = sync.RWMutex{}
+	return nc
+}
+
+// SetSessionTicketKeys updates the session ticket keys of a server. The first
+// key encrypts new tickets, while all of them decrypt the tickets that clients
+// present, so keys can be rotated by adding a new key in front and dropping
+// the oldest one later. Unlike other Config fields, the keys may be set while
+// the server is running. SetSessionTicketKeys panics if keys is empty.
+func (c *Config) SetSessionTicketKeys(keys [][32]byte) {
+	if len(keys) == 0 {
+		panic("tls: keys must have at least one key")
+	}
+
+	newKeys := make([]ticketKey, len(keys))
+	for i, bytes := range keys {
+		newKeys[i] = ticketKeyFromBytes(bytes)
+	}
+
+	c.mutex.Lock()
+	c.sessionTicketKeys = newKeys
+	c.mutex.Unlock()
+}
+
+func (c *Config) ticketKeys() []ticketKey {
+	c.mutex.RLock()
+	// c.sessionTicketKeys is constant once created. SetSessionTicketKeys
+	// only replaces it with a new slice.
+	ret := c.sessionTicketKeys
+	c.mutex.RUnlock()
+	return ret
+}
+
+// serverInit is run under c.serverInitOnce, before the first server
+// handshake, to build the NameToCertificate map of c if needed and set up
+// its session ticket keys.
+func (c *Config) serverInit() {
+	if c.NameToCertificate == nil && len(c.Certificates) > 1 {
+		c.BuildNameToCertificate()
+	}
+
+	if c.SessionTicketsDisabled || len(c.ticketKeys()) != 0 {
+		return
+	}
+
+	alreadySet := false
+	for _, b := range c.SessionTicketKey {
+		if b != 0 {
+			alreadySet = true
+			break
+		}
+	}
+
+	if !alreadySet {
+		if _, err := io.ReadFull(c.rand(), c.SessionTicketKey[:]); err != nil {
+			c.SessionTicketsDisabled = true
+			return
+		}
+	}
+
+	c.mutex.Lock()
+	c.sessionTicketKeys = []ticketKey{ticketKeyFromBytes(c.SessionTicketKey)}
+	c.mutex.Unlock()
 }
 
 func (c *Config) rand() io.Reader {
@@ -176,10 +414,205 @@ func (c *Config) cipherSuites() []uint16 {
 	return s
 }
 
+func (c *Config) minVersion() uint16 {
+	if c.MinVersion == 0 {
+		return minVersion
+	}
+	return c.MinVersion
+}
+
+func (c *Config) maxVersion() uint16 {
+	if c.MaxVersion == 0 {
+		return maxVersion
+	}
+	return c.MaxVersion
+}
+
+// mutualVersion returns the protocol version a server uses given the
+// maximum version advertised by the client.
+func (c *Config) mutualVersion(vers uint16) (uint16, bool) {
+	minVersion := c.minVersion()
+	maxVersion := c.maxVersion()
+
+	if vers < minVersion {
+		return 0, false
+	}
+	if vers > maxVersion {
+		vers = maxVersion
+	}
+	return vers, true
+}
+
+// getCertificate returns the certificate a server presents to a client that
+// asked for serverName.
+func (c *Config) getCertificate(serverName string) (*Certificate, os.Error) {
+	if c.GetCertificate != nil {
+		cert, err := c.GetCertificate(serverName)
+		if cert != nil || err != nil {
+			return cert, err
+		}
+	}
+
+	if len(c.Certificates) == 0 {
+		return nil, os.ErrorString("no certificates configured")
+	}
+
+	if len(c.Certificates) == 1 || c.NameToCertificate == nil || len(serverName) == 0 {
+		// There's only one choice, so no point doing any work.
+		return &c.Certificates[0], nil
+	}
+
+	name := strings.ToLower(strings.TrimRight(serverName, "."))
+	if cert, ok := c.NameToCertificate[name]; ok {
+		return cert, nil
+	}
+
+	// Try replacing labels in the name with wildcards until we get a
+	// match.
+	labels := strings.Split(name, ".", -1)
+	for i := range labels {
+		labels[i] = "*"
+		candidate := strings.Join(labels, ".")
+		if cert, ok := c.NameToCertificate[candidate]; ok {
+			return cert, nil
+		}
+	}
+
+	// If nothing matches, return the first certificate.
+	return &c.Certificates[0], nil
+}
+
+// BuildNameToCertificate parses c.Certificates and builds
+// c.NameToCertificate from the CommonName and the DNS names in the
+// SubjectAlternativeName extension of each of the leaf certificates. Where
+// several certificates have the same name, the first one is used.
+func (c *Config) BuildNameToCertificate() {
+	c.NameToCertificate = make(map[string]*Certificate)
+	for i := range c.Certificates {
+		cert := &c.Certificates[i]
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			continue
+		}
+		names := x509Cert.DNSNames
+		if len(x509Cert.Subject.CommonName) > 0 {
+			names = append([]string{x509Cert.Subject.CommonName}, names...)
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := c.NameToCertificate[name]; !ok {
+				c.NameToCertificate[name] = cert
+			}
+		}
+	}
+}
+
+// ClientSessionState contains the state needed by clients to resume TLS
+// sessions.
+type ClientSessionState struct {
+	sessionId          []byte              // Session ID to resume the session with, if there is no ticket
+	sessionTicket      []byte              // Encrypted ticket used to resume the session
+	vers               uint16              // SSL/TLS version negotiated for the session
+	cipherSuite        uint16              // Ciphersuite negotiated for the session
+	masterSecret       []byte              // MasterSecret generated by client on a full handshake
+	serverCertificates []*x509.Certificate // Certificate chain presented by the server
+}
+
+// ClientSessionCache is a cache of ClientSessionState objects that can be
+// used by a client to resume a TLS session with a given server. The key is
+// the ServerName of the client's Config, if set, or else the address of
+// the server. ClientSessionCache implementations should expect to be called
+// concurrently from different goroutines.
+type ClientSessionCache interface {
+	// Get searches for a ClientSessionState associated with the given key.
+	// On return, ok is true if one was found.
+	Get(sessionKey string) (session *ClientSessionState, ok bool)
+
+	// Put adds the ClientSessionState to the cache with the given key.
+	Put(sessionKey string, cs *ClientSessionState)
+}
+
+// NewLRUClientSessionCache returns a ClientSessionCache with the given
+// capacity that uses an LRU strategy. If capacity is < 1, a default
+// capacity is used instead.
+func NewLRUClientSessionCache(capacity int) ClientSessionCache {
+	const defaultSessionCacheCapacity = 64
+
+	if capacity < 1 {
+		capacity = defaultSessionCacheCapacity
+	}
+	return &lruSessionCache{
+		m:        make(map[string]*list.Element),
+		q:        list.New(),
+		capacity: capacity,
+	}
+}
+
+// lruSessionCache is a ClientSessionCache implementation that uses an LRU
+// caching strategy.
+type lruSessionCache struct {
+	sync.Mutex
+
+	m        map[string]*list.Element
+	q        *list.List
+	capacity int
+}
+
+type lruSessionCacheEntry struct {
+	sessionKey string
+	state      *ClientSessionState
+}
+
+// Put adds the provided (sessionKey, cs) pair to the cache.
+func (c *lruSessionCache) Put(sessionKey string, cs *ClientSessionState) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.m[sessionKey]; ok {
+		entry := elem.Value.(*lruSessionCacheEntry)
+		entry.state = cs
+		c.q.MoveToFront(elem)
+		return
+	}
+
+	if c.q.Len() < c.capacity {
+		entry := &lruSessionCacheEntry{sessionKey, cs}
+		c.m[sessionKey] = c.q.PushFront(entry)
+		return
+	}
+
+	// Reuse the least recently used entry.
+	elem := c.q.Back()
+	entry := elem.Value.(*lruSessionCacheEntry)
+	c.m[entry.sessionKey] = nil, false
+	entry.sessionKey = sessionKey
+	entry.state = cs
+	c.q.MoveToFront(elem)
+	c.m[sessionKey] = elem
+}
+
+// Get returns the ClientSessionState value associated with a given key. It
+// returns (nil, false) if no value is found.
+func (c *lruSessionCache) Get(sessionKey string) (*ClientSessionState, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.m[sessionKey]; ok {
+		c.q.MoveToFront(elem)
+		return elem.Value.(*lruSessionCacheEntry).state, true
+	}
+	return nil, false
+}
+
 // A Certificate is a chain of one or more certificates, leaf first.
 type Certificate struct {
 	Certificate [][]byte
-	PrivateKey  *rsa.PrivateKey
+	// PrivateKey contains the private key corresponding to the public key
+	// of the leaf certificate: an *rsa.PrivateKey or an *ecdsa.PrivateKey.
+	PrivateKey interface{}
 	// OCSPStaple contains an optional OCSP response which will be served
 	// to clients that request it.
 	OCSPStaple []byte
@@ -197,18 +630,6 @@ type handshakeMessage interface {
 	unmarshal([]byte) bool
 }
 
-// mutualVersion returns the protocol version to use given the advertised
-// version of the peer.
-func mutualVersion(vers uint16) (uint16, bool) {
-	if vers < minVersion {
-		return 0, false
-	}
-	if vers > maxVersion {
-		vers = maxVersion
-	}
-	return vers, true
-}
-
 var emptyConfig Config
 
 func defaultConfig() *Config {
@@ -258,10 +679,6 @@ func initDefaultRoots() {
 var varDefaultCipherSuites []uint16
 
 func initDefaultCipherSuites() {
-	varDefaultCipherSuites = make([]uint16, len(cipherSuites))
-	i := 0
-	for id := range cipherSuites {
-		varDefaultCipherSuites[i] = id
-		i++
-	}
+	varDefaultCipherSuites = make([]uint16, len(defaultCipherSuiteOrder))
+	copy(varDefaultCipherSuites, defaultCipherSuiteOrder)
 }
@@ -0,0 +1,27 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tls
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConfigClone(t *testing.T) {
+	c := &Config{ServerName: "example.com", NextProtos: []string{"http/1.1"}}
+	c.SetSessionTicketKeys([][32]byte{{1}})
+
+	nc := c.Clone()
+	nc.ServerName = "example.org"
+	if c.ServerName != "example.com" {
+		t.Errorf("changing the clone changed ServerName to %q", c.ServerName)
+	}
+	if len(nc.NextProtos) != 1 || nc.NextProtos[0] != "http/1.1" {
+		t.Errorf("clone has NextProtos %v", nc.NextProtos)
+	}
+	if keys := nc.ticketKeys(); len(keys) != 1 || !bytes.Equal(keys[0].keyName[:], c.ticketKeys()[0].keyName[:]) {
+		t.Errorf("clone does not share the session ticket keys")
+	}
+}
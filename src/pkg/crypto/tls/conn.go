@@ -31,6 +31,7 @@ type Conn struct {
 	haveVers          bool       // version has been negotiated
 	config            *Config    // configuration passed to constructor
 	handshakeComplete bool
+	didResume         bool // whether this connection was a session resumption
 	cipherSuite       uint16
 	ocspResponse      []byte // stapled OCSP response
 	peerCertificates  []*x509.Certificate
@@ -108,10 +109,11 @@ func (c *Conn) SetWriteTimeout(nsec int64) os.Error {
 // connection, either sending or receiving.
 type halfConn struct {
 	sync.Mutex
-	cipher interface{} // cipher algorithm
-	mac    hash.Hash   // MAC algorithm
-	seq    [8]byte     // 64-bit sequence number
-	bfree  *block      // list of free blocks
+	version uint16      // protocol version
+	cipher  interface{} // cipher algorithm
+	mac     hash.Hash   // MAC algorithm
+	seq     [8]byte     // 64-bit sequence number
+	bfree   *block      // list of free blocks
 
 	nextCipher interface{} // next encryption state
 	nextMac    hash.Hash   // next MAC algorithm
@@ -119,7 +121,8 @@ type halfConn struct {
 
 // prepareCipherSpec sets the encryption and MAC states
 // that a subsequent changeCipherSpec will use.
-func (hc *halfConn) prepareCipherSpec(cipher interface{}, mac hash.Hash) {
+func (hc *halfConn) prepareCipherSpec(version uint16, cipher interface{}, mac hash.Hash) {
+	hc.version = version
 	hc.nextCipher = cipher
 	hc.nextMac = mac
 }
@@ -202,6 +205,7 @@ func roundUp(a, b int) int {
 }
 
 // decrypt checks and strips the mac and decrypts the data in b.
+// On return, b.off is the offset of the plaintext in b.data.
 func (hc *halfConn) decrypt(b *block) (bool, alert) {
 	// pull out payload
 	payload := b.data[recordHeaderLen:]
@@ -212,6 +216,7 @@ func (hc *halfConn) decrypt(b *block) (bool, alert) {
 	}
 
 	paddingGood := byte(255)
+	explicitIVLen := 0
 
 	// decrypt
 	if hc.cipher != nil {
@@ -220,14 +225,25 @@ func (hc *halfConn) decrypt(b *block) (bool, alert) {
 			c.XORKeyStream(payload, payload)
 		case cipher.BlockMode:
 			blockSize := c.BlockSize()
+			if hc.version >= VersionTLS11 {
+				explicitIVLen = blockSize
+			}
 
-			if len(payload)%blockSize != 0 || len(payload) < roundUp(macSize+1, blockSize) {
+			if len(payload)%blockSize != 0 || len(payload) < roundUp(explicitIVLen+macSize+1, blockSize) {
 				return false, alertBadRecordMAC
 			}
 
+			// From TLS 1.1 on, each record starts with its own IV.
+			// Decrypting it along with the rest leaves garbage in
+			// its place, which is discarded, but chains the CBC
+			// state so that the following blocks decrypt correctly.
 			c.CryptBlocks(payload, payload)
 			payload, paddingGood = removePadding(payload)
+			if len(payload) < explicitIVLen {
+				return false, alertBadRecordMAC
+			}
 			b.resize(recordHeaderLen + len(payload))
+			payload = payload[explicitIVLen:]
 
 			// note that we still have a timing side-channel in the
 			// MAC check, below. An attacker can align the record
@@ -254,18 +270,20 @@ func (hc *halfConn) decrypt(b *block) (bool, alert) {
 		n := len(payload) - macSize
 		b.data[3] = byte(n >> 8)
 		b.data[4] = byte(n)
-		b.resize(recordHeaderLen + n)
 		remoteMAC := payload[n:]
+		b.resize(recordHeaderLen + explicitIVLen + n)
 
 		hc.mac.Reset()
 		hc.mac.Write(hc.seq[0:])
 		hc.incSeq()
-		hc.mac.Write(b.data)
+		hc.mac.Write(b.data[:recordHeaderLen])
+		hc.mac.Write(payload[:n])
 
 		if subtle.ConstantTimeCompare(hc.mac.Sum(), remoteMAC) != 1 || paddingGood != 255 {
 			return false, alertBadRecordMAC
 		}
 	}
+	b.off = recordHeaderLen + explicitIVLen
 
 	return true, 0
 }
@@ -287,14 +305,16 @@ func padToBlockSize(payload []byte, blockSize int) (prefix, finalBlock []byte) {
 	return
 }
 
-// encrypt encrypts and macs the data in b.
-func (hc *halfConn) encrypt(b *block) (bool, alert) {
+// encrypt encrypts and macs the data in b. The first explicitIVLen bytes of
+// the payload are the record's explicit IV, which the mac does not cover.
+func (hc *halfConn) encrypt(b *block, explicitIVLen int) (bool, alert) {
 	// mac
 	if hc.mac != nil {
 		hc.mac.Reset()
 		hc.mac.Write(hc.seq[0:])
 		hc.incSeq()
-		hc.mac.Write(b.data)
+		hc.mac.Write(b.data[:recordHeaderLen])
+		hc.mac.Write(b.data[recordHeaderLen+explicitIVLen:])
 		mac := hc.mac.Sum()
 		n := len(b.data)
 		b.resize(n + len(mac))
@@ -482,7 +502,6 @@ Again:
 
 	// Process message.
 	b, c.rawInput = c.in.splitBlock(b, recordHeaderLen+n)
-	b.off = recordHeaderLen
 	if ok, err := c.in.decrypt(b); !ok {
 		return c.sendAlert(err)
 	}
@@ -583,18 +602,36 @@ func (c *Conn) writeRecord(typ recordType, data []byte) (n int, err os.Error) {
 		if m > maxPlaintext {
 			m = maxPlaintext
 		}
-		b.resize(recordHeaderLen + m)
+		explicitIVLen := 0
+		if cbc, ok := c.out.cipher.(cipher.BlockMode); ok && c.out.version >= VersionTLS11 {
+			// The explicit IV of a CBC record is a random
+			// block, encrypted ahead of the data with the
+			// chained CBC state.  Its ciphertext, which the
+			// peer takes as the IV of the record, is thus
+			// unpredictable.  See RFC 4346, section 6.2.3.2.
+			explicitIVLen = cbc.BlockSize()
+		}
+		b.resize(recordHeaderLen + explicitIVLen + m)
 		b.data[0] = byte(typ)
 		vers := c.vers
 		if vers == 0 {
-			vers = maxVersion
+			// Some servers reject a ClientHello in a
+			// record of a version they do not support, so
+			// until a version is negotiated we use the
+			// lowest.
+			vers = VersionTLS10
 		}
 		b.data[1] = byte(vers >> 8)
 		b.data[2] = byte(vers)
 		b.data[3] = byte(m >> 8)
 		b.data[4] = byte(m)
-		copy(b.data[recordHeaderLen:], data)
-		c.out.encrypt(b)
+		if explicitIVLen > 0 {
+			if _, err = io.ReadFull(c.config.rand(), b.data[recordHeaderLen:recordHeaderLen+explicitIVLen]); err != nil {
+				break
+			}
+		}
+		copy(b.data[recordHeaderLen+explicitIVLen:], data)
+		c.out.encrypt(b, explicitIVLen)
 		_, err = c.conn.Write(b.data)
 		if err != nil {
 			break
@@ -649,10 +686,12 @@ func (c *Conn) readHandshake() (interface{}, os.Error) {
 		m = new(clientHelloMsg)
 	case typeServerHello:
 		m = new(serverHelloMsg)
+	case typeNewSessionTicket:
+		m = new(newSessionTicketMsg)
 	case typeCertificate:
 		m = new(certificateMsg)
 	case typeCertificateRequest:
-		m = new(certificateRequestMsg)
+		m = &certificateRequestMsg{hasSignatureAndHash: c.vers >= VersionTLS12}
 	case typeCertificateStatus:
 		m = new(certificateStatusMsg)
 	case typeServerKeyExchange:
@@ -662,7 +701,7 @@ func (c *Conn) readHandshake() (interface{}, os.Error) {
 	case typeClientKeyExchange:
 		m = new(clientKeyExchangeMsg)
 	case typeCertificateVerify:
-		m = new(certificateVerifyMsg)
+		m = &certificateVerifyMsg{hasSignatureAndHash: c.vers >= VersionTLS12}
 	case typeNextProtocol:
 		m = new(nextProtoMsg)
 	case typeFinished:
@@ -764,6 +803,8 @@ func (c *Conn) ConnectionState() ConnectionState {
 	var state ConnectionState
 	state.HandshakeComplete = c.handshakeComplete
 	if c.handshakeComplete {
+		state.Version = c.vers
+		state.DidResume = c.didResume
 		state.NegotiatedProtocol = c.clientProtocol
 		state.NegotiatedProtocolIsMutual = !c.clientProtocolFallback
 		state.CipherSuite = c.cipherSuite
@@ -5,7 +5,10 @@
 package tls
 
 import (
-	"crypto"
+	"asn1"
+	"big"
+	"bytes"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/subtle"
 	"crypto/x509"
@@ -13,16 +16,26 @@ import (
 	"os"
 )
 
-func (c *Conn) clientHandshake() os.Error {
-	finishedHash := newFinishedHash()
+// clientHandshakeState contains details of a client handshake in progress.
+// It's discarded once the handshake has completed.
+type clientHandshakeState struct {
+	c            *Conn
+	serverHello  *serverHelloMsg
+	hello        *clientHelloMsg
+	suite        *cipherSuite
+	suiteId      uint16
+	finishedHash finishedHash
+	masterSecret []byte
+	session      *ClientSessionState
+}
 
+func (c *Conn) clientHandshake() os.Error {
 	if c.config == nil {
 		c.config = defaultConfig()
 	}
 
 	hello := &clientHelloMsg{
-		vers:               maxVersion,
-		cipherSuites:       c.config.cipherSuites(),
+		vers:               c.config.maxVersion(),
 		compressionMethods: []uint8{compressionNone},
 		random:             make([]byte, 32),
 		ocspStapling:       true,
@@ -31,6 +44,16 @@ func (c *Conn) clientHandshake() os.Error {
 		supportedPoints:    []uint8{pointFormatUncompressed},
 		nextProtoNeg:       len(c.config.NextProtos) > 0,
 	}
+	if hello.vers >= VersionTLS12 {
+		hello.signatureAndHashes = supportedSignatureAlgorithms
+	}
+	for _, id := range c.config.cipherSuites() {
+		// Suites that need TLS 1.2 are of no use if we can't speak it.
+		if suite, ok := cipherSuites[id]; ok && suite.tls12 && hello.vers < VersionTLS12 {
+			continue
+		}
+		hello.cipherSuites = append(hello.cipherSuites, id)
+	}
 
 	t := uint32(c.config.time())
 	hello.random[0] = byte(t >> 24)
@@ -43,7 +66,51 @@ func (c *Conn) clientHandshake() os.Error {
 		return os.ErrorString("short read from Rand")
 	}
 
-	finishedHash.Write(hello.marshal())
+	var session *ClientSessionState
+	var cacheKey string
+	sessionCache := c.config.ClientSessionCache
+	if sessionCache != nil {
+		hello.ticketSupported = !c.config.SessionTicketsDisabled
+
+		// Try to resume a previously negotiated TLS session, if
+		// available.
+		cacheKey = clientSessionCacheKey(c.conn.RemoteAddr().String(), c.config)
+		candidateSession, ok := sessionCache.Get(cacheKey)
+		if ok {
+			// Check that the ciphersuite and version used for the
+			// previous session are still valid.
+			cipherSuiteOk := false
+			for _, id := range hello.cipherSuites {
+				if id == candidateSession.cipherSuite {
+					cipherSuiteOk = true
+					break
+				}
+			}
+
+			versOk := candidateSession.vers >= c.config.minVersion() &&
+				candidateSession.vers <= c.config.maxVersion()
+			if versOk && cipherSuiteOk {
+				session = candidateSession
+			}
+		}
+	}
+
+	if session != nil {
+		if session.sessionTicket != nil && hello.ticketSupported {
+			hello.sessionTicket = session.sessionTicket
+			// A random session ID is used to detect when the
+			// server accepted the ticket and is resuming a session
+			// (see RFC 5077).
+			hello.sessionId = make([]byte, 16)
+			if _, err := io.ReadFull(c.config.rand(), hello.sessionId); err != nil {
+				c.sendAlert(alertInternalError)
+				return os.ErrorString("short read from Rand")
+			}
+		} else {
+			hello.sessionId = session.sessionId
+		}
+	}
+
 	c.writeRecord(recordTypeHandshake, hello.marshal())
 
 	msg, err := c.readHandshake()
@@ -54,30 +121,84 @@ func (c *Conn) clientHandshake() os.Error {
 	if !ok {
 		return c.sendAlert(alertUnexpectedMessage)
 	}
-	finishedHash.Write(serverHello.marshal())
 
-	vers, ok := mutualVersion(serverHello.vers)
-	if !ok {
+	// The server must pick a version we offered; unlike the
+	// server, we cannot negotiate down.
+	vers := serverHello.vers
+	if vers > hello.vers || vers < c.config.minVersion() {
 		return c.sendAlert(alertProtocolVersion)
 	}
 	c.vers = vers
 	c.haveVers = true
 
-	if serverHello.compressionMethod != compressionNone {
-		return c.sendAlert(alertUnexpectedMessage)
+	suite, suiteId := mutualCipherSuite(hello.cipherSuites, serverHello.cipherSuite)
+	if suite == nil || suite.tls12 && vers < VersionTLS12 {
+		return c.sendAlert(alertHandshakeFailure)
 	}
 
-	if !hello.nextProtoNeg && serverHello.nextProtoNeg {
-		c.sendAlert(alertHandshakeFailure)
-		return os.ErrorString("server advertised unrequested NPN")
+	hs := &clientHandshakeState{
+		c:            c,
+		serverHello:  serverHello,
+		hello:        hello,
+		suite:        suite,
+		suiteId:      suiteId,
+		finishedHash: newFinishedHash(),
+		session:      session,
 	}
+	hs.finishedHash.version = vers
+	hs.finishedHash.Write(hello.marshal())
+	hs.finishedHash.Write(serverHello.marshal())
 
-	suite, suiteId := mutualCipherSuite(c.config.cipherSuites(), serverHello.cipherSuite)
-	if suite == nil {
-		return c.sendAlert(alertHandshakeFailure)
+	isResume, err := hs.processServerHello()
+	if err != nil {
+		return err
 	}
 
-	msg, err = c.readHandshake()
+	if isResume {
+		if err := hs.establishKeys(); err != nil {
+			return err
+		}
+		if err := hs.readSessionTicket(); err != nil {
+			return err
+		}
+		if err := hs.readFinished(); err != nil {
+			return err
+		}
+		if err := hs.sendFinished(); err != nil {
+			return err
+		}
+	} else {
+		if err := hs.doFullHandshake(); err != nil {
+			return err
+		}
+		if err := hs.establishKeys(); err != nil {
+			return err
+		}
+		if err := hs.sendFinished(); err != nil {
+			return err
+		}
+		if err := hs.readSessionTicket(); err != nil {
+			return err
+		}
+		if err := hs.readFinished(); err != nil {
+			return err
+		}
+	}
+
+	if sessionCache != nil && hs.session != nil && session != hs.session {
+		sessionCache.Put(cacheKey, hs.session)
+	}
+
+	c.didResume = isResume
+	c.handshakeComplete = true
+	c.cipherSuite = suiteId
+	return nil
+}
+
+func (hs *clientHandshakeState) doFullHandshake() os.Error {
+	c := hs.c
+
+	msg, err := c.readHandshake()
 	if err != nil {
 		return err
 	}
@@ -85,7 +206,7 @@ func (c *Conn) clientHandshake() os.Error {
 	if !ok || len(certMsg.certificates) == 0 {
 		return c.sendAlert(alertUnexpectedMessage)
 	}
-	finishedHash.Write(certMsg.marshal())
+	hs.finishedHash.Write(certMsg.marshal())
 
 	certs := make([]*x509.Certificate, len(certMsg.certificates))
 	for i, asn1Data := range certMsg.certificates {
@@ -120,13 +241,23 @@ func (c *Conn) clientHandshake() os.Error {
 		}
 	}
 
-	if _, ok := certs[0].PublicKey.(*rsa.PublicKey); !ok {
+	// The server's key must be of the type that the cipher suite uses.
+	switch certs[0].PublicKey.(type) {
+	case *rsa.PublicKey:
+		if hs.suite.ecdsa {
+			return c.sendAlert(alertUnsupportedCertificate)
+		}
+	case *ecdsa.PublicKey:
+		if !hs.suite.ecdsa {
+			return c.sendAlert(alertUnsupportedCertificate)
+		}
+	default:
 		return c.sendAlert(alertUnsupportedCertificate)
 	}
 
 	c.peerCertificates = certs
 
-	if serverHello.ocspStapling {
+	if hs.serverHello.ocspStapling {
 		msg, err = c.readHandshake()
 		if err != nil {
 			return err
@@ -135,7 +266,7 @@ func (c *Conn) clientHandshake() os.Error {
 		if !ok {
 			return c.sendAlert(alertUnexpectedMessage)
 		}
-		finishedHash.Write(cs.marshal())
+		hs.finishedHash.Write(cs.marshal())
 
 		if cs.statusType == statusTypeOCSP {
 			c.ocspResponse = cs.response
@@ -147,12 +278,12 @@ func (c *Conn) clientHandshake() os.Error {
 		return err
 	}
 
-	keyAgreement := suite.ka()
+	keyAgreement := hs.suite.ka(c.vers)
 
 	skx, ok := msg.(*serverKeyExchangeMsg)
 	if ok {
-		finishedHash.Write(skx.marshal())
-		err = keyAgreement.processServerKeyExchange(c.config, hello, serverHello, certs[0], skx)
+		hs.finishedHash.Write(skx.marshal())
+		err = keyAgreement.processServerKeyExchange(c.config, hs.hello, hs.serverHello, certs[0], skx)
 		if err != nil {
 			c.sendAlert(alertUnexpectedMessage)
 			return err
@@ -165,14 +296,16 @@ func (c *Conn) clientHandshake() os.Error {
 	}
 
 	transmitCert := false
+	var rsaAvail, ecdsaAvail bool
 	certReq, ok := msg.(*certificateRequestMsg)
 	if ok {
-		// We only accept certificates with RSA keys.
-		rsaAvail := false
+		// We only send certificates with RSA or ECDSA keys.
 		for _, certType := range certReq.certificateTypes {
-			if certType == certTypeRSASign {
+			switch certType {
+			case certTypeRSASign:
 				rsaAvail = true
-				break
+			case certTypeECDSASign:
+				ecdsaAvail = true
 			}
 		}
 
@@ -188,11 +321,11 @@ func (c *Conn) clientHandshake() os.Error {
 		// list is empty then the client MAY send any certificate of the
 		// appropriate ClientCertificateType, unless there is some
 		// external arrangement to the contrary.
-		if rsaAvail && len(certReq.certificateAuthorities) == 0 {
+		if (rsaAvail || ecdsaAvail) && len(certReq.certificateAuthorities) == 0 {
 			transmitCert = true
 		}
 
-		finishedHash.Write(certReq.marshal())
+		hs.finishedHash.Write(certReq.marshal())
 
 		msg, err = c.readHandshake()
 		if err != nil {
@@ -204,81 +337,149 @@ func (c *Conn) clientHandshake() os.Error {
 	if !ok {
 		return c.sendAlert(alertUnexpectedMessage)
 	}
-	finishedHash.Write(shd.marshal())
+	hs.finishedHash.Write(shd.marshal())
 
 	var cert *x509.Certificate
 	if transmitCert {
 		certMsg = new(certificateMsg)
 		if len(c.config.Certificates) > 0 {
 			cert, err = x509.ParseCertificate(c.config.Certificates[0].Certificate[0])
-			if err == nil && cert.PublicKeyAlgorithm == x509.RSA {
+			if err == nil && (rsaAvail && cert.PublicKeyAlgorithm == x509.RSA ||
+				ecdsaAvail && cert.PublicKeyAlgorithm == x509.ECDSA) {
 				certMsg.certificates = c.config.Certificates[0].Certificate
 			} else {
 				cert = nil
 			}
 		}
-		finishedHash.Write(certMsg.marshal())
+		hs.finishedHash.Write(certMsg.marshal())
 		c.writeRecord(recordTypeHandshake, certMsg.marshal())
 	}
 
-	preMasterSecret, ckx, err := keyAgreement.generateClientKeyExchange(c.config, hello, certs[0])
+	preMasterSecret, ckx, err := keyAgreement.generateClientKeyExchange(c.config, hs.hello, certs[0])
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return err
 	}
 	if ckx != nil {
-		finishedHash.Write(ckx.marshal())
+		hs.finishedHash.Write(ckx.marshal())
 		c.writeRecord(recordTypeHandshake, ckx.marshal())
 	}
 
 	if cert != nil {
-		certVerify := new(certificateVerifyMsg)
-		var digest [36]byte
-		copy(digest[0:16], finishedHash.serverMD5.Sum())
-		copy(digest[16:36], finishedHash.serverSHA1.Sum())
-		signed, err := rsa.SignPKCS1v15(c.config.rand(), c.config.Certificates[0].PrivateKey, crypto.MD5SHA1, digest[0:])
+		sigType := signatureRSA
+		if cert.PublicKeyAlgorithm == x509.ECDSA {
+			sigType = signatureECDSA
+		}
+
+		certVerify := &certificateVerifyMsg{hasSignatureAndHash: c.vers >= VersionTLS12}
+		var tls12HashId uint8
+		if certVerify.hasSignatureAndHash {
+			tls12HashId, err = pickTLS12Hash(sigType, certReq.signatureAndHashes)
+			if err != nil {
+				c.sendAlert(alertHandshakeFailure)
+				return err
+			}
+			certVerify.signatureAndHash = signatureAndHash{tls12HashId, sigType}
+		}
+		digest, hashFunc := hs.finishedHash.certificateVerifySum(sigType, tls12HashId)
+		var signed []byte
+		switch key := c.config.Certificates[0].PrivateKey.(type) {
+		case *ecdsa.PrivateKey:
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(c.config.rand(), key, digest)
+			if err == nil {
+				signed, err = asn1.Marshal(ecdsaSignature{r, s})
+			}
+		case *rsa.PrivateKey:
+			signed, err = rsa.SignPKCS1v15(c.config.rand(), key, hashFunc, digest)
+		default:
+			err = os.ErrorString("unknown private key type")
+		}
 		if err != nil {
 			return c.sendAlert(alertInternalError)
 		}
 		certVerify.signature = signed
 
-		finishedHash.Write(certVerify.marshal())
+		hs.finishedHash.Write(certVerify.marshal())
 		c.writeRecord(recordTypeHandshake, certVerify.marshal())
 	}
 
-	masterSecret, clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV :=
-		keysFromPreMasterSecret10(preMasterSecret, hello.random, serverHello.random, suite.macLen, suite.keyLen, suite.ivLen)
+	hs.masterSecret = masterFromPreMasterSecret(c.vers, preMasterSecret, hs.hello.random, hs.serverHello.random)
+	return nil
+}
 
-	clientCipher := suite.cipher(clientKey, clientIV, false /* not for reading */ )
-	clientHash := suite.mac(clientMAC)
-	c.out.prepareCipherSpec(clientCipher, clientHash)
-	c.writeRecord(recordTypeChangeCipherSpec, []byte{1})
+func (hs *clientHandshakeState) establishKeys() os.Error {
+	c := hs.c
 
-	if serverHello.nextProtoNeg {
-		nextProto := new(nextProtoMsg)
-		proto, fallback := mutualProtocol(c.config.NextProtos, serverHello.nextProtos)
-		nextProto.proto = proto
-		c.clientProtocol = proto
-		c.clientProtocolFallback = fallback
+	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV :=
+		keysFromMasterSecret(c.vers, hs.masterSecret, hs.hello.random, hs.serverHello.random, hs.suite.macLen, hs.suite.keyLen, hs.suite.ivLen)
 
-		finishedHash.Write(nextProto.marshal())
-		c.writeRecord(recordTypeHandshake, nextProto.marshal())
+	clientCipher := hs.suite.cipher(clientKey, clientIV, false /* not for reading */ )
+	clientHash := hs.suite.mac(clientMAC)
+	c.out.prepareCipherSpec(c.vers, clientCipher, clientHash)
+
+	serverCipher := hs.suite.cipher(serverKey, serverIV, true /* for reading */ )
+	serverHash := hs.suite.mac(serverMAC)
+	c.in.prepareCipherSpec(c.vers, serverCipher, serverHash)
+
+	return nil
+}
+
+// serverResumedSession reports whether the server accepted the session
+// offered in the ClientHello, which it signals by echoing its session ID.
+func (hs *clientHandshakeState) serverResumedSession() bool {
+	return hs.session != nil && len(hs.hello.sessionId) > 0 &&
+		bytes.Equal(hs.serverHello.sessionId, hs.hello.sessionId)
+}
+
+// processServerHello checks the ServerHello and returns whether the server
+// is resuming the session offered to it.
+func (hs *clientHandshakeState) processServerHello() (bool, os.Error) {
+	c := hs.c
+
+	if hs.serverHello.compressionMethod != compressionNone {
+		return false, c.sendAlert(alertUnexpectedMessage)
 	}
 
-	finished := new(finishedMsg)
-	finished.verifyData = finishedHash.clientSum(masterSecret)
-	finishedHash.Write(finished.marshal())
-	c.writeRecord(recordTypeHandshake, finished.marshal())
+	if !hs.hello.nextProtoNeg && hs.serverHello.nextProtoNeg {
+		c.sendAlert(alertHandshakeFailure)
+		return false, os.ErrorString("server advertised unrequested NPN")
+	}
+
+	if !hs.hello.ticketSupported && hs.serverHello.ticketSupported {
+		c.sendAlert(alertHandshakeFailure)
+		return false, os.ErrorString("server advertised unrequested session ticket support")
+	}
+
+	if !hs.serverResumedSession() {
+		return false, nil
+	}
+
+	if hs.session.vers != c.vers {
+		c.sendAlert(alertHandshakeFailure)
+		return false, os.ErrorString("server resumed a session with a different version")
+	}
+
+	if hs.session.cipherSuite != hs.suiteId {
+		c.sendAlert(alertHandshakeFailure)
+		return false, os.ErrorString("server resumed a session with a different cipher suite")
+	}
+
+	// Restore masterSecret and peerCerts from previous state
+	hs.masterSecret = hs.session.masterSecret
+	c.peerCertificates = hs.session.serverCertificates
+	return true, nil
+}
+
+func (hs *clientHandshakeState) readFinished() os.Error {
+	c := hs.c
 
-	serverCipher := suite.cipher(serverKey, serverIV, true /* for reading */ )
-	serverHash := suite.mac(serverMAC)
-	c.in.prepareCipherSpec(serverCipher, serverHash)
 	c.readRecord(recordTypeChangeCipherSpec)
-	if c.err != nil {
-		return c.err
+	if err := c.error(); err != nil {
+		return err
 	}
 
-	msg, err = c.readHandshake()
+	msg, err := c.readHandshake()
 	if err != nil {
 		return err
 	}
@@ -287,17 +488,88 @@ func (c *Conn) clientHandshake() os.Error {
 		return c.sendAlert(alertUnexpectedMessage)
 	}
 
-	verify := finishedHash.serverSum(masterSecret)
+	verify := hs.finishedHash.serverSum(hs.masterSecret)
 	if len(verify) != len(serverFinished.verifyData) ||
 		subtle.ConstantTimeCompare(verify, serverFinished.verifyData) != 1 {
 		return c.sendAlert(alertHandshakeFailure)
 	}
+	hs.finishedHash.Write(serverFinished.marshal())
+	return nil
+}
+
+// readSessionTicket reads the NewSessionTicket message that the server sends
+// if it advertised session tickets, and records the session it holds as the
+// one to cache. Without a ticket, a full handshake is cached under the
+// server's session ID, if it gave one.
+func (hs *clientHandshakeState) readSessionTicket() os.Error {
+	c := hs.c
+
+	if !hs.serverHello.ticketSupported {
+		if !hs.serverResumedSession() && len(hs.serverHello.sessionId) > 0 {
+			hs.session = &ClientSessionState{
+				sessionId:          hs.serverHello.sessionId,
+				vers:               c.vers,
+				cipherSuite:        hs.suiteId,
+				masterSecret:       hs.masterSecret,
+				serverCertificates: c.peerCertificates,
+			}
+		}
+		return nil
+	}
+
+	msg, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+	sessionTicketMsg, ok := msg.(*newSessionTicketMsg)
+	if !ok {
+		return c.sendAlert(alertUnexpectedMessage)
+	}
+	hs.finishedHash.Write(sessionTicketMsg.marshal())
+
+	hs.session = &ClientSessionState{
+		sessionTicket:      sessionTicketMsg.ticket,
+		vers:               c.vers,
+		cipherSuite:        hs.suiteId,
+		masterSecret:       hs.masterSecret,
+		serverCertificates: c.peerCertificates,
+	}
 
-	c.handshakeComplete = true
-	c.cipherSuite = suiteId
 	return nil
 }
 
+func (hs *clientHandshakeState) sendFinished() os.Error {
+	c := hs.c
+
+	c.writeRecord(recordTypeChangeCipherSpec, []byte{1})
+
+	if hs.serverHello.nextProtoNeg {
+		nextProto := new(nextProtoMsg)
+		proto, fallback := mutualProtocol(c.config.NextProtos, hs.serverHello.nextProtos)
+		nextProto.proto = proto
+		c.clientProtocol = proto
+		c.clientProtocolFallback = fallback
+
+		hs.finishedHash.Write(nextProto.marshal())
+		c.writeRecord(recordTypeHandshake, nextProto.marshal())
+	}
+
+	finished := new(finishedMsg)
+	finished.verifyData = hs.finishedHash.clientSum(hs.masterSecret)
+	hs.finishedHash.Write(finished.marshal())
+	c.writeRecord(recordTypeHandshake, finished.marshal())
+	return nil
+}
+
+// clientSessionCacheKey returns a key used to cache sessionTickets that could
+// be used to resume previously negotiated TLS sessions with a server.
+func clientSessionCacheKey(serverAddr string, config *Config) string {
+	if len(config.ServerName) > 0 {
+		return config.ServerName
+	}
+	return serverAddr
+}
+
 // mutualProtocol finds the mutual Next Protocol Negotiation protocol given the
 // set of client and server supported protocols. The set of client supported
 // protocols must not be empty. It returns the resulting protocol and flag
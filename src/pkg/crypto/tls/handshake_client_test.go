@@ -9,6 +9,7 @@ import (
 	"flag"
 	"io"
 	"net"
+	"os"
 	"testing"
 )
 
@@ -41,6 +42,102 @@ func TestHandshakeClientRC4(t *testing.T) {
 	testClientScript(t, "RC4", rc4ClientScript, testConfig)
 }
 
+// readClientHello reads the ClientHello that a client with the given
+// configuration starts its handshake with, and the version of the record
+// that carried it.
+func readClientHello(t *testing.T, config *Config) (*clientHelloMsg, uint16) {
+	c, s := net.Pipe()
+	go func() {
+		Client(c, config).Handshake()
+		c.Close()
+	}()
+	defer s.Close()
+
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(s, header); err != nil {
+		t.Fatalf("reading record header: %s", err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(s, body); err != nil {
+		t.Fatalf("reading record: %s", err)
+	}
+	hello := new(clientHelloMsg)
+	if recordType(header[0]) != recordTypeHandshake || !hello.unmarshal(body) {
+		t.Fatalf("failed to parse ClientHello %x", body)
+	}
+	return hello, uint16(header[1])<<8 | uint16(header[2])
+}
+
+func TestClientHelloVersion(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS10, VersionTLS11, VersionTLS12} {
+		config := new(Config)
+		*config = *testConfig
+		config.MaxVersion = vers
+		hello, recordVers := readClientHello(t, config)
+		if hello.vers != vers {
+			t.Errorf("MaxVersion %04x: ClientHello has version %04x", vers, hello.vers)
+		}
+		if recordVers != VersionTLS10 {
+			t.Errorf("MaxVersion %04x: ClientHello sent in a record of version %04x; want %04x", vers, recordVers, VersionTLS10)
+		}
+		if sendsAlgs := len(hello.signatureAndHashes) > 0; sendsAlgs != (vers >= VersionTLS12) {
+			t.Errorf("MaxVersion %04x: ClientHello has signature algorithms %v", vers, hello.signatureAndHashes)
+		}
+	}
+}
+
+// testServerHelloVersion replies to the ClientHello of a client with
+// the given configuration with a ServerHello of version vers, and
+// checks that the client rejects it with a protocol_version alert.
+func testServerHelloVersion(t *testing.T, config *Config, vers uint16) {
+	c, s := net.Pipe()
+	errc := make(chan os.Error, 1)
+	go func() {
+		errc <- Client(c, config).Handshake()
+		c.Close()
+	}()
+	defer s.Close()
+
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(s, header); err != nil {
+		t.Fatalf("reading record header: %s", err)
+	}
+	if _, err := io.ReadFull(s, make([]byte, int(header[3])<<8|int(header[4]))); err != nil {
+		t.Fatalf("reading record: %s", err)
+	}
+	hello := &serverHelloMsg{
+		vers:        vers,
+		random:      make([]byte, 32),
+		cipherSuite: TLS_RSA_WITH_RC4_128_SHA,
+	}
+	body := hello.marshal()
+	record := []byte{byte(recordTypeHandshake), uint8(vers >> 8), uint8(vers), uint8(len(body) >> 8), uint8(len(body))}
+	if _, err := s.Write(append(record, body...)); err != nil {
+		t.Fatalf("writing ServerHello: %s", err)
+	}
+
+	reply := make([]byte, recordHeaderLen+2)
+	if _, err := io.ReadFull(s, reply); err != nil {
+		t.Fatalf("reading alert: %s", err)
+	}
+	if recordType(reply[0]) != recordTypeAlert || alert(reply[6]) != alertProtocolVersion {
+		t.Errorf("ServerHello version %04x: got record %x; want a protocol_version alert", vers, reply)
+	}
+	if err := <-errc; err == nil {
+		t.Errorf("ServerHello version %04x: handshake succeeded", vers)
+	}
+}
+
+func TestClientRejectsServerHelloVersion(t *testing.T) {
+	config := new(Config)
+	*config = *testConfig
+	config.MinVersion = VersionTLS11
+	config.MaxVersion = VersionTLS11
+	// A version above the one offered is not clamped to it.
+	testServerHelloVersion(t, config, VersionTLS12)
+	testServerHelloVersion(t, config, VersionTLS10)
+}
+
 var connect = flag.Bool("connect", false, "connect to a TLS server on :10443")
 
 func TestRunClient(t *testing.T) {
@@ -22,6 +22,8 @@ var tests = []interface{}{
 	&clientKeyExchangeMsg{},
 	&finishedMsg{},
 	&nextProtoMsg{},
+	&newSessionTicketMsg{},
+	&sessionState{},
 }
 
 type testMessage interface {
@@ -124,6 +126,17 @@ func (*clientHelloMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 	for i := range m.supportedCurves {
 		m.supportedCurves[i] = uint16(rand.Intn(30000))
 	}
+	if rand.Intn(10) > 5 {
+		m.signatureAndHashes = make([]signatureAndHash, rand.Intn(5)+1)
+		for i := range m.signatureAndHashes {
+			m.signatureAndHashes[i].hash = uint8(rand.Intn(256))
+			m.signatureAndHashes[i].signature = uint8(rand.Intn(256))
+		}
+	}
+	if rand.Intn(10) > 5 {
+		m.ticketSupported = true
+		m.sessionTicket = randomBytes(rand.Intn(300), rand)
+	}
 
 	return reflect.ValueOf(m)
 }
@@ -145,6 +158,7 @@ func (*serverHelloMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 			m.nextProtos[i] = randomString(20, rand)
 		}
 	}
+	m.ticketSupported = rand.Intn(10) > 5
 
 	return reflect.ValueOf(m)
 }
@@ -204,3 +218,22 @@ func (*nextProtoMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 	m.proto = randomString(rand.Intn(255), rand)
 	return reflect.ValueOf(m)
 }
+
+func (*newSessionTicketMsg) Generate(rand *rand.Rand, size int) reflect.Value {
+	m := &newSessionTicketMsg{}
+	m.ticket = randomBytes(rand.Intn(4), rand)
+	return reflect.ValueOf(m)
+}
+
+func (*sessionState) Generate(rand *rand.Rand, size int) reflect.Value {
+	s := &sessionState{}
+	s.vers = uint16(rand.Intn(10000))
+	s.cipherSuite = uint16(rand.Intn(10000))
+	s.masterSecret = randomBytes(rand.Intn(100), rand)
+	numCerts := rand.Intn(20)
+	s.certificates = make([][]byte, numCerts)
+	for i := 0; i < numCerts; i++ {
+		s.certificates[i] = randomBytes(rand.Intn(10)+1, rand)
+	}
+	return reflect.ValueOf(s)
+}
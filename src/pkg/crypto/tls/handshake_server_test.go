@@ -7,13 +7,19 @@ package tls
 import (
 	"big"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
 	"flag"
 	"io"
 	"net"
 	"os"
 	"testing"
+	"time"
 )
 
 type zeroSource struct{}
@@ -36,6 +42,8 @@ func init() {
 	testConfig.Certificates[0].Certificate = [][]byte{testCertificate}
 	testConfig.Certificates[0].PrivateKey = testPrivateKey
 	testConfig.CipherSuites = []uint16{TLS_RSA_WITH_RC4_128_SHA}
+	// The scripts below were recorded from TLS 1.0 handshakes.
+	testConfig.MaxVersion = VersionTLS10
 }
 
 func testClientHelloFailure(t *testing.T, m handshakeMessage, expected os.Error) {
@@ -71,13 +79,13 @@ func TestRejectBadProtocolVersion(t *testing.T) {
 }
 
 func TestNoSuiteOverlap(t *testing.T) {
-	clientHello := &clientHelloMsg{nil, 0x0301, nil, nil, []uint16{0xff00}, []uint8{0}, false, "", false, nil, nil}
+	clientHello := &clientHelloMsg{nil, 0x0301, nil, nil, []uint16{0xff00}, []uint8{0}, false, "", false, nil, nil, nil, false, nil}
 	testClientHelloFailure(t, clientHello, alertHandshakeFailure)
 
 }
 
 func TestNoCompressionOverlap(t *testing.T) {
-	clientHello := &clientHelloMsg{nil, 0x0301, nil, nil, []uint16{TLS_RSA_WITH_RC4_128_SHA}, []uint8{0xff}, false, "", false, nil, nil}
+	clientHello := &clientHelloMsg{nil, 0x0301, nil, nil, []uint16{TLS_RSA_WITH_RC4_128_SHA}, []uint8{0xff}, false, "", false, nil, nil, nil, false, nil}
 	testClientHelloFailure(t, clientHello, alertHandshakeFailure)
 }
 
@@ -143,6 +151,481 @@ func TestHandshakeServerAES(t *testing.T) {
 	testServerScript(t, "AES", aesServerScript, aesConfig)
 }
 
+// testData is long enough to be sent in several records.
+var testData = bytes.Repeat([]byte("0123456789abcdef"), 1500)
+
+// testHandshake connects a client and a server with the given
+// configurations, has the client send testData and the server echo it back,
+// and returns the server's view of the connection.
+func testHandshake(clientConfig, serverConfig *Config) (state ConnectionState, err os.Error) {
+	c, s := net.Pipe()
+	clientErr := make(chan os.Error, 1)
+	go func() {
+		defer c.Close()
+		cli := Client(c, clientConfig)
+		if _, err := cli.Write(testData); err != nil {
+			clientErr <- err
+			return
+		}
+		echo := make([]byte, len(testData))
+		if _, err := io.ReadFull(cli, echo); err != nil {
+			clientErr <- err
+			return
+		}
+		if !bytes.Equal(echo, testData) {
+			clientErr <- os.ErrorString("client read back different data")
+			return
+		}
+		clientErr <- nil
+	}()
+
+	defer s.Close()
+	srv := Server(s, serverConfig)
+	data := make([]byte, len(testData))
+	if _, err = io.ReadFull(srv, data); err != nil {
+		return
+	}
+	if _, err = srv.Write(data); err != nil {
+		return
+	}
+	if err = <-clientErr; err != nil {
+		return
+	}
+	return srv.ConnectionState(), nil
+}
+
+var versionTests = []struct {
+	clientMin, clientMax uint16
+	serverMin, serverMax uint16
+	vers                 uint16 // 0 if the handshake must fail
+}{
+	{0, 0, 0, 0, VersionTLS12},
+	{0, VersionTLS10, 0, 0, VersionTLS10},
+	{0, VersionTLS11, 0, 0, VersionTLS11},
+	{0, 0, 0, VersionTLS11, VersionTLS11},
+	{VersionTLS11, 0, 0, VersionTLS12, VersionTLS12},
+	{0, VersionTLS10, VersionTLS11, 0, 0},
+}
+
+var versionTestSuites = []uint16{
+	TLS_RSA_WITH_RC4_128_SHA,
+	TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	TLS_RSA_WITH_AES_128_CBC_SHA,
+	TLS_RSA_WITH_AES_256_CBC_SHA,
+	TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+}
+
+func TestHandshakeVersions(t *testing.T) {
+	for i, tt := range versionTests {
+		for _, suite := range versionTestSuites {
+			clientConfig := new(Config)
+			*clientConfig = *testConfig
+			clientConfig.CipherSuites = []uint16{suite}
+			clientConfig.MinVersion = tt.clientMin
+			clientConfig.MaxVersion = tt.clientMax
+			serverConfig := new(Config)
+			*serverConfig = *clientConfig
+			serverConfig.MinVersion = tt.serverMin
+			serverConfig.MaxVersion = tt.serverMax
+
+			state, err := testHandshake(clientConfig, serverConfig)
+			if tt.vers == 0 {
+				if err == nil {
+					t.Errorf("#%d, suite %04x: handshake succeeded with version %04x", i, suite, state.Version)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("#%d, suite %04x: %s", i, suite, err)
+				continue
+			}
+			if state.Version != tt.vers || state.CipherSuite != suite {
+				t.Errorf("#%d: got version %04x, suite %04x; want %04x, %04x", i, state.Version, state.CipherSuite, tt.vers, suite)
+			}
+		}
+	}
+}
+
+var tls12TestSuites = []uint16{
+	TLS_RSA_WITH_AES_128_CBC_SHA256,
+	TLS_RSA_WITH_AES_256_CBC_SHA256,
+	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+}
+
+func TestHandshakeTLS12Suites(t *testing.T) {
+	for _, suite := range tls12TestSuites {
+		clientConfig := new(Config)
+		*clientConfig = *testConfig
+		clientConfig.CipherSuites = []uint16{suite, TLS_RSA_WITH_AES_128_CBC_SHA}
+		clientConfig.MaxVersion = VersionTLS12
+		serverConfig := new(Config)
+		*serverConfig = *clientConfig
+
+		state, err := testHandshake(clientConfig, serverConfig)
+		if err != nil {
+			t.Errorf("suite %04x: %s", suite, err)
+			continue
+		}
+		if state.Version != VersionTLS12 || state.CipherSuite != suite {
+			t.Errorf("got version %04x, suite %04x; want %04x, %04x", state.Version, state.CipherSuite, VersionTLS12, suite)
+		}
+
+		// Below TLS 1.2 the server must pick another suite.
+		serverConfig.MaxVersion = VersionTLS11
+		state, err = testHandshake(clientConfig, serverConfig)
+		if err != nil {
+			t.Errorf("suite %04x, TLS 1.1: %s", suite, err)
+			continue
+		}
+		if state.CipherSuite != TLS_RSA_WITH_AES_128_CBC_SHA {
+			t.Errorf("suite %04x, TLS 1.1: got suite %04x; want %04x", suite, state.CipherSuite, TLS_RSA_WITH_AES_128_CBC_SHA)
+		}
+	}
+}
+
+func TestCipherSuitePreference(t *testing.T) {
+	clientConfig := new(Config)
+	*clientConfig = *testConfig
+	clientConfig.CipherSuites = []uint16{TLS_RSA_WITH_RC4_128_SHA, TLS_RSA_WITH_AES_128_CBC_SHA}
+	serverConfig := new(Config)
+	*serverConfig = *testConfig
+	serverConfig.CipherSuites = []uint16{TLS_RSA_WITH_3DES_EDE_CBC_SHA, TLS_RSA_WITH_AES_128_CBC_SHA, TLS_RSA_WITH_RC4_128_SHA}
+
+	for _, preferServer := range []bool{false, true} {
+		serverConfig.PreferServerCipherSuites = preferServer
+		want := TLS_RSA_WITH_RC4_128_SHA
+		if preferServer {
+			want = TLS_RSA_WITH_AES_128_CBC_SHA
+		}
+		state, err := testHandshake(clientConfig, serverConfig)
+		if err != nil {
+			t.Errorf("PreferServerCipherSuites = %v: %s", preferServer, err)
+			continue
+		}
+		if state.CipherSuite != want {
+			t.Errorf("PreferServerCipherSuites = %v: got suite %04x; want %04x", preferServer, state.CipherSuite, want)
+		}
+	}
+}
+
+func TestDefaultCipherSuiteOrder(t *testing.T) {
+	seen := make(map[uint16]bool)
+	for _, id := range defaultCipherSuiteOrder {
+		if _, ok := cipherSuites[id]; !ok || seen[id] {
+			t.Errorf("suite %04x is unknown or listed twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(cipherSuites) {
+		t.Errorf("%d suites in defaultCipherSuiteOrder; want %d", len(seen), len(cipherSuites))
+	}
+}
+
+// testECDSAConfig returns a copy of testConfig whose certificate has an
+// ECDSA key.
+func testECDSAConfig() *Config {
+	config := new(Config)
+	*config = *testConfig
+	config.Certificates = []Certificate{{
+		Certificate: [][]byte{testECDSACertificate},
+		PrivateKey:  testECDSAPrivateKey,
+	}}
+	return config
+}
+
+var ecdsaTestSuites = []uint16{
+	TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+}
+
+func TestHandshakeECDSA(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS10, VersionTLS11, VersionTLS12} {
+		for _, suite := range ecdsaTestSuites {
+			clientConfig := new(Config)
+			*clientConfig = *testConfig
+			clientConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, suite}
+			clientConfig.MaxVersion = vers
+			// The server only selects a suite that suits the key
+			// of its certificate.
+			serverConfig := testECDSAConfig()
+			serverConfig.CipherSuites = clientConfig.CipherSuites
+			serverConfig.MaxVersion = vers
+
+			state, err := testHandshake(clientConfig, serverConfig)
+			if err != nil {
+				t.Errorf("version %04x, suite %04x: %s", vers, suite, err)
+				continue
+			}
+			if state.Version != vers || state.CipherSuite != suite {
+				t.Errorf("got version %04x, suite %04x; want %04x, %04x", state.Version, state.CipherSuite, vers, suite)
+			}
+		}
+	}
+
+	// There is no suite for an ECDSA certificate without ECDHE.
+	clientConfig := new(Config)
+	*clientConfig = *testConfig
+	clientConfig.CipherSuites = []uint16{TLS_RSA_WITH_RC4_128_SHA, TLS_ECDHE_ECDSA_WITH_RC4_128_SHA}
+	serverConfig := testECDSAConfig()
+	serverConfig.CipherSuites = []uint16{TLS_RSA_WITH_RC4_128_SHA}
+	if _, err := testHandshake(clientConfig, serverConfig); err == nil {
+		t.Errorf("handshake with an ECDSA certificate and an RSA suite succeeded")
+	}
+}
+
+func TestHandshakeClientAuth(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS10, VersionTLS12} {
+		for _, ecdsaCert := range []bool{false, true} {
+			clientConfig := new(Config)
+			*clientConfig = *testConfig
+			wantAlg := x509.RSA
+			if ecdsaCert {
+				clientConfig = testECDSAConfig()
+				wantAlg = x509.ECDSA
+			}
+			clientConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}
+			clientConfig.MaxVersion = vers
+			serverConfig := new(Config)
+			*serverConfig = *testConfig
+			serverConfig.CipherSuites = clientConfig.CipherSuites
+			serverConfig.MaxVersion = vers
+			serverConfig.AuthenticateClient = true
+
+			state, err := testHandshake(clientConfig, serverConfig)
+			if err != nil {
+				t.Errorf("version %04x, ECDSA %v: %s", vers, ecdsaCert, err)
+				continue
+			}
+			if len(state.PeerCertificates) != 1 {
+				t.Errorf("version %04x, ECDSA %v: got %d client certificates; want 1", vers, ecdsaCert, len(state.PeerCertificates))
+				continue
+			}
+			if alg := state.PeerCertificates[0].PublicKeyAlgorithm; alg != wantAlg {
+				t.Errorf("version %04x: got client key algorithm %d; want %d", vers, alg, wantAlg)
+			}
+		}
+	}
+}
+
+func TestResumption(t *testing.T) {
+	for _, vers := range []uint16{VersionTLS10, VersionTLS12} {
+		serverConfig := new(Config)
+		*serverConfig = *testConfig
+		serverConfig.CipherSuites = []uint16{TLS_RSA_WITH_RC4_128_SHA, TLS_RSA_WITH_AES_128_CBC_SHA}
+		serverConfig.MaxVersion = vers
+		clientConfig := new(Config)
+		*clientConfig = *serverConfig
+		clientConfig.ClientSessionCache = NewLRUClientSessionCache(32)
+
+		testResume := func(name string, want bool) {
+			state, err := testHandshake(clientConfig, serverConfig)
+			if err != nil {
+				t.Fatalf("version %04x, %s: %s", vers, name, err)
+			}
+			if state.DidResume != want {
+				t.Errorf("version %04x, %s: DidResume = %v; want %v", vers, name, state.DidResume, want)
+			}
+		}
+
+		testResume("first connection", false)
+		testResume("second connection", true)
+
+		// A client that no longer offers the cipher suite of the session
+		// does a full handshake.
+		clientConfig.CipherSuites = []uint16{TLS_RSA_WITH_AES_128_CBC_SHA}
+		testResume("different cipher suite", false)
+		testResume("after different cipher suite", true)
+
+		// Tickets encrypted with a key that has been rotated out are
+		// refused, while those encrypted with an older key still in
+		// the list are accepted.
+		serverConfig.SetSessionTicketKeys([][32]byte{{1}})
+		testResume("after key change", false)
+		serverConfig.SetSessionTicketKeys([][32]byte{{2}, {1}})
+		testResume("after key rotation", true)
+		testResume("with rotated key", true)
+
+		serverConfig.SessionTicketsDisabled = true
+		testResume("tickets disabled on server", false)
+		serverConfig.SessionTicketsDisabled = false
+		clientConfig.SessionTicketsDisabled = true
+		testResume("tickets disabled on client", false)
+	}
+}
+
+func TestResumptionClientAuth(t *testing.T) {
+	clientConfig := new(Config)
+	*clientConfig = *testConfig
+	clientConfig.MaxVersion = VersionTLS12
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(0)
+	serverConfig := new(Config)
+	*serverConfig = *clientConfig
+	serverConfig.AuthenticateClient = true
+
+	for i, want := range []bool{false, true} {
+		state, err := testHandshake(clientConfig, serverConfig)
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if state.DidResume != want {
+			t.Errorf("#%d: DidResume = %v; want %v", i, state.DidResume, want)
+		}
+		if len(state.PeerCertificates) != 1 {
+			t.Errorf("#%d: got %d client certificates; want 1", i, len(state.PeerCertificates))
+		}
+	}
+}
+
+func TestLRUClientSessionCache(t *testing.T) {
+	keys := []string{"0", "1", "2", "3", "4"}
+	cs := make([]ClientSessionState, len(keys))
+	cache := NewLRUClientSessionCache(4)
+
+	for i, k := range keys {
+		cache.Put(k, &cs[i])
+	}
+	// The oldest entry was evicted to make room for the last.
+	if _, ok := cache.Get(keys[0]); ok {
+		t.Errorf("session %s not evicted", keys[0])
+	}
+	for i, k := range keys[1:] {
+		if s, ok := cache.Get(k); !ok || s != &cs[i+1] {
+			t.Errorf("session %s not found", k)
+		}
+	}
+
+	// Getting "1" made it the most recently used, so "2" goes next.
+	cache.Get(keys[1])
+	cache.Put(keys[0], &cs[0])
+	if _, ok := cache.Get(keys[2]); ok {
+		t.Errorf("session %s not evicted", keys[2])
+	}
+	if s, ok := cache.Get(keys[1]); !ok || s != &cs[1] {
+		t.Errorf("session %s not found", keys[1])
+	}
+
+	// Putting an existing key replaces its session.
+	cache.Put(keys[1], &cs[4])
+	if s, ok := cache.Get(keys[1]); !ok || s != &cs[4] {
+		t.Errorf("session %s not updated", keys[1])
+	}
+}
+
+// newTestCertificate returns a self-signed Certificate for testPrivateKey
+// with the given names.
+func newTestCertificate(t *testing.T, commonName string, dnsNames ...string) Certificate {
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.SecondsToUTC(0),
+		NotAfter:     time.SecondsToUTC(1e10),
+		DNSNames:     dnsNames,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &testPrivateKey.PublicKey, testPrivateKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	return Certificate{Certificate: [][]byte{der}, PrivateKey: testPrivateKey}
+}
+
+func nameTestCertificates(t *testing.T) []Certificate {
+	return []Certificate{
+		newTestCertificate(t, "default.example.com"),
+		newTestCertificate(t, "www.example.com", "www.example.com", "example.com"),
+		newTestCertificate(t, "*.example.org"),
+	}
+}
+
+var getCertificateTests = []struct {
+	serverName string
+	cert       int // index into nameTestCertificates
+}{
+	{"", 0},
+	{"default.example.com", 0},
+	{"www.example.com", 1},
+	{"example.com", 1},
+	{"WWW.Example.COM", 1},
+	{"www.example.com.", 1},
+	{"foo.example.org", 2},
+	{"example.org", 0},
+	{"a.foo.example.org", 0},
+	{"unknown.example.net", 0},
+}
+
+func TestGetCertificate(t *testing.T) {
+	config := &Config{Certificates: nameTestCertificates(t)}
+	config.BuildNameToCertificate()
+
+	for _, tt := range getCertificateTests {
+		cert, err := config.getCertificate(tt.serverName)
+		if err != nil {
+			t.Errorf("%q: %s", tt.serverName, err)
+			continue
+		}
+		if cert != &config.Certificates[tt.cert] {
+			t.Errorf("%q: got wrong certificate; want #%d", tt.serverName, tt.cert)
+		}
+	}
+
+	dynamic := newTestCertificate(t, "dynamic.example.net")
+	callbackErr := os.NewError("callback error")
+	config.GetCertificate = func(serverName string) (*Certificate, os.Error) {
+		switch serverName {
+		case "dynamic.example.net":
+			return &dynamic, nil
+		case "error.example.net":
+			return nil, callbackErr
+		}
+		return nil, nil
+	}
+	if cert, _ := config.getCertificate("dynamic.example.net"); cert != &dynamic {
+		t.Errorf("GetCertificate's certificate not used")
+	}
+	if _, err := config.getCertificate("error.example.net"); err != callbackErr {
+		t.Errorf("got error %v; want GetCertificate's error", err)
+	}
+	if cert, _ := config.getCertificate("www.example.com"); cert != &config.Certificates[1] {
+		t.Errorf("Certificates not used when GetCertificate returns none")
+	}
+
+	config = &Config{GetCertificate: config.GetCertificate}
+	if _, err := config.getCertificate("unknown.example.net"); err == nil {
+		t.Errorf("no error without any certificate")
+	}
+}
+
+func TestHandshakeServerName(t *testing.T) {
+	serverConfig := &Config{
+		Rand:         zeroSource{},
+		Certificates: nameTestCertificates(t),
+	}
+
+	for _, tt := range getCertificateTests {
+		clientConfig := new(Config)
+		*clientConfig = *testConfig
+		clientConfig.ServerName = tt.serverName
+
+		c, s := net.Pipe()
+		go func() {
+			Server(s, serverConfig).Handshake()
+			s.Close()
+		}()
+		cli := Client(c, clientConfig)
+		err := cli.Handshake()
+		c.Close()
+		if err != nil {
+			t.Errorf("%q: %s", tt.serverName, err)
+			continue
+		}
+		certs := cli.ConnectionState().PeerCertificates
+		if len(certs) != 1 || !bytes.Equal(certs[0].Raw, serverConfig.Certificates[tt.cert].Certificate[0]) {
+			t.Errorf("%q: server presented the wrong certificate; want #%d", tt.serverName, tt.cert)
+		}
+	}
+}
+
 var serve = flag.Bool("serve", false, "run a TLS server on :10443")
 
 func TestRunServer(t *testing.T) {
@@ -194,6 +677,17 @@ var testPrivateKey = &rsa.PrivateKey{
 	},
 }
 
+var testECDSACertificate = fromHex("308201983082013ea003020102020101300a06082a8648ce3d040302302d3110300e060355040a130741636d6520436f3119301706035504031310746573742e6578616d706c652e636f6d301e170d3236313031363132303132355a170d3436313031313132303132355a302d3110300e060355040a130741636d6520436f3119301706035504031310746573742e6578616d706c652e636f6d3059301306072a8648ce3d020106082a8648ce3d03010703420004b03495b0c4fb6147b18e7f1ed142ff6a60243c03ac97280e6482f060b1240b055938c92adce54c77434f2380114118c5be3329bc35aa2ae3c9ae8d1e1a6c94b4a34f304d300f0603551d130101ff040530030101ff301b0603551d11041430128210746573742e6578616d706c652e636f6d301d0603551d0e041604140303d5239cf8f1def09264eaf77b26c1c1a53451300a06082a8648ce3d04030203480030450220375187ee268cb42bdc59a2d1bc24152e5ab2c0827f5405fca3ea9fcef2f503d0022100b3196a805e376d89caa0ad46e69c59f312621e0fea405c046d30d9f008a33cd9")
+
+var testECDSAPrivateKey = &ecdsa.PrivateKey{
+	PublicKey: ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     bigFromString("79699970523924266452387621741016259751909898311607392630978020788298697673477"),
+		Y:     bigFromString("40356175366134795190236766191409143195296256254495508748729594767227365397684"),
+	},
+	D: bigFromString("94345364993332387504800072071125038635740555180070212917457484252517538531405"),
+}
+
 // Script of interaction with gnutls implementation.
 // The values for this test are obtained by building and running in server mode:
 //   % gotest -test.run "TestRunServer" -serve
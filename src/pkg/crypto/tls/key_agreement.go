@@ -5,8 +5,10 @@
 package tls
 
 import (
+	"asn1"
 	"big"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rsa"
@@ -20,11 +22,11 @@ import (
 // encrypts the pre-master secret to the server's public key.
 type rsaKeyAgreement struct{}
 
-func (ka rsaKeyAgreement) generateServerKeyExchange(config *Config, clientHello *clientHelloMsg, hello *serverHelloMsg) (*serverKeyExchangeMsg, os.Error) {
+func (ka rsaKeyAgreement) generateServerKeyExchange(config *Config, cert *Certificate, clientHello *clientHelloMsg, hello *serverHelloMsg) (*serverKeyExchangeMsg, os.Error) {
 	return nil, nil
 }
 
-func (ka rsaKeyAgreement) processClientKeyExchange(config *Config, ckx *clientKeyExchangeMsg) ([]byte, os.Error) {
+func (ka rsaKeyAgreement) processClientKeyExchange(config *Config, cert *Certificate, ckx *clientKeyExchangeMsg) ([]byte, os.Error) {
 	preMasterSecret := make([]byte, 48)
 	_, err := io.ReadFull(config.rand(), preMasterSecret[2:])
 	if err != nil {
@@ -40,7 +42,11 @@ func (ka rsaKeyAgreement) processClientKeyExchange(config *Config, ckx *clientKe
 	}
 	ciphertext := ckx.ciphertext[2:]
 
-	err = rsa.DecryptPKCS1v15SessionKey(config.rand(), config.Certificates[0].PrivateKey, ciphertext, preMasterSecret)
+	priv, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, os.ErrorString("RSA key agreement requires an RSA server private key")
+	}
+	err = rsa.DecryptPKCS1v15SessionKey(config.rand(), priv, ciphertext, preMasterSecret)
 	if err != nil {
 		return nil, err
 	}
@@ -66,7 +72,11 @@ func (ka rsaKeyAgreement) generateClientKeyExchange(config *Config, clientHello
 		return nil, nil, err
 	}
 
-	encrypted, err := rsa.EncryptPKCS1v15(config.rand(), cert.PublicKey.(*rsa.PublicKey), preMasterSecret)
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, os.ErrorString("RSA key agreement requires an RSA server certificate")
+	}
+	encrypted, err := rsa.EncryptPKCS1v15(config.rand(), pub, preMasterSecret)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -78,7 +88,6 @@ func (ka rsaKeyAgreement) generateClientKeyExchange(config *Config, clientHello
 	return preMasterSecret, ckx, nil
 }
 
-
 // md5SHA1Hash implements TLS 1.0's hybrid hash function which consists of the
 // concatenation of an MD5 and SHA1 hash.
 func md5SHA1Hash(slices ...[]byte) []byte {
@@ -97,16 +106,58 @@ func md5SHA1Hash(slices ...[]byte) []byte {
 	return md5sha1
 }
 
-// ecdheRSAKeyAgreement implements a TLS key agreement where the server
-// generates a ephemeral EC public/private key pair and signs it. The
-// pre-master secret is then calculated using ECDH.
-type ecdheRSAKeyAgreement struct {
+// sha1Hash calculates a SHA1 hash over the given byte slices.
+func sha1Hash(slices ...[]byte) []byte {
+	hsha1 := sha1.New()
+	for _, slice := range slices {
+		hsha1.Write(slice)
+	}
+	return hsha1.Sum()
+}
+
+// hashForServerKeyExchange hashes the given slices and returns their digest
+// and the hash function that made it, for signing or verifying the
+// parameters of a ServerKeyExchange message with a signature of type
+// sigType. Before TLS 1.2 the hash is the MD5/SHA1 concatenation for RSA and
+// SHA1 for ECDSA; in TLS 1.2 it is given by hashAlg, a TLS 1.2 hash
+// algorithm number.
+func hashForServerKeyExchange(sigType uint8, version uint16, hashAlg uint8, slices ...[]byte) ([]byte, crypto.Hash, os.Error) {
+	if version < VersionTLS12 {
+		if sigType == signatureECDSA {
+			return sha1Hash(slices...), crypto.SHA1, nil
+		}
+		return md5SHA1Hash(slices...), crypto.MD5SHA1, nil
+	}
+	hashFunc, ok := tls12Hash(hashAlg)
+	if !ok {
+		return nil, 0, os.ErrorString("unsupported hash function in ServerKeyExchange")
+	}
+	h := hashFunc.New()
+	for _, slice := range slices {
+		h.Write(slice)
+	}
+	return h.Sum(), hashFunc, nil
+}
+
+// ecdsaSignature reflects the ASN.1 structure of an ECDSA signature, which
+// is how TLS encodes them (RFC 4492, section 5.4).
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// ecdheKeyAgreement implements a TLS key agreement where the server
+// generates a ephemeral EC public/private key pair and signs it with the
+// RSA or ECDSA key of its certificate, as given by sigType. The pre-master
+// secret is then calculated using ECDH.
+type ecdheKeyAgreement struct {
+	version    uint16
+	sigType    uint8
 	privateKey []byte
 	curve      *elliptic.Curve
 	x, y       *big.Int
 }
 
-func (ka *ecdheRSAKeyAgreement) generateServerKeyExchange(config *Config, clientHello *clientHelloMsg, hello *serverHelloMsg) (*serverKeyExchangeMsg, os.Error) {
+func (ka *ecdheKeyAgreement) generateServerKeyExchange(config *Config, cert *Certificate, clientHello *clientHelloMsg, hello *serverHelloMsg) (*serverKeyExchangeMsg, os.Error) {
 	var curveid uint16
 
 Curve:
@@ -143,16 +194,58 @@ Curve:
 	serverECDHParams[3] = byte(len(ecdhePublic))
 	copy(serverECDHParams[4:], ecdhePublic)
 
-	md5sha1 := md5SHA1Hash(clientHello.random, hello.random, serverECDHParams)
-	sig, err := rsa.SignPKCS1v15(config.rand(), config.Certificates[0].PrivateKey, crypto.MD5SHA1, md5sha1)
+	var tls12HashId uint8
+	if ka.version >= VersionTLS12 {
+		if tls12HashId, err = pickTLS12Hash(ka.sigType, clientHello.signatureAndHashes); err != nil {
+			return nil, err
+		}
+	}
+
+	digest, hashFunc, err := hashForServerKeyExchange(ka.sigType, ka.version, tls12HashId, clientHello.random, hello.random, serverECDHParams)
 	if err != nil {
-		return nil, os.ErrorString("failed to sign ECDHE parameters: " + err.String())
+		return nil, err
+	}
+	var sig []byte
+	switch ka.sigType {
+	case signatureECDSA:
+		privKey, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, os.ErrorString("ECDHE ECDSA requires an ECDSA server private key")
+		}
+		r, s, err := ecdsa.Sign(config.rand(), privKey, digest)
+		if err == nil {
+			sig, err = asn1.Marshal(ecdsaSignature{r, s})
+		}
+		if err != nil {
+			return nil, os.ErrorString("failed to sign ECDHE parameters: " + err.String())
+		}
+	case signatureRSA:
+		privKey, ok := cert.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, os.ErrorString("ECDHE RSA requires an RSA server private key")
+		}
+		sig, err = rsa.SignPKCS1v15(config.rand(), privKey, hashFunc, digest)
+		if err != nil {
+			return nil, os.ErrorString("failed to sign ECDHE parameters: " + err.String())
+		}
+	default:
+		return nil, os.ErrorString("unknown ECDHE signature algorithm")
 	}
 
 	skx := new(serverKeyExchangeMsg)
-	skx.key = make([]byte, len(serverECDHParams)+2+len(sig))
+	sigAndHashLen := 0
+	if ka.version >= VersionTLS12 {
+		sigAndHashLen = 2
+	}
+	skx.key = make([]byte, len(serverECDHParams)+sigAndHashLen+2+len(sig))
 	copy(skx.key, serverECDHParams)
 	k := skx.key[len(serverECDHParams):]
+	if ka.version >= VersionTLS12 {
+		// http://tools.ietf.org/html/rfc5246#section-7.4.3
+		k[0] = tls12HashId
+		k[1] = ka.sigType
+		k = k[2:]
+	}
 	k[0] = byte(len(sig) >> 8)
 	k[1] = byte(len(sig))
 	copy(k[2:], sig)
@@ -160,7 +253,7 @@ Curve:
 	return skx, nil
 }
 
-func (ka *ecdheRSAKeyAgreement) processClientKeyExchange(config *Config, ckx *clientKeyExchangeMsg) ([]byte, os.Error) {
+func (ka *ecdheKeyAgreement) processClientKeyExchange(config *Config, cert *Certificate, ckx *clientKeyExchangeMsg) ([]byte, os.Error) {
 	if len(ckx.ciphertext) == 0 || int(ckx.ciphertext[0]) != len(ckx.ciphertext)-1 {
 		return nil, os.ErrorString("bad ClientKeyExchange")
 	}
@@ -176,7 +269,7 @@ func (ka *ecdheRSAKeyAgreement) processClientKeyExchange(config *Config, ckx *cl
 	return preMasterSecret, nil
 }
 
-func (ka *ecdheRSAKeyAgreement) processServerKeyExchange(config *Config, clientHello *clientHelloMsg, serverHello *serverHelloMsg, cert *x509.Certificate, skx *serverKeyExchangeMsg) os.Error {
+func (ka *ecdheKeyAgreement) processServerKeyExchange(config *Config, clientHello *clientHelloMsg, serverHello *serverHelloMsg, cert *x509.Certificate, skx *serverKeyExchangeMsg) os.Error {
 	if len(skx.key) < 4 {
 		goto Error
 	}
@@ -207,6 +300,17 @@ func (ka *ecdheRSAKeyAgreement) processServerKeyExchange(config *Config, clientH
 	serverECDHParams := skx.key[:4+publicLen]
 
 	sig := skx.key[4+publicLen:]
+	var tls12HashId uint8
+	if ka.version >= VersionTLS12 {
+		if len(sig) < 2 {
+			goto Error
+		}
+		if sig[1] != ka.sigType {
+			return os.ErrorString("unsupported signature algorithm in ServerKeyExchange")
+		}
+		tls12HashId = sig[0]
+		sig = sig[2:]
+	}
 	if len(sig) < 2 {
 		goto Error
 	}
@@ -216,14 +320,44 @@ func (ka *ecdheRSAKeyAgreement) processServerKeyExchange(config *Config, clientH
 	}
 	sig = sig[2:]
 
-	md5sha1 := md5SHA1Hash(clientHello.random, serverHello.random, serverECDHParams)
-	return rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.MD5SHA1, md5sha1, sig)
+	digest, hashFunc, err := hashForServerKeyExchange(ka.sigType, ka.version, tls12HashId, clientHello.random, serverHello.random, serverECDHParams)
+	if err != nil {
+		return err
+	}
+	switch ka.sigType {
+	case signatureECDSA:
+		pubKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return os.ErrorString("ECDHE ECDSA requires an ECDSA server public key")
+		}
+		ecdsaSig := new(ecdsaSignature)
+		if _, err := asn1.Unmarshal(sig, ecdsaSig); err != nil {
+			return err
+		}
+		if ecdsaSig.R.Sign() <= 0 || ecdsaSig.S.Sign() <= 0 {
+			return os.ErrorString("ECDSA signature contained zero or negative values")
+		}
+		if !ecdsa.Verify(pubKey, digest, ecdsaSig.R, ecdsaSig.S) {
+			return os.ErrorString("ECDSA verification failure")
+		}
+	case signatureRSA:
+		pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return os.ErrorString("ECDHE RSA requires an RSA server public key")
+		}
+		if err := rsa.VerifyPKCS1v15(pubKey, hashFunc, digest, sig); err != nil {
+			return err
+		}
+	default:
+		return os.ErrorString("unknown ECDHE signature algorithm")
+	}
+	return nil
 
 Error:
 	return os.ErrorString("invalid ServerKeyExchange")
 }
 
-func (ka *ecdheRSAKeyAgreement) generateClientKeyExchange(config *Config, clientHello *clientHelloMsg, cert *x509.Certificate) ([]byte, *clientKeyExchangeMsg, os.Error) {
+func (ka *ecdheKeyAgreement) generateClientKeyExchange(config *Config, clientHello *clientHelloMsg, cert *x509.Certificate) ([]byte, *clientKeyExchangeMsg, os.Error) {
 	if ka.curve == nil {
 		return nil, nil, os.ErrorString("missing ServerKeyExchange message")
 	}
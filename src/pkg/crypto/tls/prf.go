@@ -5,9 +5,11 @@
 package tls
 
 import (
+	"crypto"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"hash"
 	"os"
 )
@@ -63,6 +65,24 @@ func pRF10(result, secret, label, seed []byte) {
 	}
 }
 
+// pRF12 implements the TLS 1.2 pseudo-random function, as defined in RFC 5246, section 5.
+func pRF12(result, secret, label, seed []byte) {
+	labelAndSeed := make([]byte, len(label)+len(seed))
+	copy(labelAndSeed, label)
+	copy(labelAndSeed[len(label):], seed)
+
+	pHash(result, secret, labelAndSeed, sha256.New)
+}
+
+// prfForVersion returns the pseudo-random function used by the given
+// version of the protocol.
+func prfForVersion(version uint16) func(result, secret, label, seed []byte) {
+	if version >= VersionTLS12 {
+		return pRF12
+	}
+	return pRF10
+}
+
 const (
 	tlsRandomLength      = 32 // Length of a random nonce in TLS 1.1.
 	masterSecretLength   = 48 // Length of a master secret in TLS 1.1.
@@ -74,22 +94,29 @@ var keyExpansionLabel = []byte("key expansion")
 var clientFinishedLabel = []byte("client finished")
 var serverFinishedLabel = []byte("server finished")
 
-// keysFromPreMasterSecret generates the connection keys from the pre master
-// secret, given the lengths of the MAC key, cipher key and IV, as defined in
-// RFC 2246, section 6.3.
-func keysFromPreMasterSecret10(preMasterSecret, clientRandom, serverRandom []byte, macLen, keyLen, ivLen int) (masterSecret, clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV []byte) {
+// masterFromPreMasterSecret generates the master secret from the pre-master
+// secret, as defined in RFC 2246, section 8.1 and RFC 5246, section 8.1.
+func masterFromPreMasterSecret(version uint16, preMasterSecret, clientRandom, serverRandom []byte) []byte {
 	var seed [tlsRandomLength * 2]byte
 	copy(seed[0:len(clientRandom)], clientRandom)
 	copy(seed[len(clientRandom):], serverRandom)
-	masterSecret = make([]byte, masterSecretLength)
-	pRF10(masterSecret, preMasterSecret, masterSecretLabel, seed[0:])
+	masterSecret := make([]byte, masterSecretLength)
+	prfForVersion(version)(masterSecret, preMasterSecret, masterSecretLabel, seed[0:])
+	return masterSecret
+}
 
+// keysFromMasterSecret generates the connection keys from the master
+// secret, given the protocol version and the lengths of the MAC key, cipher
+// key and IV, as defined in RFC 2246, section 6.3 and RFC 5246, section 6.3.
+// A resumed session reuses the master secret of the session it resumes.
+func keysFromMasterSecret(version uint16, masterSecret, clientRandom, serverRandom []byte, macLen, keyLen, ivLen int) (clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV []byte) {
+	var seed [tlsRandomLength * 2]byte
 	copy(seed[0:len(clientRandom)], serverRandom)
 	copy(seed[len(serverRandom):], clientRandom)
 
 	n := 2*macLen + 2*keyLen + 2*ivLen
 	keyMaterial := make([]byte, n)
-	pRF10(keyMaterial, masterSecret, keyExpansionLabel, seed[0:])
+	prfForVersion(version)(keyMaterial, masterSecret, keyExpansionLabel, seed[0:])
 	clientMAC = keyMaterial[:macLen]
 	keyMaterial = keyMaterial[macLen:]
 	serverMAC = keyMaterial[:macLen]
@@ -105,49 +132,67 @@ func keysFromPreMasterSecret10(preMasterSecret, clientRandom, serverRandom []byt
 }
 
 // A finishedHash calculates the hash of a set of handshake messages suitable
-// for including in a Finished message.
+// for including in a Finished message. Since the client writes its first
+// message before the version is known, the MD5, SHA1 and SHA256 hashes are
+// all kept until the handshake is over; version selects which are used.
 type finishedHash struct {
-	clientMD5  hash.Hash
-	clientSHA1 hash.Hash
-	serverMD5  hash.Hash
-	serverSHA1 hash.Hash
+	version uint16
+	md5     hash.Hash
+	sha1    hash.Hash
+	sha256  hash.Hash
 }
 
 func newFinishedHash() finishedHash {
-	return finishedHash{md5.New(), sha1.New(), md5.New(), sha1.New()}
+	return finishedHash{0, md5.New(), sha1.New(), sha256.New()}
 }
 
 func (h finishedHash) Write(msg []byte) (n int, err os.Error) {
-	h.clientMD5.Write(msg)
-	h.clientSHA1.Write(msg)
-	h.serverMD5.Write(msg)
-	h.serverSHA1.Write(msg)
+	h.md5.Write(msg)
+	h.sha1.Write(msg)
+	h.sha256.Write(msg)
 	return len(msg), nil
 }
 
 // finishedSum calculates the contents of the verify_data member of a Finished
-// message given the MD5 and SHA1 hashes of a set of handshake messages.
-func finishedSum(md5, sha1, label, masterSecret []byte) []byte {
-	seed := make([]byte, len(md5)+len(sha1))
-	copy(seed, md5)
-	copy(seed[len(md5):], sha1)
+// message given the label and the hash of the handshake messages so far.
+func (h finishedHash) finishedSum(label, masterSecret []byte) []byte {
+	var seed []byte
+	if h.version >= VersionTLS12 {
+		seed = h.sha256.Sum()
+	} else {
+		seed = append(h.md5.Sum(), h.sha1.Sum()...)
+	}
 	out := make([]byte, finishedVerifyLength)
-	pRF10(out, masterSecret, label, seed)
+	prfForVersion(h.version)(out, masterSecret, label, seed)
 	return out
 }
 
 // clientSum returns the contents of the verify_data member of a client's
 // Finished message.
 func (h finishedHash) clientSum(masterSecret []byte) []byte {
-	md5 := h.clientMD5.Sum()
-	sha1 := h.clientSHA1.Sum()
-	return finishedSum(md5, sha1, clientFinishedLabel, masterSecret)
+	return h.finishedSum(clientFinishedLabel, masterSecret)
 }
 
 // serverSum returns the contents of the verify_data member of a server's
 // Finished message.
 func (h finishedHash) serverSum(masterSecret []byte) []byte {
-	md5 := h.serverMD5.Sum()
-	sha1 := h.serverSHA1.Sum()
-	return finishedSum(md5, sha1, serverFinishedLabel, masterSecret)
+	return h.finishedSum(serverFinishedLabel, masterSecret)
+}
+
+// certificateVerifySum returns the digest of the handshake messages so far
+// that is signed in a CertificateVerify message of type sigType, and the hash
+// function that made it. Before TLS 1.2 that is the MD5/SHA1 concatenation,
+// or SHA1 alone for ECDSA (RFC 4492, section 5.10); in TLS 1.2 it is the hash
+// function given by hashAlg.
+func (h finishedHash) certificateVerifySum(sigType, hashAlg uint8) ([]byte, crypto.Hash) {
+	if h.version < VersionTLS12 {
+		if sigType == signatureECDSA {
+			return h.sha1.Sum(), crypto.SHA1
+		}
+		return append(h.md5.Sum(), h.sha1.Sum()...), crypto.MD5SHA1
+	}
+	if hashAlg == hashSHA256 {
+		return h.sha256.Sum(), crypto.SHA256
+	}
+	return h.sha1.Sum(), crypto.SHA1
 }
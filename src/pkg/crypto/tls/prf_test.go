@@ -33,7 +33,21 @@ func TestSplitPreMasterSecret(t *testing.T) {
 	}
 }
 
+func TestPRF12(t *testing.T) {
+	// A test vector for the TLS 1.2 PRF with SHA-256 from the IETF TLS list.
+	secret, _ := hex.DecodeString("9bbe436ba940f017b17652849a71db35")
+	seed, _ := hex.DecodeString("a0ba9f936cda311827a6f796ffd5198c")
+	want := "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff70187347b66"
+
+	out := make([]byte, len(want)/2)
+	pRF12(out, secret, []byte("test label"), seed)
+	if s := hex.EncodeToString(out); s != want {
+		t.Errorf("got: %s want: %s", s, want)
+	}
+}
+
 type testKeysFromTest struct {
+	version                    uint16
 	preMasterSecret            string
 	clientRandom, serverRandom string
 	masterSecret               string
@@ -47,7 +61,8 @@ func TestKeysFromPreMasterSecret(t *testing.T) {
 		in, _ := hex.DecodeString(test.preMasterSecret)
 		clientRandom, _ := hex.DecodeString(test.clientRandom)
 		serverRandom, _ := hex.DecodeString(test.serverRandom)
-		master, clientMAC, serverMAC, clientKey, serverKey, _, _ := keysFromPreMasterSecret10(in, clientRandom, serverRandom, test.macLen, test.keyLen, 0)
+		master := masterFromPreMasterSecret(test.version, in, clientRandom, serverRandom)
+		clientMAC, serverMAC, clientKey, serverKey, _, _ := keysFromMasterSecret(test.version, master, clientRandom, serverRandom, test.macLen, test.keyLen, 0)
 		masterString := hex.EncodeToString(master)
 		clientMACString := hex.EncodeToString(clientMAC)
 		serverMACString := hex.EncodeToString(serverMAC)
@@ -63,9 +78,11 @@ func TestKeysFromPreMasterSecret(t *testing.T) {
 	}
 }
 
-// These test vectors were generated from GnuTLS using `gnutls-cli --insecure -d 9 `
+// These test vectors were generated from GnuTLS using `gnutls-cli --insecure -d 9 `,
+// except the TLS 1.2 one, which reuses the inputs of the first.
 var testKeysFromTests = []testKeysFromTest{
 	{
+		VersionTLS10,
 		"0302cac83ad4b1db3b9ab49ad05957de2a504a634a386fc600889321e1a971f57479466830ac3e6f468e87f5385fa0c5",
 		"4ae66303755184a3917fcb44880605fcc53baa01912b22ed94473fc69cebd558",
 		"4ae663020ec16e6bb5130be918cfcafd4d765979a3136a5d50c593446e4e44db",
@@ -78,6 +95,7 @@ var testKeysFromTests = []testKeysFromTest{
 		16,
 	},
 	{
+		VersionTLS10,
 		"03023f7527316bc12cbcd69e4b9e8275d62c028f27e65c745cfcddc7ce01bd3570a111378b63848127f1c36e5f9e4890",
 		"4ae66364b5ea56b20ce4e25555aed2d7e67f42788dd03f3fee4adae0459ab106",
 		"4ae66363ab815cbf6a248b87d6b556184e945e9b97fbdf247858b0bdafacfa1c",
@@ -90,6 +108,7 @@ var testKeysFromTests = []testKeysFromTest{
 		16,
 	},
 	{
+		VersionTLS10,
 		"832d515f1d61eebb2be56ba0ef79879efb9b527504abb386fb4310ed5d0e3b1f220d3bb6b455033a2773e6d8bdf951d278a187482b400d45deb88a5d5a6bb7d6a7a1decc04eb9ef0642876cd4a82d374d3b6ff35f0351dc5d411104de431375355addc39bfb1f6329fb163b0bc298d658338930d07d313cd980a7e3d9196cac1",
 		"4ae663b2ee389c0de147c509d8f18f5052afc4aaf9699efe8cb05ece883d3a5e",
 		"4ae664d503fd4cff50cfc1fb8fc606580f87b0fcdac9554ba0e01d785bdf278e",
@@ -101,4 +120,17 @@ var testKeysFromTests = []testKeysFromTest{
 		20,
 		16,
 	},
+	{
+		VersionTLS12,
+		"0302cac83ad4b1db3b9ab49ad05957de2a504a634a386fc600889321e1a971f57479466830ac3e6f468e87f5385fa0c5",
+		"4ae66303755184a3917fcb44880605fcc53baa01912b22ed94473fc69cebd558",
+		"4ae663020ec16e6bb5130be918cfcafd4d765979a3136a5d50c593446e4e44db",
+		"43f9b59968c9b0f9e69b4f642632dc0bd8d0054ac6ac22777b2d135e0404203b63fd37bb345b4bd3082b0d938a9257ec",
+		"4353062048268cea7ad87cdb9657764a00eb48df",
+		"78945850c35013458ceb89d122eaa1b18d51a2cd",
+		"7e62528ed00c1b8da487e9f1f1d91a1c",
+		"3fe8677b6405f95bd72ebf44b9867625",
+		20,
+		16,
+	},
 }
@@ -7,6 +7,7 @@
 package tls
 
 import (
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -19,7 +20,7 @@ import (
 // Server returns a new TLS server side connection
 // using conn as the underlying transport.
 // The configuration config must be non-nil and must have
-// at least one certificate.
+// at least one certificate or else set GetCertificate.
 func Server(conn net.Conn, config *Config) *Conn {
 	return &Conn{conn: conn, config: config}
 }
@@ -59,7 +60,7 @@ func (l *Listener) Addr() net.Addr { return l.listener.Addr() }
 // NewListener creates a Listener which accepts connections from an inner
 // Listener and wraps each connection with Server.
 // The configuration config must be non-nil and must have
-// at least one certificate.
+// at least one certificate or else set GetCertificate.
 func NewListener(listener net.Listener, config *Config) (l *Listener) {
 	l = new(Listener)
 	l.listener = listener
@@ -70,9 +71,9 @@ func NewListener(listener net.Listener, config *Config) (l *Listener) {
 // Listen creates a TLS listener accepting connections on the
 // given network address using net.Listen.
 // The configuration config must be non-nil and must have
-// at least one certificate.
+// at least one certificate or else set GetCertificate.
 func Listen(network, laddr string, config *Config) (*Listener, os.Error) {
-	if config == nil || len(config.Certificates) == 0 {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
 		return nil, os.NewError("tls.Listen: no certificates in configuration")
 	}
 	l, err := net.Listen(network, laddr)
@@ -133,7 +134,8 @@ func LoadX509KeyPair(certFile string, keyFile string) (cert Certificate, err os.
 }
 
 // X509KeyPair parses a public/private key pair from a pair of
-// PEM encoded data.
+// PEM encoded data. The private key may be an RSA key, in an "RSA PRIVATE
+// KEY" block, or an ECDSA key, in an "EC PRIVATE KEY" block.
 func X509KeyPair(certPEMBlock, keyPEMBlock []byte) (cert Certificate, err os.Error) {
 	var certDERBlock *pem.Block
 	for {
@@ -151,20 +153,30 @@ func X509KeyPair(certPEMBlock, keyPEMBlock []byte) (cert Certificate, err os.Err
 		return
 	}
 
-	keyDERBlock, _ := pem.Decode(keyPEMBlock)
-	if keyDERBlock == nil {
-		err = os.ErrorString("crypto/tls: failed to parse key PEM data")
-		return
+	var keyDERBlock *pem.Block
+	for {
+		keyDERBlock, keyPEMBlock = pem.Decode(keyPEMBlock)
+		if keyDERBlock == nil {
+			err = os.ErrorString("crypto/tls: failed to parse key PEM data")
+			return
+		}
+		// OpenSSL writes the curve of an EC key in a block of its
+		// own before the key.
+		if keyDERBlock.Type != "EC PARAMETERS" {
+			break
+		}
 	}
 
-	key, err := x509.ParsePKCS1PrivateKey(keyDERBlock.Bytes)
+	if keyDERBlock.Type == "EC PRIVATE KEY" {
+		cert.PrivateKey, err = x509.ParseECPrivateKey(keyDERBlock.Bytes)
+	} else {
+		cert.PrivateKey, err = x509.ParsePKCS1PrivateKey(keyDERBlock.Bytes)
+	}
 	if err != nil {
 		err = os.ErrorString("crypto/tls: failed to parse key: " + err.String())
 		return
 	}
 
-	cert.PrivateKey = key
-
 	// We don't need to parse the public key for TLS, but we so do anyway
 	// to check that it looks sane and matches the private key.
 	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
@@ -172,7 +184,16 @@ func X509KeyPair(certPEMBlock, keyPEMBlock []byte) (cert Certificate, err os.Err
 		return
 	}
 
-	if x509Cert.PublicKeyAlgorithm != x509.RSA || x509Cert.PublicKey.(*rsa.PublicKey).N.Cmp(key.PublicKey.N) != 0 {
+	matches := false
+	switch pub := x509Cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		priv, ok := cert.PrivateKey.(*rsa.PrivateKey)
+		matches = ok && pub.N.Cmp(priv.N) == 0
+	case *ecdsa.PublicKey:
+		priv, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+		matches = ok && pub.Curve == priv.Curve && pub.X.Cmp(priv.X) == 0 && pub.Y.Cmp(priv.Y) == 0
+	}
+	if !matches {
 		err = os.ErrorString("crypto/tls: private key does not match public key")
 		return
 	}
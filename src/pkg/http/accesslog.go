@@ -0,0 +1,224 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// An AccessRecord describes a request served by a LoggingHandler.
+type AccessRecord struct {
+	Time       int64  // when the request arrived, in nanoseconds since the epoch
+	Latency    int64  // nanoseconds taken to serve the request
+	RemoteAddr string // network address of the client
+	Method     string
+	RawURL     string // request URI, as sent by the client
+	Proto      string // e.g. "HTTP/1.1"
+	Status     int    // status code of the response
+	Bytes      int64  // bytes written in the response body
+	Referer    string
+	UserAgent  string
+}
+
+// A LogFormatter formats an AccessRecord as a line of an access log.
+type LogFormatter func(*AccessRecord) string
+
+// clfTimeFormat is the time format of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// CommonLogFormat formats rec in the Common Log Format of the NCSA
+// httpd, as in
+//
+//	127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.0" 200 2326
+func CommonLogFormat(rec *AccessRecord) string {
+	host, _, err := net.SplitHostPort(rec.RemoteAddr)
+	if err != nil {
+		host = rec.RemoteAddr
+	}
+	if host == "" {
+		host = "-"
+	}
+	size := "-"
+	if rec.Bytes > 0 {
+		size = strconv.Itoa64(rec.Bytes)
+	}
+	t := time.SecondsToLocalTime(rec.Time / 1e9)
+	return host + " - - [" + t.Format(clfTimeFormat) + "] " +
+		strconv.Quote(rec.Method+" "+rec.RawURL+" "+rec.Proto) + " " +
+		strconv.Itoa(rec.Status) + " " + size
+}
+
+// CombinedLogFormat formats rec in the Combined Log Format, which
+// is the Common Log Format followed by the Referer and User-Agent
+// headers of the request.
+func CombinedLogFormat(rec *AccessRecord) string {
+	return CommonLogFormat(rec) + " " + quoteOrDash(rec.Referer) + " " + quoteOrDash(rec.UserAgent)
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// LoggingHandler returns a Handler that runs h and logs each
+// request it serves, once its response is complete, to l as a line
+// formatted by format.  If l is nil, the standard logger of package
+// log is used; if format is nil, CommonLogFormat is used.  Since the
+// formats include the time of the request, l is best created without
+// the log.Ldate and log.Ltime flags.
+//
+// The ResponseWriter passed to h implements Flusher and Hijacker if
+// the underlying ResponseWriter does.  Hijacked requests are logged
+// with the status 101 if h has not set another.  Requests whose
+// handler panics are logged too, with the status 500 if h had not
+// yet written its header.
+func LoggingHandler(h Handler, l *log.Logger, format LogFormatter) Handler {
+	if format == nil {
+		format = CommonLogFormat
+	}
+	return &loggingHandler{h, l, format}
+}
+
+type loggingHandler struct {
+	handler Handler
+	logger  *log.Logger
+	format  LogFormatter
+}
+
+func (h *loggingHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	start := time.Nanoseconds()
+	lw := &loggingWriter{w: w}
+	returned := false
+	defer func() {
+		if lw.status == 0 {
+			if returned {
+				// The server replies 200 OK to
+				// handlers that write nothing.
+				lw.status = StatusOK
+			} else {
+				lw.status = StatusInternalServerError
+			}
+		}
+		h.log(r, start, lw)
+	}()
+	h.handler.ServeHTTP(lw.wrap(), r)
+	returned = true
+}
+
+// log logs the request r, which arrived at start and whose
+// response was written to lw.
+func (h *loggingHandler) log(r *Request, start int64, lw *loggingWriter) {
+	rawURL := r.RawURL
+	if rawURL == "" && r.URL != nil {
+		rawURL = r.URL.RawPath
+	}
+	line := h.format(&AccessRecord{
+		Time:       start,
+		Latency:    time.Nanoseconds() - start,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		RawURL:     rawURL,
+		Proto:      r.Proto,
+		Status:     lw.status,
+		Bytes:      lw.written,
+		Referer:    r.Referer,
+		UserAgent:  r.UserAgent,
+	})
+	if h.logger != nil {
+		h.logger.Print(line)
+	} else {
+		log.Print(line)
+	}
+}
+
+// A loggingWriter records the status and size of a response.
+type loggingWriter struct {
+	w       ResponseWriter
+	status  int
+	written int64
+}
+
+// wrap returns lw as a ResponseWriter that implements Flusher and
+// Hijacker only if the underlying ResponseWriter does.
+func (lw *loggingWriter) wrap() ResponseWriter {
+	_, canFlush := lw.w.(Flusher)
+	_, canHijack := lw.w.(Hijacker)
+	switch {
+	case canFlush && canHijack:
+		return flushHijackLoggingWriter{lw}
+	case canFlush:
+		return flushLoggingWriter{lw}
+	case canHijack:
+		return hijackLoggingWriter{lw}
+	}
+	return lw
+}
+
+func (lw *loggingWriter) Header() Header {
+	return lw.w.Header()
+}
+
+func (lw *loggingWriter) WriteHeader(code int) {
+	if lw.status == 0 {
+		lw.status = code
+	}
+	lw.w.WriteHeader(code)
+}
+
+func (lw *loggingWriter) Write(p []byte) (int, os.Error) {
+	if lw.status == 0 {
+		lw.status = StatusOK
+	}
+	n, err := lw.w.Write(p)
+	lw.written += int64(n)
+	return n, err
+}
+
+func (lw *loggingWriter) flush() {
+	lw.w.(Flusher).Flush()
+}
+
+func (lw *loggingWriter) hijack() (net.Conn, *bufio.ReadWriter, os.Error) {
+	c, buf, err := lw.w.(Hijacker).Hijack()
+	if err == nil && lw.status == 0 {
+		lw.status = StatusSwitchingProtocols
+	}
+	return c, buf, err
+}
+
+type flushLoggingWriter struct {
+	*loggingWriter
+}
+
+func (lw flushLoggingWriter) Flush() {
+	lw.flush()
+}
+
+type hijackLoggingWriter struct {
+	*loggingWriter
+}
+
+func (lw hijackLoggingWriter) Hijack() (net.Conn, *bufio.ReadWriter, os.Error) {
+	return lw.hijack()
+}
+
+type flushHijackLoggingWriter struct {
+	*loggingWriter
+}
+
+func (lw flushHijackLoggingWriter) Flush() {
+	lw.flush()
+}
+
+func (lw flushHijackLoggingWriter) Hijack() (net.Conn, *bufio.ReadWriter, os.Error) {
+	return lw.hijack()
+}
@@ -0,0 +1,182 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http_test
+
+import (
+	"bytes"
+	"fmt"
+	. "http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var logFormatTests = []struct {
+	format LogFormatter
+	rec    AccessRecord
+	want   string // with the time replaced by TIME
+}{
+	{
+		CommonLogFormat,
+		AccessRecord{
+			RemoteAddr: "127.0.0.1:1234",
+			Method:     "GET",
+			RawURL:     "/index.html",
+			Proto:      "HTTP/1.0",
+			Status:     200,
+			Bytes:      2326,
+		},
+		`127.0.0.1 - - [TIME] "GET /index.html HTTP/1.0" 200 2326`,
+	},
+	{
+		CommonLogFormat,
+		AccessRecord{
+			RemoteAddr: "10.0.0.1:80",
+			Method:     "HEAD",
+			RawURL:     "/",
+			Proto:      "HTTP/1.1",
+			Status:     304,
+		},
+		`10.0.0.1 - - [TIME] "HEAD / HTTP/1.1" 304 -`,
+	},
+	{
+		CombinedLogFormat,
+		AccessRecord{
+			RemoteAddr: "127.0.0.1:1234",
+			Method:     "GET",
+			RawURL:     "/a",
+			Proto:      "HTTP/1.1",
+			Status:     404,
+			Bytes:      19,
+			Referer:    "http://example.com/",
+			UserAgent:  `Agent "quoted"`,
+		},
+		`127.0.0.1 - - [TIME] "GET /a HTTP/1.1" 404 19 "http://example.com/" "Agent \"quoted\""`,
+	},
+	{
+		CombinedLogFormat,
+		AccessRecord{
+			RemoteAddr: "127.0.0.1:1234",
+			Method:     "GET",
+			RawURL:     "/",
+			Proto:      "HTTP/1.1",
+			Status:     200,
+			Bytes:      1,
+		},
+		`127.0.0.1 - - [TIME] "GET / HTTP/1.1" 200 1 "-" "-"`,
+	},
+}
+
+var clfTimeRE = regexp.MustCompile(`\[[0-9][0-9]/[A-Z][a-z][a-z]/[0-9]+:[0-9][0-9]:[0-9][0-9]:[0-9][0-9] [\-+][0-9]+\]`)
+
+func TestLogFormats(t *testing.T) {
+	for i, tt := range logFormatTests {
+		tt.rec.Time = 971211336e9
+		got := tt.format(&tt.rec)
+		got = clfTimeRE.ReplaceAllString(got, "[TIME]")
+		if got != tt.want {
+			t.Errorf("%d. got  %s\nwant %s", i, got, tt.want)
+		}
+	}
+}
+
+func TestLoggingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	h := LoggingHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/missing" {
+			NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello")
+	}), logger, CombinedLogFormat)
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	for _, path := range []string{"/hello?x=1", "/missing"} {
+		req, _ := NewRequest("GET", ts.URL+path, nil)
+		req.UserAgent = "test-agent"
+		res, err := DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Get %s: %v", path, err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	re := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^\]]+\] "GET /hello\?x=1 HTTP/1\.1" 200 5 "-" "test-agent"
+127\.0\.0\.1 - - \[[^\]]+\] "GET /missing HTTP/1\.1" 404 19 "-" "test-agent"
+$`)
+	if !re.MatchString(buf.String()) {
+		t.Errorf("log =\n%s", buf.String())
+	}
+}
+
+func TestLoggingHandlerStatusDefault(t *testing.T) {
+	var buf bytes.Buffer
+	h := LoggingHandler(HandlerFunc(func(w ResponseWriter, r *Request) {}), log.New(&buf, "", 0), nil)
+	rec := httptest.NewRecorder()
+	req, _ := NewRequest("GET", "http://example.com/empty", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	h.ServeHTTP(rec, req)
+	re := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^\]]+\] "GET /empty HTTP/1\.1" 200 -\n$`)
+	if !re.MatchString(buf.String()) {
+		t.Errorf("log = %q", buf.String())
+	}
+}
+
+func TestLoggingHandlerInterfaces(t *testing.T) {
+	// httptest.ResponseRecorder can be flushed but not hijacked.
+	h := LoggingHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if _, ok := w.(Flusher); !ok {
+			t.Errorf("ResponseWriter does not implement Flusher")
+		}
+		if _, ok := w.(Hijacker); ok {
+			t.Errorf("ResponseWriter implements Hijacker")
+		}
+	}), log.New(ioutil.Discard, "", 0), nil)
+	req, _ := NewRequest("GET", "http://example.com/", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestLoggingHandlerPanic(t *testing.T) {
+	var buf bytes.Buffer
+	h := LoggingHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		panic("handler failed")
+	}), log.New(&buf, "", 0), nil)
+	req, _ := NewRequest("GET", "http://example.com/panic", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	func() {
+		defer func() {
+			if e := recover(); e != "handler failed" {
+				t.Errorf("recovered %v; want the handler's panic", e)
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	re := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^\]]+\] "GET /panic HTTP/1\.1" 500 -\n$`)
+	if !re.MatchString(buf.String()) {
+		t.Errorf("log = %q", buf.String())
+	}
+}
+
+func TestLoggingHandlerMaxBytesReader(t *testing.T) {
+	// The server still closes the connection after a body that
+	// is too large, though it cannot see its own ResponseWriter.
+	server := &Server{Handler: LoggingHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		r.Body = MaxBytesReader(w, r.Body, 100)
+		ioutil.ReadAll(r.Body)
+	}), log.New(ioutil.Discard, "", 0), nil)}
+	body := strings.Repeat("x", 1000)
+	res := serveOnce(t, server, fmt.Sprintf("POST / HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body))
+	defer res.Body.Close()
+	if !res.Close {
+		t.Errorf("response after body limit hit does not close the connection")
+	}
+}
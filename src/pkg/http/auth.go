@@ -0,0 +1,367 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// HTTP Basic and Digest authentication.  See RFC 2617.
+
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BasicAuth returns the user name and password provided in the
+// request's Authorization header, if the request uses HTTP Basic
+// Authentication.
+func (r *Request) BasicAuth() (username, password string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 6 || strings.ToLower(auth[:6]) != "basic " {
+		return
+	}
+	c, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[6:]))
+	if err != nil {
+		return
+	}
+	cs := string(c)
+	i := strings.Index(cs, ":")
+	if i < 0 {
+		return
+	}
+	return cs[:i], cs[i+1:], true
+}
+
+// BasicAuthHandler returns a Handler that runs h for requests whose
+// HTTP Basic Authentication credentials are accepted by check, and
+// replies to other requests with 401 Unauthorized and a challenge
+// for the given realm.
+//
+// Basic Authentication sends the password in the clear, so it
+// should only be used over TLS.
+func BasicAuthHandler(h Handler, realm string, check func(username, password string) bool) Handler {
+	return &basicAuthHandler{h, realm, check}
+}
+
+type basicAuthHandler struct {
+	handler Handler
+	realm   string
+	check   func(username, password string) bool
+}
+
+func (h *basicAuthHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	if user, password, ok := r.BasicAuth(); ok && h.check(user, password) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(h.realm))
+	Error(w, "401 unauthorized", StatusUnauthorized)
+}
+
+// A DigestSecret returns the secret of user in realm used to check
+// responses to Digest Authentication challenges: the hexadecimal MD5
+// digest of "user:realm:password", as returned by DigestHA1.  Storing
+// this digest instead of the password itself means the password
+// cannot be read from the store.  ok is false if user is unknown.
+type DigestSecret func(user, realm string) (ha1 string, ok bool)
+
+// DigestHA1 returns the secret of user in realm for the password,
+// as returned by a DigestSecret.
+func DigestHA1(user, realm, password string) string {
+	return md5Hex(user + ":" + realm + ":" + password)
+}
+
+// A NonceManager issues and validates the nonces of the challenges
+// sent by a DigestAuthHandler.
+type NonceManager interface {
+	// NewNonce returns a new nonce to send in a challenge.
+	NewNonce() string
+
+	// UseNonce reports whether nonce is one issued by NewNonce and
+	// still valid, and count, the client's count of its requests
+	// with the nonce, has not been seen with it before.  stale is
+	// set if nonce was valid but has expired, in which case the
+	// client is challenged to retry with a new nonce without
+	// asking its user for the password again.
+	UseNonce(nonce string, count uint64) (ok, stale bool)
+}
+
+// DefaultNonceMaxAge is the lifetime of the nonces issued by
+// the NonceManager of a DigestAuthHandler given none.
+const DefaultNonceMaxAge = 5 * 60e9 // 5 minutes
+
+// NewNonceManager returns a NonceManager whose nonces are valid for
+// maxAge nanoseconds.  A nonce carries the time it was issued and is
+// signed with a key chosen at random, so only the nonces in use, and
+// the counts seen with them, are kept in memory.
+func NewNonceManager(maxAge int64) NonceManager {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic("http: reading random bytes: " + err.String())
+	}
+	return &memNonceManager{maxAge: maxAge, key: key, used: make(map[string]*nonceState)}
+}
+
+type memNonceManager struct {
+	maxAge int64
+	key    []byte // signs the nonces
+
+	mu    sync.Mutex
+	used  map[string]*nonceState
+	order []string // keys of used, in the order of their first use
+}
+
+type nonceState struct {
+	expires int64
+	counts  map[uint64]bool // counts used
+}
+
+// nonceDataLen is the length of the signed part of a nonce: the
+// time it was issued and 8 random bytes.
+const nonceDataLen = 16
+
+func (m *memNonceManager) NewNonce() string {
+	b := make([]byte, nonceDataLen)
+	binary.BigEndian.PutUint64(b, uint64(time.Nanoseconds()))
+	if _, err := io.ReadFull(rand.Reader, b[8:]); err != nil {
+		panic("http: reading random bytes: " + err.String())
+	}
+	return hex.EncodeToString(append(b, m.sign(b)...))
+}
+
+func (m *memNonceManager) sign(b []byte) []byte {
+	h := hmac.NewSHA1(m.key)
+	h.Write(b)
+	return h.Sum()
+}
+
+func (m *memNonceManager) UseNonce(nonce string, count uint64) (ok, stale bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) <= nonceDataLen ||
+		subtle.ConstantTimeCompare(b[nonceDataLen:], m.sign(b[:nonceDataLen])) != 1 {
+		return false, false
+	}
+	now := time.Nanoseconds()
+	expires := int64(binary.BigEndian.Uint64(b)) + m.maxAge
+	if now > expires {
+		return false, true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Forget the nonces that have expired, which are reported
+	// stale without them.  A nonce behind one that is yet to
+	// expire waits for it.
+	for len(m.order) > 0 && m.used[m.order[0]].expires < now {
+		m.used[m.order[0]] = nil, false
+		m.order = m.order[1:]
+	}
+	s := m.used[nonce]
+	if s == nil {
+		s = &nonceState{expires: expires, counts: make(map[uint64]bool)}
+		m.used[nonce] = s
+		m.order = append(m.order, nonce)
+	}
+	if s.counts[count] {
+		return false, false
+	}
+	s.counts[count] = true
+	return true, false
+}
+
+// DigestAuthHandler returns a Handler that runs h for requests
+// authenticated by HTTP Digest Authentication, with the "auth"
+// quality of protection and the MD5 algorithm, as a user in the
+// given realm whose secret is returned by secret.  Other requests
+// are answered with 401 Unauthorized and a challenge with a nonce
+// from nonces, or with 400 Bad Request if their credentials are
+// malformed.  If nonces is nil, a NonceManager returned by
+// NewNonceManager(DefaultNonceMaxAge) is used.
+//
+// Digest Authentication does not send the password itself, but
+// protects neither the request nor the response, so it too is best
+// used over TLS.
+func DigestAuthHandler(h Handler, realm string, secret DigestSecret, nonces NonceManager) Handler {
+	if nonces == nil {
+		nonces = NewNonceManager(DefaultNonceMaxAge)
+	}
+	return &digestAuthHandler{h, realm, secret, nonces}
+}
+
+type digestAuthHandler struct {
+	handler Handler
+	realm   string
+	secret  DigestSecret
+	nonces  NonceManager
+}
+
+func (h *digestAuthHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || strings.ToLower(auth[:7]) != "digest " {
+		h.challenge(w, false)
+		return
+	}
+	p := parseAuthParams(auth[7:])
+	if p == nil || p["username"] == "" || p["nonce"] == "" || p["response"] == "" ||
+		p["realm"] != h.realm || p["uri"] != r.RawURL || p["qop"] != "auth" ||
+		p["cnonce"] == "" || len(p["nc"]) != 8 {
+		Error(w, "400 bad request", StatusBadRequest)
+		return
+	}
+	if alg := p["algorithm"]; alg != "" && strings.ToLower(alg) != "md5" {
+		Error(w, "400 bad request", StatusBadRequest)
+		return
+	}
+	nc, err := strconv.Btoui64(p["nc"], 16)
+	if err != nil {
+		Error(w, "400 bad request", StatusBadRequest)
+		return
+	}
+	ha1, ok := h.secret(p["username"], h.realm)
+	if !ok {
+		h.challenge(w, false)
+		return
+	}
+	want := digestResponse(ha1, r.Method, p["uri"], p["nonce"], p["nc"], p["cnonce"], p["qop"])
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(p["response"]))) != 1 {
+		h.challenge(w, false)
+		return
+	}
+	// Check the nonce only for a correct response, so that
+	// guesses do not use up its counts.
+	if ok, stale := h.nonces.UseNonce(p["nonce"], nc); !ok {
+		h.challenge(w, stale)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+func (h *digestAuthHandler) challenge(w ResponseWriter, stale bool) {
+	c := fmt.Sprintf(`Digest realm=%s, qop="auth", algorithm=MD5, nonce="%s"`, strconv.Quote(h.realm), h.nonces.NewNonce())
+	if stale {
+		c += ", stale=true"
+	}
+	w.Header().Set("WWW-Authenticate", c)
+	Error(w, "401 unauthorized", StatusUnauthorized)
+}
+
+// digestResponse returns the request-digest of RFC 2617 section 3.2.2.1
+// for a request with qop set, given HA1.
+func digestResponse(ha1, method, uri, nonce, nc, cnonce, qop string) string {
+	ha2 := md5Hex(method + ":" + uri)
+	return md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+}
+
+// digestAuthorization returns the value of the Authorization header
+// answering the Digest challenge, whose parameters are p, to
+// req with the given user name and password.  ok is false if the
+// challenge is not one that can be answered.
+func digestAuthorization(p map[string]string, req *Request, username, password string) (auth string, ok bool) {
+	realm, nonce := p["realm"], p["nonce"]
+	if nonce == "" {
+		return "", false
+	}
+	qop := ""
+	for _, q := range strings.Split(p["qop"], ",", -1) {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	if qop == "" {
+		// Only the "auth" quality of protection is supported.
+		return "", false
+	}
+	cnonce := randomHex(8)
+	const nc = "00000001"
+	ha1 := DigestHA1(username, realm, password)
+	alg := p["algorithm"]
+	switch {
+	case alg == "" || strings.ToLower(alg) == "md5":
+	case strings.ToLower(alg) == "md5-sess":
+		ha1 = md5Hex(ha1 + ":" + nonce + ":" + cnonce)
+	default:
+		return "", false
+	}
+	uri := req.requestURI()
+	auth = fmt.Sprintf(`Digest username=%s, realm=%s, nonce=%s, uri=%s, qop=%s, nc=%s, cnonce="%s", response="%s"`,
+		strconv.Quote(username), strconv.Quote(realm), strconv.Quote(nonce), strconv.Quote(uri),
+		qop, nc, cnonce, digestResponse(ha1, valueOrDefault(req.Method, "GET"), uri, nonce, nc, cnonce, qop))
+	if alg != "" {
+		auth += ", algorithm=" + alg
+	}
+	if opaque, ok := p["opaque"]; ok {
+		auth += ", opaque=" + strconv.Quote(opaque)
+	}
+	return auth, true
+}
+
+// digestChallenge returns the parameters of the Digest challenge
+// in res's WWW-Authenticate headers, or nil if there is none.
+func digestChallenge(res *Response) map[string]string {
+	for _, c := range res.Header["Www-Authenticate"] {
+		c = strings.TrimSpace(c)
+		if len(c) > 7 && strings.ToLower(c[:7]) == "digest " {
+			return parseAuthParams(c[7:])
+		}
+	}
+	return nil
+}
+
+// parseAuthParams parses a comma-separated list of auth-params,
+// each of the form name=token or name="quoted string".  Names are
+// lower-cased.  It returns nil if s is malformed.
+func parseAuthParams(s string) map[string]string {
+	p := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return p
+		}
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			eaten, v := httpUnquote([]byte(s))
+			if eaten < 0 {
+				return nil
+			}
+			value, s = v, s[eaten:]
+		} else {
+			j := strings.Index(s, ",")
+			if j < 0 {
+				j = len(s)
+			}
+			value, s = strings.TrimSpace(s[:j]), s[j:]
+		}
+		p[name] = value
+	}
+	panic("unreachable")
+}
+
+func md5Hex(s string) string {
+	h := md5.New()
+	io.WriteString(h, s)
+	return hex.EncodeToString(h.Sum())
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic("http: reading random bytes: " + err.String())
+	}
+	return hex.EncodeToString(b)
+}
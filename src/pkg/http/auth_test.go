@@ -0,0 +1,187 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http_test
+
+import (
+	. "http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var basicAuthTests = []struct {
+	header         string
+	user, password string
+	ok             bool
+}{
+	{"Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==", "Aladdin", "open sesame", true},
+	{"basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==", "Aladdin", "open sesame", true},
+	{"Basic OnBhc3M6d29yZA==", "", "pass:word", true},
+	{"Basic QWxhZGRpbg==", "", "", false}, // no colon
+	{"Basic !!!", "", "", false},
+	{"Digest username=\"Aladdin\"", "", "", false},
+	{"", "", "", false},
+}
+
+func TestRequestBasicAuth(t *testing.T) {
+	for i, tt := range basicAuthTests {
+		r := &Request{Header: Header{"Authorization": {tt.header}}}
+		user, password, ok := r.BasicAuth()
+		if user != tt.user || password != tt.password || ok != tt.ok {
+			t.Errorf("%d. BasicAuth() = %q, %q, %v; want %q, %q, %v", i, user, password, ok, tt.user, tt.password, tt.ok)
+		}
+	}
+
+	r, _ := NewRequest("GET", "http://example.com/", nil)
+	r.SetBasicAuth("user", "pass/+word")
+	if user, password, ok := r.BasicAuth(); user != "user" || password != "pass/+word" || !ok {
+		t.Errorf("after SetBasicAuth, BasicAuth() = %q, %q, %v", user, password, ok)
+	}
+}
+
+var helloHandler = HandlerFunc(func(w ResponseWriter, r *Request) {
+	io.WriteString(w, "hello")
+})
+
+func getStatus(t *testing.T, req *Request) (*Response, string) {
+	res, err := DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestBasicAuthHandler(t *testing.T) {
+	ts := httptest.NewServer(BasicAuthHandler(helloHandler, "test realm", func(user, password string) bool {
+		return user == "gopher" && password == "secret"
+	}))
+	defer ts.Close()
+
+	req, _ := NewRequest("GET", ts.URL, nil)
+	res, _ := getStatus(t, req)
+	if res.StatusCode != StatusUnauthorized {
+		t.Errorf("without credentials, status = %d; want 401", res.StatusCode)
+	}
+	if g, e := res.Header.Get("WWW-Authenticate"), `Basic realm="test realm"`; g != e {
+		t.Errorf("WWW-Authenticate = %q; want %q", g, e)
+	}
+
+	req, _ = NewRequest("GET", ts.URL, nil)
+	req.SetBasicAuth("gopher", "wrong")
+	if res, _ = getStatus(t, req); res.StatusCode != StatusUnauthorized {
+		t.Errorf("with wrong password, status = %d; want 401", res.StatusCode)
+	}
+
+	req, _ = NewRequest("GET", ts.URL, nil)
+	req.SetBasicAuth("gopher", "secret")
+	if res, body := getStatus(t, req); res.StatusCode != StatusOK || body != "hello" {
+		t.Errorf("with credentials, got %d %q; want 200 \"hello\"", res.StatusCode, body)
+	}
+}
+
+func digestTestServer(nonces NonceManager, auths chan<- string) *httptest.Server {
+	const realm = "digest realm"
+	secret := func(user, r string) (string, bool) {
+		if user != "gopher" {
+			return "", false
+		}
+		return DigestHA1(user, r, "secret"), true
+	}
+	h := DigestAuthHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if auths != nil {
+			auths <- r.Header.Get("Authorization")
+		}
+		helloHandler(w, r)
+	}), realm, secret, nonces)
+	return httptest.NewServer(h)
+}
+
+func TestDigestAuth(t *testing.T) {
+	auths := make(chan string, 1)
+	ts := digestTestServer(nil, auths)
+	defer ts.Close()
+	userURL := strings.Replace(ts.URL, "http://", "http://gopher:secret@", 1) + "/path?q=1"
+
+	req, _ := NewRequest("GET", userURL, nil)
+	res, body := getStatus(t, req)
+	if res.StatusCode != StatusOK || body != "hello" {
+		t.Fatalf("with credentials in URL, got %d %q; want 200 \"hello\"", res.StatusCode, body)
+	}
+	auth := <-auths
+	if !strings.HasPrefix(auth, "Digest ") || !strings.Contains(auth, `uri="/path?q=1"`) {
+		t.Errorf("Authorization = %q", auth)
+	}
+
+	// Credentials in the Authorization header also answer the challenge.
+	req, _ = NewRequest("GET", ts.URL, nil)
+	req.SetBasicAuth("gopher", "secret")
+	if res, _ = getStatus(t, req); res.StatusCode != StatusOK {
+		t.Errorf("with Basic credentials, status = %d; want 200", res.StatusCode)
+	}
+	<-auths
+
+	// A replayed response is refused.
+	req, _ = NewRequest("GET", ts.URL+"/path?q=1", nil)
+	req.Header.Set("Authorization", auth)
+	if res, _ = getStatus(t, req); res.StatusCode != StatusUnauthorized {
+		t.Errorf("replayed request: status = %d; want 401", res.StatusCode)
+	}
+
+	req, _ = NewRequest("GET", strings.Replace(userURL, "secret", "wrong", 1), nil)
+	res, _ = getStatus(t, req)
+	if res.StatusCode != StatusUnauthorized {
+		t.Errorf("with wrong password, status = %d; want 401", res.StatusCode)
+	}
+	if c := res.Header.Get("WWW-Authenticate"); !strings.HasPrefix(c, `Digest realm="digest realm", qop="auth"`) {
+		t.Errorf("WWW-Authenticate = %q", c)
+	}
+}
+
+func TestDigestAuthStaleNonce(t *testing.T) {
+	// Nonces expire immediately.
+	ts := digestTestServer(NewNonceManager(-1), nil)
+	defer ts.Close()
+	req, _ := NewRequest("GET", strings.Replace(ts.URL, "http://", "http://gopher:secret@", 1), nil)
+	res, _ := getStatus(t, req)
+	if res.StatusCode != StatusUnauthorized {
+		t.Fatalf("status = %d; want 401", res.StatusCode)
+	}
+	if c := res.Header.Get("WWW-Authenticate"); !strings.HasSuffix(c, "stale=true") {
+		t.Errorf("WWW-Authenticate = %q; want stale=true", c)
+	}
+}
+
+func TestNonceManager(t *testing.T) {
+	m := NewNonceManager(60e9)
+	nonce := m.NewNonce()
+	if ok, stale := m.UseNonce(nonce, 1); !ok || stale {
+		t.Fatalf("UseNonce(nonce, 1) = %v, %v; want true, false", ok, stale)
+	}
+	if ok, _ := m.UseNonce(nonce, 1); ok {
+		t.Errorf("count 1 accepted twice")
+	}
+	if ok, _ := m.UseNonce(nonce, 2); !ok {
+		t.Errorf("count 2 rejected")
+	}
+
+	// Nonces signed by another manager, or altered, are rejected.
+	altered := []byte(nonce)
+	altered[len(altered)-1] ^= 1
+	for _, n := range []string{
+		NewNonceManager(60e9).NewNonce(),
+		string(altered),
+		nonce[:len(nonce)-2],
+		"not hex",
+		"",
+	} {
+		if ok, stale := m.UseNonce(n, 1); ok || stale {
+			t.Errorf("UseNonce(%q, 1) = %v, %v; want false, false", n, ok, stale)
+		}
+	}
+}
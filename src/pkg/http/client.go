@@ -12,6 +12,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 )
 
 // A Client is an HTTP client. Its zero value (DefaultClient) is a usable client
@@ -29,8 +30,28 @@ type Client struct {
 	// If CheckRedirect is nil, the Client uses its default policy,
 	// which is to stop after 10 consecutive requests.
 	CheckRedirect func(req *Request, via []*Request) os.Error
+
+	// Jar specifies the cookie jar.  If Jar is non-nil, cookies from
+	// the jar are added to every outbound request, including those
+	// made while following redirects, and cookies set in every
+	// response are stored in the jar.  If Jar is nil, cookies are
+	// only sent if explicitly set on the Request.
+	Jar CookieJar
+
+	// Timeout, if non-zero, is the number of nanoseconds allowed
+	// for a request made by the Client, from dialing through to
+	// reading the last of the response body, including any
+	// redirects followed.  When it expires the request is canceled
+	// and the pending call, or read from the response body, fails
+	// with ErrClientTimeout.  Timeout requires a Transport that
+	// implements CancelRequest, as Transport does.
+	Timeout int64
 }
 
+// ErrClientTimeout is returned when a request made by a Client
+// exceeds the Client's Timeout.
+var ErrClientTimeout = os.NewError("http: Client.Timeout exceeded")
+
 // DefaultClient is the default Client and is used by Get, Head, and Post.
 var DefaultClient = &Client{}
 
@@ -74,9 +95,106 @@ func (c *Client) Do(req *Request) (resp *Response, err os.Error) {
 	if req.Method == "GET" || req.Method == "HEAD" {
 		return c.doFollowingRedirects(req)
 	}
-	return send(req, c.Transport)
+	return c.send(req, c.deadline())
 }
 
+// deadline returns the time, in nanoseconds since the epoch, by
+// which a request made now must be complete, or 0 if there is no
+// limit.
+func (c *Client) deadline() int64 {
+	if c.Timeout > 0 {
+		return time.Nanoseconds() + c.Timeout
+	}
+	return 0
+}
+
+// send issues req using c's Transport, consulting c's Jar, if any,
+// for the cookies to send and to store cookies from the response.
+// If deadline is not 0, req is canceled if it is not complete by
+// then.
+//
+// If the response is a challenge to Digest Authentication, and req
+// has a user name and password, in its URL or its Authorization
+// header, and no body, req is sent again answering the challenge.
+func (c *Client) send(req *Request, deadline int64) (resp *Response, err os.Error) {
+	resp, err = c.sendOnce(req, deadline)
+	if err != nil || resp.StatusCode != StatusUnauthorized || req.Body != nil {
+		return resp, err
+	}
+	if areq := digestRequest(req, resp); areq != nil {
+		resp.Body.Close()
+		return c.sendOnce(areq, deadline)
+	}
+	return resp, nil
+}
+
+// digestRequest returns a copy of req answering the Digest
+// Authentication challenge in resp, or nil if req has no credentials
+// with which to answer it.
+func digestRequest(req *Request, resp *Response) *Request {
+	p := digestChallenge(resp)
+	if p == nil {
+		return nil
+	}
+	var user, password string
+	var ok bool
+	if info := req.URL.RawUserinfo; info != "" {
+		var err os.Error
+		user, password, err = UnescapeUserinfo(info)
+		ok = err == nil
+	} else {
+		user, password, ok = req.BasicAuth()
+	}
+	if !ok {
+		return nil
+	}
+	auth, ok := digestAuthorization(p, req, user, password)
+	if !ok {
+		return nil
+	}
+	areq := new(Request)
+	*areq = *req
+	areq.Header = make(Header)
+	for k, vv := range req.Header {
+		areq.Header[k] = vv
+	}
+	areq.Header.Set("Authorization", auth)
+	// Drop the user info, so that it is not sent in Basic
+	// Authentication instead.
+	u := new(URL)
+	*u = *req.URL
+	u.RawUserinfo = ""
+	areq.URL = u
+	return areq
+}
+
+// sendOnce is send without the answering of challenges.
+func (c *Client) sendOnce(req *Request, deadline int64) (resp *Response, err os.Error) {
+	if c.Jar != nil {
+		if cookies := c.Jar.Cookies(req.URL); len(cookies) > 0 {
+			// The cookies are added to a copy of req, so
+			// that the caller's Request may be sent again.
+			jreq := new(Request)
+			*jreq = *req
+			jreq.Cookie = make([]*Cookie, 0, len(req.Cookie)+len(cookies))
+			jreq.Cookie = append(jreq.Cookie, req.Cookie...)
+			jreq.Cookie = append(jreq.Cookie, cookies...)
+			req = jreq
+		}
+	}
+	if deadline != 0 {
+		resp, err = c.sendWithDeadline(req, deadline)
+	} else {
+		resp, err = send(req, c.Transport)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Jar != nil {
+		c.Jar.SetCookies(req.URL, resp.SetCookie)
+	}
+	return resp, nil
+}
 
 // send issues an HTTP request.  Caller should close resp.Body when done reading from it.
 func send(req *Request, t RoundTripper) (resp *Response, err os.Error) {
@@ -100,11 +218,71 @@ func send(req *Request, t RoundTripper) (resp *Response, err os.Error) {
 		if req.Header == nil {
 			req.Header = make(Header)
 		}
-		req.Header.Set("Authorization", "Basic "+base64.URLEncoding.EncodeToString([]byte(info)))
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(info)))
 	}
 	return t.RoundTrip(req)
 }
 
+// canceler is implemented by RoundTrippers, such as Transport,
+// that can abort a request in flight.
+type canceler interface {
+	CancelRequest(*Request)
+}
+
+// sendWithDeadline issues req, canceling it if it, including the
+// reading of its response body, is not complete by deadline.
+func (c *Client) sendWithDeadline(req *Request, deadline int64) (*Response, os.Error) {
+	t := c.Transport
+	if t == nil {
+		t = DefaultTransport
+	}
+	rc, ok := t.(canceler)
+	if !ok {
+		return nil, os.NewError("http: Client.Timeout set but Transport does not implement CancelRequest")
+	}
+	ns := deadline - time.Nanoseconds()
+	if ns <= 0 {
+		return nil, ErrClientTimeout
+	}
+	timer := time.AfterFunc(ns, func() {
+		rc.CancelRequest(req)
+	})
+	resp, err := send(req, t)
+	if err != nil {
+		if !timer.Stop() {
+			err = ErrClientTimeout
+		}
+		return nil, err
+	}
+	resp.Body = &deadlineBody{resp.Body, timer}
+	return resp, nil
+}
+
+// A deadlineBody is the body of a Response to a request made with
+// a deadline.  Reading or closing it stops the timer that enforces
+// the deadline; reads that fail because the timer canceled the
+// request return ErrClientTimeout.
+type deadlineBody struct {
+	rc    io.ReadCloser
+	timer *time.Timer
+}
+
+func (b *deadlineBody) Read(p []byte) (n int, err os.Error) {
+	n, err = b.rc.Read(p)
+	if err != nil {
+		fired := !b.timer.Stop()
+		if fired && err != os.EOF {
+			err = ErrClientTimeout
+		}
+	}
+	return
+}
+
+func (b *deadlineBody) Close() os.Error {
+	b.timer.Stop()
+	return b.rc.Close()
+}
+
 // True if the specified HTTP status code is one for which the Get utility should
 // automatically redirect.
 func shouldRedirect(statusCode int) bool {
@@ -149,9 +327,10 @@ func (c *Client) Get(url string) (r *Response, err os.Error) {
 }
 
 func (c *Client) doFollowingRedirects(ireq *Request) (r *Response, err os.Error) {
-	// TODO: if/when we add cookie support, the redirected request shouldn't
-	// necessarily supply the same cookies as the original.
+	// Each redirected request is a new Request, so it carries only
+	// the cookies that c.Jar holds for its own URL.
 	var base *URL
+	deadline := c.deadline()
 	redirectChecker := c.CheckRedirect
 	if redirectChecker == nil {
 		redirectChecker = defaultCheckRedirect
@@ -184,7 +363,7 @@ func (c *Client) doFollowingRedirects(ireq *Request) (r *Response, err os.Error)
 		}
 
 		url = req.URL.String()
-		if r, err = send(req, c.Transport); err != nil {
+		if r, err = c.send(req, deadline); err != nil {
 			break
 		}
 		if shouldRedirect(r.StatusCode) {
@@ -230,7 +409,7 @@ func (c *Client) Post(url string, bodyType string, body io.Reader) (r *Response,
 		return nil, err
 	}
 	req.Header.Set("Content-Type", bodyType)
-	return send(req, c.Transport)
+	return c.send(req, c.deadline())
 }
 
 // PostForm issues a POST to the specified URL, 
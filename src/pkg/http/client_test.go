@@ -243,3 +243,119 @@ func TestStreamingGet(t *testing.T) {
 		t.Fatalf("at end expected EOF, got %v", err)
 	}
 }
+
+func TestClientTimeout(t *testing.T) {
+	release := make(chan bool)
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			Redirect(w, r, "/headers", StatusFound)
+		case "/headers":
+			<-release
+		case "/body":
+			w.Write([]byte("partial"))
+			w.(Flusher).Flush()
+			<-release
+		default:
+			w.Write([]byte("fast"))
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	c := &Client{Transport: &Transport{}, Timeout: 100e6}
+	for _, path := range []string{"/headers", "/redirect"} {
+		_, err := c.Get(ts.URL + path)
+		if ue, ok := err.(*URLError); !ok || ue.Error != ErrClientTimeout {
+			t.Errorf("Get %s: got error %v; want %v", path, err, ErrClientTimeout)
+		}
+	}
+
+	res, err := c.Get(ts.URL + "/body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != ErrClientTimeout {
+		t.Errorf("reading body: got error %v; want %v", err, ErrClientTimeout)
+	}
+	if g, e := string(body), "partial"; g != e {
+		t.Errorf("body = %q; want %q", g, e)
+	}
+
+	res, err = c.Get(ts.URL + "/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(body) != "fast" {
+		t.Errorf("Get /fast: got %q, %v; want %q, nil", body, err, "fast")
+	}
+}
+
+func TestClientJarFollowsRedirects(t *testing.T) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/" {
+			SetCookie(w, &Cookie{Name: "session", Value: "abc", Path: "/"})
+			Redirect(w, r, "/next", StatusFound)
+			return
+		}
+		for _, c := range r.Cookie {
+			fmt.Fprintf(w, "%s=%s;", c.Name, c.Value)
+		}
+	}))
+	defer ts.Close()
+
+	c := &Client{Jar: new(Jar)}
+	for i := 0; i < 2; i++ {
+		res, err := c.Get(ts.URL + "/")
+		if err != nil {
+			t.Fatalf("Get #%d: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if g, e := string(body), "session=abc;"; g != e {
+			t.Errorf("Get #%d: redirected request got cookies %q; want %q", i, g, e)
+		}
+	}
+
+	res, err := (&Client{}).Get(ts.URL + "/next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if len(body) != 0 {
+		t.Errorf("Client without Jar sent cookies %q", body)
+	}
+}
+
+func TestClientJarReusedRequest(t *testing.T) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		SetCookie(w, &Cookie{Name: "session", Value: "abc", Path: "/"})
+		for _, c := range r.Cookie {
+			fmt.Fprintf(w, "%s=%s;", c.Name, c.Value)
+		}
+	}))
+	defer ts.Close()
+
+	c := &Client{Jar: new(Jar)}
+	req, _ := NewRequest("GET", ts.URL+"/", nil)
+	req.Cookie = []*Cookie{&Cookie{Name: "own", Value: "1"}}
+	for i, want := range []string{"own=1;", "own=1;session=abc;", "own=1;session=abc;"} {
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("Do #%d: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != want {
+			t.Errorf("Do #%d: request had cookies %q; want %q", i, body, want)
+		}
+	}
+	if len(req.Cookie) != 1 {
+		t.Errorf("Do changed the Request's cookies to %v", req.Cookie)
+	}
+}
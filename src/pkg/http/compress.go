@@ -0,0 +1,294 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// compressMinLength is the smallest response body that
+// CompressHandler compresses.  Smaller bodies gain little and
+// may even grow.
+const compressMinLength = 1024
+
+// incompressibleTypes lists media types whose content is already
+// compressed.  Types ending in "/" name a whole class of types.
+var incompressibleTypes = []string{
+	"image/",
+	"audio/",
+	"video/",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-compress",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+}
+
+// CompressHandler returns a Handler that runs h and compresses its
+// responses with gzip or deflate, as negotiated with the request's
+// Accept-Encoding header.  Compressed responses have their
+// Content-Encoding header set and any Content-Length removed.
+//
+// Responses are sent uncompressed if they already have a
+// Content-Encoding, if their Content-Type names already-compressed
+// content such as an image, if they are partial or have no body, or
+// if the handler writes fewer than 1024 bytes before returning or
+// calling Flush.  Responses that might have been compressed list
+// Accept-Encoding in their Vary header.
+//
+// The ResponseWriter passed to h supports Flush, which flushes
+// compressed data to the client, and Hijack if the underlying
+// ResponseWriter does.
+func CompressHandler(h Handler) Handler {
+	return &compressHandler{h}
+}
+
+type compressHandler struct {
+	handler Handler
+}
+
+func (h *compressHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	cw := &compressWriter{
+		w:        w,
+		req:      r,
+		encoding: negotiateEncoding(r.Header.Get("Accept-Encoding")),
+	}
+	if _, ok := w.(Hijacker); ok {
+		h.handler.ServeHTTP(compressHijacker{cw}, r)
+	} else {
+		h.handler.ServeHTTP(cw, r)
+	}
+	cw.finish()
+}
+
+// negotiateEncoding returns the content coding to use for a response
+// to a request with the given Accept-Encoding header: "gzip" or
+// "deflate", preferring gzip when both are equally acceptable, or ""
+// if neither is acceptable.
+func negotiateEncoding(accept string) string {
+	if accept == "" {
+		return ""
+	}
+	qvalue := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",", -1) {
+		coding, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			coding = part[:i]
+			param := strings.TrimSpace(part[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				var err os.Error
+				if q, err = strconv.Atof64(param[2:]); err != nil {
+					q = 0
+				}
+			}
+		}
+		qvalue[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+	weight := func(coding string) float64 {
+		if q, ok := qvalue[coding]; ok {
+			return q
+		}
+		if coding == "gzip" {
+			if q, ok := qvalue["x-gzip"]; ok {
+				return q
+			}
+		}
+		return qvalue["*"]
+	}
+	gz, fl := weight("gzip"), weight("deflate")
+	switch {
+	case gz > 0 && gz >= fl:
+		return "gzip"
+	case fl > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressible reports whether a response with the given header
+// could benefit from compression.
+func compressible(h Header) bool {
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	ctype := strings.ToLower(h.Get("Content-Type"))
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(ctype, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// addVary adds Accept-Encoding to the Vary header in h,
+// unless it is already present.
+func addVary(h Header) {
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",", -1) {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.ToLower(f) == "accept-encoding" {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// flushWriteCloser is the interface of the gzip and zlib compressors.
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() os.Error
+}
+
+// A compressWriter is the ResponseWriter passed to the handler by
+// CompressHandler.  Once the handler has written its header, the
+// body is held back until it is known whether it is large enough to
+// compress.
+type compressWriter struct {
+	w        ResponseWriter
+	req      *Request
+	encoding string // negotiated content coding; "" for none
+
+	code     int              // status passed to WriteHeader; 0 until then
+	buf      []byte           // body held back while undecided
+	decided  bool             // header sent to w
+	cw       flushWriteCloser // compressor, if compressing
+	hijacked bool
+}
+
+func (cw *compressWriter) Header() Header {
+	return cw.w.Header()
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.code != 0 {
+		// Let the underlying ResponseWriter complain.
+		cw.w.WriteHeader(code)
+		return
+	}
+	cw.code = code
+	h := cw.w.Header()
+	if !compressible(h) {
+		cw.sendPlain()
+		return
+	}
+	addVary(h)
+	if cw.encoding == "" || cw.req.Method == "HEAD" ||
+		code < 200 || code == StatusNoContent || code == StatusPartialContent || code == StatusNotModified {
+		cw.sendPlain()
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < compressMinLength {
+		cw.sendPlain()
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, os.Error) {
+	if cw.code == 0 {
+		cw.WriteHeader(StatusOK)
+	}
+	if cw.decided {
+		if cw.cw != nil {
+			return cw.cw.Write(p)
+		}
+		return cw.w.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= compressMinLength {
+		if err := cw.sendCompressed(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// sendPlain sends the header, and any body held back,
+// without compression.
+func (cw *compressWriter) sendPlain() os.Error {
+	cw.decided = true
+	cw.w.WriteHeader(cw.code)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	_, err := cw.w.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// sendCompressed sends the header for a compressed response and
+// starts compressing the body, beginning with any held back.
+func (cw *compressWriter) sendCompressed() (err os.Error) {
+	cw.decided = true
+	h := cw.w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.encoding)
+	cw.w.WriteHeader(cw.code)
+	if cw.encoding == "gzip" {
+		cw.cw, err = gzip.NewWriter(cw.w)
+	} else {
+		cw.cw, err = zlib.NewWriter(cw.w)
+	}
+	if err != nil {
+		return err
+	}
+	if len(cw.buf) > 0 {
+		_, err = cw.cw.Write(cw.buf)
+		cw.buf = nil
+	}
+	return err
+}
+
+// Flush implements the Flusher interface.  A response that has not
+// been sent yet is too short to compress and is sent as it is.
+func (cw *compressWriter) Flush() {
+	if cw.code == 0 {
+		cw.WriteHeader(StatusOK)
+	}
+	if !cw.decided {
+		cw.sendPlain()
+	}
+	if cw.cw != nil {
+		cw.cw.Flush()
+	}
+	if f, ok := cw.w.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+// A compressHijacker is passed to the handler in place of a
+// compressWriter when the underlying ResponseWriter is a Hijacker.
+type compressHijacker struct {
+	*compressWriter
+}
+
+func (cw compressHijacker) Hijack() (net.Conn, *bufio.ReadWriter, os.Error) {
+	c, buf, err := cw.w.(Hijacker).Hijack()
+	if err == nil {
+		cw.hijacked = true
+	}
+	return c, buf, err
+}
+
+// finish completes the response after the handler has returned.
+func (cw *compressWriter) finish() {
+	switch {
+	case cw.hijacked || cw.code == 0:
+		// Nothing was written; leave the
+		// response to the server.
+	case !cw.decided:
+		cw.sendPlain()
+	case cw.cw != nil:
+		cw.cw.Close()
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	. "http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var bigBody = strings.Repeat("All work and no play makes Jack a dull boy.\n", 100)
+
+func compressTestHandler(ctype, body string) Handler {
+	return CompressHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+		io.WriteString(w, body)
+	}))
+}
+
+type compressTest struct {
+	accept   string // Accept-Encoding of the request
+	ctype    string // Content-Type of the response
+	body     string
+	encoding string // expected Content-Encoding
+}
+
+var compressTests = []compressTest{
+	{"gzip", "text/plain", bigBody, "gzip"},
+	{"deflate", "text/plain", bigBody, "deflate"},
+	{"gzip, deflate", "text/plain", bigBody, "gzip"},
+	{"gzip;q=0.5, deflate", "text/plain", bigBody, "deflate"},
+	{"gzip;q=0, deflate", "text/plain", bigBody, "deflate"},
+	{"*", "text/plain", bigBody, "gzip"},
+	{"*;q=0", "text/plain", bigBody, ""},
+	{"identity", "text/plain", bigBody, ""},
+	{"", "text/plain", bigBody, ""},
+
+	// Small bodies and compressed types are sent as they are.
+	{"gzip", "text/plain", "short", ""},
+	{"gzip", "image/png", bigBody, ""},
+	{"gzip", "application/zip", bigBody, ""},
+}
+
+func TestCompressHandler(t *testing.T) {
+	for i, tt := range compressTests {
+		req, _ := NewRequest("GET", "/", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept-Encoding", tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		compressTestHandler(tt.ctype, tt.body).ServeHTTP(rec, req)
+
+		if g := rec.HeaderMap.Get("Content-Encoding"); g != tt.encoding {
+			t.Errorf("#%d: Content-Encoding = %q; want %q", i, g, tt.encoding)
+			continue
+		}
+		var r io.Reader = rec.Body
+		var err os.Error
+		switch tt.encoding {
+		case "gzip":
+			r, err = gzip.NewReader(r)
+		case "deflate":
+			r, err = zlib.NewReader(r)
+		}
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("#%d: reading body: %v", i, err)
+			continue
+		}
+		if string(body) != tt.body {
+			t.Errorf("#%d: got body %q; want %q", i, body, tt.body)
+		}
+		wantVary := !strings.HasPrefix(tt.ctype, "image/") && tt.ctype != "application/zip"
+		if g := rec.HeaderMap.Get("Vary") == "Accept-Encoding"; g != wantVary {
+			t.Errorf("#%d: Vary = %q; want Accept-Encoding: %v", i, rec.HeaderMap.Get("Vary"), wantVary)
+		}
+	}
+}
+
+func TestCompressHandlerPreservesEncoding(t *testing.T) {
+	h := CompressHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("Content-Encoding", "br")
+		io.WriteString(w, bigBody)
+	}))
+	req, _ := NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if g, e := rec.HeaderMap.Get("Content-Encoding"), "br"; g != e {
+		t.Errorf("Content-Encoding = %q; want %q", g, e)
+	}
+	if rec.Body.String() != bigBody {
+		t.Errorf("body was modified")
+	}
+}
+
+func TestCompressHandlerFlush(t *testing.T) {
+	tests := []struct {
+		body     string
+		encoding string
+	}{
+		// A short body flushed before the handler returns is
+		// sent uncompressed, as it would be without the Flush.
+		{"first", ""},
+		{bigBody, "gzip"},
+	}
+	for i, tt := range tests {
+		body := tt.body
+		h := CompressHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+			io.WriteString(w, body)
+			w.(Flusher).Flush()
+		}))
+		req, _ := NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if !rec.Flushed {
+			t.Errorf("#%d: underlying ResponseWriter not flushed", i)
+		}
+		if g := rec.HeaderMap.Get("Content-Encoding"); g != tt.encoding {
+			t.Errorf("#%d: Content-Encoding = %q; want %q", i, g, tt.encoding)
+			continue
+		}
+		var r io.Reader = bytes.NewBuffer(rec.Body.Bytes())
+		if tt.encoding == "gzip" {
+			var err os.Error
+			if r, err = gzip.NewReader(r); err != nil {
+				t.Errorf("#%d: %v", i, err)
+				continue
+			}
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("#%d: reading body: %v", i, err)
+			continue
+		}
+		if string(got) != tt.body {
+			t.Errorf("#%d: got body %q; want %q", i, got, tt.body)
+		}
+	}
+}
+
+func TestCompressHandlerHijack(t *testing.T) {
+	ts := httptest.NewServer(CompressHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		conn, buf, err := w.(Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(buf, "HTTP/1.0 200 OK\r\nX-Hijacked: yes\r\n\r\nhijacked")
+		buf.Flush()
+	})))
+	defer ts.Close()
+
+	req, _ := NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if g, e := res.Header.Get("X-Hijacked"), "yes"; g != e {
+		t.Errorf("X-Hijacked = %q; want %q", g, e)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if g, e := string(body), "hijacked"; g != e {
+		t.Errorf("body = %q; want %q", g, e)
+	}
+}
+
+func TestCompressHandlerNoHijacker(t *testing.T) {
+	// httptest.ResponseRecorder cannot be hijacked, so
+	// neither can the ResponseWriter wrapping it.
+	h := CompressHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if _, ok := w.(Hijacker); ok {
+			t.Errorf("ResponseWriter implements Hijacker")
+		}
+	}))
+	req, _ := NewRequest("GET", "/", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
@@ -0,0 +1,437 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package eventsource implements Server-Sent Events, the protocol of the
+EventSource interface of web browsers: a Server that streams events
+to its subscribers, and a Decoder that reads them.
+
+A trivial example server:
+
+	package main
+
+	import (
+		"http"
+		"http/eventsource"
+		"time"
+	)
+
+	func main() {
+		events := new(eventsource.Server)
+		http.Handle("/events", events)
+		go func() {
+			for {
+				events.Publish(&eventsource.Event{Data: time.LocalTime().String()})
+				time.Sleep(1e9)
+			}
+		}()
+		err := http.ListenAndServe(":12345", nil)
+		if err != nil {
+			panic("ListenAndServe: " + err.String())
+		}
+	}
+*/
+package eventsource
+
+import (
+	"bufio"
+	"http"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Event is a message sent in an event stream.
+type Event struct {
+	// Id, if non-empty, identifies the event.  A client
+	// reconnecting to a Server sends the Id of the last event it
+	// received, and the Server replays the events that followed.
+	Id string
+
+	// Event is the type of the event.  If empty, the event is of
+	// type "message".
+	Event string
+
+	// Data is the payload of the event.  It may span several lines.
+	Data string
+
+	// Retry, if positive, tells the client to wait that many
+	// milliseconds before reconnecting should the stream be lost.
+	Retry int
+}
+
+// WriteTo writes e to w in the event stream format.
+func (e *Event) WriteTo(w io.Writer) (n int64, err os.Error) {
+	b := make([]byte, 0, len(e.Data)+32)
+	b = appendField(b, "id", e.Id)
+	b = appendField(b, "event", e.Event)
+	if e.Retry > 0 {
+		b = appendField(b, "retry", strconv.Itoa(e.Retry))
+	}
+	for _, line := range strings.Split(e.Data, "\n", -1) {
+		b = appendField(b, "data", line)
+	}
+	b = append(b, '\n')
+	m, err := w.Write(b)
+	return int64(m), err
+}
+
+// appendField appends a line giving field the value to b, unless
+// the value is empty.  The value must not contain a line break.
+func appendField(b []byte, field, value string) []byte {
+	if value == "" && field != "data" {
+		return b
+	}
+	// Line breaks cannot be represented in a field but data.
+	value = strings.Map(func(c int) int {
+		if c == '\r' || c == '\n' {
+			return ' '
+		}
+		return c
+	}, value)
+	b = append(b, []byte(field)...)
+	b = append(b, ':', ' ')
+	b = append(b, []byte(value)...)
+	return append(b, '\n')
+}
+
+const (
+	// DefaultBufferSize is the number of events with an Id kept for
+	// replay by a Server whose BufferSize is zero.
+	DefaultBufferSize = 100
+
+	// DefaultQueueSize is the number of events that may wait to be
+	// sent to a subscriber of a Server whose QueueSize is zero.
+	DefaultQueueSize = 64
+
+	// DefaultKeepAlive is the KeepAlive interval of a Server for
+	// which it is zero.
+	DefaultKeepAlive = 15e9 // 15 seconds
+)
+
+// A Server is an http.Handler that streams the events published on
+// it to each of its subscribers, the clients of its requests.  The
+// zero value for Server is a valid Server with no subscribers.
+//
+// A request with a Last-Event-ID header is first sent the buffered
+// events published after the event with that Id.  A subscriber that
+// falls more than QueueSize events behind is disconnected, so that
+// it can reconnect and catch up from the buffer.
+type Server struct {
+	// BufferSize is the number of recent events with an Id kept
+	// for replay.  If zero, DefaultBufferSize is used; if
+	// negative, no events are kept.
+	BufferSize int
+
+	// QueueSize is the number of events that may wait to be sent
+	// to a subscriber.  If zero, DefaultQueueSize is used.
+	QueueSize int
+
+	// KeepAlive is the interval, in nanoseconds, at which a
+	// comment is sent to idle subscribers, so that proxies do not
+	// close their connections.  If zero, DefaultKeepAlive is used;
+	// if negative, no comments are sent.
+	KeepAlive int64
+
+	// Retry, if positive, is sent to each new subscriber as the
+	// number of milliseconds to wait before reconnecting.
+	Retry int
+
+	mu     sync.Mutex
+	subs   map[*subscriber]bool
+	buf    []*Event // events kept for replay, oldest first
+	closed bool
+}
+
+type subscriber struct {
+	events chan *Event
+	done   chan bool // closed to disconnect the subscriber
+}
+
+func (s *Server) bufferSize() int {
+	if s.BufferSize != 0 {
+		return s.BufferSize
+	}
+	return DefaultBufferSize
+}
+
+func (s *Server) queueSize() int {
+	if s.QueueSize > 0 {
+		return s.QueueSize
+	}
+	return DefaultQueueSize
+}
+
+func (s *Server) keepAlive() int64 {
+	if s.KeepAlive != 0 {
+		return s.KeepAlive
+	}
+	return DefaultKeepAlive
+}
+
+// Publish sends e to every subscriber, and keeps it for replay if
+// it has an Id.  e must not be modified afterwards.
+func (s *Server) Publish(e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if e.Id != "" {
+		if max := s.bufferSize(); max > 0 {
+			if len(s.buf) >= max {
+				copy(s.buf, s.buf[len(s.buf)-max+1:])
+				s.buf = s.buf[:max-1]
+			}
+			s.buf = append(s.buf, e)
+		}
+	}
+	for sub := range s.subs {
+		select {
+		case sub.events <- e:
+		default:
+			// Too far behind.
+			s.unsubscribeLocked(sub)
+		}
+	}
+}
+
+// NumSubscribers returns the number of subscribers connected.
+func (s *Server) NumSubscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs)
+}
+
+// Close disconnects all subscribers, and makes the Server refuse
+// new ones with 503 Service Unavailable.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for sub := range s.subs {
+		s.unsubscribeLocked(sub)
+	}
+}
+
+// subscribe adds a subscriber, returning it and the events it is
+// to be sent first, those published after the event lastId.
+func (s *Server) subscribe(lastId string) (sub *subscriber, replay []*Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, nil
+	}
+	if lastId != "" {
+		// If lastId is no longer buffered, send all there is.
+		replay = s.buf
+		for i, e := range s.buf {
+			if e.Id == lastId {
+				replay = s.buf[i+1:]
+			}
+		}
+		replay = append([]*Event(nil), replay...)
+	}
+	sub = &subscriber{
+		events: make(chan *Event, s.queueSize()),
+		done:   make(chan bool),
+	}
+	if s.subs == nil {
+		s.subs = make(map[*subscriber]bool)
+	}
+	s.subs[sub] = true
+	return sub, replay
+}
+
+func (s *Server) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unsubscribeLocked(sub)
+}
+
+func (s *Server) unsubscribeLocked(sub *subscriber) {
+	if s.subs[sub] {
+		s.subs[sub] = false, false
+		close(sub.done)
+	}
+}
+
+// ServeHTTP streams events to the client of req until it
+// disconnects or is disconnected.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sub, replay := s.subscribe(req.Header.Get("Last-Event-Id"))
+	if sub == nil {
+		http.Error(w, "event stream closed", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.unsubscribe(sub)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if s.Retry > 0 {
+		io.WriteString(w, "retry: "+strconv.Itoa(s.Retry)+"\n\n")
+	}
+	for _, e := range replay {
+		if _, err := e.WriteTo(w); err != nil {
+			return
+		}
+	}
+	f.Flush()
+
+	var tick <-chan int64
+	if ka := s.keepAlive(); ka > 0 {
+		ticker := time.NewTicker(ka)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		var err os.Error
+		select {
+		case e := <-sub.events:
+			_, err = e.WriteTo(w)
+		case <-tick:
+			_, err = io.WriteString(w, ":\n\n")
+		case <-sub.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+		f.Flush()
+	}
+}
+
+// A Decoder reads events from an event stream.
+type Decoder struct {
+	r      *bufio.Reader
+	c      io.Closer // or nil
+	lastId string
+	retry  int
+}
+
+// NewDecoder returns a Decoder reading events from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Subscribe requests the event stream at url with client, or
+// http.DefaultClient if client is nil, and returns a Decoder of the
+// events it sends.  If lastId is not empty, it is sent as the Id of
+// the last event received, so that the stream resumes after it.
+// The caller must Close the Decoder when done with it.
+func Subscribe(client *http.Client, url, lastId string) (*Decoder, os.Error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastId != "" {
+		req.Header.Set("Last-Event-Id", lastId)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, os.NewError("eventsource: " + url + ": unexpected status " + res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		res.Body.Close()
+		return nil, os.NewError("eventsource: " + url + ": unexpected Content-Type " + strconv.Quote(ct))
+	}
+	d := NewDecoder(res.Body)
+	d.c = res.Body
+	d.lastId = lastId
+	return d, nil
+}
+
+// Close closes the response body of a Decoder returned by Subscribe.
+func (d *Decoder) Close() os.Error {
+	if d.c == nil {
+		return nil
+	}
+	return d.c.Close()
+}
+
+// LastId returns the Id of the last event decoded, with which a
+// client resumes the stream on reconnecting.
+func (d *Decoder) LastId() string {
+	return d.lastId
+}
+
+// Retry returns the number of milliseconds the server last asked
+// its clients to wait before reconnecting, or zero if it has not.
+func (d *Decoder) Retry() int {
+	return d.retry
+}
+
+// Decode reads the next event from the stream.  An event without an
+// id field is given the Id of the one before, as EventSource does.
+// At the end of the stream, Decode returns os.EOF.
+func (d *Decoder) Decode() (*Event, os.Error) {
+	var e Event
+	var data []string
+	for {
+		line, err := d.r.ReadString('\n')
+		if err == os.EOF && line != "" {
+			// An incomplete event at the end of the
+			// stream is discarded.
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if data == nil {
+				// Nothing to dispatch.
+				e = Event{}
+				continue
+			}
+			e.Id = d.lastId
+			e.Data = strings.Join(data, "\n")
+			return &e, nil
+		}
+		if line[0] == ':' {
+			// Comment.
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], line[i+1:]
+			if strings.HasPrefix(value, " ") {
+				value = value[1:]
+			}
+		}
+		switch field {
+		case "id":
+			if strings.Index(value, "\x00") < 0 {
+				d.lastId = value
+			}
+		case "event":
+			e.Event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				e.Retry, d.retry = n, n
+			}
+		}
+	}
+	panic("unreachable")
+}
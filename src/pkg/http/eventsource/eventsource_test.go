@@ -0,0 +1,193 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"bytes"
+	"http/httptest"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var writeToTests = []struct {
+	e    Event
+	want string
+}{
+	{Event{Data: "hello"}, "data: hello\n\n"},
+	{Event{Data: ""}, "data: \n\n"},
+	{Event{Id: "7", Event: "update", Data: "a\nb"}, "id: 7\nevent: update\ndata: a\ndata: b\n\n"},
+	{Event{Retry: 3000, Data: "x"}, "retry: 3000\ndata: x\n\n"},
+	{Event{Id: "bad\nid", Data: "x"}, "id: bad id\ndata: x\n\n"},
+}
+
+func TestEventWriteTo(t *testing.T) {
+	for i, tt := range writeToTests {
+		var buf bytes.Buffer
+		n, err := tt.e.WriteTo(&buf)
+		if err != nil {
+			t.Errorf("%d. WriteTo: %v", i, err)
+		}
+		if g := buf.String(); g != tt.want || n != int64(len(g)) {
+			t.Errorf("%d. WriteTo wrote %q (n=%d); want %q", i, g, n, tt.want)
+		}
+	}
+}
+
+const testStream = ": a comment\n" +
+	"retry: 5000\n" +
+	"\n" +
+	"data: first\n" +
+	"\n" +
+	"id: 1\r\n" +
+	"event: multi\r\n" +
+	"data:line one\r\n" +
+	"data: line two\r\n" +
+	"\r\n" +
+	"data: no id\n" +
+	"unknown: field\n" +
+	"\n" +
+	"id: 2\n" +
+	"\n" +
+	"data\n" +
+	"\n"
+
+var decodeWant = []Event{
+	{Data: "first"},
+	{Id: "1", Event: "multi", Data: "line one\nline two"},
+	{Id: "1", Data: "no id"},
+	{Id: "2", Data: ""},
+}
+
+func TestDecoder(t *testing.T) {
+	d := NewDecoder(strings.NewReader(testStream))
+	for i, want := range decodeWant {
+		e, err := d.Decode()
+		if err != nil {
+			t.Fatalf("%d. Decode: %v", i, err)
+		}
+		if !reflect.DeepEqual(*e, want) {
+			t.Errorf("%d. Decode = %+v; want %+v", i, *e, want)
+		}
+	}
+	if _, err := d.Decode(); err != os.EOF {
+		t.Errorf("at end, Decode error = %v; want EOF", err)
+	}
+	if d.Retry() != 5000 {
+		t.Errorf("Retry = %d; want 5000", d.Retry())
+	}
+	if d.LastId() != "2" {
+		t.Errorf("LastId = %q; want %q", d.LastId(), "2")
+	}
+
+	d = NewDecoder(strings.NewReader("data: cut off"))
+	if _, err := d.Decode(); err != io.ErrUnexpectedEOF {
+		t.Errorf("on truncated stream, Decode error = %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// waitSubscribers waits for s to have n subscribers.
+func waitSubscribers(t *testing.T, s *Server, n int) {
+	for i := 0; s.NumSubscribers() != n; i++ {
+		if i == 200 {
+			t.Fatalf("have %d subscribers; want %d", s.NumSubscribers(), n)
+		}
+		time.Sleep(10e6)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := &Server{BufferSize: 2, Retry: 1000}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	s.Publish(&Event{Id: "1", Data: "one"})
+	s.Publish(&Event{Data: "not kept"})
+	s.Publish(&Event{Id: "2", Data: "two"})
+	s.Publish(&Event{Id: "3", Data: "three"})
+
+	d, err := Subscribe(nil, ts.URL, "2")
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer d.Close()
+	waitSubscribers(t, s, 1)
+	s.Publish(&Event{Id: "4", Event: "live", Data: "four\nlines"})
+
+	for _, want := range []Event{
+		{Id: "3", Data: "three"},
+		{Id: "4", Event: "live", Data: "four\nlines"},
+	} {
+		e, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if !reflect.DeepEqual(*e, want) {
+			t.Errorf("Decode = %+v; want %+v", *e, want)
+		}
+	}
+	if d.Retry() != 1000 {
+		t.Errorf("Retry = %d; want 1000", d.Retry())
+	}
+
+	// An Id no longer buffered replays all that is.
+	d2, err := Subscribe(nil, ts.URL, "1")
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer d2.Close()
+	for _, id := range []string{"3", "4"} {
+		e, err := d2.Decode()
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if e.Id != id {
+			t.Errorf("replayed event %q; want %q", e.Id, id)
+		}
+	}
+
+	s.Close()
+	if _, err := d.Decode(); err != os.EOF {
+		t.Errorf("after Close, Decode error = %v; want EOF", err)
+	}
+	if _, err := Subscribe(nil, ts.URL, ""); err == nil {
+		t.Errorf("Subscribe to closed Server succeeded")
+	}
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	s := &Server{KeepAlive: 10e6}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	defer s.Close()
+
+	d, err := Subscribe(nil, ts.URL, "")
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer d.Close()
+	line, err := d.r.ReadString('\n')
+	if err != nil || line != ":\n" {
+		t.Errorf("read %q, %v; want keep-alive comment", line, err)
+	}
+}
+
+func TestServerDropsSlowSubscriber(t *testing.T) {
+	s := &Server{QueueSize: 1}
+	sub, _ := s.subscribe("")
+	s.Publish(&Event{Data: "1"})
+	s.Publish(&Event{Data: "2"})
+	select {
+	case <-sub.done:
+	default:
+		t.Errorf("subscriber behind by more than QueueSize not disconnected")
+	}
+	if n := s.NumSubscribers(); n != 0 {
+		t.Errorf("NumSubscribers = %d; want 0", n)
+	}
+}
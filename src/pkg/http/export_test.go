@@ -33,6 +33,12 @@ func (t *Transport) IdleConnCountForTesting(cacheKey string) int {
 	return len(conns)
 }
 
+func (t *Transport) OpenConnCountForTesting() int {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.numConns
+}
+
 func NewTestTimeoutHandler(handler Handler, ch <-chan int64) Handler {
 	f := func() <-chan int64 {
 		return ch
@@ -185,12 +185,17 @@ func (c *child) serve() {
 				// TODO(eds): This blocks until the handler reads from the pipe.
 				// If the handler takes a long time, it might be a problem.
 				req.pw.Write(content)
-			} else if req.pw != nil {
-				req.pw.Close()
+			} else {
+				if req.pw != nil {
+					req.pw.Close()
+				}
+				// The request has been read in full, and its
+				// ID may be reused once it has been served.
+				requests[rec.h.Id] = nil, false
 			}
 		case typeGetValues:
 			values := map[string]string{"FCGI_MPXS_CONNS": "1"}
-			c.conn.writePairs(0, typeGetValuesResult, values)
+			c.conn.writePairs(typeGetValuesResult, 0, values)
 		case typeData:
 			// If the filter role is implemented, read the data stream here.
 		case typeAbortRequest:
@@ -0,0 +1,553 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fcgi
+
+// This file implements FastCGI from the perspective of the web server,
+// the parent of the FastCGI application.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"http"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Handler forwards requests to a FastCGI application acting as a
+// responder, listening at Addr on network Net, and copies its
+// responses back to the client, in the way that the Handler of
+// package http/cgi runs a CGI program.  Concurrent requests are
+// multiplexed, each with its own request ID, over a single
+// connection to the application, which is kept open between
+// requests.
+type Handler struct {
+	Net  string // network of the application, such as "tcp" or "unix"
+	Addr string // address of the application
+	Path string // SCRIPT_FILENAME to pass to the application, if any
+	Root string // root URI prefix of handler or empty for "/"
+
+	Env    []string    // extra parameters to pass, if any, as "key=value"
+	Logger *log.Logger // optional log for errors or nil to use log.Print
+
+	// Dial specifies the dial function for connecting to the
+	// application.  If Dial is nil, net.Dial is used.
+	Dial func(net, addr string) (net.Conn, os.Error)
+
+	mu sync.Mutex
+	c  *client // connection to the application, or nil
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	c, err := h.client()
+	if err != nil {
+		rw.WriteHeader(http.StatusBadGateway)
+		h.printf("fcgi: connecting to application: %v", err)
+		return
+	}
+	r, err := c.begin(h.params(req))
+	if err != nil {
+		rw.WriteHeader(http.StatusBadGateway)
+		h.printf("fcgi: sending request: %v", err)
+		return
+	}
+	// Unless the whole response is copied to the client, stop
+	// reading it and have the application end the request.
+	complete := false
+	defer func() {
+		if !complete {
+			r.abort()
+		}
+		if stderr := r.wait(); len(stderr) > 0 {
+			h.printf("fcgi: application error output: %s", stderr)
+		}
+		c.release(r)
+	}()
+	go r.writeStdin(req.Body)
+
+	linebody, _ := bufio.NewReaderSize(r.stdout, 1024)
+	headers := make(http.Header)
+	statusCode := 0
+	for {
+		line, isPrefix, err := linebody.ReadLine()
+		if isPrefix {
+			rw.WriteHeader(http.StatusBadGateway)
+			h.printf("fcgi: long header line from application.")
+			return
+		}
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			h.responseError(rw, r, err)
+			return
+		}
+		if len(line) == 0 {
+			break
+		}
+		parts := strings.Split(string(line), ":", 2)
+		if len(parts) < 2 {
+			h.printf("fcgi: bogus header line: %s", string(line))
+			continue
+		}
+		header, val := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if header == "Status" {
+			if len(val) < 3 {
+				h.printf("fcgi: bogus status (short): %q", val)
+				rw.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			code, err := strconv.Atoi(val[0:3])
+			if err != nil {
+				h.printf("fcgi: bogus status: %q", val)
+				rw.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			statusCode = code
+			continue
+		}
+		headers.Add(header, val)
+	}
+	if statusCode == 0 {
+		if headers.Get("Location") != "" {
+			statusCode = http.StatusFound
+		} else {
+			statusCode = http.StatusOK
+		}
+	}
+	for k, vv := range headers {
+		for _, v := range vv {
+			rw.Header().Add(k, v)
+		}
+	}
+	rw.WriteHeader(statusCode)
+	if _, err = io.Copy(rw, linebody); err != nil {
+		h.printf("fcgi: copy error: %v", err)
+		return
+	}
+	complete = true
+}
+
+// responseError reports the failure of request r, whose response
+// could not be read.
+func (h *Handler) responseError(rw http.ResponseWriter, r *clientRequest, err os.Error) {
+	if err == errOverloaded {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+	h.printf("fcgi: reading response: %v", err)
+}
+
+func (h *Handler) printf(format string, v ...interface{}) {
+	if h.Logger != nil {
+		h.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// client returns the connection to the application, making a new
+// one if there is none or the last has failed.
+func (h *Handler) client() (*client, os.Error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.c != nil && !h.c.broken() {
+		return h.c, nil
+	}
+	dial := h.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	rwc, err := dial(h.Net, h.Addr)
+	if err != nil {
+		return nil, err
+	}
+	h.c = newClient(rwc)
+	return h.c, nil
+}
+
+// params returns the FastCGI parameters for req, which are the
+// environment variables passed by package http/cgi to a CGI program.
+func (h *Handler) params(req *http.Request) map[string]string {
+	root := h.Root
+	if root == "" {
+		root = "/"
+	}
+	pathInfo := req.URL.Path
+	if root != "/" && strings.HasPrefix(pathInfo, root) {
+		pathInfo = pathInfo[len(root):]
+	}
+	port := "80"
+	if req.TLS != nil {
+		port = "443"
+	}
+	if i := strings.LastIndex(req.Host, ":"); i > strings.LastIndex(req.Host, "]") {
+		port = req.Host[i+1:]
+	}
+
+	p := map[string]string{
+		"SERVER_SOFTWARE":   "go",
+		"SERVER_NAME":       req.Host,
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"HTTP_HOST":         req.Host,
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"REQUEST_METHOD":    req.Method,
+		"QUERY_STRING":      req.URL.RawQuery,
+		"REQUEST_URI":       req.URL.RawPath,
+		"PATH_INFO":         pathInfo,
+		"SCRIPT_NAME":       root,
+		"REMOTE_ADDR":       req.RemoteAddr,
+		"REMOTE_HOST":       req.RemoteAddr,
+		"SERVER_PORT":       port,
+	}
+	if h.Path != "" {
+		p["SCRIPT_FILENAME"] = h.Path
+	}
+	if req.TLS != nil {
+		p["HTTPS"] = "on"
+	}
+	if len(req.Cookie) > 0 {
+		b := new(bytes.Buffer)
+		for idx, c := range req.Cookie {
+			if idx > 0 {
+				b.WriteString("; ")
+			}
+			fmt.Fprintf(b, "%s=%s", c.Name, c.Value)
+		}
+		p["HTTP_COOKIE"] = b.String()
+	}
+	if req.UserAgent != "" {
+		p["HTTP_USER_AGENT"] = req.UserAgent
+	}
+	if req.Referer != "" {
+		p["HTTP_REFERER"] = req.Referer
+	}
+	for k, v := range req.Header {
+		k = strings.Map(upperCaseAndUnderscore, k)
+		p["HTTP_"+k] = strings.Join(v, ", ")
+	}
+	if req.ContentLength > 0 {
+		p["CONTENT_LENGTH"] = strconv.Itoa64(req.ContentLength)
+	}
+	if ctype := req.Header.Get("Content-Type"); ctype != "" {
+		p["CONTENT_TYPE"] = ctype
+	}
+	for _, kv := range h.Env {
+		if i := strings.Index(kv, "="); i >= 0 {
+			p[kv[:i]] = kv[i+1:]
+		}
+	}
+	return p
+}
+
+func upperCaseAndUnderscore(rune int) int {
+	switch {
+	case rune >= 'a' && rune <= 'z':
+		return rune - ('a' - 'A')
+	case rune == '-', rune == '=':
+		return '_'
+	}
+	return rune
+}
+
+var (
+	errCantMultiplex = os.NewError("fcgi: application cannot multiplex connection")
+	errOverloaded    = os.NewError("fcgi: application overloaded")
+	errUnknownRole   = os.NewError("fcgi: application does not support responder role")
+	errConnClosed    = os.NewError("fcgi: connection to application closed")
+)
+
+// maxStdoutBuffer is the most output of a request that is held for
+// the handler to read.  Past it, the reading of the connection waits
+// for the handler, holding up the other requests on the connection,
+// rather than letting a slow client fill memory.
+const maxStdoutBuffer = 256 << 10
+
+// client is a connection to a FastCGI application, over which it
+// sends requests.
+type client struct {
+	conn *conn
+
+	mu     sync.Mutex
+	reqs   map[uint16]*clientRequest // requests whose IDs are in use
+	nextId uint16
+	err    os.Error // set once the connection has failed
+}
+
+func newClient(rwc io.ReadWriteCloser) *client {
+	c := &client{conn: newConn(rwc), reqs: make(map[uint16]*clientRequest)}
+	go c.readLoop()
+	return c
+}
+
+// clientRequest holds the state of a request sent by a client.
+type clientRequest struct {
+	c      *client
+	id     uint16
+	stdout *stdoutBuffer // written by readLoop
+	stderr bytes.Buffer  // written by readLoop until done is closed
+	done   chan bool     // closed when the request ends
+	ended  bool          // the request has ended; guarded by c.mu
+}
+
+// A stdoutBuffer holds up to maxStdoutBuffer bytes of the stdout
+// stream of a request until the handler reads it, so that readLoop
+// seldom waits on a slow handler and the other requests on the
+// connection are not held up.
+type stdoutBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	err    os.Error // set when the stream ends
+	closed bool     // the reader has stopped reading
+}
+
+func newStdoutBuffer() *stdoutBuffer {
+	b := new(stdoutBuffer)
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *stdoutBuffer) Read(p []byte) (int, os.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() > 0 {
+		// Wake write if it is waiting for room.
+		b.cond.Broadcast()
+		return b.buf.Read(p)
+	}
+	return 0, b.err
+}
+
+// Close stops reading.  Data written afterwards is discarded.
+func (b *stdoutBuffer) Close() os.Error {
+	b.mu.Lock()
+	b.closed = true
+	b.buf.Reset()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	return nil
+}
+
+// write appends p to the stream, first waiting while the buffer is
+// full.
+func (b *stdoutBuffer) write(p []byte) {
+	b.mu.Lock()
+	for b.buf.Len() >= maxStdoutBuffer && !b.closed && b.err == nil {
+		b.cond.Wait()
+	}
+	if !b.closed && b.err == nil {
+		b.buf.Write(p)
+		b.cond.Broadcast()
+	}
+	b.mu.Unlock()
+}
+
+// end ends the stream with err, or with os.EOF if err is nil,
+// once the data already written has been read.
+func (b *stdoutBuffer) end(err os.Error) {
+	if err == nil {
+		err = os.EOF
+	}
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+func (c *client) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// begin starts a new request with the given parameters.
+func (c *client) begin(params map[string]string) (*clientRequest, os.Error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	if len(c.reqs) >= 0xffff {
+		c.mu.Unlock()
+		return nil, errOverloaded
+	}
+	// Find a free request ID; 0 is reserved for management records.
+	for {
+		c.nextId++
+		if _, used := c.reqs[c.nextId]; c.nextId != 0 && !used {
+			break
+		}
+	}
+	r := &clientRequest{c: c, id: c.nextId, stdout: newStdoutBuffer(), done: make(chan bool)}
+	c.reqs[r.id] = r
+	c.mu.Unlock()
+
+	if err := c.conn.writeBeginRequest(r.id, roleResponder, flagKeepConn); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	if err := c.conn.writePairs(typeParams, r.id, params); err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return r, nil
+}
+
+// writeStdin sends body, which may be nil, as the request's stdin stream.
+func (r *clientRequest) writeStdin(body io.ReadCloser) {
+	w := newWriter(r.c.conn, typeStdin, r.id)
+	if body != nil {
+		_, err := io.Copy(w, body)
+		body.Close()
+		if err != nil {
+			// The application cannot be told the body is
+			// incomplete, so give up on the request.
+			r.c.conn.writeRecord(typeAbortRequest, r.id, nil)
+			return
+		}
+	}
+	if err := w.Close(); err != nil {
+		r.c.fail(err)
+	}
+}
+
+// abort stops reading the response to r and, unless r has already
+// ended, asks the application to end it.  Its ID stays in use until
+// release, so the abort cannot reach a later request.
+func (r *clientRequest) abort() {
+	r.stdout.Close()
+	r.c.mu.Lock()
+	active := r.c.reqs[r.id] == r && !r.ended
+	r.c.mu.Unlock()
+	if active {
+		r.c.conn.writeRecord(typeAbortRequest, r.id, nil)
+	}
+}
+
+// wait waits for the request to end and returns its stderr stream.
+func (r *clientRequest) wait() []byte {
+	<-r.done
+	return r.stderr.Bytes()
+}
+
+// readLoop reads the records sent by the application and passes
+// them to the requests they belong to.
+func (c *client) readLoop() {
+	var rec record
+	for {
+		if err := rec.read(c.conn.rwc); err != nil {
+			if err == os.EOF {
+				err = errConnClosed
+			}
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		r := c.reqs[rec.h.Id]
+		if r != nil && r.ended {
+			r = nil
+		}
+		c.mu.Unlock()
+		if r == nil {
+			// Management records, and those for requests
+			// that have ended, are ignored.
+			continue
+		}
+		switch rec.h.Type {
+		case typeStdout:
+			// The end of the stream is marked by the end of
+			// the request.  Once the handler has stopped
+			// reading, the rest of the response is discarded.
+			r.stdout.write(rec.content())
+		case typeStderr:
+			r.stderr.Write(rec.content())
+		case typeEndRequest:
+			var err os.Error
+			switch _, protocolStatus := endRequestStatus(rec.content()); protocolStatus {
+			case statusCantMultiplex:
+				err = errCantMultiplex
+			case statusOverloaded:
+				err = errOverloaded
+			case statusUnknownRole:
+				err = errUnknownRole
+			}
+			c.end(r, err)
+			if err == errCantMultiplex {
+				// Future requests need a new connection.
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// end ends request r, with err if it failed, unless fail has
+// already ended it.
+func (c *client) end(r *clientRequest, err os.Error) {
+	c.mu.Lock()
+	if r.ended {
+		c.mu.Unlock()
+		return
+	}
+	r.ended = true
+	c.mu.Unlock()
+	r.stdout.end(err)
+	close(r.done)
+}
+
+// release frees the ID of request r, which has ended, for reuse.
+func (c *client) release(r *clientRequest) {
+	c.mu.Lock()
+	if c.reqs[r.id] == r {
+		c.reqs[r.id] = nil, false
+	}
+	c.mu.Unlock()
+}
+
+// fail closes the connection after an error, ending the requests
+// in progress with err.
+func (c *client) fail(err os.Error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	var reqs []*clientRequest
+	for _, r := range c.reqs {
+		if !r.ended {
+			r.ended = true
+			reqs = append(reqs, r)
+		}
+	}
+	c.reqs = make(map[uint16]*clientRequest)
+	c.mu.Unlock()
+	c.conn.Close()
+	for _, r := range reqs {
+		r.stdout.end(err)
+		close(r.done)
+	}
+}
+
+// endRequestStatus decodes the body of an end request record.
+func endRequestStatus(content []byte) (appStatus int, protocolStatus uint8) {
+	if len(content) < 5 {
+		return 0, statusRequestComplete
+	}
+	return int(binary.BigEndian.Uint32(content)), content[4]
+}
@@ -0,0 +1,258 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fcgi
+
+import (
+	"bufio"
+	"fmt"
+	"http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// startApp serves h as a FastCGI application on a local TCP port and
+// returns a Handler that forwards requests to it.
+func startApp(t *testing.T, h http.Handler) (*Handler, net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	go Serve(l, h)
+	return &Handler{Net: "tcp", Addr: l.Addr().String(), Root: "/app"}, l
+}
+
+func newHostRequest(t *testing.T, httpreq string) *http.Request {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(httpreq)))
+	if err != nil {
+		t.Fatalf("bogus http request in test: %q", httpreq)
+	}
+	req.RemoteAddr = "1.2.3.4"
+	return req
+}
+
+func TestHandler(t *testing.T) {
+	h, l := startApp(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "path=%s query=%s body=%s foo=%s", r.URL.Path, r.URL.RawQuery, body, r.Header.Get("X-Foo"))
+	}))
+	defer l.Close()
+
+	req := newHostRequest(t, "POST /app/test?a=b HTTP/1.1\r\nHost: example.com\r\n"+
+		"X-Foo: bar\r\nContent-Length: 5\r\n\r\nhello")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusCreated {
+		t.Errorf("Code = %d; want %d", rw.Code, http.StatusCreated)
+	}
+	if g, e := rw.HeaderMap.Get("X-Method"), "POST"; g != e {
+		t.Errorf("X-Method = %q; want %q", g, e)
+	}
+	if g, e := rw.Body.String(), "path=/app/test query=a=b body=hello foo=bar"; g != e {
+		t.Errorf("body = %q; want %q", g, e)
+	}
+}
+
+func TestHandlerMultiplexing(t *testing.T) {
+	h, l := startApp(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path=%s", r.URL.Path)
+	}))
+	defer l.Close()
+
+	const n = 10
+	errc := make(chan string, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			req := newHostRequest(t, fmt.Sprintf("GET /app/%d HTTP/1.1\r\nHost: example.com\r\n\r\n", i))
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if g, e := rw.Body.String(), fmt.Sprintf("path=/app/%d", i); g != e {
+				errc <- fmt.Sprintf("body = %q; want %q", g, e)
+				return
+			}
+			errc <- ""
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errc; err != "" {
+			t.Error(err)
+		}
+	}
+
+	// Request IDs are reused on the connection.
+	req := newHostRequest(t, "GET /app/again HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if g, e := rw.Body.String(), "path=/app/again"; g != e {
+		t.Errorf("body = %q; want %q", g, e)
+	}
+}
+
+func TestHandlerParams(t *testing.T) {
+	h := &Handler{Path: "/srv/index.php", Root: "/app", Env: []string{"FOO=bar"}}
+	req := newHostRequest(t, "GET /app/x/y?q=1 HTTP/1.1\r\nHost: example.com:8080\r\n"+
+		"User-Agent: test\r\nAccept-Language: en\r\n\r\n")
+	p := h.params(req)
+	want := map[string]string{
+		"REQUEST_METHOD":       "GET",
+		"SCRIPT_FILENAME":      "/srv/index.php",
+		"SCRIPT_NAME":          "/app",
+		"PATH_INFO":            "/x/y",
+		"QUERY_STRING":         "q=1",
+		"REQUEST_URI":          "/app/x/y?q=1",
+		"SERVER_PORT":          "8080",
+		"HTTP_USER_AGENT":      "test",
+		"HTTP_ACCEPT_LANGUAGE": "en",
+		"REMOTE_ADDR":          "1.2.3.4",
+		"FOO":                  "bar",
+	}
+	for k, v := range want {
+		if p[k] != v {
+			t.Errorf("%s = %q; want %q", k, p[k], v)
+		}
+	}
+}
+
+func TestHandlerNoApplication(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	h := &Handler{Net: "tcp", Addr: addr}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, newHostRequest(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("Code = %d; want %d", rw.Code, http.StatusBadGateway)
+	}
+}
+
+// blockingRecorder is a ResponseRecorder that reports its header
+// on wroteHeader and whose body writes wait until release is closed.
+type blockingRecorder struct {
+	*httptest.ResponseRecorder
+	wroteHeader chan bool
+	release     chan bool
+}
+
+func (w *blockingRecorder) WriteHeader(code int) {
+	w.ResponseRecorder.WriteHeader(code)
+	w.wroteHeader <- true
+}
+
+func (w *blockingRecorder) Write(p []byte) (int, os.Error) {
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestHandlerSlowClient(t *testing.T) {
+	// A client that is slow to take a response that fits in
+	// the buffer must not hold up the other requests sharing
+	// the connection.
+	big := strings.Repeat("x", maxStdoutBuffer/2)
+	h, l := startApp(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/app/big" {
+			io.WriteString(w, big)
+		} else {
+			io.WriteString(w, "small")
+		}
+	}))
+	defer l.Close()
+
+	slow := &blockingRecorder{httptest.NewRecorder(), make(chan bool, 1), make(chan bool)}
+	done := make(chan bool)
+	go func() {
+		h.ServeHTTP(slow, newHostRequest(t, "GET /app/big HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		done <- true
+	}()
+	<-slow.wroteHeader
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, newHostRequest(t, "GET /app/small HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if g, e := rw.Body.String(), "small"; g != e {
+		t.Errorf("body = %q; want %q", g, e)
+	}
+
+	close(slow.release)
+	<-done
+	if slow.Body.Len() != len(big) {
+		t.Errorf("slow body has %d bytes; want %d", slow.Body.Len(), len(big))
+	}
+}
+
+func TestHandlerConnectionClosed(t *testing.T) {
+	// An application that closes the connection without ending
+	// the request ends it.
+	c, ac := net.Pipe()
+	go func() {
+		var rec record
+		for rec.read(ac) == nil {
+			if rec.h.Type == typeStdin && len(rec.content()) == 0 {
+				break
+			}
+		}
+		newConn(ac).writeRecord(typeStdout, 1, []byte("Content-Type: text/plain\r\n\r\npartial"))
+		ac.Close()
+	}()
+	h := &Handler{Dial: func(net, addr string) (net.Conn, os.Error) { return c, nil }}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, newHostRequest(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if g, e := rw.Body.String(), "partial"; g != e {
+		t.Errorf("body = %q; want %q", g, e)
+	}
+	if !h.c.broken() {
+		t.Errorf("connection not marked broken")
+	}
+}
+
+// failingWriter is a ResponseRecorder whose body writes fail, as
+// when the client has gone away.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingWriter) Write(p []byte) (int, os.Error) {
+	return 0, os.EPIPE
+}
+
+func TestHandlerClientGone(t *testing.T) {
+	// A response that cannot be copied to the client is
+	// aborted.
+	c, ac := net.Pipe()
+	aborted := make(chan bool, 1)
+	go func() {
+		defer ac.Close()
+		var rec record
+		for rec.read(ac) == nil {
+			if rec.h.Type == typeStdin && len(rec.content()) == 0 {
+				break
+			}
+		}
+		conn := newConn(ac)
+		conn.writeRecord(typeStdout, 1, []byte("Content-Type: text/plain\r\n\r\nbody"))
+		if rec.read(ac) == nil && rec.h.Type == typeAbortRequest && rec.h.Id == 1 {
+			aborted <- true
+		}
+		conn.writeEndRequest(1, 0, statusRequestComplete)
+	}()
+	h := &Handler{Dial: func(net, addr string) (net.Conn, os.Error) { return c, nil }}
+
+	h.ServeHTTP(failingWriter{httptest.NewRecorder()}, newHostRequest(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	select {
+	case <-aborted:
+	default:
+		t.Errorf("request not aborted")
+	}
+}
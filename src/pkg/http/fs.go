@@ -10,7 +10,10 @@ import (
 	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
+	"net/textproto"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -18,6 +21,44 @@ import (
 	"utf8"
 )
 
+// A Dir implements FileSystem using the native file system restricted
+// to a specific directory tree.
+//
+// An empty Dir is treated as ".".
+type Dir string
+
+func (d Dir) Open(name string) (File, os.Error) {
+	if filepath.Separator != '/' && strings.IndexRune(name, filepath.Separator) >= 0 {
+		return nil, os.NewError("http: invalid character in file path")
+	}
+	dir := string(d)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name))))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// A FileSystem implements access to a collection of named files.
+// The elements in a file path are separated by slash ('/', U+002F)
+// characters, regardless of host operating system convention.
+type FileSystem interface {
+	Open(name string) (File, os.Error)
+}
+
+// A File is returned by a FileSystem's Open method and can be
+// served by the FileServer implementation.
+type File interface {
+	Close() os.Error
+	Stat() (*os.FileInfo, os.Error)
+	Readdir(count int) ([]os.FileInfo, os.Error)
+	Read([]byte) (int, os.Error)
+	Seek(offset int64, whence int) (int64, os.Error)
+}
+
 // Heuristic: b is text if it is valid UTF-8 and doesn't
 // contain any unprintable ASCII or Unicode characters.
 func isText(b []byte) bool {
@@ -44,7 +85,7 @@ func isText(b []byte) bool {
 	return true
 }
 
-func dirList(w ResponseWriter, f *os.File) {
+func dirList(w ResponseWriter, f File) {
 	fmt.Fprintf(w, "<pre>\n")
 	for {
 		dirs, err := f.Readdir(100)
@@ -63,16 +104,19 @@ func dirList(w ResponseWriter, f *os.File) {
 	fmt.Fprintf(w, "</pre>\n")
 }
 
-func serveFile(w ResponseWriter, r *Request, name string, redirect bool) {
+// name is '/'-separated, not filepath.Separator.
+func serveFile(w ResponseWriter, r *Request, fs FileSystem, name string, redirect bool) {
 	const indexPage = "/index.html"
 
 	// redirect .../index.html to .../
+	// can't use Redirect() because that would make the path absolute,
+	// which would be a problem running under StripPrefix
 	if strings.HasSuffix(r.URL.Path, indexPage) {
-		Redirect(w, r, r.URL.Path[0:len(r.URL.Path)-len(indexPage)+1], StatusMovedPermanently)
+		localRedirect(w, r, "./")
 		return
 	}
 
-	f, err := os.Open(name)
+	f, err := fs.Open(name)
 	if err != nil {
 		// TODO expose actual error?
 		NotFound(w, r)
@@ -93,27 +137,21 @@ func serveFile(w ResponseWriter, r *Request, name string, redirect bool) {
 		url := r.URL.Path
 		if d.IsDirectory() {
 			if url[len(url)-1] != '/' {
-				Redirect(w, r, url+"/", StatusMovedPermanently)
+				localRedirect(w, r, path.Base(url)+"/")
 				return
 			}
 		} else {
 			if url[len(url)-1] == '/' {
-				Redirect(w, r, url[0:len(url)-1], StatusMovedPermanently)
+				localRedirect(w, r, "../"+path.Base(url))
 				return
 			}
 		}
 	}
 
-	if t, _ := time.Parse(TimeFormat, r.Header.Get("If-Modified-Since")); t != nil && d.Mtime_ns/1e9 <= t.Seconds() {
-		w.WriteHeader(StatusNotModified)
-		return
-	}
-	w.Header().Set("Last-Modified", time.SecondsToUTC(d.Mtime_ns/1e9).Format(TimeFormat))
-
 	// use contents of index.html for directory, if present
 	if d.IsDirectory() {
-		index := name + filepath.FromSlash(indexPage)
-		ff, err := os.Open(index)
+		index := name + indexPage
+		ff, err := fs.Open(index)
 		if err == nil {
 			defer ff.Close()
 			dd, err := ff.Stat()
@@ -125,6 +163,21 @@ func serveFile(w ResponseWriter, r *Request, name string, redirect bool) {
 		}
 	}
 
+	// Directory listings change with their contents,
+	// so only files get an entity tag.
+	modtime := d.Mtime_ns / 1e9
+	etag := ""
+	if !d.IsDirectory() {
+		if etag = w.Header().Get("ETag"); etag == "" {
+			etag = fileETag(d)
+			w.Header().Set("ETag", etag)
+		}
+	}
+	w.Header().Set("Last-Modified", time.SecondsToUTC(modtime).Format(TimeFormat))
+	if checkPreconditions(w, r, etag, modtime) {
+		return
+	}
+
 	if d.IsDirectory() {
 		dirList(w, f)
 		return
@@ -136,7 +189,7 @@ func serveFile(w ResponseWriter, r *Request, name string, redirect bool) {
 
 	// If Content-Type isn't set, use the file's extension to find it.
 	if w.Header().Get("Content-Type") == "" {
-		ctype := mime.TypeByExtension(filepath.Ext(name))
+		ctype := mime.TypeByExtension(path.Ext(name))
 		if ctype == "" {
 			// read a chunk to decide between utf-8 text and binary
 			var buf [1024]byte
@@ -154,16 +207,25 @@ func serveFile(w ResponseWriter, r *Request, name string, redirect bool) {
 	}
 
 	// handle Content-Range header.
-	// TODO(adg): handle multiple ranges
-	ranges, err := parseRange(r.Header.Get("Range"), size)
-	if err == nil && len(ranges) > 1 {
-		err = os.ErrorString("multiple ranges not supported")
+	rangeHeader := r.Header.Get("Range")
+	if ir := r.Header.Get("If-Range"); ir != "" && !checkIfRange(ir, etag, modtime) {
+		// The client's copy is out of date; send it all.
+		rangeHeader = ""
 	}
+	ranges, err := parseRange(rangeHeader, size)
 	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
 		Error(w, err.String(), StatusRequestedRangeNotSatisfiable)
 		return
 	}
-	if len(ranges) == 1 {
+	if sumRangesSize(ranges) > size {
+		// The ranges overlap enough to ask for more than the
+		// whole file; send it once instead.
+		ranges = nil
+	}
+	var send func() // writes the body
+	switch {
+	case len(ranges) == 1:
 		ra := ranges[0]
 		if _, err := f.Seek(ra.start, os.SEEK_SET); err != nil {
 			Error(w, err.String(), StatusRequestedRangeNotSatisfiable)
@@ -171,7 +233,30 @@ func serveFile(w ResponseWriter, r *Request, name string, redirect bool) {
 		}
 		size = ra.length
 		code = StatusPartialContent
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.start+ra.length-1, d.Size))
+		w.Header().Set("Content-Range", ra.contentRange(d.Size))
+	case len(ranges) > 1:
+		// Send the ranges as the parts of a multipart/byteranges
+		// message, each with its own Content-Range.
+		ctype := w.Header().Get("Content-Type")
+		size = rangesMIMESize(ranges, ctype, d.Size)
+		code = StatusPartialContent
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		send = func() {
+			for _, ra := range ranges {
+				part, err := mw.CreatePart(ra.mimeHeader(ctype, d.Size))
+				if err != nil {
+					return
+				}
+				if _, err := f.Seek(ra.start, os.SEEK_SET); err != nil {
+					return
+				}
+				if _, err := io.Copyn(part, f, ra.length); err != nil {
+					return
+				}
+			}
+			mw.Close()
+		}
 	}
 
 	w.Header().Set("Accept-Ranges", "bytes")
@@ -182,34 +267,186 @@ func serveFile(w ResponseWriter, r *Request, name string, redirect bool) {
 	w.WriteHeader(code)
 
 	if r.Method != "HEAD" {
-		io.Copyn(w, f, size)
+		if send != nil {
+			send()
+		} else {
+			io.Copyn(w, f, size)
+		}
+	}
+}
+
+// localRedirect gives a Moved Permanently response.
+// It does not convert relative paths to absolute paths like Redirect does.
+func localRedirect(w ResponseWriter, r *Request, newPath string) {
+	if q := r.URL.RawQuery; q != "" {
+		newPath += "?" + q
+	}
+	w.Header().Set("Location", newPath)
+	w.WriteHeader(StatusMovedPermanently)
+}
+
+// fileETag returns the entity tag that serveFile gives a file,
+// made from its modification time and size.
+func fileETag(d *os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", d.Mtime_ns, d.Size)
+}
+
+// checkPreconditions evaluates the conditional request headers of
+// r, as per RFC 2616, for a resource with the given entity tag
+// ("" for none) and modification time in seconds.  If they say
+// that the resource should not be sent, it replies with 304 (Not
+// Modified) or 412 (Precondition Failed) and returns true.
+func checkPreconditions(w ResponseWriter, r *Request, etag string, modtime int64) bool {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatch(im, etag, true) {
+			w.WriteHeader(StatusPreconditionFailed)
+			return true
+		}
+	} else if t, _ := time.Parse(TimeFormat, r.Header.Get("If-Unmodified-Since")); t != nil && modtime > t.Seconds() {
+		w.WriteHeader(StatusPreconditionFailed)
+		return true
+	}
+
+	getOrHead := r.Method == "GET" || r.Method == "HEAD"
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// If-None-Match takes precedence over If-Modified-Since.
+		if !etagListMatch(inm, etag, false) {
+			return false
+		}
+		if getOrHead {
+			writeNotModified(w)
+		} else {
+			w.WriteHeader(StatusPreconditionFailed)
+		}
+		return true
+	}
+	if !getOrHead {
+		return false
 	}
+	if t, _ := time.Parse(TimeFormat, r.Header.Get("If-Modified-Since")); t != nil && modtime <= t.Seconds() {
+		writeNotModified(w)
+		return true
+	}
+	return false
+}
+
+// checkIfRange reports whether the If-Range header value ir, an
+// entity tag or a date, matches the resource, so that a Range
+// request may be honored.
+func checkIfRange(ir, etag string, modtime int64) bool {
+	if t, err := time.Parse(TimeFormat, ir); err == nil {
+		return t.Seconds() == modtime
+	}
+	tag, _ := scanETag(ir)
+	return tag != "" && etagEqual(tag, etag, true)
+}
+
+func writeNotModified(w ResponseWriter) {
+	// A 304 response describes the resource but
+	// carries no body.
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(StatusNotModified)
+}
+
+// etagListMatch reports whether etag matches any of the entity tags
+// in list, an If-Match or If-None-Match header value.  The strong
+// comparison function, under which weak tags match nothing, is used
+// if strong is set.
+func etagListMatch(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		// The resource exists.
+		return true
+	}
+	for {
+		var tag string
+		tag, list = scanETag(list)
+		if tag == "" {
+			return false
+		}
+		if etagEqual(tag, etag, strong) {
+			return true
+		}
+	}
+	panic("not reached")
+}
+
+// etagEqual reports whether the entity tags a and b are equal.
+func etagEqual(a, b string, strong bool) bool {
+	if strings.HasPrefix(a, "W/") {
+		if strong {
+			return false
+		}
+		a = a[2:]
+	}
+	if strings.HasPrefix(b, "W/") {
+		if strong {
+			return false
+		}
+		b = b[2:]
+	}
+	return a != "" && a == b
+}
+
+// scanETag returns the entity tag at the start of s, ignoring
+// leading spaces and commas, and the rest of s following it.
+// It returns an empty tag if s does not start with one.
+func scanETag(s string) (etag, rest string) {
+	s = strings.TrimLeft(s, " \t,")
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) < start+2 || s[start] != '"' {
+		return "", ""
+	}
+	end := strings.Index(s[start+1:], "\"")
+	if end < 0 {
+		return "", ""
+	}
+	end += start + 2
+	return s[:end], s[end:]
 }
 
 // ServeFile replies to the request with the contents of the named file or directory.
+//
+// Requests for a range of the file, or for several ranges, which are
+// sent as a multipart/byteranges message, are honored, as are the
+// conditional request headers If-Match, If-None-Match,
+// If-Modified-Since, If-Unmodified-Since and If-Range.  Files are
+// given an ETag made from their modification time and size, unless
+// the caller has already set one in the response header.
 func ServeFile(w ResponseWriter, r *Request, name string) {
-	serveFile(w, r, name, false)
+	dir, file := filepath.Split(name)
+	serveFile(w, r, Dir(dir), file, false)
 }
 
 type fileHandler struct {
-	root   string
-	prefix string
+	root FileSystem
 }
 
 // FileServer returns a handler that serves HTTP requests
 // with the contents of the file system rooted at root.
-// It strips prefix from the incoming requests before
-// looking up the file name in the file system.
-func FileServer(root, prefix string) Handler { return &fileHandler{root, prefix} }
+//
+// To use the operating system's file system implementation,
+// use http.Dir:
+//
+//	http.Handle("/", http.FileServer(http.Dir("/tmp")))
+//
+// To serve a subtree of the URL space, wrap the handler with
+// StripPrefix.
+func FileServer(root FileSystem) Handler {
+	return &fileHandler{root}
+}
 
 func (f *fileHandler) ServeHTTP(w ResponseWriter, r *Request) {
-	path := r.URL.Path
-	if !strings.HasPrefix(path, f.prefix) {
-		NotFound(w, r)
-		return
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+		r.URL.Path = upath
 	}
-	path = path[len(f.prefix):]
-	serveFile(w, r, filepath.Join(f.root, filepath.FromSlash(path)), true)
+	serveFile(w, r, f.root, path.Clean(upath), true)
 }
 
 // httpRange specifies the byte range to be sent to the client.
@@ -217,6 +454,52 @@ type httpRange struct {
 	start, length int64
 }
 
+// contentRange returns the Content-Range header value of r for a
+// file of the given size.
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// mimeHeader returns the header of r's part in a multipart/byteranges
+// message.
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+func sumRangesSize(ranges []httpRange) (size int64) {
+	for _, ra := range ranges {
+		size += ra.length
+	}
+	return
+}
+
+// rangesMIMESize returns the length of the multipart/byteranges
+// message that serveFile sends for ranges.  The boundaries chosen by
+// multipart.Writer are all the same length, so the framing can be
+// measured with one Writer and sent with another.
+func rangesMIMESize(ranges []httpRange, contentType string, size int64) int64 {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	n := int64(0)
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, size))
+		n += ra.length
+	}
+	mw.Close()
+	return n + int64(cw)
+}
+
+// A countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, os.Error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
 // parseRange parses a Range header string as per RFC 2616.
 func parseRange(s string, size int64) ([]httpRange, os.Error) {
 	if s == "" {
@@ -5,12 +5,16 @@
 package http_test
 
 import (
+	"bytes"
 	"fmt"
 	. "http"
 	"http/httptest"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"os"
 	"testing"
+	"time"
 )
 
 const (
@@ -85,6 +89,35 @@ func TestServeFile(t *testing.T) {
 	}
 }
 
+func TestServeFileRelative(t *testing.T) {
+	// A name with no directory is relative to the
+	// current directory, not the root.
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		ServeFile(w, r, "fs_test.go")
+	}))
+	defer ts.Close()
+
+	file, err := ioutil.ReadFile("fs_test.go")
+	if err != nil {
+		t.Fatal("reading file:", err)
+	}
+	res, err := Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal("reading Body:", err)
+	}
+	if res.StatusCode != StatusOK {
+		t.Fatalf("StatusCode = %d; want %d", res.StatusCode, StatusOK)
+	}
+	if !equal(body, file) {
+		t.Errorf("body mismatch: got %d bytes, want %d", len(body), len(file))
+	}
+}
+
 func TestServeFileContentType(t *testing.T) {
 	const ctype = "icecream/chocolate"
 	override := false
@@ -124,6 +157,248 @@ func TestServeFileWithContentEncoding(t *testing.T) {
 	}
 }
 
+func TestServeFileConditional(t *testing.T) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		ServeFile(w, r, testFile)
+	}))
+	defer ts.Close()
+
+	res, err := Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	etag, lastMod := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if etag == "" || lastMod == "" {
+		t.Fatalf("ETag = %q, Last-Modified = %q; want both set", etag, lastMod)
+	}
+	past := time.SecondsToUTC(0).Format(TimeFormat)
+
+	tests := []struct {
+		method string
+		header map[string]string
+		code   int
+	}{
+		{"GET", map[string]string{"If-None-Match": etag}, StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": `"other", ` + etag}, StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": "W/" + etag}, StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": "*"}, StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": `"other"`}, StatusOK},
+		{"GET", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastMod}, StatusOK},
+		{"GET", map[string]string{"If-Modified-Since": lastMod}, StatusNotModified},
+		{"GET", map[string]string{"If-Modified-Since": past}, StatusOK},
+		{"HEAD", map[string]string{"If-None-Match": etag}, StatusNotModified},
+		{"POST", map[string]string{"If-None-Match": etag}, StatusPreconditionFailed},
+		{"GET", map[string]string{"If-Match": etag}, StatusOK},
+		{"GET", map[string]string{"If-Match": "W/" + etag}, StatusPreconditionFailed},
+		{"GET", map[string]string{"If-Match": `"other"`}, StatusPreconditionFailed},
+		{"GET", map[string]string{"If-Unmodified-Since": lastMod}, StatusOK},
+		{"GET", map[string]string{"If-Unmodified-Since": past}, StatusPreconditionFailed},
+		{"GET", map[string]string{"Range": "bytes=0-4", "If-Range": etag}, StatusPartialContent},
+		{"GET", map[string]string{"Range": "bytes=0-4", "If-Range": lastMod}, StatusPartialContent},
+		{"GET", map[string]string{"Range": "bytes=0-4", "If-Range": `"other"`}, StatusOK},
+		{"GET", map[string]string{"Range": "bytes=0-4", "If-Range": past}, StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := NewRequest(tt.method, ts.URL, nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		res, err := DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.code {
+			t.Errorf("%s with %v: StatusCode = %d; want %d", tt.method, tt.header, res.StatusCode, tt.code)
+		}
+		if res.StatusCode == StatusNotModified && res.Header.Get("ETag") != etag {
+			t.Errorf("%s with %v: 304 response has ETag %q; want %q", tt.method, tt.header, res.Header.Get("ETag"), etag)
+		}
+	}
+}
+
+func TestServeFileCallerETag(t *testing.T) {
+	const etag = `"v1"`
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("ETag", etag)
+		ServeFile(w, r, testFile)
+	}))
+	defer ts.Close()
+
+	req, _ := NewRequest("GET", ts.URL, nil)
+	req.Header.Set("If-None-Match", etag)
+	res, err := DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != StatusNotModified {
+		t.Errorf("StatusCode = %d; want %d", res.StatusCode, StatusNotModified)
+	}
+	if g := res.Header.Get("ETag"); g != etag {
+		t.Errorf("ETag = %q; want %q", g, etag)
+	}
+}
+
+func TestServeFileMultipleRanges(t *testing.T) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		ServeFile(w, r, testFile)
+	}))
+	defer ts.Close()
+	file, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatal("reading file:", err)
+	}
+
+	req, _ := NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Range", "bytes=0-1,5-7,-2")
+	res, body := getBody(t, *req)
+	if res.StatusCode != StatusPartialContent {
+		t.Fatalf("StatusCode = %d; want %d", res.StatusCode, StatusPartialContent)
+	}
+	if res.ContentLength != int64(len(body)) {
+		t.Errorf("ContentLength = %d; body has %d bytes", res.ContentLength, len(body))
+	}
+	mediatype, params := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediatype != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q; want multipart/byteranges", res.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(bytes.NewBuffer(body), params["boundary"])
+	want := []struct{ start, end int }{{0, 2}, {5, 8}, {testFileLength - 2, testFileLength}}
+	for i, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		cr := fmt.Sprintf("bytes %d-%d/%d", w.start, w.end-1, testFileLength)
+		if g := part.Header.Get("Content-Range"); g != cr {
+			t.Errorf("part %d: Content-Range = %q; want %q", i, g, cr)
+		}
+		if g, e := part.Header.Get("Content-Type"), "text/plain; charset=utf-8"; g != e {
+			t.Errorf("part %d: Content-Type = %q; want %q", i, g, e)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("part %d: reading: %v", i, err)
+		}
+		if !equal(data, file[w.start:w.end]) {
+			t.Errorf("part %d: got %q; want %q", i, data, file[w.start:w.end])
+		}
+	}
+	if _, err := mr.NextPart(); err != os.EOF {
+		t.Errorf("after last range: got error %v; want %v", err, os.EOF)
+	}
+}
+
+func TestFileServerStripPrefix(t *testing.T) {
+	ts := httptest.NewServer(StripPrefix("/static/", FileServer(Dir("testdata"))))
+	defer ts.Close()
+	file, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatal("reading file:", err)
+	}
+
+	// The request for "file/" is redirected to "../file",
+	// relative to the unstripped path.
+	for _, path := range []string{"/static/file", "/static/file/"} {
+		res, err := Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != StatusOK || !equal(body, file) {
+			t.Errorf("Get %s: got %d %q; want %d %q", path, res.StatusCode, body, StatusOK, file)
+		}
+	}
+	res, err := Get(ts.URL + "/elsewhere/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != StatusNotFound {
+		t.Errorf("Get outside prefix: StatusCode = %d; want %d", res.StatusCode, StatusNotFound)
+	}
+}
+
+// A memFS is a FileSystem holding files in memory.
+type memFS map[string]string
+
+func (fs memFS) Open(name string) (File, os.Error) {
+	data, ok := fs[name]
+	if !ok {
+		return nil, os.ENOENT
+	}
+	return &memFile{name: name, data: data}, nil
+}
+
+type memFile struct {
+	name, data string
+	off        int64
+}
+
+func (f *memFile) Close() os.Error { return nil }
+
+func (f *memFile) Stat() (*os.FileInfo, os.Error) {
+	return &os.FileInfo{Name: f.name[1:], Size: int64(len(f.data)), Mtime_ns: 1e18}, nil
+}
+
+func (f *memFile) Readdir(int) ([]os.FileInfo, os.Error) { return nil, os.ENOTDIR }
+
+func (f *memFile) Read(p []byte) (int, os.Error) {
+	if f.off >= int64(len(f.data)) {
+		return 0, os.EOF
+	}
+	n := copy(p, f.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, os.Error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += f.off
+	case os.SEEK_END:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, os.EINVAL
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func TestFileServerFileSystem(t *testing.T) {
+	const hello = "hello, world\n"
+	ts := httptest.NewServer(FileServer(memFS{"/hello.txt": hello}))
+	defer ts.Close()
+
+	var req Request
+	req.Header = make(Header)
+	req.Method = "GET"
+	req.URL, _ = ParseURL(ts.URL + "/hello.txt")
+	res, body := getBody(t, req)
+	if string(body) != hello {
+		t.Errorf("body = %q; want %q", body, hello)
+	}
+	if g, e := res.Header.Get("Content-Type"), "text/plain; charset=utf-8"; g != e {
+		t.Errorf("Content-Type = %q; want %q", g, e)
+	}
+
+	req.Header.Set("Range", "bytes=7-11")
+	res, body = getBody(t, req)
+	if res.StatusCode != StatusPartialContent || string(body) != "world" {
+		t.Errorf("range request: got %d %q; want %d %q", res.StatusCode, body, StatusPartialContent, "world")
+	}
+
+	req.URL, _ = ParseURL(ts.URL + "/missing.txt")
+	res, _ = getBody(t, req)
+	if res.StatusCode != StatusNotFound {
+		t.Errorf("missing file: StatusCode = %d; want %d", res.StatusCode, StatusNotFound)
+	}
+}
+
 func getBody(t *testing.T, req Request) (*Response, []byte) {
 	r, err := DefaultClient.Do(&req)
 	if err != nil {
@@ -0,0 +1,267 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A CookieJar manages storage and use of cookies in HTTP requests.
+//
+// Implementations of CookieJar must be safe for concurrent use by multiple
+// goroutines.
+type CookieJar interface {
+	// SetCookies handles the receipt of the cookies in a reply for the
+	// given URL.  It may or may not choose to save the cookies, depending
+	// on the jar's policy and implementation.
+	SetCookies(u *URL, cookies []*Cookie)
+
+	// Cookies returns the cookies to send in a request for the given URL.
+	// It is up to the implementation to honor the standard cookie use
+	// restrictions such as in RFC 6265.
+	Cookies(u *URL) []*Cookie
+}
+
+// A PublicSuffixList reports the public suffix of a domain: the part
+// of the domain under which anyone may register names, such as "com"
+// for "example.com" or "co.uk" for "www.example.co.uk".  A Jar refuses
+// cookies whose Domain attribute names a public suffix, since they
+// would be sent to unrelated sites.
+type PublicSuffixList interface {
+	PublicSuffix(domain string) string
+}
+
+// Jar is an in-memory CookieJar following the storage and retrieval
+// rules of RFC 6265.  The zero value is an empty jar ready to use.
+type Jar struct {
+	// PublicSuffixes, if non-nil, determines which domains are
+	// public suffixes.  If nil, only top-level domains such as
+	// "com" are treated as public suffixes.
+	PublicSuffixes PublicSuffixList
+
+	mu      sync.Mutex
+	entries map[string]*jarEntry // keyed by domain;path;name
+	seq     int64                // creation order of entries
+}
+
+// A jarEntry is a cookie as stored in a Jar.
+type jarEntry struct {
+	name     string
+	value    string
+	domain   string // canonical: lower case, no leading dot
+	path     string
+	hostOnly bool  // send only to domain itself, not its subdomains
+	secure   bool  // send only over https
+	expires  int64 // in seconds since the epoch; 0 for session cookies
+	seq      int64 // creation order, for sorting
+}
+
+func (e *jarEntry) key() string {
+	return e.domain + ";" + e.path + ";" + e.name
+}
+
+// SetCookies implements the SetCookies method of the CookieJar interface.
+// Cookies with an invalid or public-suffix Domain attribute are ignored;
+// cookies that have expired remove any matching cookie from j.
+func (j *Jar) SetCookies(u *URL, cookies []*Cookie) {
+	if len(cookies) == 0 {
+		return
+	}
+	host, ok := canonicalHost(u.Host)
+	if !ok {
+		return
+	}
+	now := time.Seconds()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.entries == nil {
+		j.entries = make(map[string]*jarEntry)
+	}
+	for _, c := range cookies {
+		e, ok := j.newEntry(c, host, u.Path, now)
+		if !ok {
+			continue
+		}
+		key := e.key()
+		if e.expires != 0 && e.expires <= now {
+			j.entries[key] = nil, false
+			continue
+		}
+		if old, ok := j.entries[key]; ok {
+			e.seq = old.seq
+		} else {
+			j.seq++
+			e.seq = j.seq
+		}
+		j.entries[key] = e
+	}
+}
+
+// newEntry converts a cookie received from host for a request with the
+// given path into a jarEntry.  It reports false if the cookie must be
+// rejected.
+func (j *Jar) newEntry(c *Cookie, host, path string, now int64) (e *jarEntry, ok bool) {
+	if c.Name == "" {
+		return nil, false
+	}
+	e = &jarEntry{
+		name:   c.Name,
+		value:  c.Value,
+		secure: c.Secure,
+	}
+
+	switch {
+	case c.MaxAge < 0:
+		e.expires = now - 1
+	case c.MaxAge > 0:
+		e.expires = now + int64(c.MaxAge)
+	case len(c.Expires.Zone) > 0:
+		e.expires = c.Expires.Seconds()
+		if e.expires <= 0 {
+			// Before the epoch; 0 would mean a session cookie.
+			e.expires = now - 1
+		}
+	}
+
+	domain := strings.ToLower(c.Domain)
+	if len(domain) > 0 && domain[0] == '.' {
+		domain = domain[1:]
+	}
+	switch {
+	case domain == "":
+		e.domain, e.hostOnly = host, true
+	case j.isPublicSuffix(domain):
+		// A public suffix may only be used to set a host-only
+		// cookie on the suffix itself.
+		if domain != host {
+			return nil, false
+		}
+		e.domain, e.hostOnly = host, true
+	case !domainMatch(host, domain):
+		return nil, false
+	default:
+		e.domain = domain
+	}
+
+	e.path = c.Path
+	if e.path == "" || e.path[0] != '/' {
+		e.path = defaultCookiePath(path)
+	}
+	return e, true
+}
+
+// Cookies implements the Cookies method of the CookieJar interface.
+// Cookies with longer paths are listed first; among cookies with
+// equal-length paths, those created earlier come first.
+func (j *Jar) Cookies(u *URL) []*Cookie {
+	host, ok := canonicalHost(u.Host)
+	if !ok {
+		return nil
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	secure := u.Scheme == "https"
+	now := time.Seconds()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var matches jarEntryList
+	for key, e := range j.entries {
+		if e.expires != 0 && e.expires <= now {
+			j.entries[key] = nil, false
+			continue
+		}
+		if e.hostOnly && host != e.domain || !e.hostOnly && !domainMatch(host, e.domain) {
+			continue
+		}
+		if !pathMatchCookie(path, e.path) || e.secure && !secure {
+			continue
+		}
+		matches = append(matches, e)
+	}
+	sort.Sort(matches)
+
+	cookies := make([]*Cookie, len(matches))
+	for i, e := range matches {
+		cookies[i] = &Cookie{Name: e.name, Value: e.value}
+	}
+	return cookies
+}
+
+type jarEntryList []*jarEntry
+
+func (l jarEntryList) Len() int      { return len(l) }
+func (l jarEntryList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l jarEntryList) Less(i, j int) bool {
+	if len(l[i].path) != len(l[j].path) {
+		return len(l[i].path) > len(l[j].path)
+	}
+	return l[i].seq < l[j].seq
+}
+
+func (j *Jar) isPublicSuffix(domain string) bool {
+	if j.PublicSuffixes != nil {
+		return j.PublicSuffixes.PublicSuffix(domain) == domain
+	}
+	return strings.Index(domain, ".") < 0
+}
+
+// canonicalHost returns host in lower case with any port removed.
+// It reports false for an empty host.
+func canonicalHost(host string) (string, bool) {
+	if hasPort(host) {
+		var err os.Error
+		if host, _, err = net.SplitHostPort(host); err != nil {
+			return "", false
+		}
+	}
+	host = strings.ToLower(host)
+	if len(host) > 0 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+	return host, host != ""
+}
+
+// domainMatch reports whether host domain-matches domain,
+// per RFC 6265 section 5.1.3.
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	return strings.HasSuffix(host, "."+domain)
+}
+
+// pathMatchCookie reports whether the request path reqPath
+// path-matches cookiePath, per RFC 6265 section 5.1.4.
+func pathMatchCookie(reqPath, cookiePath string) bool {
+	if !strings.HasPrefix(reqPath, cookiePath) {
+		return false
+	}
+	return len(reqPath) == len(cookiePath) ||
+		cookiePath[len(cookiePath)-1] == '/' ||
+		reqPath[len(cookiePath)] == '/'
+}
+
+// defaultCookiePath returns the path used for a cookie without a
+// Path attribute received for a request to path, per RFC 6265
+// section 5.1.4.
+func defaultCookiePath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
@@ -0,0 +1,179 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseURL(s string) *URL {
+	u, err := ParseURL(s)
+	if err != nil {
+		panic("mustParseURL: " + err.String())
+	}
+	return u
+}
+
+// cookieString renders cookies as "a=1 b=2" for comparison.
+func cookieString(cookies []*Cookie) string {
+	s := make([]string, len(cookies))
+	for i, c := range cookies {
+		s[i] = c.Name + "=" + c.Value
+	}
+	return strings.Join(s, " ")
+}
+
+type jarQuery struct {
+	url  string
+	want string
+}
+
+var jarTests = []struct {
+	desc    string
+	fromURL string
+	set     []*Cookie
+	queries []jarQuery
+}{
+	{
+		"host-only cookie",
+		"http://www.example.com/",
+		[]*Cookie{&Cookie{Name: "a", Value: "1"}},
+		[]jarQuery{
+			{"http://www.example.com/", "a=1"},
+			{"http://www.example.com:8080/x/y", "a=1"},
+			{"http://sub.www.example.com/", ""},
+			{"http://example.com/", ""},
+		},
+	},
+	{
+		"domain cookie",
+		"http://www.example.com/",
+		[]*Cookie{&Cookie{Name: "a", Value: "1", Domain: ".example.com"}},
+		[]jarQuery{
+			{"http://www.example.com/", "a=1"},
+			{"http://example.com/", "a=1"},
+			{"http://deep.sub.example.com/", "a=1"},
+			{"http://notexample.com/", ""},
+		},
+	},
+	{
+		"foreign and public suffix domains rejected",
+		"http://www.example.com/",
+		[]*Cookie{
+			&Cookie{Name: "a", Value: "1", Domain: "other.com"},
+			&Cookie{Name: "b", Value: "2", Domain: "com"},
+			&Cookie{Name: "c", Value: "3", Domain: "sub.www.example.com"},
+		},
+		[]jarQuery{
+			{"http://www.example.com/", ""},
+			{"http://other.com/", ""},
+			{"http://x.com/", ""},
+		},
+	},
+	{
+		"path matching",
+		"http://example.com/a/b/c",
+		[]*Cookie{
+			&Cookie{Name: "root", Value: "1", Path: "/"},
+			&Cookie{Name: "dflt", Value: "2"},
+			&Cookie{Name: "ab", Value: "3", Path: "/a/b/"},
+		},
+		[]jarQuery{
+			{"http://example.com/", "root=1"},
+			{"http://example.com/a/b", "dflt=2 root=1"},
+			{"http://example.com/a/b/c", "ab=3 dflt=2 root=1"},
+			{"http://example.com/a/bc", "root=1"},
+		},
+	},
+	{
+		"secure cookie",
+		"https://example.com/",
+		[]*Cookie{&Cookie{Name: "s", Value: "1", Secure: true}},
+		[]jarQuery{
+			{"https://example.com/", "s=1"},
+			{"http://example.com/", ""},
+		},
+	},
+	{
+		"expired cookies",
+		"http://example.com/",
+		[]*Cookie{
+			&Cookie{Name: "old", Value: "1", Expires: *time.SecondsToUTC(time.Seconds() - 60)},
+			&Cookie{Name: "gone", Value: "2", MaxAge: -1},
+			&Cookie{Name: "new", Value: "3", Expires: *time.SecondsToUTC(time.Seconds() + 60)},
+		},
+		[]jarQuery{
+			{"http://example.com/", "new=3"},
+		},
+	},
+	{
+		"IP address host",
+		"http://127.0.0.1:8080/",
+		[]*Cookie{
+			&Cookie{Name: "a", Value: "1"},
+			&Cookie{Name: "b", Value: "2", Domain: "0.0.1"},
+		},
+		[]jarQuery{
+			{"http://127.0.0.1/", "a=1"},
+		},
+	},
+}
+
+func TestJar(t *testing.T) {
+	for _, tt := range jarTests {
+		jar := new(Jar)
+		jar.SetCookies(mustParseURL(tt.fromURL), tt.set)
+		for _, q := range tt.queries {
+			got := cookieString(jar.Cookies(mustParseURL(q.url)))
+			if got != q.want {
+				t.Errorf("%s: Cookies(%q) = %q; want %q", tt.desc, q.url, got, q.want)
+			}
+		}
+	}
+}
+
+func TestJarReplaceAndDelete(t *testing.T) {
+	jar := new(Jar)
+	u := mustParseURL("http://example.com/")
+	jar.SetCookies(u, []*Cookie{
+		&Cookie{Name: "a", Value: "1"},
+		&Cookie{Name: "b", Value: "2"},
+	})
+	jar.SetCookies(u, []*Cookie{&Cookie{Name: "a", Value: "changed"}})
+	if g, e := cookieString(jar.Cookies(u)), "a=changed b=2"; g != e {
+		t.Errorf("after replace, Cookies = %q; want %q", g, e)
+	}
+	jar.SetCookies(u, []*Cookie{&Cookie{Name: "a", MaxAge: -1}})
+	if g, e := cookieString(jar.Cookies(u)), "b=2"; g != e {
+		t.Errorf("after delete, Cookies = %q; want %q", g, e)
+	}
+}
+
+type fixedSuffixList []string
+
+func (l fixedSuffixList) PublicSuffix(domain string) string {
+	for _, s := range l {
+		if domain == s || strings.HasSuffix(domain, "."+s) {
+			return s
+		}
+	}
+	return domain[strings.LastIndex(domain, ".")+1:]
+}
+
+func TestJarPublicSuffixList(t *testing.T) {
+	jar := &Jar{PublicSuffixes: fixedSuffixList{"co.uk"}}
+	jar.SetCookies(mustParseURL("http://www.example.co.uk/"), []*Cookie{
+		&Cookie{Name: "a", Value: "1", Domain: "co.uk"},
+		&Cookie{Name: "b", Value: "2", Domain: "example.co.uk"},
+	})
+	if g, e := cookieString(jar.Cookies(mustParseURL("http://other.co.uk/"))), ""; g != e {
+		t.Errorf("cookies for other.co.uk = %q; want %q", g, e)
+	}
+	if g, e := cookieString(jar.Cookies(mustParseURL("http://example.co.uk/"))), "b=2"; g != e {
+		t.Errorf("cookies for example.co.uk = %q; want %q", g, e)
+	}
+}
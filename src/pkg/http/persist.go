@@ -279,16 +279,25 @@ func (cc *ClientConn) Write(req *Request) (err os.Error) {
 	// Ensure ordered execution of Writes
 	id := cc.pipe.Next()
 	cc.pipe.StartRequest(id)
+	cc.lk.Lock()
+	// Remember the pipeline id of this request before writing it,
+	// so that its response may be read while its body is still
+	// being written.
+	cc.pipereq[req] = id
+	cc.lk.Unlock()
 	defer func() {
 		cc.pipe.EndRequest(id)
 		if err != nil {
-			cc.pipe.StartResponse(id)
-			cc.pipe.EndResponse(id)
-		} else {
-			// Remember the pipeline id of this request
+			// Skip the response, unless a Read has
+			// already claimed it.
 			cc.lk.Lock()
-			cc.pipereq[req] = id
+			_, unread := cc.pipereq[req]
+			cc.pipereq[req] = 0, false
 			cc.lk.Unlock()
+			if unread {
+				cc.pipe.StartResponse(id)
+				cc.pipe.EndResponse(id)
+			}
 		}
 	}()
 
@@ -46,3 +46,30 @@ func TestUseProxy(t *testing.T) {
 		}
 	}
 }
+
+func TestProxyFromEnvironmentAllProxy(t *testing.T) {
+	for _, k := range []string{"HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, "")
+	}
+	os.Setenv("ALL_PROXY", "socks5://gateway:1080")
+
+	req, _ := NewRequest("GET", "http://example.com/", nil)
+	u, err := ProxyFromEnvironment(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || u.Scheme != "socks5" || u.Host != "gateway:1080" {
+		t.Errorf("ProxyFromEnvironment = %v; want socks5://gateway:1080", u)
+	}
+
+	// HTTP_PROXY takes precedence.
+	os.Setenv("HTTP_PROXY", "http://proxy:3128")
+	u, err = ProxyFromEnvironment(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || u.Scheme != "http" || u.Host != "proxy:3128" {
+		t.Errorf("ProxyFromEnvironment = %v; want http://proxy:3128", u)
+	}
+}
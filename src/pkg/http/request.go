@@ -167,6 +167,10 @@ type Request struct {
 	// TLS-enabled connections before invoking a handler;
 	// otherwise it leaves the field nil.
 	TLS *tls.ConnectionState
+
+	// pathValues holds the values of the variables in the ServeMux
+	// pattern that matched the request.
+	pathValues map[string]string
 }
 
 // ProtoAtLeast returns whether the HTTP protocol used
@@ -254,6 +258,19 @@ func (req *Request) WriteProxy(w io.Writer) os.Error {
 	return req.write(w, true)
 }
 
+// requestURI returns the Request-URI with which req is sent, other
+// than to a proxy.
+func (req *Request) requestURI() string {
+	if req.RawURL != "" {
+		return req.RawURL
+	}
+	uri := valueOrDefault(urlEscape(req.URL.Path, encodePath), "/")
+	if req.URL.RawQuery != "" {
+		uri += "?" + req.URL.RawQuery
+	}
+	return uri
+}
+
 func (req *Request) write(w io.Writer, usingProxy bool) os.Error {
 	host := req.Host
 	if host == "" {
@@ -263,18 +280,12 @@ func (req *Request) write(w io.Writer, usingProxy bool) os.Error {
 		host = req.URL.Host
 	}
 
-	uri := req.RawURL
-	if uri == "" {
-		uri = valueOrDefault(urlEscape(req.URL.Path, encodePath), "/")
-		if req.URL.RawQuery != "" {
-			uri += "?" + req.URL.RawQuery
-		}
-		if usingProxy {
-			if uri == "" || uri[0] != '/' {
-				uri = "/" + uri
-			}
-			uri = req.URL.Scheme + "://" + host + uri
+	uri := req.requestURI()
+	if req.RawURL == "" && usingProxy {
+		if uri[0] != '/' {
+			uri = "/" + uri
 		}
+		uri = req.URL.Scheme + "://" + host + uri
 	}
 
 	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", valueOrDefault(req.Method, "GET"), uri)
@@ -675,6 +686,70 @@ func parseQuery(m Values, query string) (err os.Error) {
 	return err
 }
 
+// ErrBodyTooLarge is returned by the Read method of a reader
+// returned by MaxBytesReader once its limit has been exceeded.
+var ErrBodyTooLarge = os.NewError("http: request body too large")
+
+// MaxBytesReader is similar to io.LimitReader but is intended for
+// limiting the size of incoming request bodies. In contrast to
+// io.LimitReader, MaxBytesReader's result is a ReadCloser, returns
+// ErrBodyTooLarge for a Read beyond the limit, and closes the
+// underlying reader when its Close method is called.
+//
+// MaxBytesReader prevents clients from accidentally or maliciously
+// sending a large request and wasting server resources.  When the
+// limit is hit, and the MaxBytesReader has replaced the Body of the
+// request being served, as in r.Body = MaxBytesReader(w, r.Body, n),
+// the connection is closed after the response, which carries a
+// "Connection: close" header if it has not yet been written.
+func MaxBytesReader(w ResponseWriter, r io.ReadCloser, n int64) io.ReadCloser {
+	return &maxBytesReader{r: r, n: n}
+}
+
+type maxBytesReader struct {
+	r   io.ReadCloser // underlying reader
+	n   int64         // max bytes remaining
+	err os.Error      // sticky error
+}
+
+func (l *maxBytesReader) Read(p []byte) (n int, err os.Error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Read one byte more than the limit allows, to tell a body
+	// that ends at the limit from one that goes beyond it.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err = l.r.Read(p)
+	if int64(n) <= l.n {
+		l.n -= int64(n)
+		l.err = err
+		return n, err
+	}
+	n = int(l.n)
+	l.n = 0
+	l.err = ErrBodyTooLarge
+	return n, l.err
+}
+
+func (l *maxBytesReader) Close() os.Error {
+	if l.err == nil {
+		// Closing the underlying reader may consume the rest of
+		// the body, so read what the limit allows first.
+		io.Copy(ioutil.Discard, l)
+	}
+	if l.err == ErrBodyTooLarge {
+		// The rest of the body is left unread; the server
+		// sees the error and closes the connection instead.
+		return nil
+	}
+	return l.r.Close()
+}
+
 // ParseForm parses the raw query.
 // For POST requests, it also parses the request body as a form.
 // ParseMultipartForm calls ParseForm automatically.
@@ -770,6 +845,13 @@ func (r *Request) FormValue(key string) string {
 	return ""
 }
 
+// PathValue returns the value of the named variable in the ServeMux
+// pattern that matched r, or the empty string if there is no such
+// variable.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
 // FormFile returns the first file for the provided form key.
 // FormFile calls ParseMultipartForm and ParseForm if necessary.
 func (r *Request) FormFile(key string) (multipart.File, *multipart.FileHeader, os.Error) {
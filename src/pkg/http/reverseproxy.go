@@ -10,7 +10,10 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 // ReverseProxy is an HTTP Handler that takes an incoming request and
@@ -20,12 +23,33 @@ type ReverseProxy struct {
 	// Director must be a function which modifies
 	// the request into a new request to be sent
 	// using Transport. Its response is then copied
-	// back to the original client unmodified.
+	// back to the original client, modified only by
+	// ModifyResponse.
+	// Director may be nil if Backends is set.
 	Director func(*Request)
 
+	// Backends, if non-nil, is the set of servers among which
+	// requests are balanced.  After Director has been called, the
+	// request's URL is rewritten to the backend chosen for it, as
+	// by NewSingleHostReverseProxy.  Requests with idempotent
+	// methods that fail because the chosen backend cannot be
+	// connected to are retried on another.
+	Backends *BackendPool
+
 	// The Transport used to perform proxy requests.
 	// If nil, DefaultTransport is used.
 	Transport RoundTripper
+
+	// FlushInterval specifies the interval, in nanoseconds, at
+	// which to flush to the client while copying the response
+	// body.  If zero, no periodic flushing is done.
+	FlushInterval int64
+
+	// ModifyResponse, if non-nil, is called with the response
+	// from the backend before it is copied to the client.  If it
+	// returns an error, the client is sent a 502 Bad Gateway
+	// response instead.
+	ModifyResponse func(*Response) os.Error
 }
 
 func singleJoiningSlash(a, b string) string {
@@ -40,25 +64,86 @@ func singleJoiningSlash(a, b string) string {
 	return a + b
 }
 
+// directTo rewrites the URL of req to the scheme, host, and base
+// path provided in target.
+func directTo(req *Request, target *URL) {
+	u := new(URL)
+	*u = *req.URL
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	u.Path = singleJoiningSlash(target.Path, u.Path)
+	if q := u.RawQuery; q != "" {
+		u.RawPath = u.Path + "?" + q
+	} else {
+		u.RawPath = u.Path
+	}
+	u.RawQuery = target.RawQuery
+	req.URL = u
+}
+
 // NewSingleHostReverseProxy returns a new ReverseProxy that rewrites
 // URLs to the scheme, host, and base path provided in target. If the
 // target's path is "/base" and the incoming request was for "/dir",
 // the target request will be for /base/dir.
 func NewSingleHostReverseProxy(target *URL) *ReverseProxy {
 	director := func(req *Request) {
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
-		if q := req.URL.RawQuery; q != "" {
-			req.URL.RawPath = req.URL.Path + "?" + q
-		} else {
-			req.URL.RawPath = req.URL.Path
-		}
-		req.URL.RawQuery = target.RawQuery
+		directTo(req, target)
 	}
 	return &ReverseProxy{Director: director}
 }
 
+// NewLoadBalancingReverseProxy returns a new ReverseProxy that
+// balances requests among targets, rewriting their URLs in the same
+// way as NewSingleHostReverseProxy.
+func NewLoadBalancingReverseProxy(policy BalancePolicy, targets ...*URL) *ReverseProxy {
+	return &ReverseProxy{Backends: NewBackendPool(policy, targets...)}
+}
+
+// Hop-by-hop headers.  These are removed when sent to the backend,
+// and from the backend's response.
+// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te", // canonicalized version of "TE"
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including
+// those named by its Connection header.
+func removeHopHeaders(h Header) {
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",", -1) {
+			if f = strings.TrimSpace(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// isIdempotent reports whether requests with the given method may
+// safely be sent more than once.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// isDialError reports whether err is a failure to connect.
+func isDialError(err os.Error) bool {
+	oe, ok := err.(*net.OpError)
+	return ok && oe.Op == "dial"
+}
+
 func (p *ReverseProxy) ServeHTTP(rw ResponseWriter, req *Request) {
 	transport := p.Transport
 	if transport == nil {
@@ -68,22 +153,50 @@ func (p *ReverseProxy) ServeHTTP(rw ResponseWriter, req *Request) {
 	outreq := new(Request)
 	*outreq = *req // includes shallow copies of maps, but okay
 
-	p.Director(outreq)
+	// The header is modified by the proxy, and perhaps by
+	// Director, so copy it rather than change the incoming
+	// request's.
+	outreq.Header = make(Header)
+	for k, vv := range req.Header {
+		outreq.Header[k] = append([]string(nil), vv...)
+	}
+
+	if p.Director != nil {
+		p.Director(outreq)
+	}
 	outreq.Proto = "HTTP/1.1"
 	outreq.ProtoMajor = 1
 	outreq.ProtoMinor = 1
 	outreq.Close = false
+	removeHopHeaders(outreq.Header)
 
 	if clientIp, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		// Add the client to the list of proxies the request has
+		// already passed through, if any.
+		if prior, ok := outreq.Header["X-Forwarded-For"]; ok {
+			clientIp = strings.Join(prior, ", ") + ", " + clientIp
+		}
 		outreq.Header.Set("X-Forwarded-For", clientIp)
 	}
 
-	res, err := transport.RoundTrip(outreq)
+	res, err := p.roundTrip(transport, outreq)
 	if err != nil {
 		log.Printf("http: proxy error: %v", err)
-		rw.WriteHeader(StatusInternalServerError)
+		rw.WriteHeader(StatusBadGateway)
 		return
 	}
+	if res.Body != nil {
+		defer res.Body.Close()
+	}
+
+	removeHopHeaders(res.Header)
+	if p.ModifyResponse != nil {
+		if err := p.ModifyResponse(res); err != nil {
+			log.Printf("http: proxy error: %v", err)
+			rw.WriteHeader(StatusBadGateway)
+			return
+		}
+	}
 
 	hdr := rw.Header()
 	for k, vv := range res.Header {
@@ -99,6 +212,219 @@ func (p *ReverseProxy) ServeHTTP(rw ResponseWriter, req *Request) {
 	rw.WriteHeader(res.StatusCode)
 
 	if res.Body != nil {
-		io.Copy(rw, res.Body)
+		var dst io.Writer = rw
+		if p.FlushInterval != 0 {
+			if wf, ok := rw.(writeFlusher); ok {
+				mlw := &maxLatencyWriter{dst: wf, latency: p.FlushInterval, done: make(chan bool)}
+				go mlw.flushLoop()
+				defer mlw.stop()
+				dst = mlw
+			}
+		}
+		io.Copy(dst, res.Body)
+	}
+}
+
+// roundTrip sends outreq, to one of p's backends if it has them.
+func (p *ReverseProxy) roundTrip(transport RoundTripper, outreq *Request) (*Response, os.Error) {
+	if p.Backends == nil {
+		return transport.RoundTrip(outreq)
+	}
+	tried := make(map[*backend]bool)
+	for {
+		b := p.Backends.pick(tried)
+		if b == nil {
+			return nil, ErrNoBackend
+		}
+		tried[b] = true
+		req := new(Request)
+		*req = *outreq
+		directTo(req, b.url)
+		res, err := transport.RoundTrip(req)
+		if err == nil {
+			if res.Body == nil {
+				p.Backends.done(b, true)
+			} else {
+				res.Body = &backendBody{ReadCloser: res.Body, pool: p.Backends, b: b}
+			}
+			return res, nil
+		}
+		dialFailed := isDialError(err)
+		p.Backends.done(b, !dialFailed)
+		if !dialFailed || !isIdempotent(outreq.Method) {
+			return nil, err
+		}
+	}
+	panic("not reached")
+}
+
+type writeFlusher interface {
+	io.Writer
+	Flusher
+}
+
+// A maxLatencyWriter flushes what is written to it at least every
+// latency nanoseconds.
+type maxLatencyWriter struct {
+	dst     writeFlusher
+	latency int64
+
+	lk   sync.Mutex // protects Write + Flush
+	done chan bool
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (int, os.Error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.dst.Write(p)
+}
+
+func (m *maxLatencyWriter) flushLoop() {
+	t := time.NewTicker(m.latency)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.lk.Lock()
+			m.dst.Flush()
+			m.lk.Unlock()
+		case <-m.done:
+			return
+		}
+	}
+	panic("unreached")
+}
+
+func (m *maxLatencyWriter) stop() { m.done <- true }
+
+// ErrNoBackend is returned by a ReverseProxy with Backends when
+// no backend is available to try.
+var ErrNoBackend = os.NewError("http: no backend available")
+
+// BalancePolicy is a policy by which a BackendPool chooses a backend.
+type BalancePolicy int
+
+const (
+	// RoundRobin chooses each backend in turn.
+	RoundRobin BalancePolicy = iota
+	// LeastConnections chooses the backend with the fewest
+	// requests in progress, taking those with equally few in turn.
+	LeastConnections
+)
+
+// DefaultFailTimeout is the FailTimeout of a BackendPool for which
+// it is zero.
+const DefaultFailTimeout = 10e9 // 10 seconds
+
+// A BackendPool is a set of backend servers among which a
+// ReverseProxy balances requests.
+//
+// The pool checks the health of its backends passively: a backend
+// that cannot be connected to is considered down, and is not chosen
+// again for FailTimeout nanoseconds unless all the backends are down.
+type BackendPool struct {
+	Policy      BalancePolicy
+	FailTimeout int64 // if zero, DefaultFailTimeout is used
+
+	mu       sync.Mutex
+	backends []*backend
+	next     int // index of the next backend to try first
+}
+
+type backend struct {
+	url      *URL
+	active   int   // requests in progress
+	downTill int64 // time until which it is considered down
+}
+
+// NewBackendPool returns a new BackendPool of the given targets.
+func NewBackendPool(policy BalancePolicy, targets ...*URL) *BackendPool {
+	p := &BackendPool{Policy: policy}
+	for _, u := range targets {
+		p.backends = append(p.backends, &backend{url: u})
+	}
+	return p
+}
+
+// pick chooses a backend, not in tried, for a request, and counts
+// the request as in progress on it.  It returns nil if every backend
+// has been tried.
+func (p *BackendPool) pick(tried map[*backend]bool) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Nanoseconds()
+	var best *backend
+	bestUp := false
+	n := len(p.backends)
+	for i := 0; i < n; i++ {
+		b := p.backends[(p.next+i)%n]
+		if tried[b] {
+			continue
+		}
+		up := b.downTill <= now
+		better := false
+		switch {
+		case best == nil:
+			better = true
+		case up != bestUp:
+			better = up
+		case !up:
+			// Of backends that are down, prefer the one
+			// that has been down longest.
+			better = b.downTill < best.downTill
+		case p.Policy == LeastConnections:
+			better = b.active < best.active
+		}
+		if !better {
+			continue
+		}
+		best, bestUp = b, up
+		if p.Policy == RoundRobin && up {
+			break
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	for i, b := range p.backends {
+		if b == best {
+			p.next = (i + 1) % n
+		}
+	}
+	best.active++
+	return best
+}
+
+// done records the end of a request on b, which was able to
+// connect to b if ok is set.
+func (p *BackendPool) done(b *backend, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.active--
+	if ok {
+		b.downTill = 0
+		return
+	}
+	timeout := p.FailTimeout
+	if timeout == 0 {
+		timeout = DefaultFailTimeout
+	}
+	b.downTill = time.Nanoseconds() + timeout
+}
+
+// backendBody is the body of a response from a backend in a
+// BackendPool, whose request is in progress until it is closed.
+type backendBody struct {
+	io.ReadCloser
+	pool   *BackendPool
+	b      *backend
+	closed bool
+}
+
+func (bb *backendBody) Close() os.Error {
+	if !bb.closed {
+		bb.closed = true
+		bb.pool.done(bb.b, true)
 	}
+	return bb.ReadCloser.Close()
 }
@@ -9,7 +9,10 @@ package http_test
 import (
 	. "http"
 	"http/httptest"
+	"io"
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -60,3 +63,182 @@ func TestReverseProxy(t *testing.T) {
 		t.Errorf("got body %q; expected %q", g, e)
 	}
 }
+
+func TestReverseProxyHeaders(t *testing.T) {
+	backend := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if g, e := r.Header.Get("X-Forwarded-For"), "1.2.3.4, 127.0.0.1"; g != e {
+			t.Errorf("X-Forwarded-For = %q; want %q", g, e)
+		}
+		for _, h := range []string{"Upgrade", "Te", "X-Hop"} {
+			if v := r.Header.Get(h); v != "" {
+				t.Errorf("hop-by-hop header %s = %q sent to backend", h, v)
+			}
+		}
+		if g, e := r.Header.Get("X-End"), "end"; g != e {
+			t.Errorf("X-End = %q; want %q", g, e)
+		}
+		w.Header().Set("X-Status", "backend")
+		w.Write([]byte("body"))
+	}))
+	defer backend.Close()
+	backendURL, _ := ParseURL(backend.URL)
+	proxy := NewSingleHostReverseProxy(backendURL)
+	proxy.ModifyResponse = func(res *Response) os.Error {
+		res.Header.Set("X-Status", res.Header.Get("X-Status")+"+modified")
+		return nil
+	}
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	req, _ := NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Upgrade", "foo")
+	req.Header.Set("X-Hop", "hop")
+	req.Header.Set("X-End", "end")
+	req.Header.Set("Connection", "Upgrade, X-Hop")
+	res, err := DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	res.Body.Close()
+	if g, e := res.Header.Get("X-Status"), "backend+modified"; g != e {
+		t.Errorf("X-Status = %q; want %q", g, e)
+	}
+}
+
+func TestReverseProxyModifyResponseError(t *testing.T) {
+	backend := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer backend.Close()
+	backendURL, _ := ParseURL(backend.URL)
+	proxy := NewSingleHostReverseProxy(backendURL)
+	proxy.ModifyResponse = func(res *Response) os.Error {
+		return os.NewError("refused")
+	}
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	res, err := Get(frontend.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != StatusBadGateway || string(body) == "secret" {
+		t.Errorf("got status %d, body %q; want status %d", res.StatusCode, body, StatusBadGateway)
+	}
+}
+
+func newNamedBackend(name string) (*httptest.Server, *URL) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Write([]byte(name))
+	}))
+	u, _ := ParseURL(ts.URL)
+	return ts, u
+}
+
+func proxyGet(t *testing.T, url string) string {
+	res, err := Get(url)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return string(body)
+}
+
+func TestLoadBalancingReverseProxy(t *testing.T) {
+	a, aURL := newNamedBackend("a")
+	defer a.Close()
+	b, bURL := newNamedBackend("b")
+	defer b.Close()
+	// A backend that cannot be connected to.
+	dead, deadURL := newNamedBackend("dead")
+	dead.Close()
+
+	proxy := NewLoadBalancingReverseProxy(RoundRobin, aURL, deadURL, bURL)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	// The request first sent to the dead backend is retried on
+	// the next, and the dead backend is not chosen again.
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, proxyGet(t, frontend.URL))
+	}
+	if g, e := strings.Join(got, ","), "a,b,a,b"; g != e {
+		t.Errorf("got responses from %s; want %s", g, e)
+	}
+
+	// Requests that are not idempotent are not retried.
+	proxy.Backends = NewBackendPool(RoundRobin, deadURL, aURL)
+	res, err := Post(frontend.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != StatusBadGateway {
+		t.Errorf("POST to dead backend: got status %d; want %d", res.StatusCode, StatusBadGateway)
+	}
+}
+
+func TestLeastConnectionsReverseProxy(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	slow := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		started <- true
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	slowURL, _ := ParseURL(slow.URL)
+	fast, fastURL := newNamedBackend("fast")
+	defer fast.Close()
+
+	frontend := httptest.NewServer(NewLoadBalancingReverseProxy(LeastConnections, slowURL, fastURL))
+	defer frontend.Close()
+
+	done := make(chan string)
+	go func() { done <- proxyGet(t, frontend.URL) }()
+	<-started
+	// While the slow backend is busy, requests go to the other.
+	for i := 0; i < 3; i++ {
+		if g := proxyGet(t, frontend.URL); g != "fast" {
+			t.Errorf("request %d went to %q; want fast", i, g)
+		}
+	}
+	release <- true
+	if g := <-done; g != "slow" {
+		t.Errorf("first request went to %q; want slow", g)
+	}
+}
+
+func TestReverseProxyFlushInterval(t *testing.T) {
+	release := make(chan bool)
+	backend := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("first"))
+		w.(Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+	backendURL, _ := ParseURL(backend.URL)
+	proxy := NewSingleHostReverseProxy(backendURL)
+	proxy.FlushInterval = 10e6 // 10ms
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+	defer close(release)
+
+	res, err := Get(frontend.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer res.Body.Close()
+	// The first part of the body arrives while the backend is
+	// still writing the response.
+	buf := make([]byte, len("first"))
+	if _, err := io.ReadFull(res.Body, buf); err != nil || string(buf) != "first" {
+		t.Errorf("got %q, %v; want %q", buf, err, "first")
+	}
+}
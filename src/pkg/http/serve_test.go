@@ -12,6 +12,7 @@ import (
 	"fmt"
 	. "http"
 	"http/httptest"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -231,6 +232,78 @@ func TestMuxRedirectLeadingSlashes(t *testing.T) {
 	}
 }
 
+var muxRouteTests = []struct {
+	method, path string
+	code         int
+	result       string // Result header set by the handler
+	allow        string
+}{
+	{"GET", "/users/42", StatusOK, "get user 42", ""},
+	{"HEAD", "/users/42", StatusOK, "get user 42", ""},
+	{"DELETE", "/users/42", StatusOK, "delete user 42", ""},
+	{"PUT", "/users/42", StatusOK, "any users", ""},
+	{"GET", "/users/new", StatusOK, "new user", ""},
+	{"POST", "/users/new", StatusOK, "any users", ""},
+	{"GET", "/users/42/posts/7", StatusOK, "posts of 42: /users/42/posts/7", ""},
+	{"GET", "/users/42/posts", StatusMovedPermanently, "", ""},
+	{"GET", "/users/", StatusOK, "any users", ""},
+	{"GET", "/users//posts/", StatusMovedPermanently, "", ""},
+	{"GET", "/static/x.css", StatusOK, "static", ""},
+	{"PUT", "/static/x.css", StatusOK, "put x.css", ""},
+	{"POST", "/static/x.css", StatusMethodNotAllowed, "", "GET, HEAD, PUT"},
+	{"GET", "/nothing", StatusNotFound, "", ""},
+}
+
+func TestMuxMethodsAndVariables(t *testing.T) {
+	mux := NewServeMux()
+	reply := func(format string, names ...string) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			args := make([]interface{}, len(names))
+			for i, name := range names {
+				args[i] = r.PathValue(name)
+			}
+			w.Header().Set("Result", fmt.Sprintf(format, args...))
+		}
+	}
+	mux.Handle("GET /users/{id}", reply("get user %s", "id"))
+	mux.Handle("DELETE /users/{id}", reply("delete user %s", "id"))
+	mux.Handle("GET /users/new", reply("new user"))
+	mux.Handle("/users/", reply("any users"))
+	mux.Handle("GET /users/{id}/posts/", HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("Result", "posts of "+r.PathValue("id")+": "+r.URL.Path)
+	}))
+	mux.Handle("GET /static/", reply("static"))
+	mux.Handle("PUT /static/{name}", reply("put %s", "name"))
+
+	for _, tt := range muxRouteTests {
+		req := &Request{Method: tt.method, URL: &URL{Path: tt.path}}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s %s: code = %d; want %d", tt.method, tt.path, rec.Code, tt.code)
+		}
+		if g := rec.Header().Get("Result"); g != tt.result {
+			t.Errorf("%s %s: Result = %q; want %q", tt.method, tt.path, g, tt.result)
+		}
+		if g := rec.Header().Get("Allow"); g != tt.allow {
+			t.Errorf("%s %s: Allow = %q; want %q", tt.method, tt.path, g, tt.allow)
+		}
+	}
+}
+
+func TestMuxInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"", "GET ", " /x", "/a{id}", "/{a}/{a}", "{host}/x", "/{}"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Handle(%q) did not panic", pattern)
+				}
+			}()
+			NewServeMux().Handle(pattern, NotFoundHandler())
+		}()
+	}
+}
+
 func TestServerTimeouts(t *testing.T) {
 	// TODO(bradfitz): convert this to use httptest.Server
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -810,6 +883,244 @@ func TestAcceptMaxFds(t *testing.T) {
 	}
 }
 
+func TestServerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	url := "http://" + l.Addr().String() + "/"
+
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	server := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/slow" {
+			started <- true
+			<-release
+		}
+		fmt.Fprintf(w, "path=%s", r.URL.Path)
+	})}
+	serveErr := make(chan os.Error, 1)
+	go func() {
+		serveErr <- server.Serve(l)
+	}()
+
+	// Leave an idle keep-alive connection behind.
+	tr := &Transport{}
+	c := &Client{Transport: tr}
+	res, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	type result struct {
+		res *Response
+		err os.Error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		res, err := Get(url + "slow")
+		slow <- result{res, err}
+	}()
+	<-started
+
+	shutdown := make(chan os.Error, 1)
+	go func() {
+		shutdown <- server.Shutdown(0)
+	}()
+
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("Serve returned %v; want %v", err, ErrServerClosed)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before in-flight request finished", err)
+	case <-time.After(50e6):
+	}
+
+	release <- true
+	r := <-slow
+	if r.err != nil {
+		t.Fatalf("in-flight Get: %v", r.err)
+	}
+	body, _ := ioutil.ReadAll(r.res.Body)
+	if g, e := string(body), "path=/slow"; g != e {
+		t.Errorf("in-flight body = %q; want %q", g, e)
+	}
+	if !r.res.Close {
+		t.Errorf("in-flight response did not request connection close")
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if _, err := Get(url); err == nil {
+		t.Errorf("Get after Shutdown succeeded; want error")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	server := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		started <- true
+		<-release
+	})}
+	go server.Serve(l)
+	defer close(release)
+
+	got := make(chan os.Error, 1)
+	go func() {
+		_, err := Get("http://" + l.Addr().String() + "/")
+		got <- err
+	}()
+	<-started
+
+	if err := server.Shutdown(50e6); err != ErrShutdownTimeout {
+		t.Errorf("Shutdown = %v; want %v", err, ErrShutdownTimeout)
+	}
+	if err := <-got; err == nil {
+		t.Errorf("Get on forcibly closed connection succeeded; want error")
+	}
+}
+
+// serveOnce starts server on a local listener, sends raw to it
+// on a new connection, and returns the response read back.
+func serveOnce(t *testing.T, server *Server, raw string) *Response {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	go server.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatalf("dial error: %v", err)
+	}
+	go io.WriteString(conn, raw)
+	res, err := ReadResponse(bufio.NewReader(conn), &Request{Method: "GET"})
+	l.Close()
+	if err != nil {
+		conn.Close()
+		t.Fatalf("ReadResponse: %v", err)
+	}
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{res.Body, conn}
+	return res
+}
+
+func TestServerMaxHeaderBytes(t *testing.T) {
+	server := &Server{
+		MaxHeaderBytes: 1 << 10,
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			t.Errorf("handler called for request with header of %d bytes", len(r.Header.Get("X-Big")))
+		}),
+	}
+	res := serveOnce(t, server, "GET / HTTP/1.1\r\nHost: test\r\nX-Big: "+strings.Repeat("a", 16<<10)+"\r\n\r\n")
+	defer res.Body.Close()
+	if res.StatusCode != StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status = %d; want %d", res.StatusCode, StatusRequestHeaderFieldsTooLarge)
+	}
+	if !res.Close {
+		t.Errorf("response to request with large header does not close the connection")
+	}
+}
+
+func TestServerMaxBodyBytes(t *testing.T) {
+	server := &Server{
+		MaxBodyBytes: 100,
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			t.Errorf("handler called for request with Content-Length %d", r.ContentLength)
+		}),
+	}
+	res := serveOnce(t, server, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 1000\r\n\r\n")
+	defer res.Body.Close()
+	if res.StatusCode != StatusRequestEntityTooLarge {
+		t.Errorf("status = %d; want %d", res.StatusCode, StatusRequestEntityTooLarge)
+	}
+}
+
+func TestMaxBytesReader(t *testing.T) {
+	const limit = 100
+	gotErr := make(chan os.Error, 1)
+	server := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		r.Body = MaxBytesReader(w, r.Body, limit)
+		_, err := ioutil.ReadAll(r.Body)
+		gotErr <- err
+		w.WriteHeader(StatusRequestEntityTooLarge)
+	})}
+	body := strings.Repeat("x", 1000)
+	res := serveOnce(t, server, fmt.Sprintf("POST / HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body))
+	defer res.Body.Close()
+	if err := <-gotErr; err != ErrBodyTooLarge {
+		t.Errorf("reading body: err = %v; want %v", err, ErrBodyTooLarge)
+	}
+	if !res.Close {
+		t.Errorf("response after body limit hit does not close the connection")
+	}
+}
+
+func TestMaxBytesReaderCompressHandler(t *testing.T) {
+	// CompressHandler hides the server's ResponseWriter from
+	// MaxBytesReader; the connection must be closed all the same,
+	// rather than the rest of the body read as the next request.
+	server := &Server{Handler: CompressHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		r.Body = MaxBytesReader(w, r.Body, 100)
+		if _, err := ioutil.ReadAll(r.Body); err != ErrBodyTooLarge {
+			t.Errorf("reading body: err = %v; want %v", err, ErrBodyTooLarge)
+		}
+		io.WriteString(w, "too large")
+	}))}
+	body := strings.Repeat("x", 1000)
+	res := serveOnce(t, server, fmt.Sprintf("POST / HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body))
+	defer res.Body.Close()
+	if !res.Close {
+		t.Errorf("response after body limit hit does not close the connection")
+	}
+}
+
+func TestMaxBytesReaderUnreadChunkedBody(t *testing.T) {
+	// The handler never reads the body, which is chunked and
+	// never ends.  Closing it must not read past the limit.
+	server := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		r.Body = MaxBytesReader(w, r.Body, 100)
+		io.WriteString(w, "ignored")
+	})}
+	body := strings.Repeat("x", 1000)
+	res := serveOnce(t, server, fmt.Sprintf("POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n", len(body), body))
+	defer res.Body.Close()
+	if !res.Close {
+		t.Errorf("response after body limit hit does not close the connection")
+	}
+}
+
+func TestMaxBytesReaderCloseLimit(t *testing.T) {
+	r := strings.NewReader(strings.Repeat("x", 1000))
+	rc := MaxBytesReader(nil, ioutil.NopCloser(r), 100)
+	rc.Close()
+	if n := r.Len(); n != 1000-101 {
+		t.Errorf("Close left %d bytes unread; want %d", n, 1000-101)
+	}
+}
+
+func TestMaxBytesReaderExactLimit(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	rc := MaxBytesReader(nil, ioutil.NopCloser(strings.NewReader(body)), int64(len(body)))
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Errorf("ReadAll: %v", err)
+	}
+	if string(got) != body {
+		t.Errorf("read %d bytes; want %d", len(got), len(body))
+	}
+}
+
 func BenchmarkClientServer(b *testing.B) {
 	b.StopTimer()
 	ts := httptest.NewServer(HandlerFunc(func(rw ResponseWriter, r *Request) {
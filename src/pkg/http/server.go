@@ -21,6 +21,7 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,6 +34,8 @@ var (
 	ErrBodyNotAllowed  = os.NewError("http: response status code does not allow body")
 	ErrHijacked        = os.NewError("Conn has been hijacked")
 	ErrContentLength   = os.NewError("Conn.Write wrote more than the declared Content-Length")
+	ErrServerClosed    = os.NewError("http: Server closed")
+	ErrShutdownTimeout = os.NewError("http: Server shutdown timed out")
 )
 
 // Objects implementing the Handler interface can be
@@ -94,9 +97,11 @@ type Hijacker interface {
 // A conn represents the server side of an HTTP connection.
 type conn struct {
 	remoteAddr string               // network address of remote side
+	server     *Server              // the Server on which the connection arrived
 	handler    Handler              // request handler
 	rwc        net.Conn             // i/o connection
-	buf        *bufio.ReadWriter    // buffered rwc
+	lr         *io.LimitedReader    // io.LimitReader(rwc)
+	buf        *bufio.ReadWriter    // buffered lr
 	hijacked   bool                 // connection has been hijacked by handler
 	tlsState   *tls.ConnectionState // or nil when not using TLS        
 }
@@ -118,6 +123,33 @@ type response struct {
 	// "Connection: keep-alive" response header and a
 	// Content-Length.
 	closeAfterReply bool
+
+	// requestBodyLimitHit is set by checkBodyLimit once a
+	// MaxBytesReader replacing the request body has hit its
+	// max size.  It is checked in WriteHeader and
+	// finishRequest, to make sure we don't consume the
+	// remaining request body to try to advance to the next
+	// HTTP request; the connection is closed instead.
+	requestBodyLimitHit bool
+}
+
+// checkBodyLimit sets requestBodyLimitHit, and arranges for the
+// connection to be closed, if the request body is a MaxBytesReader
+// that has hit its limit.  The body is checked rather than the
+// ResponseWriter given to MaxBytesReader, which a handler may have
+// wrapped.
+func (w *response) checkBodyLimit() {
+	if w.requestBodyLimitHit {
+		return
+	}
+	if l, ok := w.req.Body.(*maxBytesReader); !ok || l.err != ErrBodyTooLarge {
+		return
+	}
+	w.closeAfterReply = true
+	w.requestBodyLimitHit = true
+	if !w.wroteHeader {
+		w.header.Set("Connection", "close")
+	}
 }
 
 type writerOnly struct {
@@ -147,15 +179,10 @@ func newConn(rwc net.Conn, handler Handler) (c *conn, err os.Error) {
 	c.remoteAddr = rwc.RemoteAddr().String()
 	c.handler = handler
 	c.rwc = rwc
-	br := bufio.NewReader(rwc)
+	c.lr = io.LimitReader(rwc, noLimit).(*io.LimitedReader)
+	br := bufio.NewReader(c.lr)
 	bw := bufio.NewWriter(rwc)
 	c.buf = bufio.NewReadWriter(br, bw)
-
-	if tlsConn, ok := rwc.(*tls.Conn); ok {
-		c.tlsState = new(tls.ConnectionState)
-		*c.tlsState = tlsConn.ConnectionState()
-	}
-
 	return c, nil
 }
 
@@ -190,15 +217,31 @@ func (ecr *expectContinueReader) Close() os.Error {
 // It is like time.RFC1123 but hard codes GMT as the time zone.
 const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
 
+const noLimit int64 = (1 << 63) - 1
+
+var (
+	errHeaderTooLarge       = os.NewError("http: request header too large")
+	errDeclaredBodyTooLarge = os.NewError("http: declared request body too large")
+)
+
 // Read next request from connection.
 func (c *conn) readRequest() (w *response, err os.Error) {
 	if c.hijacked {
 		return nil, ErrHijacked
 	}
+	// Allow for the bytes bufio reads ahead.
+	c.lr.N = int64(c.server.maxHeaderBytes()) + 4096
 	var req *Request
 	if req, err = ReadRequest(c.buf.Reader); err != nil {
+		if c.lr.N == 0 {
+			return nil, errHeaderTooLarge
+		}
 		return nil, err
 	}
+	c.lr.N = noLimit
+	if max := c.server.MaxBodyBytes; max > 0 && req.ContentLength > max {
+		return nil, errDeclaredBodyTooLarge
+	}
 
 	req.RemoteAddr = c.remoteAddr
 	req.TLS = c.tlsState
@@ -208,9 +251,19 @@ func (c *conn) readRequest() (w *response, err os.Error) {
 	w.req = req
 	w.header = make(Header)
 	w.contentLength = -1
+	if max := c.server.MaxBodyBytes; max > 0 && req.ContentLength != 0 {
+		req.Body = MaxBytesReader(w, req.Body, max)
+	}
 	return w, nil
 }
 
+// writeError replies to a request that could not be read
+// with the status code, and no body.
+func (c *conn) writeError(code int) {
+	fmt.Fprintf(c.buf, "HTTP/1.1 %d %s\r\nConnection: close\r\n\r\n", code, StatusText(code))
+	c.buf.Flush()
+}
+
 func (w *response) Header() Header {
 	return w.header
 }
@@ -226,11 +279,15 @@ func (w *response) WriteHeader(code int) {
 	}
 
 	// Per RFC 2616, we should consume the request body before
-	// replying, if the handler hasn't already done so.
-	if w.req.ContentLength != 0 {
+	// replying, if the handler hasn't already done so.  A body
+	// found to be too large is not read further; the connection
+	// is closed instead.
+	w.checkBodyLimit()
+	if w.req.ContentLength != 0 && !w.requestBodyLimitHit {
 		ecr, isExpecter := w.req.Body.(*expectContinueReader)
 		if !isExpecter || ecr.resp.wroteContinue {
 			w.req.Body.Close()
+			w.checkBodyLimit()
 		}
 	}
 
@@ -318,6 +375,14 @@ func (w *response) WriteHeader(code int) {
 	if w.chunking {
 		w.header.Del("Content-Length")
 	}
+
+	// The server is shutting down: tell the client not to reuse
+	// the connection, which is closed after this reply.
+	if w.conn.server.shuttingDown() {
+		w.closeAfterReply = true
+		w.header.Set("Connection", "close")
+	}
+
 	if !w.req.ProtoAtLeast(1, 0) {
 		return
 	}
@@ -444,7 +509,11 @@ func (w *response) finishRequest() {
 		io.WriteString(w.conn.buf, "\r\n")
 	}
 	w.conn.buf.Flush()
-	w.req.Body.Close()
+	w.checkBodyLimit()
+	if !w.requestBodyLimitHit {
+		w.req.Body.Close()
+		w.checkBodyLimit()
+	}
 	if w.req.MultipartForm != nil {
 		w.req.MultipartForm.RemoveAll()
 	}
@@ -481,6 +550,7 @@ func (c *conn) serve() {
 		if err == nil {
 			return
 		}
+		c.server.forgetConn(c)
 		c.rwc.Close()
 
 		// TODO(rsc,bradfitz): this is boilerplate. move it to runtime.Stack()
@@ -503,9 +573,42 @@ func (c *conn) serve() {
 		log.Print(buf.String())
 	}()
 
+	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			c.server.forgetConn(c)
+			c.close()
+			return
+		}
+		c.tlsState = new(tls.ConnectionState)
+		*c.tlsState = tlsConn.ConnectionState()
+		if fn := c.server.TLSNextProto[c.tlsState.NegotiatedProtocol]; fn != nil {
+			c.server.forgetConn(c)
+			fn(c.server, tlsConn, c.handler)
+			c.close()
+			return
+		}
+	}
+
 	for {
+		// Wait for the start of the next request while marked idle,
+		// so that Shutdown may close the connection in the meantime.
+		if !c.server.setConnIdle(c, true) {
+			break
+		}
+		if _, err := c.buf.Peek(1); err != nil {
+			break
+		}
+		if !c.server.setConnIdle(c, false) {
+			break
+		}
+
 		w, err := c.readRequest()
 		if err != nil {
+			if err == errHeaderTooLarge {
+				c.writeError(StatusRequestHeaderFieldsTooLarge)
+			} else if err == errDeclaredBodyTooLarge {
+				c.writeError(StatusRequestEntityTooLarge)
+			}
 			break
 		}
 
@@ -554,6 +657,7 @@ func (c *conn) serve() {
 			break
 		}
 	}
+	c.server.forgetConn(c)
 	c.close()
 }
 
@@ -563,6 +667,7 @@ func (w *response) Hijack() (rwc net.Conn, buf *bufio.ReadWriter, err os.Error)
 	if w.conn.hijacked {
 		return nil, nil, ErrHijacked
 	}
+	w.conn.server.forgetConn(w.conn)
 	w.conn.hijacked = true
 	rwc = w.conn.rwc
 	buf = w.conn.buf
@@ -598,6 +703,22 @@ func NotFound(w ResponseWriter, r *Request) { Error(w, "404 page not found", Sta
 // that replies to each request with a ``404 page not found'' reply.
 func NotFoundHandler() Handler { return HandlerFunc(NotFound) }
 
+// StripPrefix returns a handler that serves HTTP requests
+// by removing the given prefix from the request URL's Path
+// and invoking the handler h. StripPrefix handles a
+// request for a path that doesn't begin with prefix by
+// replying with an HTTP 404 not found error.
+func StripPrefix(prefix string, h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			NotFound(w, r)
+			return
+		}
+		r.URL.Path = r.URL.Path[len(prefix):]
+		h.ServeHTTP(w, r)
+	})
+}
+
 // Redirect replies to the request with a redirect to url,
 // which may be a path relative to the request path.
 func Redirect(w ResponseWriter, r *Request, url string, code int) {
@@ -703,15 +824,40 @@ func RedirectHandler(url string, code int) Handler {
 // "/codesearch" and "codesearch.google.com/" without also taking over
 // requests for "http://www.google.com/".
 //
+// A path segment of the form {name} matches any single non-empty
+// segment of the request path, so that "/users/{id}" matches
+// "/users/42" and "/users/{id}/" matches the subtree below it.
+// The handler retrieves the matched segment with the request's
+// PathValue method.  Variables do not count towards a pattern's
+// length, so "/users/new" takes precedence over "/users/{id}".
+//
+// Patterns may also be preceded by a method and a space, as in
+// "GET /users/{id}", restricting matches to requests with that
+// method.  A pattern registered for GET also matches HEAD requests.
+// If the request path matches one or more patterns but none of them
+// accepts the request method, ServeMux replies with a
+// 405 Method Not Allowed error whose Allow header lists the
+// methods that are accepted.
+//
 // ServeMux also takes care of sanitizing the URL request path,
 // redirecting any request containing . or .. elements to an
 // equivalent .- and ..-free URL.
 type ServeMux struct {
-	m map[string]Handler
+	m map[string]*muxEntry // keyed by pattern without method
+}
+
+// A muxEntry holds the handlers registered for one pattern.
+type muxEntry struct {
+	pattern  string
+	host     bool               // pattern begins with a host name
+	segs     []string           // pattern split at slashes; nil if it has no variables
+	literal  int                // length of pattern excluding variables
+	handlers map[string]Handler // keyed by method; "" matches any method
+	implicit bool               // redirect for /tree added by registering /tree/
 }
 
 // NewServeMux allocates and returns a new ServeMux.
-func NewServeMux() *ServeMux { return &ServeMux{make(map[string]Handler)} }
+func NewServeMux() *ServeMux { return &ServeMux{make(map[string]*muxEntry)} }
 
 // DefaultServeMux is the default ServeMux used by Serve.
 var DefaultServeMux = NewServeMux()
@@ -746,21 +892,105 @@ func cleanPath(p string) string {
 	return np
 }
 
-// Find a handler on a handler map given a path string
-// Most-specific (longest) pattern wins
-func (mux *ServeMux) match(path string) Handler {
-	var h Handler
-	var n = 0
-	for k, v := range mux.m {
-		if !pathMatch(k, path) {
+// isPathVar reports whether the pattern segment seg is a variable.
+func isPathVar(seg string) bool {
+	return len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}'
+}
+
+// match reports whether path matches the entry's pattern.  If the
+// pattern has variables, match also returns their values.
+func (e *muxEntry) match(path string) (vars map[string]string, ok bool) {
+	if e.segs == nil {
+		return nil, pathMatch(e.pattern, path)
+	}
+	segs := e.segs
+	subtree := segs[len(segs)-1] == ""
+	if subtree {
+		segs = segs[:len(segs)-1]
+	}
+	psegs := strings.Split(path, "/", -1)
+	if subtree && len(psegs) <= len(segs) || !subtree && len(psegs) != len(segs) {
+		return nil, false
+	}
+	vars = make(map[string]string)
+	for i, seg := range segs {
+		switch {
+		case isPathVar(seg):
+			if psegs[i] == "" {
+				return nil, false
+			}
+			vars[seg[1:len(seg)-1]] = psegs[i]
+		case seg != psegs[i]:
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+// betterThan reports whether e takes precedence over f
+// when both match a request.
+func (e *muxEntry) betterThan(f *muxEntry) bool {
+	if e.host != f.host {
+		return e.host
+	}
+	if e.literal != f.literal {
+		return e.literal > f.literal
+	}
+	// An exact pattern beats a subtree of the same length.
+	return e.pattern[len(e.pattern)-1] != '/' && f.pattern[len(f.pattern)-1] == '/'
+}
+
+// handler returns the entry's handler for method, or nil.
+func (e *muxEntry) handler(method string) Handler {
+	if h, ok := e.handlers[method]; ok {
+		return h
+	}
+	if method == "HEAD" {
+		if h, ok := e.handlers["GET"]; ok {
+			return h
+		}
+	}
+	return e.handlers[""]
+}
+
+// Find a handler for the request.  The best-ranked entry whose pattern
+// matches the request and which accepts the request method wins.  If
+// entries match the path but none accepts the method, match returns a
+// nil handler and the methods they do accept.
+func (mux *ServeMux) match(r *Request) (h Handler, vars map[string]string, allow []string) {
+	var best *muxEntry
+	methods := make(map[string]bool)
+	for _, e := range mux.m {
+		path := r.URL.Path
+		if e.host {
+			path = r.Host + path
+		}
+		v, ok := e.match(path)
+		if !ok {
 			continue
 		}
-		if h == nil || len(k) > n {
-			n = len(k)
-			h = v
+		eh := e.handler(r.Method)
+		if eh == nil {
+			for m := range e.handlers {
+				methods[m] = true
+			}
+			continue
+		}
+		if best == nil || e.betterThan(best) {
+			best, h, vars = e, eh, v
 		}
 	}
-	return h
+	if h != nil || len(methods) == 0 {
+		return h, vars, nil
+	}
+	if methods["GET"] {
+		methods["HEAD"] = true
+	}
+	for m := range methods {
+		allow = append(allow, m)
+	}
+	sort.SortStrings(allow)
+	return nil, nil, allow
 }
 
 // ServeHTTP dispatches the request to the handler whose
@@ -772,33 +1002,97 @@ func (mux *ServeMux) ServeHTTP(w ResponseWriter, r *Request) {
 		w.WriteHeader(StatusMovedPermanently)
 		return
 	}
-	// Host-specific pattern takes precedence over generic ones
-	h := mux.match(r.Host + r.URL.Path)
-	if h == nil {
-		h = mux.match(r.URL.Path)
-	}
+	h, vars, allow := mux.match(r)
 	if h == nil {
+		if allow != nil {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			Error(w, "405 method not allowed", StatusMethodNotAllowed)
+			return
+		}
 		h = NotFoundHandler()
 	}
+	r.pathValues = vars
 	h.ServeHTTP(w, r)
 }
 
-// Handle registers the handler for the given pattern.
-func (mux *ServeMux) Handle(pattern string, handler Handler) {
-	if pattern == "" {
+// parsePattern splits pattern into its method, if any, and the
+// pattern proper, and checks the pattern's syntax.  If the pattern
+// has variables, parsePattern also returns its segments.
+func parsePattern(pattern string) (method, pat string, segs []string, literal int) {
+	pat = pattern
+	if i := strings.Index(pat, " "); i >= 0 {
+		method, pat = pat[:i], strings.TrimLeft(pat[i+1:], " ")
+		if method == "" {
+			panic("http: invalid pattern " + pattern)
+		}
+	}
+	if pat == "" {
 		panic("http: invalid pattern " + pattern)
 	}
+	literal = len(pat)
+	if strings.Index(pat, "{") < 0 && strings.Index(pat, "}") < 0 {
+		return method, pat, nil, literal
+	}
+	segs = strings.Split(pat, "/", -1)
+	seen := make(map[string]bool)
+	for i, seg := range segs {
+		if strings.IndexAny(seg, "{}") < 0 {
+			continue
+		}
+		// Variables must span a whole path segment,
+		// and may not appear in the host name.
+		if i == 0 || !isPathVar(seg) || strings.IndexAny(seg[1:len(seg)-1], "{}") >= 0 {
+			panic("http: invalid pattern " + pattern)
+		}
+		name := seg[1 : len(seg)-1]
+		if seen[name] {
+			panic("http: duplicate variable in pattern " + pattern)
+		}
+		seen[name] = true
+		literal -= len(seg)
+	}
+	return method, pat, segs, literal
+}
 
-	mux.m[pattern] = handler
+// Handle registers the handler for the given pattern.
+func (mux *ServeMux) Handle(pattern string, handler Handler) {
+	method, pat, segs, literal := parsePattern(pattern)
+
+	e := mux.m[pat]
+	if e == nil || e.implicit {
+		e = &muxEntry{
+			pattern:  pat,
+			host:     pat[0] != '/',
+			segs:     segs,
+			literal:  literal,
+			handlers: make(map[string]Handler),
+		}
+		mux.m[pat] = e
+	}
+	e.handlers[method] = handler
 
 	// Helpful behavior:
-	// If pattern is /tree/, insert permanent redirect for /tree.
-	n := len(pattern)
-	if n > 0 && pattern[n-1] == '/' {
-		mux.m[pattern[0:n-1]] = RedirectHandler(pattern, StatusMovedPermanently)
+	// If pattern is /tree/, insert permanent redirect for /tree,
+	// unless a handler is already registered for it.
+	n := len(pat)
+	if n > 1 && pat[n-1] == '/' && mux.m[pat[0:n-1]] == nil {
+		_, tree, segs, literal := parsePattern(pat[0 : n-1])
+		mux.m[tree] = &muxEntry{
+			pattern:  tree,
+			host:     tree[0] != '/',
+			segs:     segs,
+			literal:  literal,
+			handlers: map[string]Handler{"": HandlerFunc(redirectToSubtree)},
+			implicit: true,
+		}
 	}
 }
 
+// redirectToSubtree redirects a request for /tree to /tree/.
+func redirectToSubtree(w ResponseWriter, r *Request) {
+	Redirect(w, r, r.URL.Path+"/", StatusMovedPermanently)
+}
+
 // HandleFunc registers the handler function for the given pattern.
 func (mux *ServeMux) HandleFunc(pattern string, handler func(ResponseWriter, *Request)) {
 	mux.Handle(pattern, HandlerFunc(handler))
@@ -831,6 +1125,46 @@ type Server struct {
 	Handler      Handler // handler to invoke, http.DefaultServeMux if nil
 	ReadTimeout  int64   // the net.Conn.SetReadTimeout value for new connections
 	WriteTimeout int64   // the net.Conn.SetWriteTimeout value for new connections
+
+	// MaxHeaderBytes controls the maximum number of bytes the
+	// server will read parsing the request line and header of a
+	// request.  Requests with larger headers are answered with
+	// 431 Request Header Fields Too Large.  If zero,
+	// DefaultMaxHeaderBytes is used.
+	MaxHeaderBytes int
+
+	// MaxBodyBytes, if positive, limits the size of request
+	// bodies.  Requests declaring a larger Content-Length are
+	// answered with 413 Request Entity Too Large without being
+	// passed to the Handler; other request bodies are limited
+	// with MaxBytesReader.
+	MaxBodyBytes int64
+
+	// TLSNextProto optionally maps a protocol name negotiated
+	// with TLS NPN to a function that takes over the connection.
+	// The function is called with the Server, the connection
+	// and the Server's Handler, and the connection is closed
+	// when it returns.  Such connections are not drained by
+	// Shutdown.  ListenAndServeTLS advertises the protocols in
+	// TLSNextProto in preference to "http/1.1".
+	TLSNextProto map[string]func(*Server, *tls.Conn, Handler)
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[*conn]bool // open connections; true if idle between requests
+	closing   bool           // Shutdown or Close has been called
+	drained   chan bool      // closed once closing and no conns remain
+}
+
+// DefaultMaxHeaderBytes is the maximum permitted size of the headers
+// in an HTTP request, used by a Server whose MaxHeaderBytes is zero.
+const DefaultMaxHeaderBytes = 1 << 20 // 1 MB
+
+func (srv *Server) maxHeaderBytes() int {
+	if srv.MaxHeaderBytes > 0 {
+		return srv.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
@@ -851,8 +1185,13 @@ func (srv *Server) ListenAndServe() os.Error {
 // Serve accepts incoming connections on the Listener l, creating a
 // new service thread for each.  The service threads read requests and
 // then call srv.Handler to reply to them.
+// After Shutdown or Close, Serve returns ErrServerClosed.
 func (srv *Server) Serve(l net.Listener) os.Error {
 	defer l.Close()
+	if !srv.addListener(l) {
+		return ErrServerClosed
+	}
+	defer srv.forgetListener(l)
 	handler := srv.Handler
 	if handler == nil {
 		handler = DefaultServeMux
@@ -860,6 +1199,9 @@ func (srv *Server) Serve(l net.Listener) os.Error {
 	for {
 		rw, e := l.Accept()
 		if e != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				log.Printf("http: Accept error: %v", e)
 				continue
@@ -876,11 +1218,152 @@ func (srv *Server) Serve(l net.Listener) os.Error {
 		if err != nil {
 			continue
 		}
+		c.server = srv
+		if !srv.addConn(c) {
+			rw.Close()
+			return ErrServerClosed
+		}
 		go c.serve()
 	}
 	panic("not reached")
 }
 
+// Shutdown gracefully shuts down the server.  It closes the server's
+// listeners, so that no new connections are accepted, and closes any
+// connections that are idle between requests.  Requests already in
+// progress are allowed to complete; their replies carry a
+// "Connection: close" header and the connection is closed afterwards.
+//
+// Shutdown returns nil once all connections have gone away.  If that
+// takes longer than ns nanoseconds, Shutdown closes the remaining
+// connections and returns ErrShutdownTimeout.  If ns <= 0, Shutdown
+// waits indefinitely.
+func (srv *Server) Shutdown(ns int64) os.Error {
+	srv.mu.Lock()
+	err := srv.closeListenersLocked()
+	srv.closeConnsLocked(true)
+	drained := srv.drained
+	srv.mu.Unlock()
+
+	if ns <= 0 {
+		<-drained
+		return err
+	}
+	select {
+	case <-drained:
+		return err
+	case <-time.After(ns):
+	}
+	srv.mu.Lock()
+	srv.closeConnsLocked(false)
+	srv.mu.Unlock()
+	return ErrShutdownTimeout
+}
+
+// Close immediately closes the server's listeners and all of its
+// connections, including those with requests in progress.
+// Connections hijacked by a Handler are not affected.
+func (srv *Server) Close() os.Error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	err := srv.closeListenersLocked()
+	srv.closeConnsLocked(false)
+	return err
+}
+
+// closeListenersLocked marks srv as closing and closes its listeners,
+// returning the first error encountered.  srv.mu must be held.
+func (srv *Server) closeListenersLocked() (err os.Error) {
+	srv.closing = true
+	if srv.drained == nil {
+		srv.drained = make(chan bool)
+		if len(srv.conns) == 0 {
+			close(srv.drained)
+		}
+	}
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		srv.listeners[l] = false, false
+	}
+	return
+}
+
+// closeConnsLocked closes srv's connections, or only those idle
+// between requests if idleOnly is set.  srv.mu must be held.
+func (srv *Server) closeConnsLocked(idleOnly bool) {
+	for c, idle := range srv.conns {
+		if idle || !idleOnly {
+			c.rwc.Close()
+		}
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+func (srv *Server) addListener(l net.Listener) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]bool)
+	}
+	srv.listeners[l] = true
+	return true
+}
+
+func (srv *Server) forgetListener(l net.Listener) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.listeners[l] = false, false
+}
+
+func (srv *Server) addConn(c *conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		return false
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[*conn]bool)
+	}
+	srv.conns[c] = false
+	return true
+}
+
+// setConnIdle records whether c is idle between requests.  It
+// returns false if the server is shutting down, in which case
+// the caller should close c instead.
+func (srv *Server) setConnIdle(c *conn, idle bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		return false
+	}
+	srv.conns[c] = idle
+	return true
+}
+
+// forgetConn stops tracking c, which is being closed or hijacked.
+func (srv *Server) forgetConn(c *conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.conns[c]; !ok {
+		return
+	}
+	srv.conns[c] = false, false
+	if srv.closing && len(srv.conns) == 0 {
+		close(srv.drained)
+	}
+}
+
 // ListenAndServe listens on the TCP network address addr
 // and then calls Serve with handler to handle requests
 // on incoming connections.  Handler is typically nil,
@@ -940,11 +1423,28 @@ func ListenAndServe(addr string, handler Handler) os.Error {
 //
 // One can use generate_cert.go in crypto/tls to generate cert.pem and key.pem.
 func ListenAndServeTLS(addr string, certFile string, keyFile string, handler Handler) os.Error {
+	server := &Server{Addr: addr, Handler: handler}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ListenAndServeTLS listens on the TCP network address srv.Addr and
+// then calls Serve to handle requests on incoming TLS connections.
+// Files containing a certificate and matching private key for the
+// server must be provided.  If srv.Addr is blank, ":https" is used.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) os.Error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":https"
+	}
 	config := &tls.Config{
-		Rand:       rand.Reader,
-		Time:       time.Seconds,
-		NextProtos: []string{"http/1.1"},
+		Rand: rand.Reader,
+		Time: time.Seconds,
+	}
+	for proto := range srv.TLSNextProto {
+		config.NextProtos = append(config.NextProtos, proto)
 	}
+	sort.SortStrings(config.NextProtos)
+	config.NextProtos = append(config.NextProtos, "http/1.1")
 
 	var err os.Error
 	config.Certificates = make([]tls.Certificate, 1)
@@ -959,7 +1459,7 @@ func ListenAndServeTLS(addr string, certFile string, keyFile string, handler Han
 	}
 
 	tlsListener := tls.NewListener(conn, config)
-	return Serve(tlsListener, handler)
+	return srv.Serve(tlsListener)
 }
 
 // TimeoutHandler returns a Handler that runs h with the given time limit.
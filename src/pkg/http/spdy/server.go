@@ -0,0 +1,289 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"http"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// hopHeaders lists the HTTP headers that are specific to a connection
+// and so are not carried over SPDY.
+var hopHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+}
+
+// synHeaders lists the SPDY headers that carry the request or status
+// line, and which are therefore not HTTP headers.
+var synHeaders = map[string]bool{
+	"method":  true,
+	"url":     true,
+	"version": true,
+	"status":  true,
+}
+
+var errMissingHeaders = os.NewError("spdy: stream lacks required headers")
+
+// ConfigureServer arranges for srv to serve SPDY on TLS connections
+// that negotiate it with NPN.  If config is not nil, NPNProtocol is
+// added to the front of its NextProtos; this is necessary when srv
+// serves a TLS listener created by the caller rather than by
+// srv.ListenAndServeTLS.
+func ConfigureServer(srv *http.Server, config *tls.Config) {
+	if srv.TLSNextProto == nil {
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	srv.TLSNextProto[NPNProtocol] = func(_ *http.Server, c *tls.Conn, h http.Handler) {
+		Serve(c, h)
+	}
+	if config == nil {
+		return
+	}
+	for _, proto := range config.NextProtos {
+		if proto == NPNProtocol {
+			return
+		}
+	}
+	config.NextProtos = append([]string{NPNProtocol}, config.NextProtos...)
+}
+
+// Serve serves HTTP requests arriving as SPDY streams on c, which
+// must already have negotiated SPDY, until the session ends.  Each
+// request is handled by h in its own goroutine; if h is nil,
+// http.DefaultServeMux is used.
+func Serve(c net.Conn, h http.Handler) os.Error {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	s, err := NewSession(c, true)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	defer s.Close()
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		tlsState = new(tls.ConnectionState)
+		*tlsState = tlsConn.ConnectionState()
+	}
+	remoteAddr := c.RemoteAddr().String()
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			if err == ErrSessionClosed {
+				return nil
+			}
+			return err
+		}
+		go serveStream(st, h, remoteAddr, tlsState)
+	}
+	panic("not reached")
+}
+
+func serveStream(st *Stream, h http.Handler, remoteAddr string, tlsState *tls.ConnectionState) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("spdy: panic serving stream %d from %v: %v", st.Id(), remoteAddr, err)
+			st.Reset(InternalError)
+		}
+	}()
+
+	req, err := newRequest(st)
+	if err != nil {
+		st.Reset(ProtocolError)
+		return
+	}
+	req.RemoteAddr = remoteAddr
+	req.TLS = tlsState
+
+	w := &responseWriter{stream: st, req: req, header: make(http.Header)}
+	w.bw = bufio.NewWriter(st)
+	h.ServeHTTP(w, req)
+	w.finish()
+}
+
+// headerValue returns the first value of the SPDY header name.
+// SPDY header names are lower case, so http.Header.Get, which
+// canonicalizes its argument, cannot be used.
+func headerValue(h http.Header, name string) string {
+	if v := h[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// newRequest builds the Request carried by a stream opened by the
+// peer.  Its SYN_STREAM headers are rendered as an HTTP/1.1 request
+// header and parsed by http.ReadRequest, so that the Request is
+// filled in just as for one that arrived over HTTP.
+func newRequest(st *Stream) (*http.Request, os.Error) {
+	h, err := st.Header()
+	if err != nil {
+		return nil, err
+	}
+	method, url, version := headerValue(h, "method"), headerValue(h, "url"), headerValue(h, "version")
+	if method == "" || url == "" || version == "" {
+		return nil, errMissingHeaders
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\r\n", method, url, version)
+	if err := writeHTTPHeader(&buf, h); err != nil {
+		return nil, err
+	}
+	req, err := http.ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Body = &streamBody{st: st}
+	if _, ok := h["content-length"]; !ok && !st.remoteClosed() {
+		req.ContentLength = -1
+	}
+	return req, nil
+}
+
+// writeHTTPHeader writes the HTTP headers among the SPDY headers h
+// in wire format, followed by the blank line that ends a header.
+func writeHTTPHeader(buf *bytes.Buffer, h http.Header) os.Error {
+	exclude := make(map[string]bool)
+	for k := range h {
+		if hopHeaders[k] || synHeaders[k] {
+			exclude[k] = true
+		}
+	}
+	if err := h.WriteSubset(buf, exclude); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+	return nil
+}
+
+// spdyHeader returns the HTTP header h as SPDY headers, with lower
+// case names and without the connection-specific headers.
+func spdyHeader(h http.Header) http.Header {
+	sh := make(http.Header)
+	for k, vv := range h {
+		k = strings.ToLower(k)
+		if hopHeaders[k] || synHeaders[k] {
+			continue
+		}
+		sh[k] = append(sh[k], vv...)
+	}
+	return sh
+}
+
+// A streamBody is a Request or Response body read from a stream.
+type streamBody struct {
+	st *Stream
+
+	// cancel is whether Close resets the stream if the peer has
+	// not finished sending.
+	cancel bool
+
+	// done, if not nil, is called once the body has been read in
+	// full or closed.
+	done func()
+}
+
+func (b *streamBody) Read(p []byte) (int, os.Error) {
+	n, err := b.st.Read(p)
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *streamBody) Close() os.Error {
+	b.finish()
+	if b.cancel && !b.st.remoteClosed() {
+		return b.st.Reset(Cancel)
+	}
+	return nil
+}
+
+func (b *streamBody) finish() {
+	if b.done != nil {
+		b.done()
+		b.done = nil
+	}
+}
+
+// A responseWriter is the http.ResponseWriter for a request that
+// arrived on a SPDY stream.
+type responseWriter struct {
+	stream      *Stream
+	req         *http.Request
+	header      http.Header
+	bw          *bufio.Writer // buffers writes to stream
+	wroteHeader bool
+	status      int
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		log.Print("spdy: multiple response.WriteHeader calls")
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	if code != http.StatusNotModified && w.header.Get("Content-Type") == "" {
+		w.header.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if w.header.Get("Date") == "" {
+		w.header.Set("Date", time.UTC().Format(http.TimeFormat))
+	}
+	h := spdyHeader(w.header)
+	h["status"] = []string{fmt.Sprintf("%d %s", code, http.StatusText(code))}
+	h["version"] = []string{"HTTP/1.1"}
+	w.stream.Reply(h, false)
+}
+
+func (w *responseWriter) Write(data []byte) (int, os.Error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if w.status == http.StatusNotModified || w.req.Method == "HEAD" {
+		// Must not have body.
+		return 0, http.ErrBodyNotAllowed
+	}
+	return w.bw.Write(data)
+}
+
+// Flush implements the http.Flusher interface.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.bw.Flush()
+}
+
+// finish completes the response once the handler has returned.
+func (w *responseWriter) finish() {
+	w.Flush()
+	w.stream.Close()
+	// The handler is done with the request body; stop the
+	// peer from sending any more of it.
+	if !w.stream.remoteClosed() {
+		w.stream.Reset(Cancel)
+	}
+}
@@ -0,0 +1,671 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"http"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// NPNProtocol is the name under which this version of SPDY is
+// negotiated with TLS NPN.
+const NPNProtocol = "spdy/2"
+
+const (
+	// DefaultInitialWindowSize is the flow control window, in bytes,
+	// of a new stream, unless the peer announces a different one.
+	DefaultInitialWindowSize = 64 << 10
+
+	// DefaultMaxConcurrentStreams is the number of streams a server
+	// Session lets its peer have open at once.
+	DefaultMaxConcurrentStreams = 100
+
+	// maxDataFrameLength is the largest DATA frame a Session writes.
+	maxDataFrameLength = 16 << 10
+)
+
+var (
+	ErrSessionClosed = os.NewError("spdy: session closed")
+	ErrGoAway        = os.NewError("spdy: session is going away")
+	ErrStreamClosed  = os.NewError("spdy: stream closed")
+	ErrStreamRefused = os.NewError("spdy: stream refused by peer")
+)
+
+// A StreamError reports that the peer reset a stream.
+type StreamError struct {
+	StreamId uint32
+	Status   StatusCode
+}
+
+func (e *StreamError) String() string {
+	return fmt.Sprintf("spdy: stream %d reset with status %d", e.StreamId, e.Status)
+}
+
+// A Session multiplexes streams over a single SPDY connection.  It
+// answers the peer's PINGs and obeys its SETTINGS and GOAWAY frames.
+// It sends WINDOW_UPDATE frames as it reads the data it receives.  As
+// peers of draft 2 of the protocol need not follow flow control, the
+// windows are only enforced, on the data sent in either direction,
+// once the peer has announced an initial window size.
+type Session struct {
+	conn   net.Conn
+	framer *Framer
+	server bool
+
+	wmu sync.Mutex // serializes frame writes
+	bw  *bufio.Writer
+
+	mu             sync.Mutex
+	cond           *sync.Cond // broadcast on any change to the session or its streams
+	streams        map[uint32]*Stream
+	accepted       []*Stream // streams opened by the peer, not yet returned by Accept
+	nextStreamId   uint32    // id of the next stream opened locally
+	lastPeerStream uint32    // id of the last stream opened by the peer
+	numLocal       int       // open streams opened locally
+	numPeer        int       // open streams opened by the peer
+	maxStreams     int       // peer's limit on numLocal; 0 means none
+	peerFlow       bool      // peer announced an initial window size
+	initialSend    int32     // send window of new streams
+	pings          map[uint32]chan bool
+	nextPingId     uint32
+	goingAway      bool     // GOAWAY sent or received
+	err            os.Error // non-nil once the session has ended
+}
+
+// NewSession starts a SPDY session on c, which must already have
+// negotiated SPDY.  The server argument reports whether the local
+// end is the server; it determines the ids of the streams and pings
+// that the session originates.
+func NewSession(c net.Conn, server bool) (*Session, os.Error) {
+	bw := bufio.NewWriter(c)
+	framer, err := NewFramer(bw, bufio.NewReader(c))
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		conn:         c,
+		framer:       framer,
+		server:       server,
+		bw:           bw,
+		streams:      make(map[uint32]*Stream),
+		nextStreamId: 1,
+		initialSend:  DefaultInitialWindowSize,
+		pings:        make(map[uint32]chan bool),
+		nextPingId:   1,
+	}
+	if server {
+		s.nextStreamId = 2
+		s.nextPingId = 2
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.readLoop()
+
+	settings := &SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{Id: SettingsInitialWindowSize, Value: DefaultInitialWindowSize},
+	}}
+	if server {
+		settings.FlagIdValues = append(settings.FlagIdValues,
+			SettingsFlagIdValue{Id: SettingsMaxConcurrentStreams, Value: DefaultMaxConcurrentStreams})
+	}
+	if err := s.writeFrame(settings); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Open opens a new stream, sending SYN_STREAM with the given headers.
+// If fin is true, the local side of the stream is closed at once.
+// Open waits while the peer's limit on concurrent streams is reached.
+func (s *Session) Open(h http.Header, fin bool) (*Stream, os.Error) {
+	// Stream ids must be sent in increasing order, so the id is
+	// allocated and the SYN_STREAM written under wmu.  But wmu must
+	// not be held while waiting for room, since the streams that
+	// hold the room need it to finish.
+	for {
+		s.mu.Lock()
+		for s.err == nil && !s.goingAway && s.maxStreams > 0 && s.numLocal >= s.maxStreams {
+			s.cond.Wait()
+		}
+		s.mu.Unlock()
+
+		s.wmu.Lock()
+		s.mu.Lock()
+		if s.err != nil || s.goingAway || s.maxStreams == 0 || s.numLocal < s.maxStreams {
+			break
+		}
+		s.mu.Unlock()
+		s.wmu.Unlock()
+	}
+	var err os.Error
+	switch {
+	case s.err != nil:
+		err = s.err
+	case s.goingAway:
+		err = ErrGoAway
+	}
+	if err != nil {
+		s.mu.Unlock()
+		s.wmu.Unlock()
+		return nil, err
+	}
+	st := s.newStreamLocked(s.nextStreamId, false)
+	s.nextStreamId += 2
+	st.localFin = fin
+	s.mu.Unlock()
+
+	f := &SynStreamFrame{StreamId: st.id, Headers: h}
+	if fin {
+		f.CFHeader.Flags = ControlFlagFin
+	}
+	err = s.framer.WriteFrame(f)
+	if err == nil {
+		err = s.bw.Flush()
+	}
+	s.wmu.Unlock()
+	if err != nil {
+		s.fail(err)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for and returns the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, os.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.accepted) == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	st := s.accepted[0]
+	s.accepted = s.accepted[1:]
+	return st, nil
+}
+
+// Ping sends a PING frame and waits for the peer to echo it.
+// It returns the round trip time in nanoseconds.
+func (s *Session) Ping() (int64, os.Error) {
+	s.mu.Lock()
+	if s.err != nil {
+		defer s.mu.Unlock()
+		return 0, s.err
+	}
+	id := s.nextPingId
+	s.nextPingId += 2
+	ch := make(chan bool, 1)
+	s.pings[id] = ch
+	s.mu.Unlock()
+
+	start := time.Nanoseconds()
+	if err := s.writeFrame(&PingFrame{Id: id}); err != nil {
+		return 0, err
+	}
+	if ok := <-ch; !ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return 0, s.err
+	}
+	return time.Nanoseconds() - start, nil
+}
+
+// GoAway tells the peer that the session is ending.  Streams the peer
+// has already opened are still served, but new ones are refused, and
+// Open fails with ErrGoAway.
+func (s *Session) GoAway() os.Error {
+	s.mu.Lock()
+	s.goingAway = true
+	last := s.lastPeerStream
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return s.writeFrame(&GoAwayFrame{LastGoodStreamId: last})
+}
+
+// Close sends GOAWAY and closes the connection.  Streams still open
+// fail with ErrSessionClosed.
+func (s *Session) Close() os.Error {
+	s.GoAway()
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+// usable reports whether new streams may be opened on s.
+func (s *Session) usable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err == nil && !s.goingAway
+}
+
+// writeFrame writes f to the connection.  An error ends the session.
+func (s *Session) writeFrame(f Frame) os.Error {
+	s.wmu.Lock()
+	err := s.framer.WriteFrame(f)
+	if err == nil {
+		err = s.bw.Flush()
+	}
+	s.wmu.Unlock()
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+// sendReset resets the stream with the given id.  It does not wait
+// for the frame to be written, so that it may be used by readLoop:
+// blocking there could deadlock with a peer that is itself blocked
+// writing to us.
+func (s *Session) sendReset(id uint32, status StatusCode) {
+	go s.writeFrame(&RstStreamFrame{StreamId: id, Status: status})
+}
+
+// fail ends the session with err, failing any streams and pings
+// still outstanding, and closes the connection.
+func (s *Session) fail(err os.Error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+		for _, st := range s.streams {
+			if st.err == nil {
+				st.err = err
+			}
+		}
+		for id, ch := range s.pings {
+			close(ch)
+			s.pings[id] = nil, false
+		}
+		s.cond.Broadcast()
+	}
+	s.mu.Unlock()
+	s.conn.Close()
+}
+
+func (s *Session) readLoop() {
+	for {
+		f, err := s.framer.ReadFrame()
+		if err != nil {
+			if err == os.EOF {
+				err = ErrSessionClosed
+			}
+			s.fail(err)
+			return
+		}
+		s.mu.Lock()
+		s.handleFrameLocked(f)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+func (s *Session) handleFrameLocked(frame Frame) {
+	switch f := frame.(type) {
+	case *SynStreamFrame:
+		id := f.StreamId
+		if id == 0 || id%2 == s.nextStreamId%2 || id <= s.lastPeerStream {
+			s.sendReset(id, ProtocolError)
+			return
+		}
+		s.lastPeerStream = id
+		if !s.server || s.goingAway || s.numPeer >= DefaultMaxConcurrentStreams {
+			s.sendReset(id, RefusedStream)
+			return
+		}
+		st := s.newStreamLocked(id, true)
+		st.header = f.Headers
+		st.remoteFin = f.CFHeader.Flags&ControlFlagFin != 0
+		s.accepted = append(s.accepted, st)
+
+	case *SynReplyFrame:
+		st := s.streams[f.StreamId]
+		if st == nil {
+			s.sendReset(f.StreamId, InvalidStream)
+			return
+		}
+		if st.peer || st.header != nil {
+			s.resetLocked(st, ProtocolError)
+			return
+		}
+		st.header = f.Headers
+		if f.CFHeader.Flags&ControlFlagFin != 0 {
+			st.remoteFin = true
+			s.removeIfDoneLocked(st)
+		}
+
+	case *HeadersFrame:
+		st := s.streams[f.StreamId]
+		if st == nil {
+			s.sendReset(f.StreamId, InvalidStream)
+			return
+		}
+		if st.header == nil || st.remoteFin {
+			s.resetLocked(st, ProtocolError)
+			return
+		}
+		for k, vv := range f.Headers {
+			st.header[k] = append(st.header[k], vv...)
+		}
+		if f.CFHeader.Flags&ControlFlagFin != 0 {
+			st.remoteFin = true
+			s.removeIfDoneLocked(st)
+		}
+
+	case *DataFrame:
+		st := s.streams[f.StreamId]
+		if st == nil {
+			s.sendReset(f.StreamId, InvalidStream)
+			return
+		}
+		if st.header == nil || st.remoteFin {
+			s.resetLocked(st, ProtocolError)
+			return
+		}
+		if s.peerFlow && int32(len(f.Data)) > st.recvWindow {
+			s.resetLocked(st, FlowControlError)
+			return
+		}
+		st.recvWindow -= int32(len(f.Data))
+		st.buf.Write(f.Data)
+		if f.Flags&DataFlagFin != 0 {
+			st.remoteFin = true
+			s.removeIfDoneLocked(st)
+		}
+
+	case *RstStreamFrame:
+		st := s.streams[f.StreamId]
+		if st == nil {
+			return
+		}
+		if f.Status == RefusedStream {
+			st.err = ErrStreamRefused
+		} else {
+			st.err = &StreamError{f.StreamId, f.Status}
+		}
+		s.removeStreamLocked(st)
+
+	case *SettingsFrame:
+		for _, v := range f.FlagIdValues {
+			switch v.Id {
+			case SettingsMaxConcurrentStreams:
+				s.maxStreams = int(v.Value)
+			case SettingsInitialWindowSize:
+				// Adjust the windows of the open streams by
+				// the change in the initial window size.
+				delta := int32(v.Value) - s.initialSend
+				for _, st := range s.streams {
+					st.sendWindow += delta
+				}
+				s.initialSend = int32(v.Value)
+				s.peerFlow = true
+			}
+		}
+
+	case *WindowUpdateFrame:
+		if st := s.streams[f.StreamId]; st != nil {
+			st.sendWindow += int32(f.DeltaWindowSize)
+		}
+
+	case *PingFrame:
+		if f.Id%2 != s.nextPingId%2 {
+			// The peer's ping; echo it.
+			go s.writeFrame(&PingFrame{Id: f.Id})
+			return
+		}
+		if ch := s.pings[f.Id]; ch != nil {
+			ch <- true
+			s.pings[f.Id] = nil, false
+		}
+
+	case *GoAwayFrame:
+		s.goingAway = true
+		// The peer did not process the streams we opened after
+		// the last good one; they may be retried elsewhere.
+		for id, st := range s.streams {
+			if !st.peer && id > f.LastGoodStreamId {
+				st.err = ErrStreamRefused
+				s.removeStreamLocked(st)
+			}
+		}
+
+	case *NoopFrame:
+		// Nothing to do.
+	}
+}
+
+func (s *Session) newStreamLocked(id uint32, peer bool) *Stream {
+	st := &Stream{
+		session:    s,
+		id:         id,
+		peer:       peer,
+		recvWindow: DefaultInitialWindowSize,
+		sendWindow: s.initialSend,
+	}
+	s.streams[id] = st
+	if peer {
+		s.numPeer++
+	} else {
+		s.numLocal++
+	}
+	return st
+}
+
+func (s *Session) removeStreamLocked(st *Stream) {
+	if s.streams[st.id] != st {
+		return
+	}
+	s.streams[st.id] = nil, false
+	if st.peer {
+		s.numPeer--
+	} else {
+		s.numLocal--
+	}
+}
+
+// removeIfDoneLocked forgets st once both of its sides are closed.
+func (s *Session) removeIfDoneLocked(st *Stream) {
+	if st.localFin && st.remoteFin {
+		s.removeStreamLocked(st)
+	}
+}
+
+// resetLocked fails st and resets it with the given status.
+func (s *Session) resetLocked(st *Stream, status StatusCode) {
+	st.err = &StreamError{st.id, status}
+	s.removeStreamLocked(st)
+	s.sendReset(st.id, status)
+}
+
+// A Stream is a single stream of a Session.  Read returns the data
+// sent by the peer and Write sends data to it; Close closes the local
+// side of the stream.
+type Stream struct {
+	session *Session
+	id      uint32
+	peer    bool // opened by the peer
+
+	// The remaining fields are guarded by session.mu.
+	header     http.Header  // received with SYN_STREAM or SYN_REPLY; nil until then
+	buf        bytes.Buffer // data received but not yet read
+	recvWindow int32        // bytes the peer may still send us
+	unacked    int32        // bytes read but not yet returned to recvWindow
+	sendWindow int32        // bytes the peer is prepared to receive
+	replied    bool         // SYN_REPLY sent, for streams opened by the peer
+	localFin   bool
+	remoteFin  bool
+	err        os.Error // non-nil once the stream has been reset
+}
+
+// Id returns the stream's id.
+func (st *Stream) Id() uint32 { return st.id }
+
+// Header returns the headers the peer sent when opening or replying
+// to the stream, waiting for them if necessary.
+func (st *Stream) Header() (http.Header, os.Error) {
+	s := st.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for st.header == nil && st.err == nil {
+		s.cond.Wait()
+	}
+	if st.header == nil {
+		return nil, st.err
+	}
+	return st.header, nil
+}
+
+// Reply replies to a stream opened by the peer, sending SYN_REPLY
+// with the given headers.  If fin is true, the local side of the
+// stream is closed at once.
+func (st *Stream) Reply(h http.Header, fin bool) os.Error {
+	s := st.session
+	s.mu.Lock()
+	var err os.Error
+	switch {
+	case !st.peer || st.replied:
+		err = os.NewError("spdy: Reply on stream that cannot be replied to")
+	case st.err != nil:
+		err = st.err
+	}
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	st.replied = true
+	st.localFin = fin
+	s.removeIfDoneLocked(st)
+	s.mu.Unlock()
+
+	f := &SynReplyFrame{StreamId: st.id, Headers: h}
+	if fin {
+		f.CFHeader.Flags = ControlFlagFin
+	}
+	return s.writeFrame(f)
+}
+
+// Read reads data sent by the peer.  It returns os.EOF once the peer
+// has closed its side of the stream and all data has been read.
+func (st *Stream) Read(p []byte) (n int, err os.Error) {
+	s := st.session
+	s.mu.Lock()
+	for st.buf.Len() == 0 && !st.remoteFin && st.err == nil {
+		s.cond.Wait()
+	}
+	switch {
+	case st.buf.Len() > 0:
+		n, _ = st.buf.Read(p)
+	case st.remoteFin:
+		err = os.EOF
+	default:
+		err = st.err
+	}
+	// Return the data read to the window we announced once
+	// enough of it has accumulated.
+	var ack int32
+	if n > 0 && !st.remoteFin {
+		st.unacked += int32(n)
+		if st.unacked >= DefaultInitialWindowSize/2 {
+			ack, st.unacked = st.unacked, 0
+			st.recvWindow += ack
+		}
+	}
+	s.mu.Unlock()
+	if ack > 0 {
+		s.writeFrame(&WindowUpdateFrame{StreamId: st.id, DeltaWindowSize: uint32(ack)})
+	}
+	return n, err
+}
+
+// Write sends p to the peer in one or more DATA frames, waiting as
+// needed for room in the stream's flow control window.
+func (st *Stream) Write(p []byte) (n int, err os.Error) {
+	s := st.session
+	for len(p) > 0 {
+		s.mu.Lock()
+		for st.err == nil && !st.localFin && s.peerFlow && st.sendWindow <= 0 {
+			s.cond.Wait()
+		}
+		switch {
+		case st.err != nil:
+			err = st.err
+		case st.localFin:
+			err = ErrStreamClosed
+		case st.peer && !st.replied:
+			err = os.NewError("spdy: Write on stream before Reply")
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return
+		}
+		m := len(p)
+		if m > maxDataFrameLength {
+			m = maxDataFrameLength
+		}
+		if s.peerFlow && int32(m) > st.sendWindow {
+			m = int(st.sendWindow)
+		}
+		st.sendWindow -= int32(m)
+		s.mu.Unlock()
+
+		if err = s.writeFrame(&DataFrame{StreamId: st.id, Data: p[:m]}); err != nil {
+			return
+		}
+		n += m
+		p = p[m:]
+	}
+	return
+}
+
+// Close closes the local side of the stream, telling the peer that
+// no more data will be written.  Data from the peer may still be read.
+func (st *Stream) Close() os.Error {
+	s := st.session
+	s.mu.Lock()
+	if st.localFin || st.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	if st.peer && !st.replied {
+		s.mu.Unlock()
+		return st.Reply(http.Header{}, true)
+	}
+	st.localFin = true
+	s.removeIfDoneLocked(st)
+	s.mu.Unlock()
+	return s.writeFrame(&DataFrame{StreamId: st.id, Flags: DataFlagFin})
+}
+
+// Reset aborts the stream, sending RST_STREAM with the given status.
+func (st *Stream) Reset(status StatusCode) os.Error {
+	return st.reset(status, ErrStreamClosed)
+}
+
+// reset aborts the stream like Reset, failing local calls on it
+// with err.
+func (st *Stream) reset(status StatusCode, err os.Error) os.Error {
+	s := st.session
+	s.mu.Lock()
+	if st.err != nil || st.localFin && st.remoteFin {
+		s.mu.Unlock()
+		return nil
+	}
+	st.err = err
+	s.removeStreamLocked(st)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return s.writeFrame(&RstStreamFrame{StreamId: st.id, Status: status})
+}
+
+// remoteClosed reports whether the peer has closed its side of st.
+func (st *Stream) remoteClosed() bool {
+	s := st.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return st.remoteFin
+}
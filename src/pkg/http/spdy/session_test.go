@@ -0,0 +1,322 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// newServerSession serves h over SPDY on one end of a pipe and
+// returns a client Session on the other.
+func newServerSession(t *testing.T, h http.Handler) *Session {
+	c, sc := net.Pipe()
+	go Serve(sc, h)
+	s, err := NewSession(c, false)
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	return s
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	s := newServerSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading request body: %v", err)
+		}
+		w.Header().Set("X-Path", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s host=%s agent=%s", r.Method, r.URL.RawQuery, body, r.Host, r.UserAgent)
+	}))
+	defer s.Close()
+
+	req, err := http.NewRequest("POST", "https://example.com/echo?x=1", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.UserAgent = "spdytest"
+	res, err := s.RoundTrip(req)
+	if err != nil {
+		t.Fatal("RoundTrip:", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("StatusCode = %d; want %d", res.StatusCode, http.StatusCreated)
+	}
+	if g, e := res.Header.Get("X-Path"), "/echo"; g != e {
+		t.Errorf("X-Path = %q; want %q", g, e)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal("reading response body:", err)
+	}
+	if g, e := string(body), "POST x=1 hello host=example.com agent=spdytest"; g != e {
+		t.Errorf("body = %q; want %q", g, e)
+	}
+}
+
+func TestSessionConcurrentStreams(t *testing.T) {
+	s := newServerSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path=%s", r.URL.Path)
+	}))
+	defer s.Close()
+
+	const n = 10
+	errc := make(chan string, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("https://example.com/%d", i), nil)
+			res, err := s.RoundTrip(req)
+			if err != nil {
+				errc <- err.String()
+				return
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if g, e := string(body), fmt.Sprintf("path=/%d", i); g != e {
+				errc <- fmt.Sprintf("body = %q; want %q", g, e)
+				return
+			}
+			errc <- ""
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errc; err != "" {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSessionFlowControl(t *testing.T) {
+	// A response several times the initial window can only be
+	// received if the client returns window to the server.
+	big := bytes.Repeat([]byte("0123456789abcdef"), DefaultInitialWindowSize/4)
+	s := newServerSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(big)
+	}))
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", "https://example.com/big", nil)
+	res, err := s.RoundTrip(req)
+	if err != nil {
+		t.Fatal("RoundTrip:", err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal("reading response body:", err)
+	}
+	if !bytes.Equal(body, big) {
+		t.Errorf("got %d bytes of body; want %d", len(body), len(big))
+	}
+}
+
+func TestSessionPingAndGoAway(t *testing.T) {
+	// Each end writes SETTINGS as it starts, which blocks
+	// until the other end reads it.
+	c, sc := net.Pipe()
+	serverc := make(chan *Session)
+	go func() {
+		s, err := NewSession(sc, true)
+		if err != nil {
+			t.Error("NewSession:", err)
+		}
+		serverc <- s
+	}()
+	client, err := NewSession(c, false)
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	defer client.Close()
+	server := <-serverc
+	if server == nil {
+		return
+	}
+	defer server.Close()
+
+	st, err := client.Open(http.Header{"method": {"GET"}}, true)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	sst, err := server.Accept()
+	if err != nil {
+		t.Fatal("Accept:", err)
+	}
+	if sst.Id() != st.Id() {
+		t.Errorf("accepted stream %d; want %d", sst.Id(), st.Id())
+	}
+
+	if _, err := client.Ping(); err != nil {
+		t.Fatal("client Ping:", err)
+	}
+	if err := server.GoAway(); err != nil {
+		t.Fatal("GoAway:", err)
+	}
+	// The server's reply to a ping follows its GOAWAY.
+	if _, err := client.Ping(); err != nil {
+		t.Fatal("client Ping after GoAway:", err)
+	}
+	if _, err := client.Open(http.Header{"method": {"GET"}}, true); err != ErrGoAway {
+		t.Errorf("Open after GOAWAY: got error %v; want %v", err, ErrGoAway)
+	}
+
+	// The stream opened before GOAWAY is still served.
+	if err := sst.Reply(http.Header{"status": {"200 OK"}}, false); err != nil {
+		t.Fatal("Reply:", err)
+	}
+	go func() {
+		sst.Write([]byte("still here"))
+		sst.Close()
+	}()
+	body, err := ioutil.ReadAll(st)
+	if err != nil {
+		t.Fatal("reading stream:", err)
+	}
+	if g, e := string(body), "still here"; g != e {
+		t.Errorf("stream data = %q; want %q", g, e)
+	}
+}
+
+// newRawPeer starts a server Session on one end of a pipe and returns
+// a Framer for the other, along with a channel of the frames the
+// Session sends.
+func newRawPeer(t *testing.T) (*Session, *Framer, chan Frame) {
+	c, pc := net.Pipe()
+	f, err := NewFramer(pc, pc)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	frames := make(chan Frame, 100)
+	go func() {
+		for {
+			fr, err := f.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- fr
+		}
+	}()
+	s, err := NewSession(c, true)
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	return s, f, frames
+}
+
+// sendData writes n bytes to stream id in DATA frames of at most 16KB.
+func sendData(t *testing.T, f *Framer, id uint32, n int, fin bool) {
+	for n > 0 {
+		m := n
+		if m > 16<<10 {
+			m = 16 << 10
+		}
+		n -= m
+		var flags DataFlags
+		if n == 0 && fin {
+			flags = DataFlagFin
+		}
+		if err := f.WriteFrame(&DataFrame{StreamId: id, Flags: flags, Data: make([]byte, m)}); err != nil {
+			t.Fatal("writing DATA:", err)
+		}
+	}
+}
+
+func TestSessionReceiveWindowWithoutSettings(t *testing.T) {
+	// A peer that announces no SETTINGS still gets the default
+	// window replenished as we read.
+	s, f, frames := newRawPeer(t)
+	defer s.Close()
+
+	syn := &SynStreamFrame{StreamId: 1, Headers: http.Header{"method": {"POST"}}}
+	if err := f.WriteFrame(syn); err != nil {
+		t.Fatal("writing SYN_STREAM:", err)
+	}
+	st, err := s.Accept()
+	if err != nil {
+		t.Fatal("Accept:", err)
+	}
+	done := make(chan int)
+	go func() {
+		body, err := ioutil.ReadAll(st)
+		if err != nil {
+			t.Error("reading stream:", err)
+		}
+		done <- len(body)
+	}()
+
+	sendData(t, f, 1, DefaultInitialWindowSize, false)
+	for fr := range frames {
+		if wu, ok := fr.(*WindowUpdateFrame); ok && wu.StreamId == 1 {
+			break
+		}
+		if _, ok := fr.(*RstStreamFrame); ok {
+			t.Fatal("stream reset before WINDOW_UPDATE")
+		}
+	}
+	sendData(t, f, 1, DefaultInitialWindowSize/2, true)
+	if g, e := <-done, DefaultInitialWindowSize*3/2; g != e {
+		t.Errorf("read %d bytes; want %d", g, e)
+	}
+}
+
+func TestSessionReceiveWithoutFlowControl(t *testing.T) {
+	// A draft 2 peer, which announces no initial window size,
+	// may send more than the window before reading any updates.
+	s, f, _ := newRawPeer(t)
+	defer s.Close()
+
+	syn := &SynStreamFrame{StreamId: 1, Headers: http.Header{"method": {"POST"}}}
+	if err := f.WriteFrame(syn); err != nil {
+		t.Fatal("writing SYN_STREAM:", err)
+	}
+	st, err := s.Accept()
+	if err != nil {
+		t.Fatal("Accept:", err)
+	}
+	sendData(t, f, 1, DefaultInitialWindowSize*2, true)
+	body, err := ioutil.ReadAll(st)
+	if err != nil {
+		t.Fatal("reading stream:", err)
+	}
+	if g, e := len(body), DefaultInitialWindowSize*2; g != e {
+		t.Errorf("read %d bytes; want %d", g, e)
+	}
+}
+
+func TestSessionReceiveWindowExceeded(t *testing.T) {
+	s, f, frames := newRawPeer(t)
+	defer s.Close()
+
+	settings := &SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{Id: SettingsInitialWindowSize, Value: DefaultInitialWindowSize},
+	}}
+	if err := f.WriteFrame(settings); err != nil {
+		t.Fatal("writing SETTINGS:", err)
+	}
+	syn := &SynStreamFrame{StreamId: 1, Headers: http.Header{"method": {"POST"}}}
+	if err := f.WriteFrame(syn); err != nil {
+		t.Fatal("writing SYN_STREAM:", err)
+	}
+	if _, err := s.Accept(); err != nil {
+		t.Fatal("Accept:", err)
+	}
+	sendData(t, f, 1, DefaultInitialWindowSize+1, false)
+	for fr := range frames {
+		if rst, ok := fr.(*RstStreamFrame); ok {
+			if rst.StreamId != 1 || rst.Status != FlowControlError {
+				t.Errorf("got RST_STREAM %d status %d; want 1 status %d", rst.StreamId, rst.Status, FlowControlError)
+			}
+			return
+		}
+	}
+	t.Error("session closed without resetting the stream")
+}
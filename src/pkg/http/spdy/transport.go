@@ -0,0 +1,378 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"http"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transport is an http.RoundTripper that sends https requests over
+// SPDY to servers that negotiate it with TLS NPN, keeping one Session
+// for each server.  For requests it does not send, such as those to
+// servers that do not speak SPDY, RoundTrip returns
+// http.ErrSkipAltProtocol, so that an http.Transport with which the
+// Transport is registered sends them over HTTP instead.
+type Transport struct {
+	// TLSConfig, if non-nil, is the TLS configuration used for new
+	// connections.  Its NextProtos are replaced by NPNProtocol and
+	// "http/1.1".
+	TLSConfig *tls.Config
+
+	// Dial specifies the dial function for creating TCP
+	// connections.
+	// If Dial is nil, net.Dial is used.
+	Dial func(net, addr string) (c net.Conn, err os.Error)
+
+	// Proxy, if non-nil, is consulted for each request in the same
+	// way as by http.Transport.  Requests to be sent through a
+	// proxy are not sent over SPDY.
+	Proxy func(*http.Request) (*http.URL, os.Error)
+
+	lk       sync.Mutex
+	sessions map[string]*Session       // keyed by host:port
+	noSPDY   map[string]bool           // servers that did not negotiate SPDY
+	reqs     map[*http.Request]*Stream // requests in flight; nil until their stream is open
+}
+
+// ConfigureTransport returns a new Transport, using t's Dial and Proxy
+// functions, that it registers with t for the "https" scheme.
+func ConfigureTransport(t *http.Transport) *Transport {
+	st := &Transport{Dial: t.Dial, Proxy: t.Proxy}
+	t.RegisterProtocol("https", st)
+	return st
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err os.Error) {
+	if req.URL == nil {
+		if req.URL, err = http.ParseURL(req.RawURL); err != nil {
+			return
+		}
+	}
+	if req.URL.Scheme != "https" {
+		return nil, http.ErrSkipAltProtocol
+	}
+	if t.Proxy != nil {
+		proxyURL, err := t.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			return nil, http.ErrSkipAltProtocol
+		}
+	}
+	addr := req.URL.Host
+	if strings.LastIndex(addr, ":") <= strings.LastIndex(addr, "]") {
+		addr += ":443"
+	}
+
+	t.setReqStream(req, nil)
+	opened := func(st *Stream) bool { return t.replaceReqStream(req, st) }
+	for retried := false; ; retried = true {
+		s, err := t.getSession(addr)
+		if err != nil || s == nil {
+			t.forgetReq(req)
+			if err != nil {
+				return nil, err
+			}
+			return nil, http.ErrSkipAltProtocol
+		}
+		resp, err = s.roundTrip(req, opened)
+		if err != nil && !retried && req.Body == nil &&
+			(err == ErrGoAway || err == ErrStreamRefused) {
+			// The server did not process the request;
+			// try again on a new session.
+			t.forgetSession(addr, s)
+			continue
+		}
+		if err != nil {
+			t.forgetReq(req)
+			return nil, err
+		}
+		// The request stays cancelable until its response
+		// body has been read or closed.
+		resp.Body.(*streamBody).done = func() { t.forgetReq(req) }
+		return resp, nil
+	}
+	panic("not reached")
+}
+
+// CancelRequest cancels an in-flight request by resetting its
+// stream.  The RoundTrip call, or reads from the body of the Response
+// it returned, fail with http.ErrRequestCanceled.  An http.Transport
+// with which t is registered passes its CancelRequest calls on to t.
+func (t *Transport) CancelRequest(req *http.Request) {
+	t.lk.Lock()
+	st, ok := t.reqs[req]
+	if ok {
+		t.reqs[req] = nil, false
+	}
+	t.lk.Unlock()
+	if st != nil {
+		st.reset(Cancel, http.ErrRequestCanceled)
+	}
+}
+
+// setReqStream records req as in flight on st, which is nil until
+// the stream carrying req is open.
+func (t *Transport) setReqStream(req *http.Request, st *Stream) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.reqs == nil {
+		t.reqs = make(map[*http.Request]*Stream)
+	}
+	t.reqs[req] = st
+}
+
+// replaceReqStream records the stream carrying req.  It reports
+// false if req has been canceled.
+func (t *Transport) replaceReqStream(req *http.Request, st *Stream) bool {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if _, ok := t.reqs[req]; !ok {
+		return false
+	}
+	t.reqs[req] = st
+	return true
+}
+
+func (t *Transport) forgetReq(req *http.Request) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if _, ok := t.reqs[req]; ok {
+		t.reqs[req] = nil, false
+	}
+}
+
+// CloseIdleConnections closes the Transport's sessions.  Requests in
+// progress on them fail.
+func (t *Transport) CloseIdleConnections() {
+	t.lk.Lock()
+	sessions := t.sessions
+	t.sessions = nil
+	t.lk.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+}
+
+// getSession returns the session to use for requests to addr,
+// establishing it if necessary.  It returns a nil Session if the
+// server does not speak SPDY.
+func (t *Transport) getSession(addr string) (*Session, os.Error) {
+	t.lk.Lock()
+	if t.noSPDY[addr] {
+		t.lk.Unlock()
+		return nil, nil
+	}
+	if s := t.sessions[addr]; s != nil && s.usable() {
+		t.lk.Unlock()
+		return s, nil
+	}
+	t.lk.Unlock()
+
+	conn, err := t.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != NPNProtocol || !state.NegotiatedProtocolIsMutual {
+		conn.Close()
+		t.lk.Lock()
+		if t.noSPDY == nil {
+			t.noSPDY = make(map[string]bool)
+		}
+		t.noSPDY[addr] = true
+		t.lk.Unlock()
+		return nil, nil
+	}
+	s, err := NewSession(conn, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if old := t.sessions[addr]; old != nil && old.usable() {
+		// Another request established a session first.
+		go s.Close()
+		return old, nil
+	}
+	if t.sessions == nil {
+		t.sessions = make(map[string]*Session)
+	}
+	t.sessions[addr] = s
+	return s, nil
+}
+
+func (t *Transport) forgetSession(addr string, s *Session) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.sessions[addr] == s {
+		t.sessions[addr] = nil, false
+	}
+}
+
+func (t *Transport) dial(addr string) (*tls.Conn, os.Error) {
+	dial := t.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	config := new(tls.Config)
+	if t.TLSConfig != nil {
+		config = t.TLSConfig.Clone()
+	}
+	config.NextProtos = []string{NPNProtocol, "http/1.1"}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = tlsConn.VerifyHostname(host); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// RoundTrip sends req on a new stream of the client session s and
+// returns the server's response.  It implements the
+// http.RoundTripper interface.
+func (s *Session) RoundTrip(req *http.Request) (*http.Response, os.Error) {
+	return s.roundTrip(req, nil)
+}
+
+// roundTrip is RoundTrip, calling opened, if not nil, with the stream
+// carrying req once it is open.  If opened returns false, the stream
+// is reset and the request fails with http.ErrRequestCanceled.
+func (s *Session) roundTrip(req *http.Request, opened func(*Stream) bool) (*http.Response, os.Error) {
+	h, err := requestHeader(req)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.Open(h, req.Body == nil)
+	if err != nil {
+		return nil, err
+	}
+	if opened != nil && !opened(st) {
+		st.reset(Cancel, http.ErrRequestCanceled)
+		return nil, http.ErrRequestCanceled
+	}
+	if req.Body != nil {
+		go func() {
+			_, err := io.Copy(st, req.Body)
+			req.Body.Close()
+			if err != nil {
+				st.Reset(Cancel)
+				return
+			}
+			st.Close()
+		}()
+	}
+
+	rh, err := st.Header()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newResponse(st, rh, req)
+	if err != nil {
+		st.Reset(ProtocolError)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// requestHeader returns the SYN_STREAM headers for req.  The request
+// header is rendered by Request.WriteProxy, which gives the absolute
+// URL SPDY requires, and then parsed back, so that fields such as
+// UserAgent, Referer and Cookie are sent just as over HTTP.
+func requestHeader(req *http.Request) (http.Header, os.Error) {
+	// Only the fields that make up the header are copied: a
+	// Request cannot be copied whole from outside package http.
+	r := &http.Request{
+		Method:    req.Method,
+		URL:       req.URL,
+		Header:    req.Header,
+		Cookie:    req.Cookie,
+		Host:      req.Host,
+		Referer:   req.Referer,
+		UserAgent: req.UserAgent,
+	}
+	var buf bytes.Buffer
+	if err := r.WriteProxy(&buf); err != nil {
+		return nil, err
+	}
+	tp := textproto.NewReader(bufio.NewReader(&buf))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	f := strings.Split(line, " ", 3)
+	if len(f) < 3 {
+		return nil, fmt.Errorf("spdy: malformed request line %q", line)
+	}
+	mh, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	mh.Del("Content-Length")
+	h := spdyHeader(http.Header(mh))
+	h["method"] = []string{f[0]}
+	h["url"] = []string{f[1]}
+	h["version"] = []string{f[2]}
+	if req.Body != nil && req.ContentLength > 0 {
+		h["content-length"] = []string{strconv.Itoa64(req.ContentLength)}
+	}
+	return h, nil
+}
+
+// newResponse builds the Response to req from the SYN_REPLY headers
+// of its stream, in the same way as newRequest builds a Request.
+func newResponse(st *Stream, h http.Header, req *http.Request) (*http.Response, os.Error) {
+	status, version := headerValue(h, "status"), headerValue(h, "version")
+	if status == "" || version == "" {
+		return nil, errMissingHeaders
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\r\n", version, status)
+	if err := writeHTTPHeader(&buf, h); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &streamBody{st: st, cancel: true}
+	if _, ok := h["content-length"]; !ok {
+		resp.ContentLength = -1
+	}
+	resp.TransferEncoding = nil
+	resp.Close = false
+	return resp, nil
+}
@@ -237,6 +237,7 @@ const (
 	SettingsRoundTripTime                   = 3
 	SettingsMaxConcurrentStreams            = 4
 	SettingsCurrentCwnd                     = 5
+	SettingsInitialWindowSize               = 7
 )
 
 // SettingsFlagIdValue is the unpacked, in-memory representation of the
@@ -278,6 +279,14 @@ type HeadersFrame struct {
 	Headers  http.Header
 }
 
+// WindowUpdateFrame is the unpacked, in-memory representation of a
+// WINDOW_UPDATE frame.
+type WindowUpdateFrame struct {
+	CFHeader        ControlFrameHeader
+	StreamId        uint32
+	DeltaWindowSize uint32
+}
+
 // DataFrame is the unpacked, in-memory representation of a DATA frame.
 type DataFrame struct {
 	// Note, high bit is the "Control" bit. Should be 0 for data frames.
@@ -104,6 +104,24 @@ func (frame *HeadersFrame) write(f *Framer) os.Error {
 	return f.writeHeadersFrame(frame)
 }
 
+func (frame *WindowUpdateFrame) write(f *Framer) (err os.Error) {
+	frame.CFHeader.version = Version
+	frame.CFHeader.frameType = TypeWindowUpdate
+	frame.CFHeader.length = 8
+
+	// Serialize frame to Writer
+	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
+		return
+	}
+	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
+		return
+	}
+	if err = binary.Write(f.w, binary.BigEndian, frame.DeltaWindowSize); err != nil {
+		return
+	}
+	return
+}
+
 func (frame *DataFrame) write(f *Framer) os.Error {
 	return f.writeDataFrame(frame)
 }
@@ -44,6 +44,8 @@ const (
 	StatusRequestedRangeNotSatisfiable = 416
 	StatusExpectationFailed            = 417
 
+	StatusRequestHeaderFieldsTooLarge = 431
+
 	StatusInternalServerError     = 500
 	StatusNotImplemented          = 501
 	StatusBadGateway              = 502
@@ -91,6 +93,8 @@ var statusText = map[int]string{
 	StatusRequestedRangeNotSatisfiable: "Requested Range Not Satisfiable",
 	StatusExpectationFailed:            "Expectation Failed",
 
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+
 	StatusInternalServerError:     "Internal Server Error",
 	StatusNotImplemented:          "Not Implemented",
 	StatusBadGateway:              "Bad Gateway",
@@ -14,38 +14,58 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/socks"
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 // DefaultTransport is the default implementation of Transport and is
 // used by DefaultClient.  It establishes a new network connection for
-// each call to Do and uses HTTP proxies as directed by the
-// $HTTP_PROXY and $NO_PROXY (or $http_proxy and $no_proxy)
+// each call to Do and uses proxies as directed by the $HTTP_PROXY,
+// $ALL_PROXY and $NO_PROXY (or $http_proxy, $all_proxy and $no_proxy)
 // environment variables.
 var DefaultTransport RoundTripper = &Transport{Proxy: ProxyFromEnvironment}
 
+// ErrSkipAltProtocol is returned by a RoundTripper registered with
+// Transport.RegisterProtocol for "http" or "https" to indicate that
+// the Transport should handle the request itself.
+var ErrSkipAltProtocol = os.NewError("http: skip alternate protocol")
+
+// ErrRequestCanceled is returned by RoundTrip, and by reads from the
+// body of the Response it returned, once the request has been
+// aborted by CancelRequest.
+var ErrRequestCanceled = os.NewError("http: request canceled")
+
 // DefaultMaxIdleConnsPerHost is the default value of Transport's
 // MaxIdleConnsPerHost.
 const DefaultMaxIdleConnsPerHost = 2
 
+// DefaultMaxPipelineDepth is the default value of Transport's
+// MaxPipelineDepth.
+const DefaultMaxPipelineDepth = 8
+
 // Transport is an implementation of RoundTripper that supports http,
 // https, and http proxies (for either http or https with CONNECT).
 // Transport can also cache connections for future re-use.
 type Transport struct {
-	lk       sync.Mutex
-	idleConn map[string][]*persistConn
-	altProto map[string]RoundTripper // nil or map of URI scheme => RoundTripper
+	lk        sync.Mutex
+	idleConn  map[string][]*persistConn
+	altProto  map[string]RoundTripper   // nil or map of URI scheme => RoundTripper
+	connCount map[string]int            // open (active or idle) conns per cache key
+	numConns  int                       // total open conns
+	connWait  []*connWaiter             // getConn calls waiting for a conn, oldest first
+	pipeConn  map[string][]*persistConn // conns that may carry pipelined requests
 
-	// TODO: tunable on global max cached connections
-	// TODO: tunable on timeout on cached connections
-	// TODO: optional pipelining
+	reqCanceler map[*Request]func() // aborts each request in flight
 
 	// Proxy specifies a function to return a proxy for a given
 	// Request. If the function returns a non-nil error, the
 	// request is aborted with the provided error.
 	// If Proxy is nil or returns a nil *URL, no proxy is used.
+	// A proxy URL with the scheme "socks5" names a SOCKS5 proxy,
+	// and any other an HTTP proxy.
 	Proxy func(*Request) (*URL, os.Error)
 
 	// Dial specifies the dial function for creating TCP
@@ -60,14 +80,70 @@ type Transport struct {
 	// (keep-alive) to keep to keep per-host.  If zero,
 	// DefaultMaxIdleConnsPerHost is used.
 	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost, if non-zero, limits the number of
+	// connections, active or idle, open to any one host.
+	// Requests that would exceed the limit wait, in order,
+	// for a connection to that host to become available.
+	MaxConnsPerHost int
+
+	// MaxConns, if non-zero, limits the total number of
+	// connections, active or idle, open to all hosts.  When
+	// the limit is reached, idle connections to other hosts
+	// are closed to make room; otherwise requests wait, in
+	// order, for a connection to be released.
+	MaxConns int
+
+	// IdleConnTimeout, if non-zero, is the number of nanoseconds
+	// an idle (keep-alive) connection may remain unused before
+	// it is closed.
+	IdleConnTimeout int64
+
+	// ResponseHeaderTimeout, if non-zero, is the number of
+	// nanoseconds to wait for a server's response headers after
+	// the request has been written.  If it expires, the
+	// connection is closed and RoundTrip returns an error.
+	ResponseHeaderTimeout int64
+
+	// Pipelining, if true, enables HTTP/1.1 request pipelining:
+	// GET and HEAD requests without a body may be written to a
+	// connection that is still awaiting responses to earlier
+	// requests, rather than waiting for an idle connection or
+	// dialing a new one.  Only connections on which the server
+	// has already answered with a persistent HTTP/1.1 response
+	// are used this way.  Responses are matched to requests in
+	// order.  A pipelined request left unanswered because the
+	// server closed the connection early is retried once on
+	// another connection.
+	Pipelining bool
+
+	// MaxPipelineDepth, if non-zero, limits the number of
+	// unanswered requests on a pipelined connection.  If zero,
+	// DefaultMaxPipelineDepth is used.
+	MaxPipelineDepth int
+
+	// ExpectContinueTimeout, if non-zero, is the number of
+	// nanoseconds to wait, after writing the header of a request
+	// with a body and an "Expect: 100-continue" header, for the
+	// server's "100 Continue" response before sending the body
+	// regardless.  If the server sends a final response first,
+	// such as 417 Expectation Failed, the body is not sent, and
+	// the connection is closed once the response has been read.
+	// If zero, the body is sent without waiting.
+	ExpectContinueTimeout int64
 }
 
 // ProxyFromEnvironment returns the URL of the proxy to use for a
 // given request, as indicated by the environment variables
-// $HTTP_PROXY and $NO_PROXY (or $http_proxy and $no_proxy).
-// Either URL or an error is returned.
+// $HTTP_PROXY, or if it is unset $ALL_PROXY, and $NO_PROXY (or
+// $http_proxy, $all_proxy and $no_proxy).  A proxy URL with the
+// scheme "socks5", such as socks5://gateway:1080, names a SOCKS5
+// proxy.  Either URL or an error is returned.
 func ProxyFromEnvironment(req *Request) (*URL, os.Error) {
 	proxy := getenvEitherCase("HTTP_PROXY")
+	if proxy == "" {
+		proxy = getenvEitherCase("ALL_PROXY")
+	}
 	if proxy == "" {
 		return nil, nil
 	}
@@ -102,34 +178,152 @@ func (t *Transport) RoundTrip(req *Request) (resp *Response, err os.Error) {
 			return
 		}
 	}
+	t.lk.Lock()
+	var rt RoundTripper
+	if t.altProto != nil {
+		rt = t.altProto[req.URL.Scheme]
+	}
+	t.lk.Unlock()
 	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
-		t.lk.Lock()
-		var rt RoundTripper
-		if t.altProto != nil {
-			rt = t.altProto[req.URL.Scheme]
-		}
-		t.lk.Unlock()
 		if rt == nil {
 			return nil, &badStringError{"unsupported protocol scheme", req.URL.Scheme}
 		}
 		return rt.RoundTrip(req)
 	}
+	if rt != nil {
+		if resp, err = rt.RoundTrip(req); err != ErrSkipAltProtocol {
+			return resp, err
+		}
+	}
 
 	cm, err := t.connectMethodForRequest(req)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the cached or newly-created connection to either the
-	// host (for http or https), the http proxy, or the http proxy
-	// pre-CONNECTed to https server.  In any case, we'll be ready
-	// to send it requests.
-	pconn, err := t.getConn(cm)
-	if err != nil {
-		return nil, err
+	// Until req has a connection, canceling it need only
+	// abandon the wait for one.
+	cancel := make(chan bool)
+	t.setReqCanceler(req, func() { close(cancel) })
+
+	pipeline := t.Pipelining && canPipeline(req)
+	for retried := false; ; retried = true {
+		// Get the cached or newly-created connection to either the
+		// host (for http or https), the http proxy, or the http proxy
+		// pre-CONNECTed to https server.  In any case, we'll be ready
+		// to send it requests.
+		pconn, err := t.getConn(cm, pipeline && !retried, cancel)
+		if err != nil {
+			t.setReqCanceler(req, nil)
+			return nil, err
+		}
+		if !t.replaceReqCanceler(req, func() { close(cancel); pconn.close() }) {
+			// Canceled as the connection was handed over;
+			// nothing has been written to it.
+			if !pconn.expectingResponse() {
+				t.putIdleConn(pconn)
+			}
+			return nil, ErrRequestCanceled
+		}
+
+		resp, err = pconn.roundTrip(req, cancel)
+		if err == errPipelineReset && !retried {
+			if !t.replaceReqCanceler(req, func() { close(cancel) }) {
+				return nil, ErrRequestCanceled
+			}
+			continue
+		}
+		if err != nil {
+			t.setReqCanceler(req, nil)
+			return nil, err
+		}
+		// The request stays cancelable until its response
+		// body has been read or closed.
+		if es, ok := resp.Body.(*bodyEOFSignal); ok {
+			fn := es.fn
+			es.fn = func(err os.Error) {
+				t.setReqCanceler(req, nil)
+				if fn != nil {
+					fn(err)
+				}
+			}
+		} else {
+			t.setReqCanceler(req, nil)
+		}
+		return resp, nil
 	}
+	panic("not reached")
+}
 
-	return pconn.roundTrip(req)
+// CancelRequest cancels an in-flight request sent over HTTP by
+// RoundTrip.  A request waiting for a connection stops waiting;
+// otherwise the connection carrying the request is closed, which
+// also fails any other requests pipelined on it.  The RoundTrip
+// call, or reads from the body of the Response it returned, fail
+// with ErrRequestCanceled.  CancelRequest does nothing once the
+// response body has been read in full or closed.
+//
+// Requests sent by a RoundTripper registered with RegisterProtocol
+// are canceled by its CancelRequest method, if it has one.
+func (t *Transport) CancelRequest(req *Request) {
+	t.lk.Lock()
+	cancel, ok := t.reqCanceler[req]
+	if ok {
+		t.reqCanceler[req] = nil, false
+	}
+	var alt []canceler
+	for _, rt := range t.altProto {
+		if rc, ok := rt.(canceler); ok {
+			alt = append(alt, rc)
+		}
+	}
+	t.lk.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	for _, rc := range alt {
+		rc.CancelRequest(req)
+	}
+}
+
+// setReqCanceler sets the function CancelRequest calls to abort
+// req, or forgets req if fn is nil.
+func (t *Transport) setReqCanceler(req *Request, fn func()) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if fn == nil {
+		if _, ok := t.reqCanceler[req]; ok {
+			t.reqCanceler[req] = nil, false
+		}
+		return
+	}
+	if t.reqCanceler == nil {
+		t.reqCanceler = make(map[*Request]func())
+	}
+	t.reqCanceler[req] = fn
+}
+
+// replaceReqCanceler replaces the function that aborts req.  It
+// reports false, leaving things as they are, if req has already
+// been canceled.
+func (t *Transport) replaceReqCanceler(req *Request, fn func()) bool {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if _, ok := t.reqCanceler[req]; !ok {
+		return false
+	}
+	t.reqCanceler[req] = fn
+	return true
+}
+
+// canPipeline reports whether req may be pipelined behind other
+// requests: it must be idempotent and have no body.
+func canPipeline(req *Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD":
+		return req.Body == nil && !req.Close
+	}
+	return false
 }
 
 // RegisterProtocol registers a new protocol with scheme.
@@ -138,10 +332,12 @@ func (t *Transport) RoundTrip(req *Request) (resp *Response, err os.Error) {
 //
 // RegisterProtocol can be used by other packages to provide
 // implementations of protocol schemes like "ftp" or "file".
+//
+// A RoundTripper registered for "http" or "https", such as one that
+// speaks SPDY, is tried first for requests using that scheme; if it
+// returns ErrSkipAltProtocol, the Transport handles the request
+// itself.
 func (t *Transport) RegisterProtocol(scheme string, rt RoundTripper) {
-	if scheme == "http" || scheme == "https" {
-		panic("protocol " + scheme + " already registered")
-	}
 	t.lk.Lock()
 	defer t.lk.Unlock()
 	if t.altProto == nil {
@@ -165,7 +361,7 @@ func (t *Transport) CloseIdleConnections() {
 	}
 	for _, conns := range t.idleConn {
 		for _, pconn := range conns {
-			pconn.close()
+			t.closeConnLocked(pconn)
 		}
 	}
 	t.idleConn = nil
@@ -200,7 +396,7 @@ func (t *Transport) connectMethodForRequest(req *Request) (*connectMethod, os.Er
 // proxyAuth returns the Proxy-Authorization header to set
 // on requests, if applicable.
 func (cm *connectMethod) proxyAuth() string {
-	if cm.proxyURL == nil {
+	if cm.proxyURL == nil || cm.isSOCKS() {
 		return ""
 	}
 	proxyInfo := cm.proxyURL.RawUserinfo
@@ -214,22 +410,77 @@ func (t *Transport) putIdleConn(pconn *persistConn) {
 	t.lk.Lock()
 	defer t.lk.Unlock()
 	if t.DisableKeepAlives || t.MaxIdleConnsPerHost < 0 {
-		pconn.close()
+		t.closeConnLocked(pconn)
 		return
 	}
 	if pconn.isBroken() {
 		return
 	}
 	key := pconn.cacheKey
+
+	// Hand the connection straight to a waiting request, if any.
+	for i, w := range t.connWait {
+		if w.key == key {
+			t.connWait = append(t.connWait[:i], t.connWait[i+1:]...)
+			w.ch <- pconn
+			return
+		}
+	}
+	// Free its slot for a request to another host.
+	for _, w := range t.connWait {
+		if t.hostHasRoomLocked(w.key) {
+			t.closeConnLocked(pconn)
+			return
+		}
+	}
+
 	max := t.MaxIdleConnsPerHost
 	if max == 0 {
 		max = DefaultMaxIdleConnsPerHost
 	}
 	if len(t.idleConn[key]) >= max {
-		pconn.close()
+		t.closeConnLocked(pconn)
 		return
 	}
+	if t.idleConn == nil {
+		t.idleConn = make(map[string][]*persistConn)
+	}
 	t.idleConn[key] = append(t.idleConn[key], pconn)
+	pconn.idleAt = time.Nanoseconds()
+	if t.IdleConnTimeout > 0 {
+		idleAt := pconn.idleAt
+		time.AfterFunc(t.IdleConnTimeout, func() {
+			t.expireIdleConn(pconn, idleAt)
+		})
+	}
+}
+
+// expireIdleConn closes pconn if it has been idle since idleAt.
+func (t *Transport) expireIdleConn(pconn *persistConn, idleAt int64) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if pconn.idleAt == idleAt && t.removeIdleConnLocked(pconn) {
+		t.closeConnLocked(pconn)
+	}
+}
+
+// removeIdleConnLocked removes pconn from the idle list,
+// reporting whether it was there.  t.lk must be held.
+func (t *Transport) removeIdleConnLocked(pconn *persistConn) bool {
+	key := pconn.cacheKey
+	pconns := t.idleConn[key]
+	for i, pc := range pconns {
+		if pc != pconn {
+			continue
+		}
+		if len(pconns) == 1 {
+			t.idleConn[key] = nil, false
+		} else {
+			t.idleConn[key] = append(pconns[:i], pconns[i+1:]...)
+		}
+		return true
+	}
+	return false
 }
 
 func (t *Transport) getIdleConn(cm *connectMethod) (pconn *persistConn) {
@@ -254,12 +505,182 @@ func (t *Transport) getIdleConn(cm *connectMethod) (pconn *persistConn) {
 			t.idleConn[key] = pconns[0 : len(pconns)-1]
 		}
 		if !pconn.isBroken() {
+			pconn.idleAt = 0
 			return
 		}
 	}
 	return
 }
 
+// A connWaiter is a getConn call waiting for a connection to
+// cacheKey key.  It receives either an idle connection, or nil
+// once a slot has been reserved for it to dial a new one.
+type connWaiter struct {
+	key string
+	ch  chan *persistConn
+}
+
+// hostHasRoomLocked reports whether the per-host limit permits
+// another connection to key.  t.lk must be held.
+func (t *Transport) hostHasRoomLocked(key string) bool {
+	return t.MaxConnsPerHost <= 0 || t.connCount[key] < t.MaxConnsPerHost
+}
+
+// reserveConnLocked reserves a slot for a new connection to key,
+// closing idle connections to other hosts if that is all that
+// stands in the way.  It reports whether a slot was reserved.
+// t.lk must be held.
+func (t *Transport) reserveConnLocked(key string) bool {
+	if !t.hostHasRoomLocked(key) {
+		return false
+	}
+	for t.MaxConns > 0 && t.numConns >= t.MaxConns {
+		var oldest *persistConn
+		for _, pconns := range t.idleConn {
+			for _, pc := range pconns {
+				if oldest == nil || pc.idleAt < oldest.idleAt {
+					oldest = pc
+				}
+			}
+		}
+		if oldest == nil {
+			return false
+		}
+		t.removeIdleConnLocked(oldest)
+		if oldest.closeConn() {
+			t.uncountConnLocked(oldest.cacheKey)
+		}
+	}
+	t.countConnLocked(key)
+	return true
+}
+
+func (t *Transport) countConnLocked(key string) {
+	if t.connCount == nil {
+		t.connCount = make(map[string]int)
+	}
+	t.connCount[key]++
+	t.numConns++
+}
+
+func (t *Transport) uncountConnLocked(key string) {
+	if n := t.connCount[key]; n > 1 {
+		t.connCount[key] = n - 1
+	} else {
+		t.connCount[key] = 0, false
+	}
+	t.numConns--
+}
+
+// releaseConnLocked gives up the slot held by a connection to key
+// and passes it on to the oldest waiter able to use it.
+// t.lk must be held.
+func (t *Transport) releaseConnLocked(key string) {
+	t.uncountConnLocked(key)
+	for i, w := range t.connWait {
+		if t.hostHasRoomLocked(w.key) && (t.MaxConns <= 0 || t.numConns < t.MaxConns) {
+			t.connWait = append(t.connWait[:i], t.connWait[i+1:]...)
+			t.countConnLocked(w.key)
+			w.ch <- nil
+			return
+		}
+	}
+}
+
+// closeConnLocked closes pconn, releasing its slot if it was still
+// open.  t.lk must be held.
+func (t *Transport) closeConnLocked(pconn *persistConn) {
+	if pconn.closeConn() {
+		t.releaseConnLocked(pconn.cacheKey)
+	}
+}
+
+// pipelineConnLocked returns the least busy connection to key that
+// can take another pipelined request, or nil if there is none.
+// t.lk must be held.
+func (t *Transport) pipelineConnLocked(key string) *persistConn {
+	max := t.MaxPipelineDepth
+	if max <= 0 {
+		max = DefaultMaxPipelineDepth
+	}
+	var best *persistConn
+	bestN := 0
+	live := t.pipeConn[key][:0]
+	for _, pc := range t.pipeConn[key] {
+		pc.lk.Lock()
+		dead := pc.broken || pc.reqsClosed
+		n := pc.numExpectedResponses
+		ok := pc.pipelineOK && n < max && n < cap(pc.reqch)
+		pc.lk.Unlock()
+		if dead {
+			continue
+		}
+		live = append(live, pc)
+		if ok && (best == nil || n < bestN) {
+			best, bestN = pc, n
+		}
+	}
+	if len(live) == 0 {
+		t.pipeConn[key] = nil, false
+	} else {
+		t.pipeConn[key] = live
+	}
+	if best != nil && t.removeIdleConnLocked(best) {
+		best.idleAt = 0
+	}
+	return best
+}
+
+// getConnSlot returns an idle connection for cm, a busy one on
+// which to pipeline the request if pipeline is set, or, if nil,
+// reserves a slot for dialing a new one.  It waits if the
+// Transport's connection limits do not yet permit any of these,
+// unless cancel is closed, when it returns ErrRequestCanceled.
+func (t *Transport) getConnSlot(cm *connectMethod, pipeline bool, cancel <-chan bool) (*persistConn, os.Error) {
+	if pc := t.getIdleConn(cm); pc != nil {
+		return pc, nil
+	}
+	key := cm.String()
+	t.lk.Lock()
+	if pipeline {
+		if pc := t.pipelineConnLocked(key); pc != nil {
+			t.lk.Unlock()
+			return pc, nil
+		}
+	}
+	if t.reserveConnLocked(key) {
+		t.lk.Unlock()
+		return nil, nil
+	}
+	w := &connWaiter{key, make(chan *persistConn, 1)}
+	t.connWait = append(t.connWait, w)
+	t.lk.Unlock()
+
+	select {
+	case pc := <-w.ch:
+		return pc, nil
+	case <-cancel:
+	}
+	t.lk.Lock()
+	for i, w2 := range t.connWait {
+		if w2 == w {
+			t.connWait = append(t.connWait[:i], t.connWait[i+1:]...)
+			t.lk.Unlock()
+			return nil, ErrRequestCanceled
+		}
+	}
+	// The waiter has been served already; pass on
+	// what it was given.
+	if pc := <-w.ch; pc != nil {
+		t.lk.Unlock()
+		t.putIdleConn(pc)
+	} else {
+		t.releaseConnLocked(key)
+		t.lk.Unlock()
+	}
+	return nil, ErrRequestCanceled
+}
+
 func (t *Transport) dial(network, addr string) (c net.Conn, err os.Error) {
 	if t.Dial != nil {
 		return t.Dial(network, addr)
@@ -271,12 +692,70 @@ func (t *Transport) dial(network, addr string) (c net.Conn, err os.Error) {
 // specified in the connectMethod.  This includes doing a proxy CONNECT
 // and/or setting up TLS.  If this doesn't return an error, the persistConn
 // is ready to write requests to.
-func (t *Transport) getConn(cm *connectMethod) (*persistConn, os.Error) {
-	if pc := t.getIdleConn(cm); pc != nil {
-		return pc, nil
+//
+// If pipeline is set, getConn may return a connection that is still
+// awaiting responses to earlier requests.
+//
+// If cancel is closed first, getConn returns ErrRequestCanceled.  A
+// dial already under way is left to finish, and its connection is
+// kept for other requests.
+func (t *Transport) getConn(cm *connectMethod, pipeline bool, cancel <-chan bool) (*persistConn, os.Error) {
+	if pc, err := t.getConnSlot(cm, pipeline, cancel); pc != nil || err != nil {
+		return pc, err
 	}
+	dialc := make(chan dialResult, 1)
+	go func() {
+		pconn, err := t.dialConn(cm)
+		dialc <- dialResult{pconn, t.addConn(cm, pconn, err)}
+	}()
+	select {
+	case r := <-dialc:
+		return r.pconn, r.err
+	case <-cancel:
+	}
+	go func() {
+		if r := <-dialc; r.err == nil {
+			t.putIdleConn(r.pconn)
+		}
+	}()
+	return nil, ErrRequestCanceled
+}
+
+type dialResult struct {
+	pconn *persistConn
+	err   os.Error
+}
 
-	conn, err := t.dial("tcp", cm.addr())
+// addConn records the outcome of dialing a new connection for cm,
+// releasing its slot if err is not nil.  It returns err.
+func (t *Transport) addConn(cm *connectMethod, pconn *persistConn, err os.Error) os.Error {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if err != nil {
+		t.releaseConnLocked(cm.String())
+		return err
+	}
+	if t.Pipelining {
+		if t.pipeConn == nil {
+			t.pipeConn = make(map[string][]*persistConn)
+		}
+		t.pipeConn[pconn.cacheKey] = append(t.pipeConn[pconn.cacheKey], pconn)
+	}
+	return nil
+}
+
+// dialConn dials a new persistConn as described for getConn.
+func (t *Transport) dialConn(cm *connectMethod) (*persistConn, os.Error) {
+	var conn net.Conn
+	var err os.Error
+	if cm.isSOCKS() {
+		var d *socks.Dialer
+		if d, err = cm.socksDialer(t.dial); err == nil {
+			conn, err = d.Dial("tcp", cm.targetAddr)
+		}
+	} else {
+		conn, err = t.dial("tcp", cm.addr())
+	}
 	if err != nil {
 		if cm.proxyURL != nil {
 			err = fmt.Errorf("http: error connecting to proxy %s: %v", cm.proxyURL, err)
@@ -295,7 +774,7 @@ func (t *Transport) getConn(cm *connectMethod) (*persistConn, os.Error) {
 	newClientConnFunc := NewClientConn
 
 	switch {
-	case cm.proxyURL == nil:
+	case cm.proxyURL == nil, cm.isSOCKS():
 		// Do nothing.
 	case cm.targetScheme == "http":
 		newClientConnFunc = NewProxyClientConn
@@ -339,9 +818,11 @@ func (t *Transport) getConn(cm *connectMethod) (*persistConn, os.Error) {
 		// Initiate TLS and check remote host name against certificate.
 		conn = tls.Client(conn, nil)
 		if err = conn.(*tls.Conn).Handshake(); err != nil {
+			conn.Close()
 			return nil, err
 		}
 		if err = conn.(*tls.Conn).VerifyHostname(cm.tlsHost()); err != nil {
+			conn.Close()
 			return nil, err
 		}
 		pconn.conn = conn
@@ -409,6 +890,8 @@ func useProxy(addr string) bool {
 // ||https|foo.com               https directly to server, no proxy
 // http://proxy.com|https|foo.com  http to proxy, then CONNECT to foo.com
 // http://proxy.com|http           http to proxy, http to anywhere after that
+// socks5://proxy.com|http|foo.com  socks5 to proxy, then http to foo.com
+// socks5://proxy.com|https|foo.com socks5 to proxy, then https to foo.com
 //
 // Note: no support to https to the proxy yet.
 //
@@ -434,6 +917,29 @@ func (cm *connectMethod) addr() string {
 	return cm.targetAddr
 }
 
+// isSOCKS reports whether the connection is made through
+// a SOCKS5 proxy.
+func (cm *connectMethod) isSOCKS() bool {
+	return cm.proxyURL != nil && cm.proxyURL.Scheme == "socks5"
+}
+
+// socksDialer returns a dialer for connections through the SOCKS5
+// proxy, which dials the proxy with dial.  It returns an error if the
+// user name and password in the proxy URL are malformed.
+func (cm *connectMethod) socksDialer(dial func(net, addr string) (net.Conn, os.Error)) (*socks.Dialer, os.Error) {
+	var auth *socks.Auth
+	if cm.proxyURL.RawUserinfo != "" {
+		user, password, err := UnescapeUserinfo(cm.proxyURL.RawUserinfo)
+		if err != nil {
+			return nil, err
+		}
+		auth = &socks.Auth{user, password}
+	}
+	d := socks.NewDialer("tcp", cm.addr(), auth)
+	d.Forward = dial
+	return d, nil
+}
+
 // tlsHost returns the host name to match against the peer's
 // TLS certificate.
 func (cm *connectMethod) tlsHost() string {
@@ -469,9 +975,17 @@ type persistConn struct {
 	reqch             chan requestAndChan // written by roundTrip(); read by readLoop()
 	mutateRequestFunc func(*Request)      // nil or func to modify each outbound request
 
-	lk                   sync.Mutex // guards numExpectedResponses and broken
+	idleAt int64 // when put in Transport.idleConn, in ns; guarded by Transport.lk
+
+	// writeLk serializes writing a request with queueing it on
+	// reqch, so that readLoop sees requests in the order written.
+	writeLk sync.Mutex
+
+	lk                   sync.Mutex // guards the following fields
 	numExpectedResponses int
 	broken               bool // an error has happened on this connection; marked broken so it's not reused.
+	reqsClosed           bool // no more requests may be written; also guarded by writeLk
+	pipelineOK           bool // server has sent a persistent HTTP/1.1 response
 }
 
 func (pc *persistConn) isBroken() bool {
@@ -487,6 +1001,8 @@ func (pc *persistConn) expectingResponse() bool {
 }
 
 func (pc *persistConn) readLoop() {
+	defer pc.failPending()
+
 	alive := true
 	for alive {
 		pb, err := pc.br.Peek(1)
@@ -508,6 +1024,14 @@ func (pc *persistConn) readLoop() {
 		rc := <-pc.reqch
 		resp, err := pc.cc.readUsing(rc.req, func(buf *bufio.Reader, forReq *Request) (*Response, os.Error) {
 			resp, err := ReadResponse(buf, forReq)
+			// Skip interim responses, other than 101 Switching
+			// Protocols, which is final.
+			for err == nil && resp.StatusCode/100 == 1 && resp.StatusCode != StatusSwitchingProtocols {
+				if resp.StatusCode == StatusContinue && rc.gate != nil {
+					rc.gate.decide(true)
+				}
+				resp, err = ReadResponse(buf, forReq)
+			}
 			if err != nil || resp.ContentLength == 0 {
 				return resp, err
 			}
@@ -522,7 +1046,7 @@ func (pc *persistConn) readLoop() {
 				}
 				resp.Body = &readFirstCloseBoth{&discardOnCloseReadCloser{gzReader}, resp.Body}
 			}
-			resp.Body = &bodyEOFSignal{body: resp.Body}
+			resp.Body = &bodyEOFSignal{body: resp.Body, cancel: rc.cancel}
 			return resp, err
 		})
 
@@ -535,14 +1059,42 @@ func (pc *persistConn) readLoop() {
 		} else if err != nil || rc.req.Close {
 			alive = false
 		}
+		if rc.gate != nil && rc.gate.decide(false) {
+			// The request's body will not be sent, so the
+			// server may not read another request from the
+			// connection.
+			alive = false
+		}
+
+		pc.lk.Lock()
+		if !alive {
+			pc.numExpectedResponses--
+		} else if resp.ProtoAtLeast(1, 1) {
+			pc.pipelineOK = true
+		}
+		pc.lk.Unlock()
 
 		hasBody := resp != nil && resp.ContentLength != 0
 		var waitForBodyRead chan bool
-		if alive {
+		if !alive {
+			// Close the connection once the response body, if
+			// any, has been consumed, freeing its slot.
+			if hasBody {
+				resp.Body.(*bodyEOFSignal).fn = func(os.Error) {
+					pc.close()
+				}
+			} else {
+				pc.close()
+			}
+		} else {
 			if hasBody {
 				waitForBodyRead = make(chan bool)
-				resp.Body.(*bodyEOFSignal).fn = func() {
-					pc.t.putIdleConn(pc)
+				resp.Body.(*bodyEOFSignal).fn = func(err os.Error) {
+					if err != nil {
+						pc.close()
+					} else {
+						pc.responseDone()
+					}
 					waitForBodyRead <- true
 				}
 			} else {
@@ -557,7 +1109,7 @@ func (pc *persistConn) readLoop() {
 				pc.cc.lastbody = nil
 				pc.cc.lk.Unlock()
 
-				pc.t.putIdleConn(pc)
+				pc.responseDone()
 			}
 		}
 
@@ -567,6 +1119,52 @@ func (pc *persistConn) readLoop() {
 		// before we race and peek on the underlying bufio reader.
 		if waitForBodyRead != nil {
 			<-waitForBodyRead
+			if pc.isBroken() {
+				return
+			}
+		}
+	}
+}
+
+// responseDone is called by readLoop once a response on a persistent
+// connection has been read in full, including its body.  Unless more
+// pipelined responses are due, it makes pc available for reuse, or
+// closes it if no more requests may be written to it.
+func (pc *persistConn) responseDone() {
+	pc.lk.Lock()
+	pc.numExpectedResponses--
+	more, closed := pc.numExpectedResponses > 0, pc.reqsClosed
+	pc.lk.Unlock()
+	switch {
+	case more:
+	case closed:
+		pc.close()
+	default:
+		pc.t.putIdleConn(pc)
+	}
+}
+
+// failPending is called as readLoop exits.  It stops further requests
+// from being written to pc and fails those that were written but
+// whose responses will now never be read.
+func (pc *persistConn) failPending() {
+	pc.writeLk.Lock()
+	defer pc.writeLk.Unlock()
+	pc.lk.Lock()
+	pc.reqsClosed = true
+	pc.lk.Unlock()
+	for {
+		select {
+		case rc := <-pc.reqch:
+			if rc.gate != nil {
+				rc.gate.decide(false)
+			}
+			pc.lk.Lock()
+			pc.numExpectedResponses--
+			pc.lk.Unlock()
+			rc.ch <- responseAndError{nil, io.ErrUnexpectedEOF}
+		default:
+			return
 		}
 	}
 }
@@ -584,9 +1182,13 @@ type requestAndChan struct {
 	// Accept-Encoding gzip header? only if it we set it do
 	// we transparently decode the gzip.
 	addedGzip bool
+
+	cancel <-chan bool // closed if the request is canceled
+
+	gate *continueGate // nil unless awaiting "100 Continue"
 }
 
-func (pc *persistConn) roundTrip(req *Request) (resp *Response, err os.Error) {
+func (pc *persistConn) roundTrip(req *Request, cancel <-chan bool) (resp *Response, err os.Error) {
 	if pc.mutateRequestFunc != nil {
 		pc.mutateRequestFunc(req)
 	}
@@ -604,38 +1206,229 @@ func (pc *persistConn) roundTrip(req *Request) (resp *Response, err os.Error) {
 		req.Header.Set("Accept-Encoding", "gzip")
 	}
 
+	// errPipelineReset tells RoundTrip to retry req elsewhere, so
+	// leave req as it was.
+	reset := func() (*Response, os.Error) {
+		if requestedGzip {
+			req.Header.Del("Accept-Encoding")
+		}
+		return nil, errPipelineReset
+	}
+
+	pc.writeLk.Lock()
 	pc.lk.Lock()
+	if pc.broken || pc.reqsClosed {
+		// Closed since getConn handed it out; nothing was sent.
+		pc.lk.Unlock()
+		pc.writeLk.Unlock()
+		return reset()
+	}
+	pipelined := pc.numExpectedResponses > 0
 	pc.numExpectedResponses++
 	pc.lk.Unlock()
 
+	ch := make(chan responseAndError, 1)
+	rc := requestAndChan{req, ch, requestedGzip, cancel, nil}
+	var cb *continueBody
+	if !pipelined && pc.t.ExpectContinueTimeout > 0 && req.Body != nil && req.expectsContinue() {
+		// Queue the request for readLoop once its header has
+		// been written, as the body waits on the server's reply.
+		rc.gate = &continueGate{ch: make(chan bool)}
+		cb = &continueBody{
+			ReadCloser: req.Body,
+			gate:       rc.gate,
+			timeout:    pc.t.ExpectContinueTimeout,
+			cancel:     cancel,
+			sent:       func() { pc.reqch <- rc },
+		}
+		req.Body = cb
+	}
+
 	err = pc.cc.Write(req)
+	if cb != nil {
+		req.Body = cb.ReadCloser
+		if cb.started {
+			if err == errBodySkipped {
+				req.Body.Close()
+			}
+			if err != nil {
+				// readLoop has the request and will
+				// return its response, if any.
+				pc.lk.Lock()
+				pc.reqsClosed = true
+				pc.lk.Unlock()
+			}
+			pc.writeLk.Unlock()
+			return pc.awaitResponse(ch, cancel, pipelined, reset)
+		}
+	}
 	if err != nil {
+		pc.lk.Lock()
+		pc.numExpectedResponses--
+		pc.reqsClosed = true
+		pc.lk.Unlock()
+		pc.writeLk.Unlock()
+		if isCanceled(cancel) {
+			return nil, ErrRequestCanceled
+		}
+		if pipelined || err == ErrPersistEOF {
+			// Leave the connection to readLoop, which is
+			// still reading responses to earlier requests.
+			return reset()
+		}
 		pc.close()
 		return
 	}
 
-	ch := make(chan responseAndError, 1)
-	pc.reqch <- requestAndChan{req, ch, requestedGzip}
-	re := <-ch
-	pc.lk.Lock()
-	pc.numExpectedResponses--
-	pc.lk.Unlock()
+	pc.reqch <- rc
+	pc.writeLk.Unlock()
+	return pc.awaitResponse(ch, cancel, pipelined, reset)
+}
 
+// awaitResponse waits for readLoop to send the response to a request
+// on ch, subject to the Transport's ResponseHeaderTimeout and to the
+// request being canceled.  An unanswered pipelined request is reset.
+func (pc *persistConn) awaitResponse(ch chan responseAndError, cancel <-chan bool, pipelined bool, reset func() (*Response, os.Error)) (*Response, os.Error) {
+	var timeout <-chan int64
+	if pc.t.ResponseHeaderTimeout > 0 {
+		timer := time.NewTimer(pc.t.ResponseHeaderTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var re responseAndError
+	select {
+	case re = <-ch:
+	case <-timeout:
+		// Closing the connection makes readLoop
+		// give up on the response.
+		pc.close()
+		re = responseAndError{nil, errResponseHeaderTimeout}
+	case <-cancel:
+		// CancelRequest has closed the connection.
+		re = responseAndError{nil, ErrRequestCanceled}
+	}
+	if re.err == errResponseHeaderTimeout || re.err == ErrRequestCanceled {
+		// A response that arrived regardless must still be
+		// closed, or readLoop would wait for it to be read.
+		go func() {
+			if re := <-ch; re.res != nil {
+				re.res.Body.Close()
+			}
+		}()
+		return re.res, re.err
+	}
+	if pipelined && re.res == nil {
+		return reset()
+	}
 	return re.res, re.err
 }
 
+// isCanceled reports whether the cancel channel of a request,
+// which is only ever closed, has been closed.
+func isCanceled(cancel <-chan bool) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+	}
+	return false
+}
+
+var (
+	errResponseHeaderTimeout = os.NewError("http: timeout awaiting response headers")
+	errPipelineReset         = os.NewError("http: connection closed before pipelined request was answered")
+	errBodySkipped           = os.NewError("http: request body not sent after early response")
+)
+
+// A continueGate decides whether the body of a request sent with
+// "Expect: 100-continue" is sent: yes if the server replies "100
+// Continue" or the wait for it times out, no if the server sends a
+// final response first or the request is canceled.
+type continueGate struct {
+	ch chan bool // closed once decided
+
+	lk      sync.Mutex
+	decided bool
+	send    bool
+}
+
+// decide decides whether the body is sent, unless that has already
+// been decided, and reports whether this call decided it.
+func (g *continueGate) decide(send bool) bool {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if g.decided {
+		return false
+	}
+	g.decided, g.send = true, send
+	close(g.ch)
+	return true
+}
+
+// A continueBody is the body of a request sent with "Expect:
+// 100-continue".  Its first Read, made once the request header has
+// been written, calls sent and then waits for the gate to decide
+// whether the body is to be sent.
+type continueBody struct {
+	io.ReadCloser
+	gate    *continueGate
+	timeout int64
+	cancel  <-chan bool
+	sent    func()
+	started bool
+}
+
+func (cb *continueBody) Read(p []byte) (int, os.Error) {
+	if !cb.started {
+		cb.started = true
+		cb.sent()
+		timer := time.NewTimer(cb.timeout)
+		select {
+		case <-cb.gate.ch:
+		case <-timer.C:
+			cb.gate.decide(true)
+		case <-cb.cancel:
+			cb.gate.decide(false)
+		}
+		timer.Stop()
+	}
+	cb.gate.lk.Lock()
+	send := cb.gate.send
+	cb.gate.lk.Unlock()
+	if !send {
+		return 0, errBodySkipped
+	}
+	return cb.ReadCloser.Read(p)
+}
+
+// close closes pc and releases its slot in the Transport.
 func (pc *persistConn) close() {
+	if pc.closeConn() {
+		pc.t.lk.Lock()
+		pc.t.releaseConnLocked(pc.cacheKey)
+		pc.t.lk.Unlock()
+	}
+}
+
+// closeConn closes pc's underlying connection, reporting whether
+// it was still open.
+func (pc *persistConn) closeConn() bool {
 	pc.lk.Lock()
 	defer pc.lk.Unlock()
+	if pc.broken {
+		return false
+	}
 	pc.broken = true
 	pc.cc.Close()
 	pc.conn.Close()
 	pc.mutateRequestFunc = nil
+	return true
 }
 
 var portMap = map[string]string{
-	"http":  "80",
-	"https": "443",
+	"http":   "80",
+	"https":  "443",
+	"socks5": "1080",
 }
 
 // canonicalAddr returns url.Host but always with a ":port" suffix
@@ -654,10 +1447,13 @@ func responseIsKeepAlive(res *Response) bool {
 
 // bodyEOFSignal wraps a ReadCloser but runs fn (if non-nil) at most
 // once, right before the final Read() or Close() call returns, but after
-// EOF has been seen.
+// EOF has been seen.  fn is passed the error, if any, from closing body.
+// Read errors after cancel has been closed are reported as
+// ErrRequestCanceled.
 type bodyEOFSignal struct {
 	body     io.ReadCloser
-	fn       func()
+	fn       func(os.Error)
+	cancel   <-chan bool
 	isClosed bool
 }
 
@@ -666,8 +1462,11 @@ func (es *bodyEOFSignal) Read(p []byte) (n int, err os.Error) {
 	if es.isClosed && n > 0 {
 		panic("http: unexpected bodyEOFSignal Read after Close; see issue 1725")
 	}
+	if err != nil && err != os.EOF && isCanceled(es.cancel) {
+		err = ErrRequestCanceled
+	}
 	if err == os.EOF && es.fn != nil {
-		es.fn()
+		es.fn(nil)
 		es.fn = nil
 	}
 	return
@@ -679,8 +1478,8 @@ func (es *bodyEOFSignal) Close() (err os.Error) {
 	}
 	es.isClosed = true
 	err = es.body.Close()
-	if err == nil && es.fn != nil {
-		es.fn()
+	if es.fn != nil {
+		es.fn(err)
 		es.fn = nil
 	}
 	return
@@ -15,16 +15,15 @@ import (
 	"http/httptest"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-// TODO: test 5 pipelined requests with responses: 1) OK, 2) OK, Connection: Close
-//       and then verify that the final 2 responses get errors back.
-
 // hostPortHandler writes back the client's "host:port".
 var hostPortHandler = HandlerFunc(func(w ResponseWriter, r *Request) {
 	if r.FormValue("close") == "true" {
@@ -250,6 +249,296 @@ func TestTransportMaxPerHostIdleConns(t *testing.T) {
 	}
 }
 
+func TestTransportMaxConnsPerHost(t *testing.T) {
+	ts := httptest.NewServer(hostPortHandler)
+	defer ts.Close()
+
+	tr := &Transport{MaxConnsPerHost: 1}
+	c := &Client{Transport: tr}
+
+	const n = 5
+	bodies := make(chan string, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			res, err := c.Get(ts.URL)
+			if err != nil {
+				t.Error(err)
+				bodies <- ""
+				return
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			bodies <- string(body)
+		}()
+	}
+	addrs := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		addrs[<-bodies] = true
+	}
+	if len(addrs) != 1 {
+		t.Errorf("requests used %d connections; want 1: %v", len(addrs), addrs)
+	}
+	if g := tr.OpenConnCountForTesting(); g > 1 {
+		t.Errorf("%d open connections; want at most 1", g)
+	}
+}
+
+func TestTransportMaxConnsClosesIdle(t *testing.T) {
+	ts1 := httptest.NewServer(hostPortHandler)
+	defer ts1.Close()
+	ts2 := httptest.NewServer(hostPortHandler)
+	defer ts2.Close()
+
+	tr := &Transport{MaxConns: 1}
+	c := &Client{Transport: tr}
+	for _, url := range []string{ts1.URL, ts2.URL} {
+		res, err := c.Get(url)
+		if err != nil {
+			t.Fatalf("Get %s: %v", url, err)
+		}
+		ioutil.ReadAll(res.Body)
+	}
+
+	keys := tr.IdleConnKeysForTesting()
+	if e := "|http|" + ts2.Listener.Addr().String(); len(keys) != 1 || keys[0] != e {
+		t.Errorf("idle conn keys = %q; want [%q]", keys, e)
+	}
+	if g := tr.OpenConnCountForTesting(); g != 1 {
+		t.Errorf("%d open connections; want 1", g)
+	}
+}
+
+func TestTransportIdleConnTimeout(t *testing.T) {
+	ts := httptest.NewServer(hostPortHandler)
+	defer ts.Close()
+
+	tr := &Transport{IdleConnTimeout: 50e6}
+	c := &Client{Transport: tr}
+	res, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	if g := len(tr.IdleConnKeysForTesting()); g != 1 {
+		t.Fatalf("after Get, %d idle conn keys; want 1", g)
+	}
+
+	time.Sleep(250e6)
+	if g := len(tr.IdleConnKeysForTesting()); g != 0 {
+		t.Errorf("after idle timeout, %d idle conn keys; want 0", g)
+	}
+	if g := tr.OpenConnCountForTesting(); g != 0 {
+		t.Errorf("after idle timeout, %d open connections; want 0", g)
+	}
+}
+
+func TestTransportResponseHeaderTimeout(t *testing.T) {
+	release := make(chan bool)
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	tr := &Transport{ResponseHeaderTimeout: 50e6}
+	c := &Client{Transport: tr}
+	if _, err := c.Get(ts.URL + "/slow"); err == nil {
+		t.Errorf("Get of slow URL succeeded; want timeout error")
+	}
+	res, err := c.Get(ts.URL + "/fast")
+	if err != nil {
+		t.Fatalf("Get of fast URL: %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestTransportCancelRequest(t *testing.T) {
+	release := make(chan bool)
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("hello"))
+		w.(Flusher).Flush()
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	tr := &Transport{}
+	req, _ := NewRequest("GET", ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50e6)
+		tr.CancelRequest(req)
+	}()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != ErrRequestCanceled {
+		t.Errorf("reading body: got error %v; want %v", err, ErrRequestCanceled)
+	}
+	if g, e := string(body), "hello"; g != e {
+		t.Errorf("body = %q; want %q", g, e)
+	}
+	res.Body.Close()
+	if g := tr.OpenConnCountForTesting(); g != 0 {
+		t.Errorf("after cancel, %d open connections; want 0", g)
+	}
+}
+
+func TestTransportCancelRequestAwaitingHeaders(t *testing.T) {
+	release := make(chan bool)
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	tr := &Transport{}
+	req, _ := NewRequest("GET", ts.URL, nil)
+	go func() {
+		time.Sleep(50e6)
+		tr.CancelRequest(req)
+	}()
+	if _, err := tr.RoundTrip(req); err != ErrRequestCanceled {
+		t.Errorf("RoundTrip: got error %v; want %v", err, ErrRequestCanceled)
+	}
+}
+
+func TestTransportCancelRequestInDial(t *testing.T) {
+	dialing, release := make(chan bool), make(chan bool)
+	tr := &Transport{
+		Dial: func(network, addr string) (net.Conn, os.Error) {
+			dialing <- true
+			<-release
+			return nil, os.NewError("dial abandoned")
+		},
+	}
+	req, _ := NewRequest("GET", "http://example.com/", nil)
+	go func() {
+		<-dialing
+		tr.CancelRequest(req)
+	}()
+	if _, err := tr.RoundTrip(req); err != ErrRequestCanceled {
+		t.Errorf("RoundTrip: got error %v; want %v", err, ErrRequestCanceled)
+	}
+	close(release)
+}
+
+// writeNotifyConn is a net.Conn that sends on written for each GET
+// request written to it.
+type writeNotifyConn struct {
+	net.Conn
+	written chan bool
+}
+
+func (c *writeNotifyConn) Write(b []byte) (int, os.Error) {
+	n, err := c.Conn.Write(b)
+	for i := bytes.Count(b[:n], []byte("GET ")); i > 0; i-- {
+		c.written <- true
+	}
+	return n, err
+}
+
+// pipelineFetch issues GETs of paths concurrently through a pipelining
+// Transport, after priming it with one request so that it has a
+// connection known to be fit for pipelining.  Each request is written
+// before the next is issued, and release is closed once all are, for
+// the handlers to answer them.  It returns the response bodies in the
+// order of paths.
+func pipelineFetch(t *testing.T, base string, paths []string, release chan bool) []string {
+	written := make(chan bool, 2*len(paths)+1)
+	tr := &Transport{
+		Pipelining: true,
+		Dial: func(network, addr string) (net.Conn, os.Error) {
+			c, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &writeNotifyConn{c, written}, nil
+		},
+	}
+	c := &Client{Transport: tr}
+	res, err := c.Get(base + "/")
+	if err != nil {
+		t.Fatalf("priming Get: %v", err)
+	}
+	ioutil.ReadAll(res.Body)
+	<-written
+
+	bodies := make([]string, len(paths))
+	done := make(chan bool)
+	for i, path := range paths {
+		go func(i int, path string) {
+			defer func() { done <- true }()
+			res, err := c.Get(base + path)
+			if err != nil {
+				t.Errorf("Get %s: %v", path, err)
+				return
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			bodies[i] = string(body)
+		}(i, path)
+		<-written
+	}
+	close(release)
+	for _ = range paths {
+		<-done
+	}
+	return bodies
+}
+
+func TestTransportPipelining(t *testing.T) {
+	release := make(chan bool)
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path != "/" {
+			<-release
+		}
+		fmt.Fprintf(w, "%s %s", r.URL.Path, r.RemoteAddr)
+	}))
+	defer ts.Close()
+
+	paths := []string{"/a", "/b", "/c", "/d"}
+	bodies := pipelineFetch(t, ts.URL, paths, release)
+
+	addrs := make(map[string]bool)
+	for i, body := range bodies {
+		f := strings.Fields(body)
+		if len(f) != 2 || f[0] != paths[i] {
+			t.Errorf("Get %s got body %q", paths[i], body)
+			continue
+		}
+		addrs[f[1]] = true
+	}
+	if len(addrs) != 1 {
+		t.Errorf("pipelined requests used %d connections; want 1", len(addrs))
+	}
+}
+
+func TestTransportPipeliningServerCloses(t *testing.T) {
+	release := make(chan bool)
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		switch r.URL.Path {
+		case "/":
+		case "/close":
+			<-release
+			w.Header().Set("Connection", "close")
+		default:
+			<-release
+		}
+		fmt.Fprintf(w, "%s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	paths := []string{"/ok", "/close", "/after1", "/after2"}
+	bodies := pipelineFetch(t, ts.URL, paths, release)
+	for i, body := range bodies {
+		if body != paths[i] {
+			t.Errorf("Get %s got body %q; want %q", paths[i], body, paths[i])
+		}
+	}
+}
+
 func TestTransportServerClosingUnexpectedly(t *testing.T) {
 	ts := httptest.NewServer(hostPortHandler)
 	defer ts.Close()
@@ -503,6 +792,97 @@ func TestTransportProxy(t *testing.T) {
 	}
 }
 
+// serveSOCKS serves one connection from a SOCKS5 client that offers
+// no authentication, reporting the address it asks for on addrc and
+// then relaying its traffic to that address.
+func serveSOCKS(t *testing.T, l net.Listener, addrc chan<- string) {
+	c, err := l.Accept()
+	if err != nil {
+		t.Errorf("Accept: %v", err)
+		return
+	}
+	defer c.Close()
+	buf := make([]byte, 256)
+	io.ReadFull(c, buf[:3]) // version, 1 method, no authentication
+	c.Write([]byte{5, 0})
+	io.ReadFull(c, buf[:4]) // version, CONNECT, reserved, address type
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(c, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(c, buf[:1])
+		n := int(buf[0])
+		io.ReadFull(c, buf[:n])
+		host = string(buf[:n])
+	}
+	io.ReadFull(c, buf[:2])
+	addr := net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+	addrc <- addr
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, c)
+	io.Copy(c, target)
+}
+
+func TestTransportSOCKSProxy(t *testing.T) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "real server")
+	}))
+	defer ts.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addrc := make(chan string, 1)
+	go serveSOCKS(t, l, addrc)
+
+	pu, err := ParseURL("socks5://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &Transport{Proxy: ProxyURL(pu), DisableKeepAlives: true}
+	c := &Client{Transport: tr}
+	res, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if g, e := string(body), "real server"; g != e {
+		t.Errorf("body = %q; want %q", g, e)
+	}
+	if g, e := <-addrc, ts.Listener.Addr().String(); g != e {
+		t.Errorf("proxy asked for %q; want %q", g, e)
+	}
+}
+
+func TestTransportSOCKSProxyBadUserinfo(t *testing.T) {
+	dialed := false
+	tr := &Transport{
+		Proxy: ProxyURL(&URL{Scheme: "socks5", Host: "127.0.0.1:1080", RawUserinfo: "gopher:%zz"}),
+		Dial: func(network, addr string) (net.Conn, os.Error) {
+			dialed = true
+			return nil, os.NewError("unexpected dial")
+		},
+	}
+	c := &Client{Transport: tr}
+	_, err := c.Get("http://example.com/")
+	if err == nil || !strings.Contains(err.String(), "%zz") {
+		t.Errorf("Get error = %v; want one for the malformed proxy password", err)
+	}
+	if dialed {
+		t.Errorf("proxy dialed with a malformed password")
+	}
+}
+
 // TestTransportGzipRecursive sends a gzip quine and checks that the
 // client gets the same value back. This is more cute than anything,
 // but checks that we don't recurse forever, and checks that
@@ -562,6 +942,79 @@ func TestTransportAltProto(t *testing.T) {
 	}
 }
 
+// skipProto handles requests for "/alt" and leaves the rest
+// to the Transport.
+type skipProto struct{}
+
+func (skipProto) RoundTrip(req *Request) (*Response, os.Error) {
+	if req.URL.Path != "/alt" {
+		return nil, ErrSkipAltProtocol
+	}
+	return fooProto{}.RoundTrip(req)
+}
+
+func TestTransportAltProtoOverridesHTTP(t *testing.T) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Write([]byte("from server"))
+	}))
+	defer ts.Close()
+
+	tr := &Transport{}
+	c := &Client{Transport: tr}
+	tr.RegisterProtocol("http", skipProto{})
+	for _, tt := range []struct{ path, want string }{
+		{"/alt", "You wanted " + ts.URL + "/alt"},
+		{"/other", "from server"},
+	} {
+		res, err := c.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatalf("Get %s: %v", tt.path, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tt.want {
+			t.Errorf("Get %s: got %q; want %q", tt.path, body, tt.want)
+		}
+	}
+}
+
+// hangProto hangs in RoundTrip until the request is canceled.
+type hangProto struct {
+	lk     sync.Mutex
+	cancel map[*Request]chan bool
+}
+
+func (p *hangProto) RoundTrip(req *Request) (*Response, os.Error) {
+	ch := make(chan bool)
+	p.lk.Lock()
+	p.cancel[req] = ch
+	p.lk.Unlock()
+	<-ch
+	return nil, ErrRequestCanceled
+}
+
+func (p *hangProto) CancelRequest(req *Request) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if ch, ok := p.cancel[req]; ok {
+		close(ch)
+		p.cancel[req] = nil, false
+	}
+}
+
+func TestTransportAltProtoTimeout(t *testing.T) {
+	tr := &Transport{}
+	tr.RegisterProtocol("http", &hangProto{cancel: make(map[*Request]chan bool)})
+	c := &Client{Transport: tr, Timeout: 100e6}
+	_, err := c.Get("http://example.com/hang")
+	if ue, ok := err.(*URLError); !ok || ue.Error != ErrClientTimeout {
+		t.Errorf("Get: got error %v; want %v", err, ErrClientTimeout)
+	}
+}
+
 // rgz is a gzip quine that uncompresses to itself.
 var rgz = []byte{
 	0x1f, 0x8b, 0x08, 0x08, 0x00, 0x00, 0x00, 0x00,
@@ -597,3 +1050,108 @@ var rgz = []byte{
 	0x00, 0x00, 0x3d, 0xb1, 0x20, 0x85, 0xfa, 0x00,
 	0x00, 0x00,
 }
+
+// readCounter counts the bytes read through it.
+type readCounter struct {
+	r io.Reader
+	n int
+}
+
+func (rc *readCounter) Read(p []byte) (n int, err os.Error) {
+	n, err = rc.r.Read(p)
+	rc.n += n
+	return
+}
+
+func TestTransportExpectContinue(t *testing.T) {
+	ts := httptest.NewServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(StatusExpectationFailed)
+			return
+		}
+		slurp, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("server reading body: %v", err)
+		}
+		fmt.Fprintf(w, "%d", len(slurp))
+	}))
+	defer ts.Close()
+
+	tr := &Transport{ExpectContinueTimeout: 10e9}
+	c := &Client{Transport: tr}
+	body := strings.Repeat("x", 1<<20)
+
+	tests := []struct {
+		path     string
+		status   int
+		bodySent bool
+	}{
+		{"/accept", StatusOK, true},
+		{"/reject", StatusExpectationFailed, false},
+		{"/accept", StatusOK, true},
+	}
+	for _, tt := range tests {
+		rc := &readCounter{r: strings.NewReader(body)}
+		req, _ := NewRequest("PUT", ts.URL+tt.path, rc)
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Expect", "100-continue")
+		start := time.Nanoseconds()
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		slurp, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if d := time.Nanoseconds() - start; d > 5e9 {
+			t.Errorf("%s: took %d ms; want no wait for the timeout", tt.path, d/1e6)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: status = %d; want %d", tt.path, res.StatusCode, tt.status)
+		}
+		if sent := rc.n > 0; sent != tt.bodySent {
+			t.Errorf("%s: body sent = %v (%d bytes); want %v", tt.path, sent, rc.n, tt.bodySent)
+		}
+		if tt.bodySent && string(slurp) != strconv.Itoa(len(body)) {
+			t.Errorf("%s: server read %q bytes; want %d", tt.path, slurp, len(body))
+		}
+	}
+}
+
+func TestTransportExpectContinueTimeout(t *testing.T) {
+	// A server that ignores "Expect: 100-continue" and waits for
+	// the body.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 4096)
+		var got []byte
+		for !bytes.HasSuffix(got, []byte("\r\n\r\nbody")) {
+			n, err := c.Read(buf)
+			if err != nil {
+				return
+			}
+			got = append(got, buf[:n]...)
+		}
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	}()
+
+	tr := &Transport{ExpectContinueTimeout: 50e6}
+	req, _ := NewRequest("POST", "http://"+l.Addr().String()+"/", strings.NewReader("body"))
+	req.Header.Set("Expect", "100-continue")
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != StatusOK {
+		t.Errorf("status = %d; want 200", res.StatusCode)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package socks implements a client for SOCKS version 5 proxies
+// as defined in RFC 1928, with the username/password
+// authentication of RFC 1929.
+package socks
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	version5 = 5
+
+	authNone     = 0
+	authPassword = 2
+
+	passwordVersion = 1
+
+	cmdConnect = 1
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+// Auth holds the credentials with which to authenticate to a proxy.
+type Auth struct {
+	User, Password string
+}
+
+// A Dialer makes connections through a SOCKS5 proxy.
+type Dialer struct {
+	Net  string // network of the proxy, usually "tcp"
+	Addr string // address of the proxy, as "host:port"
+
+	// Auth, if non-nil, holds the credentials with which to
+	// authenticate to the proxy, if it asks for them.
+	Auth *Auth
+
+	// Forward specifies the dial function with which to connect
+	// to the proxy.  If Forward is nil, net.Dial is used.
+	Forward func(net, addr string) (net.Conn, os.Error)
+}
+
+// NewDialer returns a Dialer that connects through the proxy at
+// addr on the given network, authenticating with auth if it is
+// non-nil.
+func NewDialer(network, addr string, auth *Auth) *Dialer {
+	return &Dialer{Net: network, Addr: addr, Auth: auth}
+}
+
+// An Error is a failure reported by a proxy.
+type Error struct {
+	Addr   string // address to which the connection was requested
+	Reason string
+}
+
+func (e *Error) String() string {
+	return "socks: connecting to " + e.Addr + ": " + e.Reason
+}
+
+var (
+	ErrNoAuth     = os.NewError("socks: proxy accepted none of the offered authentication methods")
+	ErrAuthFailed = os.NewError("socks: username/password authentication failed")
+	ErrBadReply   = os.NewError("socks: malformed reply from proxy")
+)
+
+// replyReasons gives the meaning of the reply codes of RFC 1928 section 6.
+var replyReasons = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Dial connects to addr on the given network, which must be "tcp",
+// "tcp4" or "tcp6", through the proxy.  A host name in addr is
+// resolved by the proxy.  Dial has the signature of net.Dial, so that
+// d.Dial may be used, for instance, as the Dial function of an
+// http.Transport.
+func (d *Dialer) Dial(network, addr string) (net.Conn, os.Error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{"dial", network, nil, net.UnknownNetworkError(network)}
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return nil, &Error{addr, "bad port"}
+	}
+	if len(host) > 255 {
+		return nil, &Error{addr, "host name too long"}
+	}
+
+	dial := d.Forward
+	if dial == nil {
+		dial = net.Dial
+	}
+	c, err := dial(d.Net, d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.connect(c, addr, host, port); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect performs the SOCKS5 handshake on c, asking the proxy to
+// connect to host and port.
+func (d *Dialer) connect(c net.Conn, addr, host string, port int) os.Error {
+	// Negotiate the authentication method.
+	buf := []byte{version5, 1, authNone}
+	if d.Auth != nil {
+		buf = []byte{version5, 2, authNone, authPassword}
+	}
+	if _, err := c.Write(buf); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != version5 {
+		return ErrBadReply
+	}
+	switch buf[1] {
+	case authNone:
+	case authPassword:
+		if d.Auth == nil {
+			return ErrNoAuth
+		}
+		if err := d.authenticate(c); err != nil {
+			return err
+		}
+	default:
+		return ErrNoAuth
+	}
+
+	// Send the request.
+	buf = []byte{version5, cmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, atypIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, atypIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		buf = append(buf, atypDomain, byte(len(host)))
+		buf = append(buf, []byte(host)...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	if _, err := c.Write(buf); err != nil {
+		return err
+	}
+
+	// Read the reply, and skip the bound address it holds.
+	buf = buf[:4]
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	if buf[0] != version5 {
+		return ErrBadReply
+	}
+	if rep := int(buf[1]); rep != 0 {
+		reason := "unknown error " + strconv.Itoa(rep)
+		if rep < len(replyReasons) {
+			reason = replyReasons[rep]
+		}
+		return &Error{addr, reason}
+	}
+	var n int
+	switch buf[3] {
+	case atypIPv4:
+		n = net.IPv4len
+	case atypIPv6:
+		n = net.IPv6len
+	case atypDomain:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return ErrBadReply
+	}
+	_, err := io.ReadFull(c, make([]byte, n+2))
+	return err
+}
+
+// authenticate authenticates to the proxy with d.Auth.
+func (d *Dialer) authenticate(c net.Conn) os.Error {
+	user, password := d.Auth.User, d.Auth.Password
+	if len(user) > 255 || len(password) > 255 {
+		return ErrAuthFailed
+	}
+	buf := []byte{passwordVersion, byte(len(user))}
+	buf = append(buf, []byte(user)...)
+	buf = append(buf, byte(len(password)))
+	buf = append(buf, []byte(password)...)
+	if _, err := c.Write(buf); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != passwordVersion {
+		return ErrBadReply
+	}
+	if buf[1] != 0 {
+		return ErrAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// socksServer is a SOCKS5 proxy for tests.  It serves connections
+// until its listener is closed, requiring user and password if user
+// is set, and records the destination of each request.
+type socksServer struct {
+	l              net.Listener
+	user, password string
+	authVersion    byte // version of its authentication replies
+	dest           chan string
+}
+
+func newSocksServer(t *testing.T, user, password string) *socksServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	s := &socksServer{l: l, user: user, password: password, authVersion: passwordVersion, dest: make(chan string, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) serve(c net.Conn) {
+	defer c.Close()
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil || buf[0] != version5 {
+		return
+	}
+	methods := buf[2 : 2+buf[1]]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return
+	}
+	want := byte(authNone)
+	if s.user != "" {
+		want = authPassword
+	}
+	method := byte(0xff)
+	for _, m := range methods {
+		if m == want {
+			method = m
+		}
+	}
+	c.Write([]byte{version5, method})
+	if method == 0xff {
+		return
+	}
+	if method == authPassword {
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, buf[:1])
+		password := make([]byte, buf[0])
+		io.ReadFull(c, password)
+		if string(user) != s.user || string(password) != s.password {
+			c.Write([]byte{s.authVersion, 1})
+			return
+		}
+		c.Write([]byte{s.authVersion, 0})
+	}
+
+	if _, err := io.ReadFull(c, buf[:4]); err != nil || buf[1] != cmdConnect {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case atypIPv4:
+		ip := make(net.IP, net.IPv4len)
+		io.ReadFull(c, ip)
+		host = ip.String()
+	case atypIPv6:
+		ip := make(net.IP, net.IPv6len)
+		io.ReadFull(c, ip)
+		host = ip.String()
+	case atypDomain:
+		io.ReadFull(c, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(c, name)
+		host = string(name)
+	}
+	io.ReadFull(c, buf[:2])
+	port := int(buf[0])<<8 | int(buf[1])
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	s.dest <- addr
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		// Connection refused.
+		c.Write([]byte{version5, 5, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	c.Write([]byte{version5, 0, 0, atypIPv4, 127, 0, 0, 1, 0, 0})
+	go io.Copy(target, c)
+	io.Copy(c, target)
+}
+
+// startEchoServer returns the port of a server that echoes what
+// it reads.
+func startEchoServer(t *testing.T) (net.Listener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return l, port
+}
+
+func testEcho(t *testing.T, c net.Conn) {
+	msg := []byte("hello, world")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal("Write:", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal("Read:", err)
+	}
+	if string(buf) != string(msg) {
+		t.Errorf("got %q; want %q", buf, msg)
+	}
+}
+
+func TestDial(t *testing.T) {
+	echo, port := startEchoServer(t)
+	defer echo.Close()
+	s := newSocksServer(t, "", "")
+	defer s.l.Close()
+
+	d := NewDialer("tcp", s.l.Addr().String(), nil)
+	for _, addr := range []string{"127.0.0.1:" + port, "localhost:" + port} {
+		c, err := d.Dial("tcp", addr)
+		if err != nil {
+			t.Errorf("Dial %s: %v", addr, err)
+			continue
+		}
+		// Host names are sent to the proxy unresolved.
+		if g := <-s.dest; g != addr {
+			t.Errorf("proxy connected to %s; want %s", g, addr)
+		}
+		testEcho(t, c)
+		c.Close()
+	}
+}
+
+func TestDialPassword(t *testing.T) {
+	echo, port := startEchoServer(t)
+	defer echo.Close()
+	s := newSocksServer(t, "gopher", "secret")
+	defer s.l.Close()
+	proxyAddr := s.l.Addr().String()
+
+	d := NewDialer("tcp", proxyAddr, &Auth{"gopher", "secret"})
+	c, err := d.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	testEcho(t, c)
+	c.Close()
+
+	d = NewDialer("tcp", proxyAddr, &Auth{"gopher", "wrong"})
+	if _, err := d.Dial("tcp", "127.0.0.1:"+port); err != ErrAuthFailed {
+		t.Errorf("Dial with wrong password: got error %v; want %v", err, ErrAuthFailed)
+	}
+	d = NewDialer("tcp", proxyAddr, nil)
+	if _, err := d.Dial("tcp", "127.0.0.1:"+port); err != ErrNoAuth {
+		t.Errorf("Dial without password: got error %v; want %v", err, ErrNoAuth)
+	}
+
+	s.authVersion = 5
+	d = NewDialer("tcp", proxyAddr, &Auth{"gopher", "secret"})
+	if _, err := d.Dial("tcp", "127.0.0.1:"+port); err != ErrBadReply {
+		t.Errorf("Dial with bad authentication version: got error %v; want %v", err, ErrBadReply)
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	l, port := startEchoServer(t)
+	l.Close()
+	s := newSocksServer(t, "", "")
+	defer s.l.Close()
+
+	d := NewDialer("tcp", s.l.Addr().String(), nil)
+	_, err := d.Dial("tcp", "127.0.0.1:"+port)
+	if e, ok := err.(*Error); !ok || e.Reason != "connection refused" {
+		t.Errorf("Dial: got error %v; want connection refused", err)
+	}
+}
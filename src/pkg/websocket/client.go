@@ -97,6 +97,8 @@ A trivial example client:
 		}
 		// use msg[0:n]
 	}
+
+Dial speaks the protocol of RFC 6455.
 */
 func Dial(url, protocol, origin string) (ws *Conn, err os.Error) {
 	var client net.Conn
@@ -120,7 +122,7 @@ func Dial(url, protocol, origin string) (ws *Conn, err os.Error) {
 		goto Error
 	}
 
-	ws, err = newClient(parsedUrl.RawPath, parsedUrl.Host, origin, url, protocol, client, handshake)
+	ws, err = newHybiClient(parsedUrl.RawPath, parsedUrl.Host, origin, url, protocol, client)
 	if err != nil {
 		goto Error
 	}
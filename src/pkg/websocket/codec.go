@@ -0,0 +1,234 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bufio"
+	"json"
+	"os"
+)
+
+// DefaultMaxPayloadBytes is the largest message Receive accepts
+// on a connection whose MaxPayloadBytes is zero.
+const DefaultMaxPayloadBytes = 32 << 20 // 32MB
+
+var ErrFrameTooLarge = &ProtocolError{"message too large"}
+
+// Codec represents a symmetric pair of functions that implement a
+// codec for messages sent over a Web Socket.  Marshal returns the
+// payload of the message representing v and the type of frame to
+// send it in, TextFrame or BinaryFrame; Unmarshal stores in v the
+// value represented by a message received in a frame of the given
+// type.
+//
+// Send and Receive send and receive one value as one message,
+// so that applications need not mark message boundaries themselves.
+type Codec struct {
+	Marshal   func(v interface{}) (data []byte, payloadType byte, err os.Error)
+	Unmarshal func(data []byte, payloadType byte, v interface{}) os.Error
+}
+
+// Send sends v marshaled by cd.Marshal as a single message.
+func (cd Codec) Send(ws *Conn, v interface{}) os.Error {
+	data, payloadType, err := cd.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.writeMessage(payloadType, data)
+}
+
+// Receive receives a single message and unmarshals it into v by
+// cd.Unmarshal.  Messages larger than ws.MaxPayloadBytes are refused
+// with ErrFrameTooLarge, and text messages that are not valid UTF-8
+// with ErrInvalidText; either way the connection is closed.  The type
+// of frame the message arrived in is reported by ws.MessageType.
+func (cd Codec) Receive(ws *Conn, v interface{}) os.Error {
+	data, payloadType, err := ws.readMessage()
+	if err != nil {
+		return err
+	}
+	return cd.Unmarshal(data, payloadType, v)
+}
+
+func marshal(v interface{}) (data []byte, payloadType byte, err os.Error) {
+	switch data := v.(type) {
+	case string:
+		return []byte(data), TextFrame, nil
+	case []byte:
+		return data, BinaryFrame, nil
+	}
+	return nil, UnknownFrame, ErrNotSupported
+}
+
+func unmarshal(data []byte, payloadType byte, v interface{}) os.Error {
+	switch v := v.(type) {
+	case *string:
+		*v = string(data)
+		return nil
+	case *[]byte:
+		*v = data
+		return nil
+	}
+	return ErrNotSupported
+}
+
+/*
+Message is a codec to send and receive text and binary messages.
+A string is sent as a text message and a []byte as a binary one.
+Either kind of message may be received into a *string or a *[]byte.
+
+Trivial usage:
+
+	import "websocket"
+
+	// receive a message
+	var message string
+	websocket.Message.Receive(ws, &message)
+
+	// send a text message
+	message = "hello"
+	websocket.Message.Send(ws, message)
+
+	// send a binary message
+	data := []byte{0, 1, 2}
+	websocket.Message.Send(ws, data)
+*/
+var Message = Codec{marshal, unmarshal}
+
+func jsonMarshal(v interface{}) (data []byte, payloadType byte, err os.Error) {
+	data, err = json.Marshal(v)
+	return data, TextFrame, err
+}
+
+func jsonUnmarshal(data []byte, payloadType byte, v interface{}) os.Error {
+	return json.Unmarshal(data, v)
+}
+
+/*
+JSON is a codec to send and receive values encoded in JSON, by package
+json, in text messages.
+
+Trivial usage:
+
+	import "websocket"
+
+	type T struct {
+		Msg   string
+		Count int
+	}
+
+	// receive a JSON value
+	var data T
+	websocket.JSON.Receive(ws, &data)
+
+	// send a JSON value
+	websocket.JSON.Send(ws, data)
+*/
+var JSON = Codec{jsonMarshal, jsonUnmarshal}
+
+// MessageType returns the type of frame, TextFrame or BinaryFrame,
+// in which the message last received by Receive or Read arrived.
+func (ws *Conn) MessageType() byte {
+	if !ws.hybi {
+		return TextFrame
+	}
+	return ws.messageType
+}
+
+// maxPayloadBytes returns the largest message ws accepts.
+func (ws *Conn) maxPayloadBytes() int64 {
+	if ws.MaxPayloadBytes > 0 {
+		return int64(ws.MaxPayloadBytes)
+	}
+	return DefaultMaxPayloadBytes
+}
+
+// writeMessage sends data as a single message of the given type.
+// Connections speaking the hixie drafts can only send text.
+func (ws *Conn) writeMessage(payloadType byte, data []byte) os.Error {
+	if payloadType != TextFrame && payloadType != BinaryFrame {
+		return ErrBadFrame
+	}
+	if !ws.hybi {
+		if payloadType != TextFrame {
+			return ErrNotSupported
+		}
+		_, err := ws.Write(data)
+		return err
+	}
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return ErrClosed
+	}
+	return ws.writeFrameLocked(0x80|payloadType, data)
+}
+
+// readMessage reads the rest of the message being read by Read,
+// if any, or else the next message, and returns its payload and
+// type.
+func (ws *Conn) readMessage() (data []byte, payloadType byte, err os.Error) {
+	if !ws.hybi {
+		return ws.readHixieMessage()
+	}
+	if ws.readErr != nil {
+		return nil, UnknownFrame, ws.readErr
+	}
+	// Unless Read has consumed some of it, the whole message is
+	// read here, and text is checked to be UTF-8.
+	whole := ws.rem == 0 && !ws.inMessage
+	if whole {
+		if err = ws.nextFrame(); err != nil {
+			return nil, UnknownFrame, err
+		}
+	}
+	max := ws.maxPayloadBytes()
+	for {
+		if ws.rem > max-int64(len(data)) {
+			return nil, UnknownFrame, ws.fail(CloseMessageTooBig, ErrFrameTooLarge)
+		}
+		p := make([]byte, ws.rem)
+		for len(p) > 0 {
+			n, err := ws.hybiRead(p)
+			data = append(data, p[:n]...)
+			if err != nil {
+				return nil, UnknownFrame, err
+			}
+			p = p[n:]
+		}
+		if !ws.inMessage {
+			if whole && ws.messageType == TextFrame && !validUTF8(data) {
+				return nil, UnknownFrame, ws.fail(CloseInvalidPayload, ErrInvalidText)
+			}
+			return data, ws.messageType, nil
+		}
+		if err = ws.nextFrame(); err != nil {
+			return nil, UnknownFrame, err
+		}
+	}
+	panic("not reached")
+}
+
+// readHixieMessage reads a message, always of text, from a connection
+// speaking the hixie drafts.
+func (ws *Conn) readHixieMessage() (data []byte, payloadType byte, err os.Error) {
+	max := ws.maxPayloadBytes()
+	buf := make([]byte, 512)
+	for {
+		n, err := ws.Read(buf)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, UnknownFrame, err
+		}
+		data = append(data, buf[:n]...)
+		if int64(len(data)) > max {
+			ws.Close()
+			return nil, UnknownFrame, ErrFrameTooLarge
+		}
+		if !ws.reading && len(ws.data) == 0 {
+			return data, TextFrame, nil
+		}
+	}
+	panic("not reached")
+}
@@ -0,0 +1,547 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+// This file implements the protocol of RFC 6455, also known by the name
+// of its drafts, hybi: its opening handshake, for both client and
+// server, and its framing.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"http"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"utf8"
+)
+
+// Frame types (opcodes) of RFC 6455.
+const (
+	ContinuationFrame = 0
+	TextFrame         = 1
+	BinaryFrame       = 2
+	CloseFrame        = 8
+	PingFrame         = 9
+	PongFrame         = 10
+	UnknownFrame      = 255
+)
+
+// Status codes sent in close frames, as defined in RFC 6455 section 7.4.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005 // never sent; reported when a close frame has no status
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseMandatoryExt     = 1010
+	CloseInternalError    = 1011
+)
+
+// protocolVersion is the Sec-WebSocket-Version this package speaks.
+const protocolVersion = "13"
+
+// websocketGUID is appended to the client's key to form the server's
+// Sec-WebSocket-Accept value.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxControlPayload is the largest payload a control frame may carry.
+const maxControlPayload = 125
+
+var (
+	ErrBadFrame     = &ProtocolError{"bad frame"}
+	ErrNotSupported = &ProtocolError{"not supported by protocol version"}
+	ErrClosed       = os.ErrorString("use of closed Web Socket")
+	ErrInvalidText  = &ProtocolError{"text message is not valid UTF-8"}
+)
+
+// acceptKey returns the Sec-WebSocket-Accept value that answers
+// the Sec-WebSocket-Key key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum())
+}
+
+// generateNonce returns a random Sec-WebSocket-Key.
+func generateNonce() (string, os.Error) {
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// headerHasToken reports whether the comma-separated list in header
+// field name of h contains token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",", -1) {
+			if strings.ToLower(strings.TrimSpace(t)) == token {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newHybiClient creates a new client connection speaking RFC 6455,
+// performing the opening handshake over rwc.
+func newHybiClient(resourceName, host, origin, location, protocol string, rwc io.ReadWriteCloser) (ws *Conn, err os.Error) {
+	br := bufio.NewReader(rwc)
+	bw := bufio.NewWriter(rwc)
+	protocol, err = hybiClientHandshake(resourceName, host, origin, protocol, br, bw)
+	if err != nil {
+		return
+	}
+	ws = newConn(origin, location, protocol, bufio.NewReadWriter(br, bw), rwc)
+	ws.hybi = true
+	ws.client = true
+	return
+}
+
+// hybiClientHandshake performs the client's side of the opening
+// handshake, offering the comma-separated subprotocols in protocol.
+// It returns the subprotocol chosen by the server.
+func hybiClientHandshake(resourceName, host, origin, protocol string, br *bufio.Reader, bw *bufio.Writer) (string, os.Error) {
+	key, err := generateNonce()
+	if err != nil {
+		return "", err
+	}
+	bw.WriteString("GET " + resourceName + " HTTP/1.1\r\n")
+	bw.WriteString("Host: " + host + "\r\n")
+	bw.WriteString("Upgrade: websocket\r\n")
+	bw.WriteString("Connection: Upgrade\r\n")
+	bw.WriteString("Sec-WebSocket-Key: " + key + "\r\n")
+	bw.WriteString("Sec-WebSocket-Version: " + protocolVersion + "\r\n")
+	if origin != "" {
+		bw.WriteString("Origin: " + origin + "\r\n")
+	}
+	if protocol != "" {
+		bw.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	bw.WriteString("\r\n")
+	if err := bw.Flush(); err != nil {
+		return "", err
+	}
+
+	resp, err := http.ReadResponse(br, &http.Request{Method: "GET"})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return "", ErrBadStatus
+	}
+	if !headerHasToken(resp.Header, "Upgrade", "websocket") ||
+		!headerHasToken(resp.Header, "Connection", "upgrade") {
+		return "", ErrBadUpgrade
+	}
+	if resp.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		return "", ErrChallengeResponse
+	}
+	// The server may choose one of the offered subprotocols, or none.
+	chosen := strings.TrimSpace(resp.Header.Get("Sec-Websocket-Protocol"))
+	if chosen != "" {
+		offered := false
+		for _, p := range strings.Split(protocol, ",", -1) {
+			if strings.TrimSpace(p) == chosen {
+				offered = true
+			}
+		}
+		if !offered {
+			return "", ErrBadWebSocketProtocol
+		}
+	}
+	return chosen, nil
+}
+
+// serveHybi performs the server's side of the opening handshake for a
+// client speaking RFC 6455, and then runs f.
+func (f Handler) serveHybi(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" ||
+		!headerHasToken(req.Header, "Upgrade", "websocket") ||
+		!headerHasToken(req.Header, "Connection", "upgrade") {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "bad Web Socket handshake")
+		return
+	}
+	// Version 8, of the last drafts, differs from version 13 only
+	// in the name of its origin header.
+	var origin string
+	switch req.Header.Get("Sec-Websocket-Version") {
+	case protocolVersion:
+		origin = req.Header.Get("Origin")
+	case "8":
+		origin = req.Header.Get("Sec-Websocket-Origin")
+	default:
+		w.Header().Set("Sec-WebSocket-Version", protocolVersion)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "unsupported Web Socket protocol version")
+		return
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+
+	// Choose the first subprotocol the client offers.
+	protocol := req.Header.Get("Sec-Websocket-Protocol")
+	if i := strings.Index(protocol, ","); i >= 0 {
+		protocol = protocol[:i]
+	}
+	protocol = strings.TrimSpace(protocol)
+
+	rwc, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic("Hijack failed: " + err.String())
+		return
+	}
+
+	var location string
+	if req.TLS != nil {
+		location = "wss://" + req.Host + req.URL.RawPath
+	} else {
+		location = "ws://" + req.Host + req.URL.RawPath
+	}
+
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buf.WriteString("Upgrade: websocket\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n")
+	if protocol != "" {
+		buf.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	if err := buf.Flush(); err != nil {
+		rwc.Close()
+		return
+	}
+	ws := newConn(origin, location, protocol, buf, rwc)
+	ws.hybi = true
+	ws.Request = req
+	defer ws.Close()
+	f(ws)
+}
+
+// hybiRead implements Read for a connection speaking RFC 6455.
+// It returns the payload of data frames, whatever their type and
+// however the messages they make up are fragmented, and handles
+// the control frames that arrive between them.
+func (ws *Conn) hybiRead(msg []byte) (n int, err os.Error) {
+	if ws.readErr != nil {
+		return 0, ws.readErr
+	}
+	for ws.rem == 0 {
+		if err = ws.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(msg)) > ws.rem {
+		msg = msg[:ws.rem]
+	}
+	n, err = ws.buf.Read(msg)
+	ws.rem -= int64(n)
+	if ws.masked {
+		for i := 0; i < n; i++ {
+			msg[i] ^= ws.mask[ws.maskPos]
+			ws.maskPos = (ws.maskPos + 1) & 3
+		}
+	}
+	if err == os.EOF && ws.rem > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads frames until it finds the header of a data frame,
+// handling any control frames before it.  It leaves the connection
+// ready to read the data frame's payload.
+func (ws *Conn) nextFrame() os.Error {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(ws.buf, hdr[:2]); err != nil {
+			return err
+		}
+		fin := hdr[0]&0x80 != 0
+		opcode := hdr[0] & 0x0f
+		masked := hdr[1]&0x80 != 0
+		if hdr[0]&0x70 != 0 || masked == ws.client {
+			// No extensions are negotiated, so the reserved
+			// bits must be clear; frames from the client,
+			// and only those, must be masked.
+			return ws.fail(CloseProtocolError, ErrBadFrame)
+		}
+		length := int64(hdr[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(ws.buf, hdr[:2]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint16(hdr[:2]))
+		case 127:
+			if _, err := io.ReadFull(ws.buf, hdr[:8]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint64(hdr[:8]))
+			if length < 0 {
+				return ws.fail(CloseProtocolError, ErrBadFrame)
+			}
+		}
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(ws.buf, mask[:]); err != nil {
+				return err
+			}
+		}
+
+		switch opcode {
+		case ContinuationFrame:
+			if !ws.inMessage {
+				return ws.fail(CloseProtocolError, ErrBadFrame)
+			}
+		case TextFrame, BinaryFrame:
+			if ws.inMessage {
+				return ws.fail(CloseProtocolError, ErrBadFrame)
+			}
+			ws.messageType = opcode
+		case CloseFrame, PingFrame, PongFrame:
+			// Control frames may come between the fragments
+			// of a message, but may not be fragmented.
+			if !fin || length > maxControlPayload {
+				return ws.fail(CloseProtocolError, ErrBadFrame)
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(ws.buf, payload); err != nil {
+				return err
+			}
+			for i := range payload {
+				payload[i] ^= mask[i&3]
+			}
+			if err := ws.handleControl(opcode, payload); err != nil {
+				return err
+			}
+			continue
+		default:
+			return ws.fail(CloseProtocolError, ErrBadFrame)
+		}
+		ws.inMessage = !fin
+		ws.rem = length
+		ws.masked = masked
+		ws.mask = mask
+		ws.maskPos = 0
+		return nil
+	}
+	panic("not reached")
+}
+
+// handleControl acts on a control frame received from the peer.
+func (ws *Conn) handleControl(opcode byte, payload []byte) os.Error {
+	switch opcode {
+	case PingFrame:
+		ws.wmu.Lock()
+		defer ws.wmu.Unlock()
+		if ws.closeSent {
+			return nil
+		}
+		return ws.writeFrameLocked(0x80|PongFrame, payload)
+	case CloseFrame:
+		switch len(payload) {
+		case 0:
+			ws.closeCode = CloseNoStatusReceived
+		case 1:
+			return ws.fail(CloseProtocolError, ErrBadFrame)
+		default:
+			ws.closeCode = int(binary.BigEndian.Uint16(payload))
+			ws.closeReason = string(payload[2:])
+		}
+		// Complete the closing handshake, echoing the status.
+		ws.WriteClose(ws.closeCode, "")
+		ws.readErr = os.EOF
+		return os.EOF
+	}
+	// Unsolicited pongs are ignored.
+	return nil
+}
+
+// fail reports an error by the peer, closing the connection with
+// the status code, and returns err.
+func (ws *Conn) fail(code int, err os.Error) os.Error {
+	ws.readErr = err
+	ws.WriteClose(code, "")
+	return err
+}
+
+// validUTF8 reports whether p is valid UTF-8, as the payload of a
+// text message must be: it may not encode surrogate halves or code
+// points beyond unicode.MaxRune, which package utf8 decodes.
+func validUTF8(p []byte) bool {
+	for len(p) > 0 {
+		rune, size := utf8.DecodeRune(p)
+		if rune == utf8.RuneError && size == 1 ||
+			0xd800 <= rune && rune <= 0xdfff || rune > unicode.MaxRune {
+			return false
+		}
+		p = p[size:]
+	}
+	return true
+}
+
+// hybiWrite implements Write for a connection speaking RFC 6455.
+// Each call sends msg as a single frame of type ws.PayloadType.
+func (ws *Conn) hybiWrite(msg []byte) (n int, err os.Error) {
+	if ws.PayloadType != TextFrame && ws.PayloadType != BinaryFrame {
+		return 0, ErrBadFrame
+	}
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return 0, ErrClosed
+	}
+	if err = ws.writeFrameLocked(0x80|ws.PayloadType, msg); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// writeFrameLocked writes a frame with the given first header byte,
+// holding the FIN bit and opcode, and payload.  Frames written by a
+// client are masked.  ws.wmu must be held.
+func (ws *Conn) writeFrameLocked(b0 byte, payload []byte) os.Error {
+	var hdr [14]byte
+	hdr[0] = b0
+	n := 2
+	switch length := len(payload); {
+	case length <= 125:
+		hdr[1] = byte(length)
+	case length <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(length))
+		n = 4
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(length))
+		n = 10
+	}
+	if ws.client {
+		hdr[1] |= 0x80
+		mask := hdr[n : n+4]
+		if _, err := io.ReadFull(rand.Reader, mask); err != nil {
+			return err
+		}
+		n += 4
+		// Mask a copy, leaving the caller's data untouched.
+		masked := make([]byte, len(payload))
+		for i, c := range payload {
+			masked[i] = c ^ mask[i&3]
+		}
+		payload = masked
+	}
+	ws.buf.Write(hdr[:n])
+	ws.buf.Write(payload)
+	return ws.buf.Flush()
+}
+
+// Ping sends a ping frame carrying data, which may be at most 125
+// bytes long.  The peer's pong in reply is discarded by Read.
+// Pings from the peer are answered automatically.
+func (ws *Conn) Ping(data []byte) os.Error {
+	if !ws.hybi {
+		return ErrNotSupported
+	}
+	if len(data) > maxControlPayload {
+		return ErrBadFrame
+	}
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return ErrClosed
+	}
+	return ws.writeFrameLocked(0x80|PingFrame, data)
+}
+
+// WriteClose starts the closing handshake, sending a close frame with
+// the given status code and reason.  No more data may be written, but
+// Read returns what the peer sends until it replies with its own
+// close frame, when Read returns os.EOF.  WriteClose does nothing if
+// a close frame has already been sent.
+func (ws *Conn) WriteClose(code int, reason string) os.Error {
+	if !ws.hybi {
+		return ErrNotSupported
+	}
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return nil
+	}
+	ws.closeSent = true
+	var payload []byte
+	if code != CloseNoStatusReceived {
+		payload = make([]byte, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		copy(payload[2:], reason)
+		if len(payload) > maxControlPayload {
+			payload = payload[:maxControlPayload]
+		}
+	}
+	return ws.writeFrameLocked(0x80|CloseFrame, payload)
+}
+
+// CloseStatus returns the status code and reason of the close frame
+// received from the peer, or 0 if none has been received.  It is
+// CloseNoStatusReceived if the peer's close frame had no status.
+func (ws *Conn) CloseStatus() (code int, reason string) {
+	return ws.closeCode, ws.closeReason
+}
+
+// NewMessageWriter returns a writer that sends a message of the given
+// type, TextFrame or BinaryFrame, as a series of fragments: each Write
+// sends one frame, and Close sends the final one.  Messages of unknown
+// length may be streamed this way.  No other data may be written to
+// ws until the writer is closed.
+func (ws *Conn) NewMessageWriter(payloadType byte) (io.WriteCloser, os.Error) {
+	if !ws.hybi {
+		return nil, ErrNotSupported
+	}
+	if payloadType != TextFrame && payloadType != BinaryFrame {
+		return nil, ErrBadFrame
+	}
+	return &messageWriter{ws: ws, opcode: payloadType}, nil
+}
+
+type messageWriter struct {
+	ws     *Conn
+	opcode byte // of the next frame
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, os.Error) {
+	if err := w.writeFrame(w.opcode, p); err != nil {
+		return 0, err
+	}
+	w.opcode = ContinuationFrame
+	return len(p), nil
+}
+
+func (w *messageWriter) Close() os.Error {
+	err := w.writeFrame(0x80|w.opcode, nil)
+	w.closed = true
+	return err
+}
+
+func (w *messageWriter) writeFrame(b0 byte, p []byte) os.Error {
+	if w.closed {
+		return ErrClosed
+	}
+	w.ws.wmu.Lock()
+	defer w.ws.wmu.Unlock()
+	if w.ws.closeSent {
+		return ErrClosed
+	}
+	return w.ws.writeFrameLocked(b0, p)
+}
@@ -56,8 +56,14 @@ func getKeyNumber(s string) (r uint32) {
 	return
 }
 
-// ServeHTTP implements the http.Handler interface for a Web Socket
+// ServeHTTP implements the http.Handler interface for a Web Socket.
+// It accepts clients speaking RFC 6455, or versions 8 and 13 of its
+// drafts, as well as draft-hixie-thewebsocketprotocol-76.
 func (f Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Sec-Websocket-Key") != "" {
+		f.serveHybi(w, req)
+		return
+	}
 	rwc, buf, err := w.(http.Hijacker).Hijack()
 	if err != nil {
 		panic("Hijack failed: " + err.String())
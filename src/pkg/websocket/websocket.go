@@ -2,8 +2,10 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package websocket implements a client and server for the Web Socket protocol.
-// The protocol is defined at http://tools.ietf.org/html/draft-hixie-thewebsocketprotocol
+// Package websocket implements a client and server for the Web Socket protocol
+// as defined in RFC 6455, http://tools.ietf.org/html/rfc6455.
+// Servers also accept clients speaking the earlier drafts,
+// http://tools.ietf.org/html/draft-hixie-thewebsocketprotocol
 package websocket
 
 // TODO(ukai):
@@ -17,6 +19,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"sync"
 )
 
 // WebSocketAddr is an implementation of net.Addr for Web Sockets.
@@ -46,6 +49,12 @@ type Conn struct {
 	Protocol string
 	// The initial http Request (for the Server side only).
 	Request *http.Request
+	// The type of frame, TextFrame or BinaryFrame, sent by Write.
+	// It is only used by connections speaking RFC 6455.
+	PayloadType byte
+	// The largest message accepted by Receive, in bytes.
+	// If zero, DefaultMaxPayloadBytes is used.
+	MaxPayloadBytes int
 
 	buf *bufio.ReadWriter
 	rwc io.ReadWriteCloser
@@ -53,6 +62,24 @@ type Conn struct {
 	// It holds text data in previous Read() that failed with small buffer.
 	data    []byte
 	reading bool
+
+	// State of connections speaking RFC 6455.
+	hybi   bool // speaks RFC 6455 rather than a hixie draft
+	client bool // client side; frames sent are masked
+
+	wmu       sync.Mutex // serializes frames written
+	closeSent bool       // close frame sent; guarded by wmu
+
+	rem         int64   // payload left in the current data frame
+	masked      bool    // current data frame is masked
+	mask        [4]byte // its masking key
+	maskPos     int     // index into mask of the next payload byte
+	inMessage   bool    // final fragment of the message not yet read
+	messageType byte    // TextFrame or BinaryFrame
+	readErr     os.Error
+
+	closeCode   int // status of the peer's close frame
+	closeReason string
 }
 
 // newConn creates a new Web Socket.
@@ -62,12 +89,18 @@ func newConn(origin, location, protocol string, buf *bufio.ReadWriter, rwc io.Re
 		bw := bufio.NewWriter(rwc)
 		buf = bufio.NewReadWriter(br, bw)
 	}
-	ws := &Conn{Origin: origin, Location: location, Protocol: protocol, buf: buf, rwc: rwc}
+	ws := &Conn{Origin: origin, Location: location, Protocol: protocol, PayloadType: TextFrame, buf: buf, rwc: rwc}
 	return ws
 }
 
 // Read implements the io.Reader interface for a Conn.
+// For a connection speaking RFC 6455, it returns the payload of the
+// data frames received, and os.EOF once the peer has closed the
+// connection.
 func (ws *Conn) Read(msg []byte) (n int, err os.Error) {
+	if ws.hybi {
+		return ws.hybiRead(msg)
+	}
 Frame:
 	for !ws.reading && len(ws.data) == 0 {
 		// Beginning of frame, possibly.
@@ -125,7 +158,12 @@ Frame:
 }
 
 // Write implements the io.Writer interface for a Conn.
+// For a connection speaking RFC 6455, each Write sends one
+// unfragmented message of type ws.PayloadType.
 func (ws *Conn) Write(msg []byte) (n int, err os.Error) {
+	if ws.hybi {
+		return ws.hybiWrite(msg)
+	}
 	ws.buf.WriteByte(0)
 	ws.buf.Write(msg)
 	ws.buf.WriteByte(0xff)
@@ -134,7 +172,14 @@ func (ws *Conn) Write(msg []byte) (n int, err os.Error) {
 }
 
 // Close implements the io.Closer interface for a Conn.
-func (ws *Conn) Close() os.Error { return ws.rwc.Close() }
+// A connection speaking RFC 6455 sends a close frame with status
+// CloseNormalClosure first, unless WriteClose has been called.
+func (ws *Conn) Close() os.Error {
+	if ws.hybi {
+		ws.WriteClose(CloseNormalClosure, "")
+	}
+	return ws.rwc.Close()
+}
 
 // LocalAddr returns the WebSocket Origin for the connection.
 func (ws *Conn) LocalAddr() net.Addr { return WebSocketAddr(ws.Origin) }
@@ -11,8 +11,10 @@ import (
 	"http"
 	"http/httptest"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"sync"
 	"testing"
 )
@@ -22,9 +24,25 @@ var once sync.Once
 
 func echoServer(ws *Conn) { io.Copy(ws, ws) }
 
+// messageEchoServer echoes each message in a frame of the same type.
+func messageEchoServer(ws *Conn) {
+	for {
+		var msg []byte
+		if err := Message.Receive(ws, &msg); err != nil {
+			return
+		}
+		if ws.MessageType() == TextFrame {
+			Message.Send(ws, string(msg))
+		} else {
+			Message.Send(ws, msg)
+		}
+	}
+}
+
 func startServer() {
 	http.Handle("/echo", Handler(echoServer))
 	http.Handle("/echoDraft75", Draft75Handler(echoServer))
+	http.Handle("/echoMessage", Handler(messageEchoServer))
 	server := httptest.NewServer(nil)
 	serverAddr = server.Listener.Addr().String()
 	log.Print("Test WebSocket server listening on ", serverAddr)
@@ -268,3 +286,301 @@ func testSkipNoUTF8Frame(t *testing.T) {
 		t.Errorf("Read: expected %q got %q", msg[4:8], msg[0:n])
 	}
 }
+
+func newHybiTestClient(t *testing.T, path string) *Conn {
+	once.Do(startServer)
+
+	client, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	ws, err := newHybiClient(path, "localhost", "http://localhost",
+		"ws://localhost"+path, "", client)
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	return ws
+}
+
+func TestHybiEcho(t *testing.T) {
+	ws := newHybiTestClient(t, "/echo")
+	defer ws.Close()
+
+	msg := []byte("hello, world\n")
+	if _, err := ws.Write(msg); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+	actual_msg := make([]byte, 512)
+	n, err := ws.Read(actual_msg)
+	if err != nil {
+		t.Errorf("Read: %v", err)
+	}
+	actual_msg = actual_msg[0:n]
+	if !bytes.Equal(msg, actual_msg) {
+		t.Errorf("Echo: expected %q got %q", msg, actual_msg)
+	}
+}
+
+func TestHybiFragmentedMessage(t *testing.T) {
+	ws := newHybiTestClient(t, "/echo")
+	defer ws.Close()
+
+	w, err := ws.NewMessageWriter(BinaryFrame)
+	if err != nil {
+		t.Fatal("NewMessageWriter:", err)
+	}
+	io.WriteString(w, "hello, ")
+	io.WriteString(w, "world")
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := w.Write([]byte("more")); err != ErrClosed {
+		t.Errorf("Write after Close: got error %v; want %v", err, ErrClosed)
+	}
+
+	// The echo server returns each fragment it reads as a frame.
+	var got []byte
+	buf := make([]byte, 512)
+	for len(got) < len("hello, world") {
+		n, err := ws.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "hello, world" {
+		t.Errorf("Echo: expected %q got %q", "hello, world", got)
+	}
+}
+
+func TestHybiPingAndClose(t *testing.T) {
+	ws := newHybiTestClient(t, "/echo")
+	defer ws.Close()
+
+	if err := ws.Ping([]byte("ping")); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+	if err := ws.WriteClose(CloseNormalClosure, "bye"); err != nil {
+		t.Errorf("WriteClose: %v", err)
+	}
+	if _, err := ws.Write([]byte("late")); err != ErrClosed {
+		t.Errorf("Write after WriteClose: got error %v; want %v", err, ErrClosed)
+	}
+	// The pong is discarded, and the server's close frame ends
+	// the connection.
+	if n, err := ws.Read(make([]byte, 512)); err != os.EOF {
+		t.Errorf("Read: got %d, %v; want 0, os.EOF", n, err)
+	}
+	if code, _ := ws.CloseStatus(); code != CloseNormalClosure {
+		t.Errorf("CloseStatus: got %d; want %d", code, CloseNormalClosure)
+	}
+}
+
+func TestHybiVersion(t *testing.T) {
+	once.Do(startServer)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/echo", serverAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "99")
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Do:", err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d; want %d", r.StatusCode, http.StatusBadRequest)
+	}
+	if g, e := r.Header.Get("Sec-Websocket-Version"), "13"; g != e {
+		t.Errorf("Sec-WebSocket-Version = %q; want %q", g, e)
+	}
+}
+
+// Test acceptKey with the example in section 1.3 of RFC 6455.
+func TestAcceptKey(t *testing.T) {
+	if g, e := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; g != e {
+		t.Errorf("acceptKey: got %q; want %q", g, e)
+	}
+}
+
+// nopCloser is a connection whose Close does nothing.
+type nopCloser struct {
+	io.Reader
+	io.Writer
+}
+
+func (nopCloser) Close() os.Error { return nil }
+
+// newHybiTestConn returns a connection speaking RFC 6455 that reads
+// the frames in b and writes to out.
+func newHybiTestConn(b []byte, out *bytes.Buffer, client bool) *Conn {
+	ws := newConn("http://127.0.0.1/", "ws://127.0.0.1/", "", nil, nopCloser{bytes.NewBuffer(b), out})
+	ws.hybi = true
+	ws.client = client
+	return ws
+}
+
+// Frames from the examples in section 5.7 of RFC 6455.
+var (
+	maskedHello     = []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	fragmentedHello = []byte{0x01, 0x03, 'H', 'e', 'l', 0x80, 0x02, 'l', 'o'}
+	pingHello       = []byte{0x89, 0x05, 'H', 'e', 'l', 'l', 'o'}
+	closeNormal     = []byte{0x88, 0x02, 0x03, 0xe8}
+)
+
+func TestHybiReadFrames(t *testing.T) {
+	// A server reads masked frames.
+	var out bytes.Buffer
+	ws := newHybiTestConn(maskedHello, &out, false)
+	msg, err := ioutil.ReadAll(ws)
+	if err != nil || string(msg) != "Hello" {
+		t.Errorf("masked: got %q, %v; want %q", msg, err, "Hello")
+	}
+
+	// A client reads unmasked ones, and answers pings.
+	var b []byte
+	b = append(b, fragmentedHello[:5]...)
+	b = append(b, pingHello...)
+	b = append(b, fragmentedHello[5:]...)
+	b = append(b, closeNormal...)
+	out.Reset()
+	ws = newHybiTestConn(b, &out, true)
+	msg, err = ioutil.ReadAll(ws)
+	if err != nil || string(msg) != "Hello" {
+		t.Errorf("fragmented: got %q, %v; want %q", msg, err, "Hello")
+	}
+	// The pong and the reply to the close frame are masked.
+	frames := out.Bytes()
+	if len(frames) != 2+4+5+2+4+2 || frames[0] != 0x80|PongFrame || frames[11] != 0x80|CloseFrame {
+		t.Errorf("unexpected frames written: % x", frames)
+	}
+	if code, _ := ws.CloseStatus(); code != CloseNormalClosure {
+		t.Errorf("CloseStatus: got %d; want %d", code, CloseNormalClosure)
+	}
+}
+
+func TestHybiUnmaskedFromClient(t *testing.T) {
+	var out bytes.Buffer
+	ws := newHybiTestConn(fragmentedHello, &out, false)
+	if _, err := ws.Read(make([]byte, 512)); err != ErrBadFrame {
+		t.Errorf("Read: got error %v; want %v", err, ErrBadFrame)
+	}
+	// The server fails the connection with a protocol error.
+	if !bytes.Equal(out.Bytes(), []byte{0x88, 0x02, 0x03, 0xea}) {
+		t.Errorf("unexpected frames written: % x", out.Bytes())
+	}
+}
+
+func TestMessageCodec(t *testing.T) {
+	ws := newHybiTestClient(t, "/echoMessage")
+	defer ws.Close()
+
+	if err := Message.Send(ws, "hello"); err != nil {
+		t.Fatal("Send text:", err)
+	}
+	var text string
+	if err := Message.Receive(ws, &text); err != nil {
+		t.Fatal("Receive text:", err)
+	}
+	if text != "hello" || ws.MessageType() != TextFrame {
+		t.Errorf("Receive text: got %q in frame type %d", text, ws.MessageType())
+	}
+
+	data := []byte{0, 1, 2, 0xff}
+	if err := Message.Send(ws, data); err != nil {
+		t.Fatal("Send binary:", err)
+	}
+	var got []byte
+	if err := Message.Receive(ws, &got); err != nil {
+		t.Fatal("Receive binary:", err)
+	}
+	if !bytes.Equal(got, data) || ws.MessageType() != BinaryFrame {
+		t.Errorf("Receive binary: got %q in frame type %d", got, ws.MessageType())
+	}
+
+	if err := Message.Send(ws, 42); err != ErrNotSupported {
+		t.Errorf("Send int: got error %v; want %v", err, ErrNotSupported)
+	}
+}
+
+type jsonTest struct {
+	Msg   string
+	Count int
+}
+
+func TestJSONCodec(t *testing.T) {
+	ws := newHybiTestClient(t, "/echoMessage")
+	defer ws.Close()
+
+	want := jsonTest{"hello", 3}
+	if err := JSON.Send(ws, want); err != nil {
+		t.Fatal("Send:", err)
+	}
+	var got jsonTest
+	if err := JSON.Receive(ws, &got); err != nil {
+		t.Fatal("Receive:", err)
+	}
+	if got.Msg != want.Msg || got.Count != want.Count {
+		t.Errorf("Receive: got %+v; want %+v", got, want)
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	ws := newHybiTestClient(t, "/echoMessage")
+	defer ws.Close()
+	ws.MaxPayloadBytes = 4
+
+	if err := Message.Send(ws, "hello"); err != nil {
+		t.Fatal("Send:", err)
+	}
+	var msg string
+	if err := Message.Receive(ws, &msg); err != ErrFrameTooLarge {
+		t.Errorf("Receive: got error %v; want %v", err, ErrFrameTooLarge)
+	}
+}
+
+func TestMessageFragmented(t *testing.T) {
+	var out bytes.Buffer
+	var b []byte
+	b = append(b, fragmentedHello[:5]...)
+	b = append(b, pingHello...)
+	b = append(b, fragmentedHello[5:]...)
+	ws := newHybiTestConn(b, &out, true)
+	var msg string
+	if err := Message.Receive(ws, &msg); err != nil {
+		t.Fatal("Receive:", err)
+	}
+	if msg != "Hello" || ws.MessageType() != TextFrame {
+		t.Errorf("Receive: got %q in frame type %d", msg, ws.MessageType())
+	}
+}
+
+func TestMessageInvalidUTF8(t *testing.T) {
+	// A character split between fragments is fine.
+	var out bytes.Buffer
+	ws := newHybiTestConn([]byte{0x01, 0x81, 0, 0, 0, 0, 0xc3, 0x80, 0x81, 0, 0, 0, 0, 0xa9}, &out, false)
+	var msg string
+	if err := Message.Receive(ws, &msg); err != nil || msg != "é" {
+		t.Errorf("Receive split character: got %q, %v", msg, err)
+	}
+
+	// Binary messages need not be UTF-8.
+	ws = newHybiTestConn([]byte{0x82, 0x81, 0, 0, 0, 0, 0xff}, &out, false)
+	var data []byte
+	if err := Message.Receive(ws, &data); err != nil {
+		t.Errorf("Receive binary: %v", err)
+	}
+
+	// A surrogate half fails the connection with status 1007.
+	ws = newHybiTestConn([]byte{0x81, 0x83, 0, 0, 0, 0, 0xed, 0xa0, 0x80}, &out, false)
+	if err := Message.Receive(ws, &msg); err != ErrInvalidText {
+		t.Errorf("Receive: got error %v; want %v", err, ErrInvalidText)
+	}
+	if !bytes.Equal(out.Bytes(), []byte{0x88, 0x02, 0x03, 0xef}) {
+		t.Errorf("unexpected frames written: % x", out.Bytes())
+	}
+}